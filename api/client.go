@@ -671,6 +671,13 @@ func (c *Client) SetBackoff(backoff retryablehttp.Backoff) {
 // the api.Config struct, such as policy override and wrapping function
 // behavior, must currently then be set as desired on the new client.
 func (c *Client) Clone() (*Client, error) {
+	return NewClient(c.CloneConfig())
+}
+
+// CloneConfig returns a copy of the client's configuration. The returned
+// config shares the client's HttpClient, so callers that need to modify it
+// should replace it with a copy.
+func (c *Client) CloneConfig() *Config {
 	c.modifyLock.RLock()
 	c.config.modifyLock.RLock()
 	config := c.config
@@ -687,7 +694,7 @@ func (c *Client) Clone() (*Client, error) {
 	}
 	config.modifyLock.RUnlock()
 
-	return NewClient(newConfig)
+	return newConfig
 }
 
 // SetPolicyOverride sets whether requests should be sent with the policy
@@ -2,10 +2,13 @@ package userpass
 
 import (
 	"context"
+	"time"
 
 	"github.com/hashicorp/vault/helper/mfa"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	cache "github.com/patrickmn/go-cache"
 )
 
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
@@ -30,10 +33,13 @@ func Backend() *backend {
 		},
 
 		Paths: append([]*framework.Path{
+			pathConfig(&b),
 			pathUsers(&b),
 			pathUsersList(&b),
 			pathUserPolicies(&b),
 			pathUserPassword(&b),
+			pathUserUnlock(&b),
+			pathUserTOTP(&b),
 		},
 			mfa.MFAPaths(b.Backend, pathLogin(&b))...,
 		),
@@ -42,11 +48,22 @@ func Backend() *backend {
 		BackendType: logical.TypeCredential,
 	}
 
+	b.userLocks = locksutil.CreateLocks()
+	b.usedTOTPCodes = cache.New(0, 30*time.Second)
+
 	return &b
 }
 
 type backend struct {
 	*framework.Backend
+
+	// userLocks serialize the updates of the users' entries and lockout
+	// state
+	userLocks []*locksutil.LockEntry
+
+	// usedTOTPCodes holds the TOTP codes used to log in, which can't be used
+	// again until they expire
+	usedTOTPCodes *cache.Cache
 }
 
 const backendHelp = `
@@ -56,5 +73,6 @@ are supported.
 
 The username/password combination is configured using the "users/"
 endpoints by a user with root access. Authentication is then done
-by supplying the two fields for "login".
+by supplying the two fields for "login". A password policy that
+passwords must satisfy can be set using the "config" endpoint.
 `
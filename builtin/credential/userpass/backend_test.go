@@ -1,9 +1,12 @@
 package userpass
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +19,9 @@ import (
 	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/mitchellh/mapstructure"
+	otplib "github.com/pquerna/otp"
+	totplib "github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -250,6 +256,828 @@ func TestBackend_policiesUpdate(t *testing.T) {
 
 }
 
+func TestBackend_passwordPolicy(t *testing.T) {
+	b, err := Factory(context.Background(), &logical.BackendConfig{
+		Logger: nil,
+		System: &logical.StaticSystemView{
+			DefaultLeaseTTLVal: testSysTTL,
+			MaxLeaseTTLVal:     testSysMaxTTL,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		CredentialBackend: b,
+		Steps: []logicaltest.TestStep{
+			// Users created before the policy is set are unaffected until
+			// their password is changed
+			testAccStepUser(t, "web", "password", "foo"),
+			testAccStepConfig(t, testPasswordPolicy),
+			testAccStepLogin(t, "web", "password", []string{"default", "foo"}),
+
+			testAccStepUserRejected(t, "web2", "short1!", "at least 12 characters"),
+			testAccStepUserRejected(t, "web2", "longpassword12", "at least 1 of the characters"),
+			testAccStepUserRejected(t, "web2", "longpassword!", "at least 2 of the characters"),
+			testAccStepUser(t, "web2", "longpassword12!", "foo"),
+			testAccStepLogin(t, "web2", "longpassword12!", []string{"default", "foo"}),
+
+			testUpdatePasswordRejected(t, "web", "newpassword", "at least 12 characters"),
+			testAccStepLogin(t, "web", "password", []string{"default", "foo"}),
+			testUpdatePassword(t, "web", "newpassword12!"),
+			testAccStepLogin(t, "web", "newpassword12!", []string{"default", "foo"}),
+
+			// Unsetting the policy accepts any password again
+			testAccStepConfig(t, ""),
+			testUpdatePassword(t, "web", "short"),
+			testAccStepLogin(t, "web", "short", []string{"default", "foo"}),
+		},
+	})
+}
+
+func TestBackend_configInvalidPasswordPolicy(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Path:      "config",
+		Operation: logical.UpdateOperation,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"password_policy": `length = "twelve"`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "invalid password_policy") {
+		t.Fatalf("expected invalid password_policy error, got: %#v", resp)
+	}
+}
+
+func TestBackend_lockout(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Path:       path,
+			Operation:  op,
+			Storage:    storage,
+			Data:       data,
+			Connection: &logical.Connection{},
+		})
+	}
+	login := func(password string) (*logical.Response, error) {
+		return request(logical.UpdateOperation, "login/web", map[string]interface{}{
+			"password": password,
+		})
+	}
+	expectLoggedIn := func() {
+		t.Helper()
+		resp, err := login("password")
+		if err != nil || resp == nil || resp.IsError() || resp.Auth == nil {
+			t.Fatalf("expected successful login, got: resp: %#v\nerr: %v", resp, err)
+		}
+	}
+	expectLockedOut := func() {
+		t.Helper()
+		resp, err := login("password")
+		if err != logical.ErrPermissionDenied || resp == nil || !strings.Contains(resp.Error().Error(), "locked out") {
+			t.Fatalf("expected user to be locked out, got: resp: %#v\nerr: %v", resp, err)
+		}
+	}
+	failLogins := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			resp, err := login("wrong")
+			if err != nil || resp == nil || !resp.IsError() {
+				t.Fatalf("expected failed login, got: resp: %#v\nerr: %v", resp, err)
+			}
+		}
+	}
+
+	resp, err := request(logical.UpdateOperation, "users/web", map[string]interface{}{
+		"password": "password",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// Without a threshold, users are never locked out
+	failLogins(5)
+	expectLoggedIn()
+
+	resp, err = request(logical.UpdateOperation, "config", map[string]interface{}{
+		"lockout_threshold":     3,
+		"lockout_duration":      "2s",
+		"lockout_counter_reset": "1m",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// A successful login resets the count of failed logins
+	failLogins(2)
+	expectLoggedIn()
+	failLogins(2)
+	expectLoggedIn()
+
+	// Reaching the threshold locks the user out, even with the right
+	// password, until the lockout expires
+	failLogins(3)
+	expectLockedOut()
+	time.Sleep(2 * time.Second)
+	expectLoggedIn()
+
+	// Once the lockout has expired, the count starts over
+	failLogins(3)
+	expectLockedOut()
+	time.Sleep(2 * time.Second)
+	failLogins(1)
+	expectLoggedIn()
+
+	// Locked out users can be unlocked manually
+	failLogins(3)
+	expectLockedOut()
+	resp, err = request(logical.UpdateOperation, "users/web/unlock", nil)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	expectLoggedIn()
+
+	// Failed logins of unknown users aren't tracked
+	resp, err = request(logical.UpdateOperation, "login/unknown", map[string]interface{}{
+		"password": "password",
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected failed login, got: resp: %#v\nerr: %v", resp, err)
+	}
+	keys, err := storage.List(ctx, "lockout/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected no lockout entries, got: %v", keys)
+	}
+
+	// Deleting the user removes its lockout state
+	failLogins(1)
+	resp, err = request(logical.DeleteOperation, "users/web", nil)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	keys, err = storage.List(ctx, "lockout/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected no lockout entries, got: %v", keys)
+	}
+}
+
+func TestBackend_passwordExpiration(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b := Backend()
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Path:       path,
+			Operation:  op,
+			Storage:    storage,
+			Data:       data,
+			Connection: &logical.Connection{},
+		})
+	}
+	login := func() (*logical.Response, error) {
+		return request(logical.UpdateOperation, "login/web", map[string]interface{}{
+			"password": "password",
+		})
+	}
+	// ageUser makes the password of the user look like it was set an hour ago
+	ageUser := func() {
+		t.Helper()
+		user, err := b.user(ctx, storage, "web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.PasswordLastChanged = time.Now().Add(-time.Hour)
+		if err := b.setUser(ctx, storage, "web", user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := request(logical.UpdateOperation, "users/web", map[string]interface{}{
+		"password":  "password",
+		"token_ttl": "1h",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = request(logical.UpdateOperation, "config", map[string]interface{}{
+		"password_ttl": "30m",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// The password was just set, and hasn't expired
+	resp, err = login()
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if len(resp.Warnings) != 0 || resp.Auth.TTL != time.Hour {
+		t.Fatalf("unexpected response to login with a valid password: %#v", resp)
+	}
+
+	resp, err = request(logical.ReadOperation, "users/web", nil)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if _, ok := resp.Data["password_last_changed"]; !ok {
+		t.Fatalf("expected password_last_changed to be returned, got: %#v", resp.Data)
+	}
+
+	// An expired password returns a short-lived token and a warning
+	ageUser()
+	resp, err = login()
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "password expired") {
+		t.Fatalf("expected a password expiration warning, got: %#v", resp.Warnings)
+	}
+	if resp.Auth.TTL != expiredPasswordTokenTTL || resp.Auth.ExplicitMaxTTL != expiredPasswordTokenTTL {
+		t.Fatalf("expected a short-lived token, got TTL %s and explicit max TTL %s", resp.Auth.TTL, resp.Auth.ExplicitMaxTTL)
+	}
+
+	// A user's own password_ttl overrides the mount's
+	resp, err = request(logical.UpdateOperation, "users/web", map[string]interface{}{
+		"password_ttl": "2h",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = login()
+	if err != nil || resp == nil || resp.IsError() || len(resp.Warnings) != 0 {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = request(logical.UpdateOperation, "users/web", map[string]interface{}{
+		"password_ttl": 0,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// Logins with an expired password are denied until it's changed
+	resp, err = request(logical.UpdateOperation, "config", map[string]interface{}{
+		"deny_expired_passwords": true,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = login()
+	if err != logical.ErrPermissionDenied || resp == nil || !strings.Contains(resp.Error().Error(), "password has expired") {
+		t.Fatalf("expected login to be denied, got: resp: %#v\nerr: %v", resp, err)
+	}
+
+	resp, err = request(logical.UpdateOperation, "users/web/password", map[string]interface{}{
+		"password": "password",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = login()
+	if err != nil || resp == nil || resp.IsError() || len(resp.Warnings) != 0 {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// Passwords set before their last change was tracked don't expire
+	user, err := b.user(ctx, storage, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.PasswordLastChanged = time.Time{}
+	if err := b.setUser(ctx, storage, "web", user); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = login()
+	if err != nil || resp == nil || resp.IsError() || len(resp.Warnings) != 0 {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+}
+
+func TestBackend_passwordExpirationWithoutConfig(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b := Backend()
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Path:      "users/web",
+		Operation: logical.UpdateOperation,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"password":     "password",
+			"password_ttl": "30m",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	user, err := b.user(ctx, storage, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.PasswordLastChanged = time.Now().Add(-time.Hour)
+	if err := b.setUser(ctx, storage, "web", user); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user's own password_ttl expires the password, even though the
+	// mount was never configured
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Path:      "login/web",
+		Operation: logical.UpdateOperation,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"password": "password",
+		},
+		Connection: &logical.Connection{},
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "password expired") {
+		t.Fatalf("expected a password expiration warning, got: %#v", resp.Warnings)
+	}
+	if resp.Auth.TTL != expiredPasswordTokenTTL {
+		t.Fatalf("expected a short-lived token, got TTL %s", resp.Auth.TTL)
+	}
+}
+
+const testPasswordPolicy = `
+length = 12
+rule "charset" {
+  charset = "0123456789"
+  min-chars = 2
+}
+rule "charset" {
+  charset = "!@#$%^&*"
+  min-chars = 1
+}`
+
+func testAccStepConfig(t *testing.T, passwordPolicy string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"password_policy": passwordPolicy,
+		},
+	}
+}
+
+func testAccStepUserRejected(t *testing.T, name, password, expected string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "users/" + name,
+		Data: map[string]interface{}{
+			"password": password,
+		},
+		ErrorOk: true,
+		Check:   testCheckErrorContains(expected),
+	}
+}
+
+func testUpdatePasswordRejected(t *testing.T, user, password, expected string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "users/" + user + "/password",
+		Data: map[string]interface{}{
+			"password": password,
+		},
+		ErrorOk: true,
+		Check:   testCheckErrorContains(expected),
+	}
+}
+
+func testCheckErrorContains(expected string) logicaltest.TestCheckFunc {
+	return func(resp *logical.Response) error {
+		if resp == nil || !resp.IsError() {
+			return fmt.Errorf("expected an error response, got: %#v", resp)
+		}
+		if !strings.Contains(resp.Error().Error(), expected) {
+			return fmt.Errorf("expected error containing %q, got: %s", expected, resp.Error())
+		}
+		return nil
+	}
+}
+
+func TestBackend_selfServicePassword(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	config.System = &logical.StaticSystemView{
+		DefaultLeaseTTLVal: testSysTTL,
+		MaxLeaseTTLVal:     testSysMaxTTL,
+		EntityVal: &logical.Entity{
+			ID: "entity",
+			Aliases: []*logical.Alias{
+				{
+					MountAccessor: "auth_userpass_1234",
+					Name:          "web",
+				},
+			},
+		},
+	}
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// self makes a request with a token of the user, while admin makes one
+	// with a token that isn't tied to an entity
+	request := func(self bool, op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		req := &logical.Request{
+			Path:          path,
+			Operation:     op,
+			Storage:       storage,
+			Data:          data,
+			Connection:    &logical.Connection{},
+			MountAccessor: "auth_userpass_1234",
+		}
+		if self {
+			req.EntityID = "entity"
+		}
+		return b.HandleRequest(ctx, req)
+	}
+	expectLogin := func(password string) {
+		t.Helper()
+		resp, err := request(false, logical.UpdateOperation, "login/web", map[string]interface{}{
+			"password": password,
+		})
+		if err != nil || resp == nil || resp.IsError() || resp.Auth == nil {
+			t.Fatalf("expected successful login, got: resp: %#v\nerr: %v", resp, err)
+		}
+		if diff := deep.Equal(resp.Auth.Policies, []string{"foo"}); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+	expectError := func(resp *logical.Response, err error, expected string) {
+		t.Helper()
+		if err == nil || resp == nil || !strings.Contains(resp.Error().Error(), expected) {
+			t.Fatalf("expected error containing %q, got: resp: %#v\nerr: %v", expected, resp, err)
+		}
+	}
+
+	resp, err := request(false, logical.UpdateOperation, "users/web", map[string]interface{}{
+		"password":       "password",
+		"token_policies": "foo",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// Users must provide their current password
+	resp, err = request(true, logical.UpdateOperation, "users/web/password", map[string]interface{}{
+		"password": "newpassword",
+	})
+	expectError(resp, err, "missing current_password")
+	resp, err = request(true, logical.UpdateOperation, "users/web/password", map[string]interface{}{
+		"password":         "newpassword",
+		"current_password": "wrong",
+	})
+	expectError(resp, err, "invalid current_password")
+	expectLogin("password")
+
+	// Only the password can be changed through this path
+	resp, err = request(true, logical.UpdateOperation, "users/web/password", map[string]interface{}{
+		"password":         "newpassword",
+		"current_password": "password",
+		"token_policies":   "root",
+		"policies":         "root",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	expectLogin("newpassword")
+
+	resp, err = request(false, logical.ReadOperation, "users/web", nil)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if diff := deep.Equal(resp.Data["token_policies"], []string{"foo"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// The password policy and lockout apply
+	resp, err = request(false, logical.UpdateOperation, "config", map[string]interface{}{
+		"password_policy":   testPasswordPolicy,
+		"lockout_threshold": 2,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = request(true, logical.UpdateOperation, "users/web/password", map[string]interface{}{
+		"password":         "short",
+		"current_password": "newpassword",
+	})
+	expectError(resp, err, "at least 12 characters")
+
+	for i := 0; i < 2; i++ {
+		resp, err = request(true, logical.UpdateOperation, "users/web/password", map[string]interface{}{
+			"password":         "longpassword12!",
+			"current_password": "wrong",
+		})
+		expectError(resp, err, "invalid current_password")
+	}
+	resp, err = request(true, logical.UpdateOperation, "users/web/password", map[string]interface{}{
+		"password":         "longpassword12!",
+		"current_password": "newpassword",
+	})
+	expectError(resp, err, "locked out")
+
+	// Operators can reset the password without knowing the current one
+	resp, err = request(false, logical.UpdateOperation, "users/web/unlock", nil)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = request(false, logical.UpdateOperation, "users/web/password", map[string]interface{}{
+		"password": "longpassword12!",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	expectLogin("longpassword12!")
+}
+
+func TestBackend_totp(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Path:       path,
+			Operation:  op,
+			Storage:    storage,
+			Data:       data,
+			Connection: &logical.Connection{},
+		})
+	}
+	login := func(code string) (*logical.Response, error) {
+		data := map[string]interface{}{
+			"password": "password",
+		}
+		if code != "" {
+			data["totp_code"] = code
+		}
+		return request(logical.UpdateOperation, "login/web", data)
+	}
+	expectDenied := func(code, expected string) {
+		t.Helper()
+		resp, err := login(code)
+		if err != logical.ErrPermissionDenied || resp == nil || !strings.Contains(resp.Error().Error(), expected) {
+			t.Fatalf("expected login to be denied with %q, got: resp: %#v\nerr: %v", expected, resp, err)
+		}
+	}
+
+	resp, err := request(logical.UpdateOperation, "users/web", map[string]interface{}{
+		"password": "password",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// Users that aren't enrolled don't need a code
+	resp, err = login("")
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	resp, err = request(logical.UpdateOperation, "users/web/totp", map[string]interface{}{
+		"issuer": "Example",
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	key, err := otplib.NewKeyFromURL(resp.Data["url"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Issuer() != "Example" || key.AccountName() != "web" {
+		t.Fatalf("unexpected key: issuer %q, account name %q", key.Issuer(), key.AccountName())
+	}
+
+	resp, err = request(logical.ReadOperation, "users/web", nil)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if resp.Data["totp_enabled"] != true {
+		t.Fatalf("expected totp_enabled, got: %#v", resp.Data)
+	}
+
+	code, err := totplib.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongCode := fmt.Sprintf("%06d", (mustAtoi(t, code)+1)%1000000)
+
+	expectDenied("", "missing totp_code")
+	expectDenied(wrongCode, "invalid totp_code")
+
+	resp, err = login(code)
+	if err != nil || resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+
+	// A code can't be used twice
+	expectDenied(code, "already used")
+
+	// The wrong password is still rejected with a valid code
+	resp, err = request(logical.UpdateOperation, "login/web", map[string]interface{}{
+		"password":  "wrong",
+		"totp_code": code,
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected failed login, got: resp: %#v\nerr: %v", resp, err)
+	}
+
+	// Disabling TOTP removes the second factor
+	resp, err = request(logical.DeleteOperation, "users/web/totp", nil)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	resp, err = login("")
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	t.Helper()
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestBackend_userListDetailed(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := map[string][]string{
+		"web":  []string{"foo"},
+		"web2": []string{"bar", "foo"},
+	}
+	for name, policies := range users {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Path:      "users/" + name,
+			Operation: logical.CreateOperation,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"password":       "password",
+				"token_policies": policies,
+				"token_ttl":      "1h",
+			},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+		}
+	}
+
+	// Without detailed, only the names are returned
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Path:      "users/",
+		Operation: logical.ListOperation,
+		Storage:   storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if _, ok := resp.Data["key_info"]; ok {
+		t.Fatalf("unexpected key_info: %#v", resp.Data)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Path:      "users/",
+		Operation: logical.ListOperation,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"detailed": true,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	if diff := deep.Equal(resp.Data["keys"], []string{"web", "web2"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	keyInfo := resp.Data["key_info"].(map[string]interface{})
+	for name, policies := range users {
+		info, ok := keyInfo[name].(map[string]interface{})
+		if !ok {
+			t.Fatalf("missing key_info for %q: %#v", name, keyInfo)
+		}
+		if diff := deep.Equal(info["token_policies"], policies); diff != nil {
+			t.Fatalf("%s: %v", name, diff)
+		}
+		if info["token_ttl"].(int64) != 3600 {
+			t.Fatalf("%s: unexpected token_ttl: %v", name, info["token_ttl"])
+		}
+		if _, ok := info["password_last_changed"]; !ok {
+			t.Fatalf("%s: missing password_last_changed: %#v", name, info)
+		}
+		if info["locked"] != false || info["password_expired"] != false {
+			t.Fatalf("%s: unexpected state: %#v", name, info)
+		}
+	}
+}
+
+func TestBackend_usernameCase(t *testing.T) {
+	b, err := Factory(context.Background(), &logical.BackendConfig{
+		Logger: nil,
+		System: &logical.StaticSystemView{
+			DefaultLeaseTTLVal: testSysTTL,
+			MaxLeaseTTLVal:     testSysMaxTTL,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		CredentialBackend: b,
+		Steps: []logicaltest.TestStep{
+			testAccStepUser(t, "Web", "password", "foo"),
+			testAccStepReadUser(t, "web", "foo"),
+			testAccStepLogin(t, "WEB", "password", []string{"default", "foo"}),
+			testUpdatePassword(t, "wEb", "newpassword"),
+			testAccStepLogin(t, "web", "newpassword", []string{"default", "foo"}),
+			testUpdatePolicies(t, "WEB", "foo,bar"),
+			testAccStepReadUser(t, "Web", "bar,foo"),
+			testAccStepLogin(t, "wEB", "newpassword", []string{"bar", "default", "foo"}),
+		},
+	})
+}
+
 func testUpdatePassword(t *testing.T, user, password string) logicaltest.TestStep {
 	return logicaltest.TestStep{
 		Operation: logical.UpdateOperation,
@@ -415,3 +1243,563 @@ func TestBackend_UserUpgrade(t *testing.T) {
 		t.Fatal(diff)
 	}
 }
+
+func TestBackend_passwordHashUpgrade(t *testing.T) {
+	s := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = s
+
+	ctx := context.Background()
+
+	b := Backend()
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+
+	weakHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := map[string]*UserEntry{
+		// Passwords stored before Vault 0.2
+		"legacy": &UserEntry{
+			Password: "password",
+		},
+		"weak": &UserEntry{
+			PasswordHash: weakHash,
+		},
+	}
+	for name, user := range users {
+		if err := b.setUser(ctx, s, name, user); err != nil {
+			t.Fatal(err)
+		}
+
+		login := func(password string) (*logical.Response, error) {
+			return b.HandleRequest(ctx, &logical.Request{
+				Path:       "login/" + name,
+				Operation:  logical.UpdateOperation,
+				Storage:    s,
+				Connection: &logical.Connection{},
+				Data: map[string]interface{}{
+					"password": password,
+				},
+			})
+		}
+
+		// A failed login doesn't upgrade the hash
+		resp, err := login("wrong")
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("%s: expected failed login, got: resp: %#v\nerr: %v", name, resp, err)
+		}
+		stored, err := b.user(ctx, s, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(stored, user); diff != nil {
+			t.Fatalf("%s: %v", name, diff)
+		}
+
+		resp, err = login("password")
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("%s: bad: resp: %#v\nerr: %v\n", name, resp, err)
+		}
+
+		stored, err = b.user(ctx, s, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Password != "" {
+			t.Fatalf("%s: expected the legacy password to be removed", name)
+		}
+		cost, err := bcrypt.Cost(stored.PasswordHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cost != bcrypt.DefaultCost {
+			t.Fatalf("%s: expected a bcrypt cost of %d, got %d", name, bcrypt.DefaultCost, cost)
+		}
+
+		// The upgraded hash still matches the password
+		resp, err = login("password")
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("%s: bad: resp: %#v\nerr: %v\n", name, resp, err)
+		}
+	}
+}
+
+func TestBackend_passwordHashUpgradeKeepsUpdates(t *testing.T) {
+	s := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = s
+
+	ctx := context.Background()
+
+	b := Backend()
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+
+	weakHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := &UserEntry{
+		PasswordHash: weakHash,
+		Policies:     []string{"foo"},
+	}
+	if err := b.setUser(ctx, s, "web", verified); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user is updated while it logs in
+	updated := &UserEntry{
+		PasswordHash: weakHash,
+		Policies:     []string{"bar"},
+	}
+	if err := b.setUser(ctx, s, "web", updated); err != nil {
+		t.Fatal(err)
+	}
+	b.upgradePasswordHash(ctx, s, "web", verified, "password")
+
+	stored, err := b.user(ctx, s, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Policies, []string{"bar"}) {
+		t.Fatalf("expected the update to be kept, got policies: %v", stored.Policies)
+	}
+	if cost, err := bcrypt.Cost(stored.PasswordHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("expected the hash to be upgraded, got cost %d, err: %v", cost, err)
+	}
+
+	// A password changed since it was verified is left alone
+	newHash, err := bcrypt.GenerateFromPassword([]byte("newpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.PasswordHash = newHash
+	if err := b.setUser(ctx, s, "web", stored); err != nil {
+		t.Fatal(err)
+	}
+	b.upgradePasswordHash(ctx, s, "web", verified, "password")
+
+	stored, err = b.user(ctx, s, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.PasswordHash, newHash) {
+		t.Fatal("expected the changed password to be left alone")
+	}
+
+	// Logins that are rejected after the password check don't upgrade the hash
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Path:      "config",
+		Operation: logical.UpdateOperation,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"deny_expired_passwords": true,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+	}
+	stored.PasswordTTL = time.Minute
+	stored.PasswordLastChanged = time.Now().Add(-time.Hour)
+	if err := b.setUser(ctx, s, "web", stored); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Path:       "login/web",
+		Operation:  logical.UpdateOperation,
+		Storage:    s,
+		Connection: &logical.Connection{},
+		Data: map[string]interface{}{
+			"password": "newpassword",
+		},
+	})
+	if err != logical.ErrPermissionDenied {
+		t.Fatalf("expected login to be denied, got: resp: %#v\nerr: %v", resp, err)
+	}
+
+	stored, err = b.user(ctx, s, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.PasswordHash, newHash) {
+		t.Fatal("expected the hash not to be upgraded by a denied login")
+	}
+}
+
+func TestBackend_tokenType(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Path:       path,
+			Operation:  op,
+			Storage:    storage,
+			Data:       data,
+			Connection: &logical.Connection{},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+		}
+		return resp
+	}
+	expectTokenType := func(user string, tokenType logical.TokenType) {
+		t.Helper()
+		resp := request(logical.UpdateOperation, "login/"+user, map[string]interface{}{
+			"password": "password",
+		})
+		if resp.Auth.TokenType != tokenType {
+			t.Fatalf("%s: expected token type %q, got %q", user, tokenType, resp.Auth.TokenType)
+		}
+		// Batch tokens aren't renewable
+		if resp.Auth.Renewable != (tokenType != logical.TokenTypeBatch) {
+			t.Fatalf("%s: unexpected renewable %t for token type %q", user, resp.Auth.Renewable, tokenType)
+		}
+	}
+
+	request(logical.UpdateOperation, "users/default", map[string]interface{}{
+		"password": "password",
+	})
+	request(logical.UpdateOperation, "users/service", map[string]interface{}{
+		"password":   "password",
+		"token_type": "service",
+	})
+	request(logical.UpdateOperation, "users/batch", map[string]interface{}{
+		"password":   "password",
+		"token_type": "batch",
+	})
+	request(logical.UpdateOperation, "users/periodic", map[string]interface{}{
+		"password":     "password",
+		"token_period": "1h",
+	})
+
+	expectTokenType("default", logical.TokenTypeDefault)
+	expectTokenType("service", logical.TokenTypeService)
+	expectTokenType("batch", logical.TokenTypeBatch)
+
+	// The mount's default applies to users that don't set their own type
+	request(logical.UpdateOperation, "config", map[string]interface{}{
+		"token_type": "batch",
+	})
+	resp := request(logical.ReadOperation, "config", nil)
+	if resp.Data["token_type"] != "batch" {
+		t.Fatalf("unexpected token_type: %v", resp.Data["token_type"])
+	}
+	expectTokenType("default", logical.TokenTypeBatch)
+	expectTokenType("service", logical.TokenTypeService)
+	expectTokenType("batch", logical.TokenTypeBatch)
+
+	// Batch tokens can't be periodic
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Path:       "login/periodic",
+		Operation:  logical.UpdateOperation,
+		Storage:    storage,
+		Connection: &logical.Connection{},
+		Data: map[string]interface{}{
+			"password": "password",
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error, got: resp: %#v\nerr: %v", resp, err)
+	}
+
+	request(logical.UpdateOperation, "config", map[string]interface{}{
+		"token_type": "service",
+	})
+	expectTokenType("default", logical.TokenTypeService)
+	expectTokenType("batch", logical.TokenTypeBatch)
+
+	// Unknown types are rejected
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Path:      "config",
+		Operation: logical.UpdateOperation,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"token_type": "bogus",
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error, got: resp: %#v\nerr: %v", resp, err)
+	}
+}
+
+func TestBackend_metadata(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Path:       path,
+			Operation:  op,
+			Storage:    storage,
+			Data:       data,
+			Connection: &logical.Connection{},
+		})
+	}
+
+	resp, err := request(logical.CreateOperation, "users/web", map[string]interface{}{
+		"password": "password",
+		"metadata": map[string]interface{}{
+			"team":  "platform",
+			"owner": "alice",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr: %v", resp, err)
+	}
+
+	expected := map[string]string{
+		"team":  "platform",
+		"owner": "alice",
+	}
+	resp, err = request(logical.ReadOperation, "users/web", nil)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v", resp, err)
+	}
+	if diff := deep.Equal(resp.Data["metadata"], expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// The metadata is added to the token's metadata
+	resp, err = request(logical.UpdateOperation, "login/web", map[string]interface{}{
+		"password": "password",
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v", resp, err)
+	}
+	expected["username"] = "web"
+	if diff := deep.Equal(resp.Auth.Metadata, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Empty keys and values, and the username key, are rejected
+	for _, metadata := range []map[string]interface{}{
+		{"": "platform"},
+		{"team": ""},
+		{"username": "bob"},
+	} {
+		resp, err = request(logical.UpdateOperation, "users/web", map[string]interface{}{
+			"metadata": metadata,
+		})
+		if err == nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected an error for metadata %v, got: resp: %#v\nerr: %v", metadata, resp, err)
+		}
+	}
+}
+
+func TestBackend_boundCIDRs(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Path:       path,
+			Operation:  op,
+			Storage:    storage,
+			Data:       data,
+			Connection: &logical.Connection{},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+		}
+		return resp
+	}
+	login := func(user, remoteAddr string) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Path:       "login/" + user,
+			Operation:  logical.UpdateOperation,
+			Storage:    storage,
+			Connection: &logical.Connection{RemoteAddr: remoteAddr},
+			Data: map[string]interface{}{
+				"password": "password",
+			},
+		})
+	}
+	expectAllowed := func(user, remoteAddr string, boundCIDRs ...string) {
+		t.Helper()
+		resp, err := login(user, remoteAddr)
+		if err != nil || resp == nil || resp.IsError() || resp.Auth == nil {
+			t.Fatalf("%s from %s: bad: resp: %#v\nerr: %v", user, remoteAddr, resp, err)
+		}
+		var actual []string
+		for _, cidr := range resp.Auth.BoundCIDRs {
+			actual = append(actual, cidr.String())
+		}
+		if !reflect.DeepEqual(actual, boundCIDRs) {
+			t.Fatalf("%s from %s: expected bound CIDRs %v, got %v", user, remoteAddr, boundCIDRs, actual)
+		}
+	}
+	expectDenied := func(user, remoteAddr string) {
+		t.Helper()
+		if _, err := login(user, remoteAddr); err != logical.ErrPermissionDenied {
+			t.Fatalf("%s from %s: expected permission denied, got: %v", user, remoteAddr, err)
+		}
+	}
+
+	request(logical.UpdateOperation, "users/unbound", map[string]interface{}{
+		"password": "password",
+	})
+	request(logical.UpdateOperation, "users/bound", map[string]interface{}{
+		"password":          "password",
+		"token_bound_cidrs": "10.0.0.0/8",
+	})
+
+	expectAllowed("unbound", "192.168.0.1")
+	expectAllowed("bound", "10.1.2.3", "10.0.0.0/8")
+	expectDenied("bound", "192.168.0.1")
+
+	// The mount's default applies to users that don't set their own CIDRs
+	request(logical.UpdateOperation, "config", map[string]interface{}{
+		"token_bound_cidrs": "192.168.0.0/16,127.0.0.1",
+	})
+	resp := request(logical.ReadOperation, "config", nil)
+	if expected := []string{"192.168.0.0/16", "127.0.0.1"}; !reflect.DeepEqual(resp.Data["token_bound_cidrs"], expected) {
+		t.Fatalf("unexpected token_bound_cidrs: %v", resp.Data["token_bound_cidrs"])
+	}
+	expectAllowed("unbound", "192.168.0.1", "192.168.0.0/16", "127.0.0.1")
+	expectDenied("unbound", "10.1.2.3")
+	expectAllowed("bound", "10.1.2.3", "10.0.0.0/8")
+	expectDenied("bound", "192.168.0.1")
+
+	// Invalid CIDRs are rejected
+	for _, path := range []string{"config", "users/invalid"} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Path:      path,
+			Operation: logical.UpdateOperation,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"password":          "password",
+				"token_bound_cidrs": "10.0.0.0/8,not-a-cidr",
+			},
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("%s: expected an error, got: %#v", path, resp)
+		}
+	}
+}
+
+func TestBackend_policyTemplate(t *testing.T) {
+	storage := &logical.InmemStorage{}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	ctx := context.Background()
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Path:       path,
+			Operation:  op,
+			Storage:    storage,
+			Data:       data,
+			Connection: &logical.Connection{},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v\nerr: %v\n", resp, err)
+		}
+		return resp
+	}
+
+	request(logical.UpdateOperation, "users/alice.smith", map[string]interface{}{
+		"password": "password",
+		"policies": "foo",
+	})
+	request(logical.UpdateOperation, "config", map[string]interface{}{
+		"policy_template": "user-{{username}}",
+	})
+	resp := request(logical.ReadOperation, "config", nil)
+	if resp.Data["policy_template"] != "user-{{username}}" {
+		t.Fatalf("unexpected policy_template: %v", resp.Data["policy_template"])
+	}
+
+	resp = request(logical.UpdateOperation, "login/alice.smith", map[string]interface{}{
+		"password": "password",
+	})
+	if expected := []string{"foo", "user-alice_smith"}; !reflect.DeepEqual(resp.Auth.Policies, expected) {
+		t.Fatalf("expected policies %v, got %v", expected, resp.Auth.Policies)
+	}
+
+	// Tokens with the templated policy can be renewed
+	auth := resp.Auth
+	auth.TokenPolicies = auth.Policies
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Path:      "login/alice.smith",
+		Operation: logical.RenewOperation,
+		Storage:   storage,
+		Auth:      auth,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr: %v", resp, err)
+	}
+
+	// The template can't grant the root policy
+	request(logical.UpdateOperation, "users/root", map[string]interface{}{
+		"password": "password",
+	})
+	request(logical.UpdateOperation, "config", map[string]interface{}{
+		"policy_template": "{{username}}",
+	})
+	resp = request(logical.UpdateOperation, "login/root", map[string]interface{}{
+		"password": "password",
+	})
+	if len(resp.Auth.Policies) != 0 {
+		t.Fatalf("expected no policies, got %v", resp.Auth.Policies)
+	}
+
+	// Invalid templates are rejected
+	for _, template := range []string{"user", "user-{{name}}", "user/{{username}}"} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Path:      "config",
+			Operation: logical.UpdateOperation,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"policy_template": template,
+			},
+		})
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("%q: expected an error, got: resp: %#v\nerr: %v", template, resp, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package userpass
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/vault/helper/random"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const defaultLockoutDuration = 15 * time.Minute
+
+// policyTemplateUsername is replaced by the username when policy_template is
+// rendered.
+const policyTemplateUsername = "{{username}}"
+
+// invalidPolicyNameChars matches the characters that are replaced in
+// usernames before they are used in policy names.
+var invalidPolicyNameChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+func pathConfig(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config",
+		Fields: map[string]*framework.FieldSchema{
+			"password_policy": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Password policy, in the HCL or JSON format of Vault's
+password policies, that passwords must satisfy when they are set. The length
+of the policy is the minimum length of the passwords.`,
+			},
+
+			"lockout_threshold": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `Number of failed logins after which a user is locked out.
+If zero, users are never locked out.`,
+			},
+
+			"lockout_duration": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration for which a user is locked out. Defaults to 15 minutes.",
+			},
+
+			"password_ttl": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `Duration after which passwords expire, for users that don't
+set their own password_ttl. If zero, passwords don't expire.`,
+			},
+
+			"deny_expired_passwords": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, logins with an expired password are denied until the
+password is changed. Otherwise they return a short-lived token and a warning.`,
+			},
+
+			"token_type": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The type of token to generate, service or batch, for users
+that don't set their own token_type.`,
+			},
+
+			"token_bound_cidrs": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Comma separated string or JSON list of CIDR blocks, for users
+that don't set their own token_bound_cidrs. If set, logins are only accepted
+from these blocks and the generated tokens can only be used from them.`,
+			},
+
+			"policy_template": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Name of a policy added to the tokens of all users, in which
+"{{username}}" is replaced by the username. Characters of the username other
+than lowercase letters, digits, '_' and '-' are replaced by '_'.`,
+			},
+
+			"lockout_counter_reset": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `Duration after the first failed login after which the count
+of failed logins is reset. Defaults to lockout_duration.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathConfigWrite,
+			logical.ReadOperation:   b.pathConfigRead,
+		},
+
+		HelpSynopsis:    pathConfigHelpSyn,
+		HelpDescription: pathConfigHelpDesc,
+	}
+}
+
+func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	c, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = &config{}
+	}
+
+	if passwordPolicyRaw, ok := d.GetOk("password_policy"); ok {
+		c.PasswordPolicy = passwordPolicyRaw.(string)
+		if c.PasswordPolicy != "" {
+			if _, err := random.ParsePolicy(c.PasswordPolicy); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("invalid password_policy: %s", err)), nil
+			}
+		}
+	}
+
+	if lockoutThresholdRaw, ok := d.GetOk("lockout_threshold"); ok {
+		c.LockoutThreshold = lockoutThresholdRaw.(int)
+		if c.LockoutThreshold < 0 {
+			return logical.ErrorResponse("lockout_threshold must not be negative"), nil
+		}
+	}
+	if lockoutDurationRaw, ok := d.GetOk("lockout_duration"); ok {
+		c.LockoutDuration = time.Duration(lockoutDurationRaw.(int)) * time.Second
+		if c.LockoutDuration < 0 {
+			return logical.ErrorResponse("lockout_duration must not be negative"), nil
+		}
+	}
+	if lockoutCounterResetRaw, ok := d.GetOk("lockout_counter_reset"); ok {
+		c.LockoutCounterReset = time.Duration(lockoutCounterResetRaw.(int)) * time.Second
+		if c.LockoutCounterReset < 0 {
+			return logical.ErrorResponse("lockout_counter_reset must not be negative"), nil
+		}
+	}
+
+	if tokenTypeRaw, ok := d.GetOk("token_type"); ok {
+		switch tokenTypeStr := tokenTypeRaw.(string); tokenTypeStr {
+		case "", "default":
+			c.TokenType = logical.TokenTypeDefault
+		case "service":
+			c.TokenType = logical.TokenTypeService
+		case "batch":
+			c.TokenType = logical.TokenTypeBatch
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("invalid 'token_type' value %q", tokenTypeStr)), nil
+		}
+	}
+
+	if boundCIDRsRaw, ok := d.GetOk("token_bound_cidrs"); ok {
+		boundCIDRs, err := parseutil.ParseAddrs(boundCIDRsRaw.([]string))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid token_bound_cidrs: %s", err)), nil
+		}
+		c.TokenBoundCIDRs = boundCIDRs
+	}
+
+	if policyTemplateRaw, ok := d.GetOk("policy_template"); ok {
+		c.PolicyTemplate = strings.ToLower(strings.TrimSpace(policyTemplateRaw.(string)))
+		if c.PolicyTemplate != "" {
+			if !strings.Contains(c.PolicyTemplate, policyTemplateUsername) {
+				return logical.ErrorResponse(fmt.Sprintf("policy_template must contain %q", policyTemplateUsername)), nil
+			}
+			if invalidPolicyNameChars.MatchString(strings.Replace(c.PolicyTemplate, policyTemplateUsername, "", -1)) {
+				return logical.ErrorResponse(fmt.Sprintf("policy_template may only contain lowercase letters, digits, '_', '-' and %q", policyTemplateUsername)), nil
+			}
+		}
+	}
+
+	if passwordTTLRaw, ok := d.GetOk("password_ttl"); ok {
+		c.PasswordTTL = time.Duration(passwordTTLRaw.(int)) * time.Second
+		if c.PasswordTTL < 0 {
+			return logical.ErrorResponse("password_ttl must not be negative"), nil
+		}
+	}
+	if denyExpiredPasswordsRaw, ok := d.GetOk("deny_expired_passwords"); ok {
+		c.DenyExpiredPasswords = denyExpiredPasswordsRaw.(bool)
+	}
+
+	entry, err := logical.StorageEntryJSON("config", c)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	c, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, nil
+	}
+
+	boundCIDRs := make([]string, 0, len(c.TokenBoundCIDRs))
+	for _, cidr := range c.TokenBoundCIDRs {
+		boundCIDRs = append(boundCIDRs, cidr.String())
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"password_policy":        c.PasswordPolicy,
+			"lockout_threshold":      c.LockoutThreshold,
+			"lockout_duration":       int64(c.lockoutDuration().Seconds()),
+			"lockout_counter_reset":  int64(c.lockoutCounterReset().Seconds()),
+			"password_ttl":           int64(c.PasswordTTL.Seconds()),
+			"deny_expired_passwords": c.DenyExpiredPasswords,
+			"token_type":             c.TokenType.String(),
+			"token_bound_cidrs":      boundCIDRs,
+			"policy_template":        c.PolicyTemplate,
+		},
+	}, nil
+}
+
+// config returns the configuration of the mount, or nil if it hasn't been
+// configured.
+func (b *backend) config(ctx context.Context, s logical.Storage) (*config, error) {
+	entry, err := s.Get(ctx, "config")
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result config
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, errwrap.Wrapf("error reading configuration: {{err}}", err)
+	}
+
+	return &result, nil
+}
+
+// checkPasswordPolicy returns a user error describing how the password fails
+// to satisfy the configured password policy, if any.
+func (b *backend) checkPasswordPolicy(ctx context.Context, s logical.Storage, password string) (error, error) {
+	c, err := b.config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || c.PasswordPolicy == "" {
+		return nil, nil
+	}
+
+	policy, err := random.ParsePolicy(c.PasswordPolicy)
+	if err != nil {
+		return nil, errwrap.Wrapf("error parsing password policy: {{err}}", err)
+	}
+
+	value := []rune(password)
+	if len(value) < policy.Length {
+		return fmt.Errorf("password must be at least %d characters long", policy.Length), nil
+	}
+	for _, rule := range policy.Rules {
+		if rule.Pass(value) {
+			continue
+		}
+		if charsetRule, ok := rule.(random.CharsetRule); ok {
+			return fmt.Errorf("password must contain at least %d of the characters %q", charsetRule.MinChars, string(charsetRule.Charset)), nil
+		}
+		return fmt.Errorf("password does not satisfy the %q rule of the password policy", rule.Type()), nil
+	}
+
+	return nil, nil
+}
+
+type config struct {
+	PasswordPolicy       string            `json:"password_policy" structs:"password_policy" mapstructure:"password_policy"`
+	LockoutThreshold     int               `json:"lockout_threshold" structs:"lockout_threshold" mapstructure:"lockout_threshold"`
+	LockoutDuration      time.Duration     `json:"lockout_duration" structs:"lockout_duration" mapstructure:"lockout_duration"`
+	LockoutCounterReset  time.Duration     `json:"lockout_counter_reset" structs:"lockout_counter_reset" mapstructure:"lockout_counter_reset"`
+	PasswordTTL          time.Duration     `json:"password_ttl" structs:"password_ttl" mapstructure:"password_ttl"`
+	DenyExpiredPasswords bool              `json:"deny_expired_passwords" structs:"deny_expired_passwords" mapstructure:"deny_expired_passwords"`
+	TokenType            logical.TokenType `json:"token_type" structs:"token_type" mapstructure:"token_type"`
+
+	TokenBoundCIDRs []*sockaddr.SockAddrMarshaler `json:"token_bound_cidrs" structs:"token_bound_cidrs" mapstructure:"token_bound_cidrs"`
+	PolicyTemplate  string                        `json:"policy_template" structs:"policy_template" mapstructure:"policy_template"`
+}
+
+// lockoutEnabled returns true if users are locked out after failed logins.
+func (c *config) lockoutEnabled() bool {
+	return c != nil && c.LockoutThreshold > 0
+}
+
+func (c *config) lockoutDuration() time.Duration {
+	if c.LockoutDuration == 0 {
+		return defaultLockoutDuration
+	}
+	return c.LockoutDuration
+}
+
+func (c *config) lockoutCounterReset() time.Duration {
+	if c.LockoutCounterReset == 0 {
+		return c.lockoutDuration()
+	}
+	return c.LockoutCounterReset
+}
+
+// templatedPolicy returns the policy policy_template renders to for the
+// given user, or an empty string if no template is configured.
+func (c *config) templatedPolicy(username string) string {
+	if c == nil || c.PolicyTemplate == "" {
+		return ""
+	}
+
+	name := invalidPolicyNameChars.ReplaceAllString(strings.ToLower(username), "_")
+	policy := strings.Replace(c.PolicyTemplate, policyTemplateUsername, name, -1)
+
+	// A template must never grant the root policy
+	if policy == "root" {
+		return ""
+	}
+	return policy
+}
+
+// userPolicies returns the policies of the tokens of the given user: the
+// user's own policies and the templated policy, if any.
+func (c *config) userPolicies(username string, user *UserEntry) []string {
+	policies := append([]string(nil), user.TokenPolicies...)
+	if policy := c.templatedPolicy(username); policy != "" {
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+const pathConfigHelpSyn = `
+Configure the userpass auth method.
+`
+
+const pathConfigHelpDesc = `
+This endpoint allows configuring the password policy that passwords must
+satisfy when users are created or their password is changed. Existing
+passwords are not checked until they are next changed.
+
+It also configures the lockout of users after repeated failed logins. Once
+lockout_threshold logins have failed within lockout_counter_reset, logins of
+the user are denied for lockout_duration, or until the user is unlocked using
+the "users/<username>/unlock" endpoint. A successful login resets the count.
+
+Finally, it configures the expiration of passwords. Once a password is older
+than password_ttl, logins return a short-lived token along with a warning, or
+are denied if deny_expired_passwords is set, until the password is changed.
+
+The token_type and token_bound_cidrs values are defaults for users that don't
+set their own, and the policy rendered from policy_template is added to the
+policies of all users.
+`
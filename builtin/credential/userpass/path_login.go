@@ -1,13 +1,16 @@
 package userpass
 
 import (
+	"bytes"
 	"context"
 	"crypto/subtle"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/helper/cidrutil"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/helper/policyutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"golang.org/x/crypto/bcrypt"
@@ -26,6 +29,11 @@ func pathLogin(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Password for this user.",
 			},
+
+			"totp_code": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "TOTP code, required if the user is enrolled in TOTP.",
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -61,6 +69,36 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, d *framew
 		return nil, fmt.Errorf("missing password")
 	}
 
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// The user's lock is only taken when the login updates its lockout state
+	// or password hash
+	lock := locksutil.LockForKey(b.userLocks, username)
+	locked := false
+	defer func() {
+		if locked {
+			lock.Unlock()
+		}
+	}()
+
+	// Refuse the login of a locked out user, even with the right password
+	var lockout *lockoutEntry
+	if config.lockoutEnabled() {
+		lock.Lock()
+		locked = true
+
+		lockout, err = b.lockout(ctx, req.Storage, username)
+		if err != nil {
+			return nil, err
+		}
+		if lockout != nil && time.Now().Before(lockout.LockedUntil) {
+			return logical.ErrorResponse("user is locked out after too many failed logins"), logical.ErrPermissionDenied
+		}
+	}
+
 	// Get the user and validate auth
 	user, userError := b.user(ctx, req.Storage, username)
 
@@ -86,14 +124,21 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, d *framew
 	// Check for a password match. Check for a hash collision for Vault 0.2+,
 	// but handle the older legacy passwords with a constant time comparison.
 	passwordBytes := []byte(password)
+	var passwordMatch bool
 	if !legacyPassword {
-		if err := bcrypt.CompareHashAndPassword(userPassword, passwordBytes); err != nil {
-			return logical.ErrorResponse("invalid username or password"), nil
-		}
+		passwordMatch = bcrypt.CompareHashAndPassword(userPassword, passwordBytes) == nil
 	} else {
-		if subtle.ConstantTimeCompare(userPassword, passwordBytes) != 1 {
-			return logical.ErrorResponse("invalid username or password"), nil
+		passwordMatch = subtle.ConstantTimeCompare(userPassword, passwordBytes) == 1
+	}
+	if !passwordMatch {
+		// Only the failures of existing users are counted, so that storage
+		// isn't filled by logins with arbitrary usernames
+		if config.lockoutEnabled() && user != nil && userError == nil {
+			if err := b.recordFailedLogin(ctx, req.Storage, config, username, lockout); err != nil {
+				return nil, err
+			}
 		}
+		return logical.ErrorResponse("invalid username or password"), nil
 	}
 
 	if userError != nil {
@@ -103,31 +148,147 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, d *framew
 		return logical.ErrorResponse("invalid username or password"), nil
 	}
 
-	// Check for a CIDR match.
-	if len(user.TokenBoundCIDRs) > 0 {
+	// Check the second factor of enrolled users. A wrong code counts as a
+	// failed login.
+	if user.TOTPSecret != "" {
+		userErr, intErr := b.validateTOTPCode(username, user, d.Get("totp_code").(string))
+		if intErr != nil {
+			return nil, intErr
+		}
+		if userErr != nil {
+			if config.lockoutEnabled() {
+				if err := b.recordFailedLogin(ctx, req.Storage, config, username, lockout); err != nil {
+					return nil, err
+				}
+			}
+			return logical.ErrorResponse(userErr.Error()), logical.ErrPermissionDenied
+		}
+	}
+
+	// Check for a CIDR match. Users that don't set their own CIDRs use the
+	// mount's default.
+	boundCIDRs := user.TokenBoundCIDRs
+	if len(boundCIDRs) == 0 && config != nil {
+		boundCIDRs = config.TokenBoundCIDRs
+	}
+	if len(boundCIDRs) > 0 {
 		if req.Connection == nil {
 			b.Logger().Warn("token bound CIDRs found but no connection information available for validation")
 			return nil, logical.ErrPermissionDenied
 		}
-		if !cidrutil.RemoteAddrIsOk(req.Connection.RemoteAddr, user.TokenBoundCIDRs) {
+		if !cidrutil.RemoteAddrIsOk(req.Connection.RemoteAddr, boundCIDRs) {
 			return nil, logical.ErrPermissionDenied
 		}
 	}
 
+	passwordExpiredAt, passwordExpired := user.passwordExpiry(config)
+	if passwordExpired && config != nil && config.DenyExpiredPasswords {
+		return logical.ErrorResponse("password has expired and must be changed"), logical.ErrPermissionDenied
+	}
+
+	metadata := make(map[string]string, len(user.Metadata)+1)
+	for k, v := range user.Metadata {
+		metadata[k] = v
+	}
+	metadata["username"] = username
+
 	auth := &logical.Auth{
-		Metadata: map[string]string{
-			"username": username,
-		},
+		Metadata:    metadata,
 		DisplayName: username,
 		Alias: &logical.Alias{
 			Name: username,
 		},
 	}
 	user.PopulateTokenAuth(auth)
+	auth.BoundCIDRs = boundCIDRs
+	auth.Policies = config.userPolicies(username, user)
 
-	return &logical.Response{
+	// Users that don't set their own token type use the mount's default
+	if auth.TokenType == logical.TokenTypeDefault && config != nil {
+		auth.TokenType = config.TokenType
+	}
+	if auth.TokenType == logical.TokenTypeBatch {
+		if auth.Period != 0 || auth.NumUses != 0 {
+			return logical.ErrorResponse("the 'token_type' of the configuration cannot be 'batch' for a user that generates periodic tokens or tokens with limited use count"), nil
+		}
+		// Batch tokens can't be renewed
+		auth.Renewable = false
+	}
+
+	resp := &logical.Response{
 		Auth: auth,
-	}, nil
+	}
+
+	// The token of a user with an expired password only lasts long enough to
+	// change it
+	if passwordExpired {
+		auth.Period = 0
+		if auth.ExplicitMaxTTL == 0 || auth.ExplicitMaxTTL > expiredPasswordTokenTTL {
+			auth.ExplicitMaxTTL = expiredPasswordTokenTTL
+		}
+		if auth.TTL == 0 || auth.TTL > expiredPasswordTokenTTL {
+			auth.TTL = expiredPasswordTokenTTL
+		}
+		resp.AddWarning(fmt.Sprintf("password expired at %s; change it using the \"users/%s/password\" endpoint, the returned token expires after %s", passwordExpiredAt.Format(time.RFC3339), username, expiredPasswordTokenTTL))
+	}
+
+	if lockout != nil {
+		if err := b.deleteLockout(ctx, req.Storage, username); err != nil {
+			return nil, err
+		}
+	}
+
+	if user.needsPasswordHashUpgrade() {
+		if !locked {
+			lock.Lock()
+			locked = true
+		}
+		b.upgradePasswordHash(ctx, req.Storage, username, user, password)
+	}
+
+	return resp, nil
+}
+
+// needsPasswordHashUpgrade returns true if the password of the user is stored
+// as a legacy plaintext password or with a weaker bcrypt cost.
+func (u *UserEntry) needsPasswordHashUpgrade() bool {
+	if u.PasswordHash == nil {
+		return true
+	}
+	cost, err := bcrypt.Cost(u.PasswordHash)
+	return err != nil || cost < bcrypt.DefaultCost
+}
+
+// upgradePasswordHash rehashes the password of the user with the current
+// scheme. It's called with the user's lock held once a login has succeeded,
+// when the password is known. The entry is read again so that updates of the
+// user made during the login aren't reverted, and it's left alone if the
+// password was changed since it was verified. Failures are logged rather than
+// failing the login.
+func (b *backend) upgradePasswordHash(ctx context.Context, s logical.Storage, username string, verified *UserEntry, password string) {
+	user, err := b.user(ctx, s, username)
+	if err != nil {
+		b.Logger().Warn("failed to upgrade password hash", "username", username, "error", err)
+		return
+	}
+	if user == nil || user.Password != verified.Password || !bytes.Equal(user.PasswordHash, verified.PasswordHash) {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		b.Logger().Warn("failed to upgrade password hash", "username", username, "error", err)
+		return
+	}
+
+	user.PasswordHash = hash
+	user.Password = ""
+	if err := b.setUser(ctx, s, username, user); err != nil {
+		b.Logger().Warn("failed to upgrade password hash", "username", username, "error", err)
+		return
+	}
+
+	b.Logger().Info("upgraded password hash", "username", username)
 }
 
 func (b *backend) pathLoginRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -141,7 +302,12 @@ func (b *backend) pathLoginRenew(ctx context.Context, req *logical.Request, d *f
 		return nil, nil
 	}
 
-	if !policyutil.EquivalentPolicies(user.TokenPolicies, req.Auth.TokenPolicies) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if !policyutil.EquivalentPolicies(config.userPolicies(req.Auth.Metadata["username"], user), req.Auth.TokenPolicies) {
 		return nil, fmt.Errorf("policies have changed, not renewing")
 	}
 
@@ -152,6 +318,10 @@ func (b *backend) pathLoginRenew(ctx context.Context, req *logical.Request, d *f
 	return resp, nil
 }
 
+// expiredPasswordTokenTTL is the maximum TTL of the tokens returned by logins
+// with an expired password.
+const expiredPasswordTokenTTL = 5 * time.Minute
+
 const pathLoginSyn = `
 Log in with a username and password.
 `
@@ -3,10 +3,13 @@ package userpass
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -23,6 +26,15 @@ func pathUserPassword(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Password for this user.",
 			},
+
+			"current_password": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Current password of the user. Required when users change
+their own password.`,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -35,7 +47,11 @@ func pathUserPassword(b *backend) *framework.Path {
 }
 
 func (b *backend) pathUserPasswordUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	username := d.Get("username").(string)
+	username := strings.ToLower(d.Get("username").(string))
+
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
 
 	userEntry, err := b.user(ctx, req.Storage, username)
 	if err != nil {
@@ -45,10 +61,23 @@ func (b *backend) pathUserPasswordUpdate(ctx context.Context, req *logical.Reque
 		return nil, fmt.Errorf("username does not exist")
 	}
 
-	userErr, intErr := b.updateUserPassword(req, d, userEntry)
-	if intErr != nil {
+	// Users changing their own password must prove they know the current
+	// one, so that a leaked token can't be used to take over the account
+	self, err := b.isSelf(req, username)
+	if err != nil {
 		return nil, err
 	}
+	currentPassword := d.Get("current_password").(string)
+	if self || currentPassword != "" {
+		if resp, err := b.verifyCurrentPassword(ctx, req, username, userEntry, currentPassword); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+
+	userErr, intErr := b.updateUserPassword(ctx, req, d, userEntry)
+	if intErr != nil {
+		return nil, intErr
+	}
 	if userErr != nil {
 		return logical.ErrorResponse(userErr.Error()), logical.ErrInvalidRequest
 	}
@@ -56,17 +85,81 @@ func (b *backend) pathUserPasswordUpdate(ctx context.Context, req *logical.Reque
 	return nil, b.setUser(ctx, req.Storage, username, userEntry)
 }
 
-func (b *backend) updateUserPassword(req *logical.Request, d *framework.FieldData, userEntry *UserEntry) (error, error) {
+// isSelf returns true if the request was made with a token of the user,
+// obtained by logging in through this mount.
+func (b *backend) isSelf(req *logical.Request, username string) (bool, error) {
+	if req.EntityID == "" {
+		return false, nil
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return false, err
+	}
+	if entity == nil {
+		return false, nil
+	}
+
+	for _, alias := range entity.Aliases {
+		if alias.MountAccessor == req.MountAccessor && alias.Name == username {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// verifyCurrentPassword returns an error response if the current password of
+// the user doesn't match. The check is subject to the same lockout as logins.
+// The caller must hold the user's lock.
+func (b *backend) verifyCurrentPassword(ctx context.Context, req *logical.Request, username string, user *UserEntry, currentPassword string) (*logical.Response, error) {
+	if currentPassword == "" {
+		return logical.ErrorResponse("missing current_password"), logical.ErrInvalidRequest
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockout *lockoutEntry
+	if config.lockoutEnabled() {
+		lockout, err = b.lockout(ctx, req.Storage, username)
+		if err != nil {
+			return nil, err
+		}
+		if lockout != nil && time.Now().Before(lockout.LockedUntil) {
+			return logical.ErrorResponse("user is locked out after too many failed logins"), logical.ErrPermissionDenied
+		}
+	}
+
+	if !user.passwordMatches(currentPassword) {
+		if config.lockoutEnabled() {
+			if err := b.recordFailedLogin(ctx, req.Storage, config, username, lockout); err != nil {
+				return nil, err
+			}
+		}
+		return logical.ErrorResponse("invalid current_password"), logical.ErrPermissionDenied
+	}
+
+	return nil, nil
+}
+
+func (b *backend) updateUserPassword(ctx context.Context, req *logical.Request, d *framework.FieldData, userEntry *UserEntry) (error, error) {
 	password := d.Get("password").(string)
 	if password == "" {
 		return fmt.Errorf("missing password"), nil
 	}
+	if userErr, intErr := b.checkPasswordPolicy(ctx, req.Storage, password); intErr != nil || userErr != nil {
+		return userErr, intErr
+	}
 	// Generate a hash of the password
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
 	}
 	userEntry.PasswordHash = hash
+	userEntry.PasswordLastChanged = time.Now()
 	return nil, nil
 }
 
@@ -75,5 +168,9 @@ Reset user's password.
 `
 
 const pathUserPasswordHelpDesc = `
-This endpoint allows resetting the user's password.
+This endpoint allows resetting the user's password. It can be granted to
+users for their own password, for example using a templated policy, without
+granting access to the rest of the user's configuration. Users changing their
+own password must provide it as "current_password". The password policy and
+lockout configured for the mount apply.
 `
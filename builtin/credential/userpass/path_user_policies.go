@@ -3,8 +3,10 @@ package userpass
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/helper/policyutil"
 	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -39,7 +41,11 @@ func pathUserPolicies(b *backend) *framework.Path {
 }
 
 func (b *backend) pathUserPoliciesUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	username := d.Get("username").(string)
+	username := strings.ToLower(d.Get("username").(string))
+
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
 
 	userEntry, err := b.user(ctx, req.Storage, username)
 	if err != nil {
@@ -0,0 +1,159 @@
+package userpass
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	otplib "github.com/pquerna/otp"
+	totplib "github.com/pquerna/otp/totp"
+)
+
+const (
+	// totpPeriod is the number of seconds a TOTP code is valid for
+	totpPeriod = 30
+
+	// totpSkew is the number of periods before and after the current one
+	// whose codes are accepted, to allow for clock drift
+	totpSkew = 1
+)
+
+func pathUserTOTP(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "users/" + framework.GenericNameRegex("username") + "/totp$",
+		Fields: map[string]*framework.FieldSchema{
+			"username": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Username for this user.",
+			},
+
+			"issuer": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Default:     "Vault",
+				Description: "Issuer shown by authenticator apps for the key.",
+			},
+
+			"account_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Account name shown by authenticator apps for the key. Defaults to the username.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathUserTOTPEnroll,
+			logical.DeleteOperation: b.pathUserTOTPDelete,
+		},
+
+		HelpSynopsis:    pathUserTOTPHelpSyn,
+		HelpDescription: pathUserTOTPHelpDesc,
+	}
+}
+
+func (b *backend) pathUserTOTPEnroll(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	username := strings.ToLower(d.Get("username").(string))
+
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	userEntry, err := b.user(ctx, req.Storage, username)
+	if err != nil {
+		return nil, err
+	}
+	if userEntry == nil {
+		return nil, fmt.Errorf("username does not exist")
+	}
+
+	accountName := d.Get("account_name").(string)
+	if accountName == "" {
+		accountName = username
+	}
+
+	key, err := totplib.Generate(totplib.GenerateOpts{
+		Issuer:      d.Get("issuer").(string),
+		AccountName: accountName,
+		Period:      totpPeriod,
+		Digits:      otplib.DigitsSix,
+		Algorithm:   otplib.AlgorithmSHA1,
+		Rand:        b.GetRandomReader(),
+	})
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to generate TOTP key: %s", err)), nil
+	}
+
+	userEntry.TOTPSecret = key.Secret()
+	if err := b.setUser(ctx, req.Storage, username, userEntry); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"url": key.String(),
+		},
+	}, nil
+}
+
+func (b *backend) pathUserTOTPDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	username := strings.ToLower(d.Get("username").(string))
+
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	userEntry, err := b.user(ctx, req.Storage, username)
+	if err != nil {
+		return nil, err
+	}
+	if userEntry == nil {
+		return nil, nil
+	}
+
+	userEntry.TOTPSecret = ""
+	return nil, b.setUser(ctx, req.Storage, username, userEntry)
+}
+
+// validateTOTPCode returns a user error if the code isn't a valid TOTP code of
+// the user, or was already used.
+func (b *backend) validateTOTPCode(username string, user *UserEntry, code string) (error, error) {
+	if code == "" {
+		return fmt.Errorf("missing totp_code"), nil
+	}
+
+	usedName := fmt.Sprintf("%s_%s", username, code)
+	if _, ok := b.usedTOTPCodes.Get(usedName); ok {
+		return fmt.Errorf("totp_code already used; wait until the next time period"), nil
+	}
+
+	valid, err := totplib.ValidateCustom(code, user.TOTPSecret, time.Now(), totplib.ValidateOpts{
+		Period:    totpPeriod,
+		Skew:      totpSkew,
+		Digits:    otplib.DigitsSix,
+		Algorithm: otplib.AlgorithmSHA1,
+	})
+	if err != nil || !valid {
+		return fmt.Errorf("invalid totp_code"), nil
+	}
+
+	// A code is valid for its own period and the skewed ones around it. Add
+	// fails if a concurrent login used the code first.
+	if err := b.usedTOTPCodes.Add(usedName, nil, time.Duration(totpPeriod*(2+totpSkew))*time.Second); err != nil {
+		return fmt.Errorf("totp_code already used; wait until the next time period"), nil
+	}
+
+	return nil, nil
+}
+
+const pathUserTOTPHelpSyn = `
+Enroll a user in TOTP second factor authentication.
+`
+
+const pathUserTOTPHelpDesc = `
+Writing to this endpoint generates a new TOTP key for the user and returns its
+provisioning URL, which can be imported by authenticator apps. Once enrolled,
+logins of the user require a valid "totp_code" along with the password. A
+code can only be used once. Deleting the endpoint disables the second factor.
+`
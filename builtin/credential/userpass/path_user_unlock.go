@@ -0,0 +1,117 @@
+package userpass
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathUserUnlock(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "users/" + framework.GenericNameRegex("username") + "/unlock$",
+		Fields: map[string]*framework.FieldSchema{
+			"username": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Username for this user.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathUserUnlockUpdate,
+		},
+
+		HelpSynopsis:    pathUserUnlockHelpSyn,
+		HelpDescription: pathUserUnlockHelpDesc,
+	}
+}
+
+func (b *backend) pathUserUnlockUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	username := strings.ToLower(d.Get("username").(string))
+
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return nil, b.deleteLockout(ctx, req.Storage, username)
+}
+
+// lockoutEntry tracks the failed logins of a user
+type lockoutEntry struct {
+	// FailedAttempts is the number of failed logins since FirstFailure
+	FailedAttempts int `json:"failed_attempts"`
+
+	// FirstFailure is the time of the first failed login counted in
+	// FailedAttempts
+	FirstFailure time.Time `json:"first_failure"`
+
+	// LockedUntil is the time until which logins are denied, if the user has
+	// been locked out
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+func (b *backend) lockout(ctx context.Context, s logical.Storage, username string) (*lockoutEntry, error) {
+	entry, err := s.Get(ctx, "lockout/"+username)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result lockoutEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) setLockout(ctx context.Context, s logical.Storage, username string, lockout *lockoutEntry) error {
+	entry, err := logical.StorageEntryJSON("lockout/"+username, lockout)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) deleteLockout(ctx context.Context, s logical.Storage, username string) error {
+	return s.Delete(ctx, "lockout/"+username)
+}
+
+// recordFailedLogin counts a failed login of the user, locking it out once the
+// configured threshold is reached within the counter reset window.
+func (b *backend) recordFailedLogin(ctx context.Context, s logical.Storage, c *config, username string, lockout *lockoutEntry) error {
+	now := time.Now()
+
+	// Start counting again once the counter reset window has passed or the
+	// user's lockout has expired
+	if lockout == nil ||
+		(!lockout.LockedUntil.IsZero() && !now.Before(lockout.LockedUntil)) ||
+		now.Sub(lockout.FirstFailure) > c.lockoutCounterReset() {
+		lockout = &lockoutEntry{
+			FirstFailure: now,
+		}
+	}
+
+	lockout.FailedAttempts++
+	if lockout.FailedAttempts >= c.LockoutThreshold {
+		lockout.LockedUntil = now.Add(c.lockoutDuration())
+		b.Logger().Warn("user locked out after too many failed logins", "username", username, "locked_until", lockout.LockedUntil)
+	}
+
+	return b.setLockout(ctx, s, username, lockout)
+}
+
+const pathUserUnlockHelpSyn = `
+Unlock a user that was locked out.
+`
+
+const pathUserUnlockHelpDesc = `
+This endpoint allows unlocking a user that was locked out after too many
+failed logins, and resets its count of failed logins.
+`
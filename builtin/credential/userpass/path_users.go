@@ -2,19 +2,29 @@ package userpass
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"strings"
 	"time"
 
 	sockaddr "github.com/hashicorp/go-sockaddr"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func pathUsersList(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "users/?",
+		Fields: map[string]*framework.FieldSchema{
+			"detailed": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the metadata of each user is returned in key_info:
+its token settings, password expiration and lockout state.`,
+			},
+		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ListOperation: b.pathUserList,
@@ -64,11 +74,23 @@ func pathUsers(b *backend) *framework.Path {
 				Deprecated:  true,
 			},
 
+			"password_ttl": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `Duration after which the password of this user expires.
+If zero, the password_ttl of the auth method's configuration is used.`,
+			},
+
 			"bound_cidrs": &framework.FieldSchema{
 				Type:        framework.TypeCommaStringSlice,
 				Description: tokenutil.DeprecationText("token_bound_cidrs"),
 				Deprecated:  true,
 			},
+
+			"metadata": &framework.FieldSchema{
+				Type: framework.TypeKVPairs,
+				Description: `Metadata added to the tokens issued to this user. Keys and
+values must be non-empty strings, and the "username" key is reserved.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -149,16 +171,63 @@ func (b *backend) pathUserList(ctx context.Context, req *logical.Request, d *fra
 	if err != nil {
 		return nil, err
 	}
-	return logical.ListResponse(users), nil
+	if !d.Get("detailed").(bool) {
+		return logical.ListResponse(users), nil
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := make(map[string]interface{}, len(users))
+	for _, username := range users {
+		user, err := b.user(ctx, req.Storage, username)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			// The user was deleted since being listed
+			continue
+		}
+
+		info := map[string]interface{}{}
+		user.PopulateTokenData(info)
+		info["password_ttl"] = int64(user.PasswordTTL.Seconds())
+		if !user.PasswordLastChanged.IsZero() {
+			info["password_last_changed"] = user.PasswordLastChanged.Format(time.RFC3339)
+		}
+		_, info["password_expired"] = user.passwordExpiry(config)
+
+		lockout, err := b.lockout(ctx, req.Storage, username)
+		if err != nil {
+			return nil, err
+		}
+		info["locked"] = false
+		if config.lockoutEnabled() && lockout != nil && time.Now().Before(lockout.LockedUntil) {
+			info["locked"] = true
+			info["locked_until"] = lockout.LockedUntil.Format(time.RFC3339)
+		}
+
+		keyInfo[username] = info
+	}
+
+	return logical.ListResponseWithInfo(users, keyInfo), nil
 }
 
 func (b *backend) pathUserDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, "user/"+strings.ToLower(d.Get("username").(string)))
+	username := strings.ToLower(d.Get("username").(string))
+
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := req.Storage.Delete(ctx, "user/"+username)
 	if err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	return nil, b.deleteLockout(ctx, req.Storage, username)
 }
 
 func (b *backend) pathUserRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -187,6 +256,13 @@ func (b *backend) pathUserRead(ctx context.Context, req *logical.Request, d *fra
 		data["bound_cidrs"] = user.BoundCIDRs
 	}
 
+	data["password_ttl"] = int64(user.PasswordTTL.Seconds())
+	data["totp_enabled"] = user.TOTPSecret != ""
+	data["metadata"] = user.Metadata
+	if !user.PasswordLastChanged.IsZero() {
+		data["password_last_changed"] = user.PasswordLastChanged.Format(time.RFC3339)
+	}
+
 	return &logical.Response{
 		Data: data,
 	}, nil
@@ -194,6 +270,11 @@ func (b *backend) pathUserRead(ctx context.Context, req *logical.Request, d *fra
 
 func (b *backend) userCreateUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	username := strings.ToLower(d.Get("username").(string))
+
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
 	userEntry, err := b.user(ctx, req.Storage, username)
 	if err != nil {
 		return nil, err
@@ -207,8 +288,28 @@ func (b *backend) userCreateUpdate(ctx context.Context, req *logical.Request, d
 		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
 	}
 
+	if passwordTTLRaw, ok := d.GetOk("password_ttl"); ok {
+		userEntry.PasswordTTL = time.Duration(passwordTTLRaw.(int)) * time.Second
+		if userEntry.PasswordTTL < 0 {
+			return logical.ErrorResponse("password_ttl must not be negative"), logical.ErrInvalidRequest
+		}
+	}
+
+	if metadataRaw, ok := d.GetOk("metadata"); ok {
+		metadata := metadataRaw.(map[string]string)
+		for k, v := range metadata {
+			switch {
+			case k == "" || v == "":
+				return logical.ErrorResponse("metadata keys and values must not be empty"), logical.ErrInvalidRequest
+			case k == "username":
+				return logical.ErrorResponse(`metadata key "username" is reserved`), logical.ErrInvalidRequest
+			}
+		}
+		userEntry.Metadata = metadata
+	}
+
 	if _, ok := d.GetOk("password"); ok {
-		userErr, intErr := b.updateUserPassword(req, d, userEntry)
+		userErr, intErr := b.updateUserPassword(ctx, req, d, userEntry)
 		if intErr != nil {
 			return nil, intErr
 		}
@@ -267,6 +368,45 @@ type UserEntry struct {
 	MaxTTL time.Duration
 
 	BoundCIDRs []*sockaddr.SockAddrMarshaler
+
+	// PasswordTTL is the duration after which the password expires. If zero,
+	// the mount's default is used.
+	PasswordTTL time.Duration
+
+	// PasswordLastChanged is the time the password was last set. It's zero
+	// for passwords set before it was tracked, which don't expire.
+	PasswordLastChanged time.Time
+
+	// TOTPSecret is the secret of the TOTP key the user is enrolled with. If
+	// set, logins require a TOTP code.
+	TOTPSecret string
+
+	// Metadata is added to the metadata of the tokens issued to the user.
+	Metadata map[string]string
+}
+
+// passwordMatches returns true if the password is the user's password. The
+// comparison of legacy passwords, stored as is, is constant time.
+func (u *UserEntry) passwordMatches(password string) bool {
+	if u.PasswordHash == nil {
+		return subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+	}
+	return bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) == nil
+}
+
+// passwordExpiry returns the time the password of the user expires, and
+// whether it has expired.
+func (u *UserEntry) passwordExpiry(c *config) (time.Time, bool) {
+	ttl := u.PasswordTTL
+	if ttl == 0 && c != nil {
+		ttl = c.PasswordTTL
+	}
+	if ttl == 0 || u.PasswordLastChanged.IsZero() {
+		return time.Time{}, false
+	}
+
+	expiresAt := u.PasswordLastChanged.Add(ttl)
+	return expiresAt, !time.Now().Before(expiresAt)
 }
 
 const pathUserHelpSyn = `
@@ -3,6 +3,8 @@ package userpass
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/vault/api"
@@ -27,10 +29,74 @@ func TestAccBackend_stepwise_UserCrud(t *testing.T) {
 			testAccStepwiseReadUser(t, "web", "foo"),
 			testAccStepwiseDeleteUser(t, "web"),
 			testAccStepwiseReadUser(t, "web", ""),
+
+			// Usernames are case insensitive
+			testAccStepwiseUser(t, "Web", "password", "foo"),
+			testAccStepwiseReadUser(t, "web", "foo"),
+			testAccStepwiseLogin(t, "WEB", "password", []string{"default", "foo"}),
+			testAccStepwisePassword(t, "wEb", "newpassword"),
+			testAccStepwiseLogin(t, "web", "newpassword", []string{"default", "foo"}),
+			testAccStepwiseDeleteUser(t, "WEB"),
+			testAccStepwiseReadUser(t, "Web", ""),
 		},
 	})
 }
 
+func TestAccBackend_stepwise_PasswordPolicy(t *testing.T) {
+	customPluginName := "my-userpass"
+	envOptions := &stepwise.MountOptions{
+		RegistryName:    customPluginName,
+		PluginType:      stepwise.PluginTypeCredential,
+		PluginName:      "userpass",
+		MountPathPrefix: customPluginName,
+	}
+	stepwise.Run(t, stepwise.Case{
+		Environment: dockerEnvironment.NewEnvironment(customPluginName, envOptions),
+		Steps: []stepwise.Step{
+			testAccStepwiseConfig(t, `
+length = 12
+rule "charset" {
+  charset = "0123456789"
+  min-chars = 2
+}`),
+			testAccStepwiseUserRejected(t, "web", "password", "at least 12 characters"),
+			testAccStepwiseUserRejected(t, "web", "longpassword", "at least 2 of the characters"),
+			testAccStepwiseReadUser(t, "web", ""),
+			testAccStepwiseUser(t, "web", "longpassword12", "foo"),
+			testAccStepwiseReadUser(t, "web", "foo"),
+		},
+	})
+}
+
+func testAccStepwiseConfig(t *testing.T, passwordPolicy string) stepwise.Step {
+	return stepwise.Step{
+		Operation: stepwise.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"password_policy": passwordPolicy,
+		},
+	}
+}
+
+func testAccStepwiseUserRejected(t *testing.T, name, password, expected string) stepwise.Step {
+	return stepwise.Step{
+		Operation: stepwise.UpdateOperation,
+		Path:      "users/" + name,
+		Data: map[string]interface{}{
+			"password": password,
+		},
+		Assert: func(resp *api.Secret, err error) error {
+			if err == nil {
+				return fmt.Errorf("expected the password to be rejected")
+			}
+			if !strings.Contains(err.Error(), expected) {
+				return fmt.Errorf("expected error containing %q, got: %s", expected, err)
+			}
+			return nil
+		},
+	}
+}
+
 func testAccStepwiseUser(
 	t *testing.T, name string, password string, policies string) stepwise.Step {
 	return stepwise.Step{
@@ -43,6 +109,46 @@ func testAccStepwiseUser(
 	}
 }
 
+func testAccStepwisePassword(t *testing.T, name string, password string) stepwise.Step {
+	return stepwise.Step{
+		Operation: stepwise.UpdateOperation,
+		Path:      "users/" + name + "/password",
+		Data: map[string]interface{}{
+			"password": password,
+		},
+	}
+}
+
+func testAccStepwiseLogin(t *testing.T, name string, password string, policies []string) stepwise.Step {
+	return stepwise.Step{
+		Operation: stepwise.UpdateOperation,
+		Path:      "login/" + name,
+		Data: map[string]interface{}{
+			"password": password,
+		},
+		Unauthenticated: true,
+		Assert: func(resp *api.Secret, err error) error {
+			if err != nil {
+				return err
+			}
+			if resp == nil || resp.Auth == nil {
+				return fmt.Errorf("expected auth in the response, got: %#v", resp)
+			}
+
+			actualPolicies := append([]string(nil), resp.Auth.Policies...)
+			sort.Strings(actualPolicies)
+			if !reflect.DeepEqual(actualPolicies, policies) {
+				return fmt.Errorf("Actual policies: %#v\nExpected policies: %#v", actualPolicies, policies)
+			}
+			if resp.Auth.Metadata["username"] != strings.ToLower(name) {
+				return fmt.Errorf("expected username %q in the metadata, got: %q", strings.ToLower(name), resp.Auth.Metadata["username"])
+			}
+
+			return nil
+		},
+	}
+}
+
 func testAccStepwiseDeleteUser(t *testing.T, name string) stepwise.Step {
 	return stepwise.Step{
 		Operation: stepwise.DeleteOperation,
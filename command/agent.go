@@ -6,10 +6,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -30,14 +32,19 @@ import (
 	"github.com/hashicorp/vault/command/agent/auth/kerberos"
 	"github.com/hashicorp/vault/command/agent/auth/kubernetes"
 	"github.com/hashicorp/vault/command/agent/cache"
+	"github.com/hashicorp/vault/command/agent/cache/cacheboltdb"
 	agentConfig "github.com/hashicorp/vault/command/agent/config"
 	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/command/agent/sink/fifo"
 	"github.com/hashicorp/vault/command/agent/sink/file"
 	"github.com/hashicorp/vault/command/agent/sink/inmem"
+	k8ssink "github.com/hashicorp/vault/command/agent/sink/kubernetes"
+	websocketsink "github.com/hashicorp/vault/command/agent/sink/websocket"
 	"github.com/hashicorp/vault/command/agent/template"
 	"github.com/hashicorp/vault/internalshared/gatedwriter"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/version"
 	"github.com/kr/pretty"
@@ -48,6 +55,30 @@ import (
 var _ cli.Command = (*AgentCommand)(nil)
 var _ cli.CommandAutocomplete = (*AgentCommand)(nil)
 
+// builtinAuthMethods are the auth methods available to auto-auth by default.
+// Other methods can be added with auth.RegisterAuthMethod.
+var builtinAuthMethods = map[string]auth.AuthMethodFactory{
+	"alicloud":   alicloud.NewAliCloudAuthMethod,
+	"aws":        aws.NewAWSAuthMethod,
+	"azure":      azure.NewAzureAuthMethod,
+	"cert":       cert.NewCertAuthMethod,
+	"cf":         cf.NewCFAuthMethod,
+	"gcp":        gcp.NewGCPAuthMethod,
+	"jwt":        jwt.NewJWTAuthMethod,
+	"kerberos":   kerberos.NewKerberosAuthMethod,
+	"kubernetes": kubernetes.NewKubernetesAuthMethod,
+	"approle":    approle.NewApproleAuthMethod,
+	"pcf":        cf.NewCFAuthMethod, // Deprecated.
+}
+
+func init() {
+	for methodType, factory := range builtinAuthMethods {
+		if err := auth.RegisterAuthMethod(methodType, factory); err != nil {
+			panic(err)
+		}
+	}
+}
+
 type AgentCommand struct {
 	*BaseCommand
 
@@ -360,6 +391,61 @@ func (c *AgentCommand) Run(args []string) int {
 				}
 				config.Sink = s
 				sinks = append(sinks, config)
+			case "fifo":
+				config := &sink.SinkConfig{
+					Logger:    c.logger.Named("sink.fifo"),
+					Config:    sc.Config,
+					Client:    client,
+					WrapTTL:   sc.WrapTTL,
+					DHType:    sc.DHType,
+					DeriveKey: sc.DeriveKey,
+					DHPath:    sc.DHPath,
+					AAD:       sc.AAD,
+				}
+				s, err := fifo.NewFIFOSink(config)
+				if err != nil {
+					c.UI.Error(errwrap.Wrapf("Error creating fifo sink: {{err}}", err).Error())
+					return 1
+				}
+				config.Sink = s
+				sinks = append(sinks, config)
+			case "kubernetes":
+				config := &sink.SinkConfig{
+					Logger:    c.logger.Named("sink.kubernetes"),
+					Config:    sc.Config,
+					Client:    client,
+					WrapTTL:   sc.WrapTTL,
+					DHType:    sc.DHType,
+					DeriveKey: sc.DeriveKey,
+					DHPath:    sc.DHPath,
+					AAD:       sc.AAD,
+				}
+				s, err := k8ssink.NewKubernetesSink(config, nil)
+				if err != nil {
+					c.UI.Error(errwrap.Wrapf("Error creating kubernetes sink: {{err}}", err).Error())
+					return 1
+				}
+				config.Sink = s
+				sinks = append(sinks, config)
+			case "websocket":
+				config := &sink.SinkConfig{
+					Logger:    c.logger.Named("sink.websocket"),
+					Config:    sc.Config,
+					Client:    client,
+					WrapTTL:   sc.WrapTTL,
+					DHType:    sc.DHType,
+					DeriveKey: sc.DeriveKey,
+					DHPath:    sc.DHPath,
+					AAD:       sc.AAD,
+				}
+				s, err := websocketsink.NewWebSocketSink(config)
+				if err != nil {
+					c.UI.Error(errwrap.Wrapf("Error creating websocket sink: {{err}}", err).Error())
+					return 1
+				}
+				defer s.(io.Closer).Close()
+				config.Sink = s
+				sinks = append(sinks, config)
 			default:
 				c.UI.Error(fmt.Sprintf("Unknown sink type %q", sc.Type))
 				return 1
@@ -378,39 +464,37 @@ func (c *AgentCommand) Run(args []string) int {
 			MountPath: mountPath,
 			Config:    config.AutoAuth.Method.Config,
 		}
-		switch config.AutoAuth.Method.Type {
-		case "alicloud":
-			method, err = alicloud.NewAliCloudAuthMethod(authConfig)
-		case "aws":
-			method, err = aws.NewAWSAuthMethod(authConfig)
-		case "azure":
-			method, err = azure.NewAzureAuthMethod(authConfig)
-		case "cert":
-			method, err = cert.NewCertAuthMethod(authConfig)
-		case "cf":
-			method, err = cf.NewCFAuthMethod(authConfig)
-		case "gcp":
-			method, err = gcp.NewGCPAuthMethod(authConfig)
-		case "jwt":
-			method, err = jwt.NewJWTAuthMethod(authConfig)
-		case "kerberos":
-			method, err = kerberos.NewKerberosAuthMethod(authConfig)
-		case "kubernetes":
-			method, err = kubernetes.NewKubernetesAuthMethod(authConfig)
-		case "approle":
-			method, err = approle.NewApproleAuthMethod(authConfig)
-		case "pcf": // Deprecated.
-			method, err = cf.NewCFAuthMethod(authConfig)
-		default:
+		if !strutil.StrListContains(auth.RegisteredAuthMethods(), config.AutoAuth.Method.Type) {
 			c.UI.Error(fmt.Sprintf("Unknown auth method %q", config.AutoAuth.Method.Type))
 			return 1
 		}
+		method, err = auth.NewAuthMethod(config.AutoAuth.Method.Type, authConfig)
 		if err != nil {
 			c.UI.Error(errwrap.Wrapf(fmt.Sprintf("Error creating %s auth method: {{err}}", config.AutoAuth.Method.Type), err).Error())
 			return 1
 		}
 	}
 
+	// The auth handler is created ahead of the listeners, so that they can
+	// report the status of its token
+	var ah *auth.AuthHandler
+	var authStatus cache.AutoAuthStatus
+	if method != nil {
+		enableTokenCh := len(config.Templates) > 0
+		ah = auth.NewAuthHandler(&auth.AuthHandlerConfig{
+			Logger:                       c.logger.Named("auth.handler"),
+			Client:                       c.client,
+			WrapTTL:                      config.AutoAuth.Method.WrapTTL,
+			MinBackoff:                   config.AutoAuth.Method.MinBackoff,
+			MaxBackoff:                   config.AutoAuth.Method.MaxBackoff,
+			EnableReauthOnNewCredentials: config.AutoAuth.EnableReauthOnNewCredentials,
+			EnableTemplateTokenCh:        enableTokenCh,
+			ExitAfterAuth:                exitAfterAuth,
+			RevokeOnShutdown:             config.AutoAuth.RevokeOnShutdown,
+		})
+		authStatus = ah
+	}
+
 	// Output the header that the server has started
 	if !c.flagCombineLogs {
 		c.UI.Output("==> Vault server started! Log data will stream in below:\n")
@@ -422,27 +506,65 @@ func (c *AgentCommand) Run(args []string) int {
 	default:
 	}
 
+	// templateProxyAddress is set when templates read secrets through the
+	// cache
+	var templateProxyAddress string
+
 	// Parse agent listener configurations
 	if config.Cache != nil && len(config.Listeners) != 0 {
 		cacheLogger := c.logger.Named("cache")
 
+		// Create the metric sink shared by the cache layers, served on the
+		// metrics endpoint of each listener
+		metricSink, metricRegistry, err := cache.NewPrometheusMetricSink()
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error creating cache metric sink: %v", err))
+			return 1
+		}
+
 		// Create the API proxier
 		apiProxy, err := cache.NewAPIProxy(&cache.APIProxyConfig{
-			Client: client,
-			Logger: cacheLogger.Named("apiproxy"),
+			Client:     client,
+			Logger:     cacheLogger.Named("apiproxy"),
+			MetricSink: metricSink,
 		})
 		if err != nil {
 			c.UI.Error(fmt.Sprintf("Error creating API proxy: %v", err))
 			return 1
 		}
 
+		var cacheStorage *cacheboltdb.BoltStorage
+		if config.Cache.PersistPath != "" {
+			wrapper, err := cacheboltdb.NewKeyFileWrapper(config.Cache.PersistKeyFile)
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error loading persistent cache key: %v", err))
+				return 1
+			}
+			cacheStorage, err = cacheboltdb.NewBoltStorage(&cacheboltdb.BoltStorageConfig{
+				Path:    config.Cache.PersistPath,
+				Logger:  cacheLogger.Named("storage"),
+				Wrapper: wrapper,
+			})
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error creating persistent cache storage: %v", err))
+				return 1
+			}
+			defer cacheStorage.Close()
+		}
+
 		// Create the lease cache proxier and set its underlying proxier to
 		// the API proxier.
 		leaseCache, err := cache.NewLeaseCache(&cache.LeaseCacheConfig{
-			Client:      client,
-			BaseContext: ctx,
-			Proxier:     apiProxy,
-			Logger:      cacheLogger.Named("leasecache"),
+			Client:          client,
+			BaseContext:     ctx,
+			Proxier:         apiProxy,
+			Logger:          cacheLogger.Named("leasecache"),
+			StaleIfError:    config.Cache.StaleIfError,
+			Storage:         cacheStorage,
+			MaxEntries:      config.Cache.MaxEntries,
+			StaticSecretTTL: config.Cache.StaticSecretTTL,
+			MetricSink:      metricSink,
+			RevokeOnEvict:   config.Cache.RevokeOnEvict,
 		})
 		if err != nil {
 			c.UI.Error(fmt.Sprintf("Error creating lease cache: %v", err))
@@ -490,6 +612,8 @@ func (c *AgentCommand) Run(args []string) int {
 			// Create a muxer and add paths relevant for the lease cache layer
 			mux := http.NewServeMux()
 			mux.Handle(consts.AgentPathCacheClear, leaseCache.HandleCacheClear(ctx))
+			mux.Handle(consts.AgentPathMetrics, cache.MetricsHandler(metricRegistry))
+			mux.Handle(consts.AgentPathHealth, cache.HealthHandler(authStatus, leaseCache))
 			mux.Handle("/", muxHandler)
 
 			scheme := "https://"
@@ -517,6 +641,43 @@ func (c *AgentCommand) Run(args []string) int {
 			go server.Serve(ln)
 		}
 
+		// Serve the cache to the template server, so that templates share
+		// the lease cache instead of talking to Vault directly. The cache is
+		// served on a unix socket within a private directory rather than on a
+		// TCP port, so that other local processes can't use it to send
+		// requests with the auto-auth token, bypassing the TLS and
+		// require_request_header settings of the configured listeners.
+		if len(config.Templates) > 0 {
+			socketDir, err := ioutil.TempDir("", "vault-agent-template-")
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error creating template proxy directory: %v", err))
+				return 1
+			}
+			defer os.RemoveAll(socketDir)
+
+			socketPath := filepath.Join(socketDir, "proxy.sock")
+			ln, err := net.Listen("unix", socketPath)
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error starting template proxy listener: %v", err))
+				return 1
+			}
+			listeners = append(listeners, ln)
+			if err := os.Chmod(socketPath, 0600); err != nil {
+				c.UI.Error(fmt.Sprintf("Error setting template proxy socket permissions: %v", err))
+				return 1
+			}
+			templateProxyAddress = "unix://" + socketPath
+
+			server := &http.Server{
+				Handler:           cacheHandler,
+				ReadHeaderTimeout: 10 * time.Second,
+				ReadTimeout:       30 * time.Second,
+				IdleTimeout:       5 * time.Minute,
+				ErrorLog:          cacheLogger.StandardLogger(nil),
+			}
+			go server.Serve(ln)
+		}
+
 		// Ensure that listeners are closed at all the exits
 		listenerCloseFunc := func() {
 			for _, ln := range listeners {
@@ -533,20 +694,14 @@ func (c *AgentCommand) Run(args []string) int {
 	var ssDoneCh, ahDoneCh, tsDoneCh chan struct{}
 	// Start auto-auth and sink servers
 	if method != nil {
-		enableTokenCh := len(config.Templates) > 0
-		ah := auth.NewAuthHandler(&auth.AuthHandlerConfig{
-			Logger:                       c.logger.Named("auth.handler"),
-			Client:                       c.client,
-			WrapTTL:                      config.AutoAuth.Method.WrapTTL,
-			EnableReauthOnNewCredentials: config.AutoAuth.EnableReauthOnNewCredentials,
-			EnableTemplateTokenCh:        enableTokenCh,
-		})
 		ahDoneCh = ah.DoneCh
 
 		ss := sink.NewSinkServer(&sink.SinkServerConfig{
 			Logger:        c.logger.Named("sink.server"),
 			Client:        client,
 			ExitAfterAuth: exitAfterAuth,
+			Validate:      config.AutoAuth.ValidateToken,
+			ReauthCh:      ah.ReauthCh,
 		})
 		ssDoneCh = ss.DoneCh
 
@@ -557,6 +712,7 @@ func (c *AgentCommand) Run(args []string) int {
 			VaultConf:     config.Vault,
 			Namespace:     namespace,
 			ExitAfterAuth: exitAfterAuth,
+			ProxyAddress:  templateProxyAddress,
 		})
 		tsDoneCh = ts.DoneCh
 
@@ -4,6 +4,8 @@ import (
 	"context"
 	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
@@ -11,6 +13,11 @@ import (
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
 )
 
+const (
+	defaultMinBackoff = 1 * time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
 type AuthMethod interface {
 	// Authenticate returns a mount path, header, request body, and error.
 	// The header may be nil if no special header is needed.
@@ -20,6 +27,16 @@ type AuthMethod interface {
 	Shutdown()
 }
 
+// AuthMethodWithClient is an extended interface for auth methods that need to
+// log in with a client of their own, such as one presenting a TLS client
+// certificate.
+type AuthMethodWithClient interface {
+	AuthMethod
+	// AuthClient returns the client to log in with, derived from the given
+	// client.
+	AuthClient(client *api.Client) (*api.Client, error)
+}
+
 type AuthConfig struct {
 	Logger    hclog.Logger
 	MountPath string
@@ -28,25 +45,51 @@ type AuthConfig struct {
 }
 
 // AuthHandler is responsible for keeping a token alive and renewed and passing
-// new tokens to the sink server
+// new tokens to the sink server. Multiple handlers, each with their own auth
+// method and sink server, may run concurrently and share a client; each one
+// authenticates and renews its token independently. Sending on ReauthCh
+// makes the handler discard its token and, after backing off, authenticate
+// again.
 type AuthHandler struct {
 	DoneCh                       chan struct{}
 	OutputCh                     chan string
 	TemplateTokenCh              chan string
+	ReauthCh                     chan struct{}
 	logger                       hclog.Logger
 	client                       *api.Client
 	random                       *rand.Rand
 	wrapTTL                      time.Duration
+	minBackoff                   time.Duration
+	maxBackoff                   time.Duration
 	enableReauthOnNewCredentials bool
 	enableTemplateTokenCh        bool
+	exitAfterAuth                bool
+	revokeOnShutdown             bool
+
+	// statusLock protects hasToken and tokenExpiry, the status of the last
+	// token reported by TokenStatus. A zero expiry means the token doesn't
+	// expire.
+	statusLock  sync.RWMutex
+	hasToken    bool
+	tokenExpiry time.Time
 }
 
 type AuthHandlerConfig struct {
 	Logger                       hclog.Logger
 	Client                       *api.Client
 	WrapTTL                      time.Duration
+	MinBackoff                   time.Duration
+	MaxBackoff                   time.Duration
 	EnableReauthOnNewCredentials bool
 	EnableTemplateTokenCh        bool
+
+	// ExitAfterAuth causes the handler to stop once the first token has been
+	// handed off, rather than keeping it renewed
+	ExitAfterAuth bool
+
+	// RevokeOnShutdown causes the handler to revoke its token when its
+	// context is cancelled. Batch tokens can't be revoked and are skipped.
+	RevokeOnShutdown bool
 }
 
 func NewAuthHandler(conf *AuthHandlerConfig) *AuthHandler {
@@ -56,22 +99,83 @@ func NewAuthHandler(conf *AuthHandlerConfig) *AuthHandler {
 		// has been shut down, during agent shutdown, we won't block
 		OutputCh:                     make(chan string, 1),
 		TemplateTokenCh:              make(chan string, 1),
+		ReauthCh:                     make(chan struct{}, 1),
 		logger:                       conf.Logger,
 		client:                       conf.Client,
 		random:                       rand.New(rand.NewSource(int64(time.Now().Nanosecond()))),
 		wrapTTL:                      conf.WrapTTL,
+		minBackoff:                   conf.MinBackoff,
+		maxBackoff:                   conf.MaxBackoff,
 		enableReauthOnNewCredentials: conf.EnableReauthOnNewCredentials,
 		enableTemplateTokenCh:        conf.EnableTemplateTokenCh,
+		exitAfterAuth:                conf.ExitAfterAuth,
+		revokeOnShutdown:             conf.RevokeOnShutdown,
+	}
+
+	if ah.minBackoff <= 0 {
+		ah.minBackoff = defaultMinBackoff
+	}
+	if ah.maxBackoff <= 0 {
+		ah.maxBackoff = defaultMaxBackoff
+	}
+	if ah.maxBackoff < ah.minBackoff {
+		ah.maxBackoff = ah.minBackoff
 	}
 
 	return ah
 }
 
-func backoffOrQuit(ctx context.Context, backoff time.Duration) {
+// agentBackoff tracks the time to wait after a failed authentication or
+// renewal. It grows exponentially with jitter between min and max, and is
+// reset after a successful authentication.
+type agentBackoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+	random  *rand.Rand
+}
+
+func newAgentBackoff(min, max time.Duration, random *rand.Rand) *agentBackoff {
+	return &agentBackoff{
+		min:     min,
+		max:     max,
+		current: min,
+		random:  random,
+	}
+}
+
+// next doubles the current backoff, capped to the max value, and trims a
+// random amount of up to 25% off so that many agents failing at the same time
+// don't retry in lockstep.
+func (b *agentBackoff) next() {
+	maxBackoff := 2 * b.current
+	if maxBackoff > b.max {
+		maxBackoff = b.max
+	}
+
+	if trimRange := int64(maxBackoff) / 4; trimRange > 0 {
+		maxBackoff -= time.Duration(b.random.Int63n(trimRange))
+	}
+	if maxBackoff < b.min {
+		maxBackoff = b.min
+	}
+
+	b.current = maxBackoff
+}
+
+func (b *agentBackoff) reset() {
+	b.current = b.min
+}
+
+// backoffOrQuit waits for the current backoff, or until the context is done,
+// and then increases the backoff for the next failure.
+func backoffOrQuit(ctx context.Context, backoff *agentBackoff) {
 	select {
-	case <-time.After(backoff):
+	case <-time.After(backoff.current):
 	case <-ctx.Done():
 	}
+
+	backoff.next()
 }
 
 func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
@@ -79,8 +183,15 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 		panic("nil auth method")
 	}
 
+	// token is the last token the handler obtained, if it wasn't wrapped
+	var token string
+
 	ah.logger.Info("starting auth handler")
 	defer func() {
+		if ah.revokeOnShutdown && ctx.Err() != nil {
+			ah.revokeToken(token)
+		}
+		ah.clearTokenStatus()
 		am.Shutdown()
 		close(ah.OutputCh)
 		close(ah.DoneCh)
@@ -109,6 +220,11 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 	}
 
 	var watcher *api.LifetimeWatcher
+	backoff := newAgentBackoff(ah.minBackoff, ah.maxBackoff, ah.random)
+
+	// reauthRequested is set when the previous token failed validation, so
+	// that the backoff keeps growing while new tokens keep failing
+	var reauthRequested bool
 
 	for {
 		select {
@@ -118,40 +234,55 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 		default:
 		}
 
-		// Create a fresh backoff value
-		backoff := 2*time.Second + time.Duration(ah.random.Int63()%int64(time.Second*2)-int64(time.Second))
-
 		ah.logger.Info("authenticating")
 		path, header, data, err := am.Authenticate(ctx, ah.client)
 		if err != nil {
-			ah.logger.Error("error getting path or data from method", "error", err, "backoff", backoff.Seconds())
+			ah.logger.Error("error getting path or data from method", "error", err, "backoff", backoff.current.Seconds())
 			backoffOrQuit(ctx, backoff)
 			continue
 		}
 
 		clientToUse := ah.client
-		if ah.wrapTTL > 0 {
-			wrapClient, err := ah.client.Clone()
+		if amWithClient, ok := am.(AuthMethodWithClient); ok {
+			clientToUse, err = amWithClient.AuthClient(ah.client)
 			if err != nil {
-				ah.logger.Error("error creating client for wrapped call", "error", err, "backoff", backoff.Seconds())
+				ah.logger.Error("error creating client for authentication call", "error", err, "backoff", backoff.current.Seconds())
 				backoffOrQuit(ctx, backoff)
 				continue
 			}
-			wrapClient.SetWrappingLookupFunc(func(string, string) string {
-				return ah.wrapTTL.String()
-			})
-			clientToUse = wrapClient
 		}
-		for key, values := range header {
-			for _, value := range values {
-				clientToUse.AddHeader(key, value)
+
+		// Use a separate client for the login whenever it needs request
+		// specific state, so that the shared client is never modified. This
+		// keeps multiple auth handlers sharing a client from interfering with
+		// each other, and headers from accumulating across re-authentications.
+		if ah.wrapTTL > 0 || len(header) > 0 {
+			loginClient, err := clientToUse.Clone()
+			if err != nil {
+				ah.logger.Error("error creating client for login", "error", err, "backoff", backoff.current.Seconds())
+				backoffOrQuit(ctx, backoff)
+				continue
+			}
+			if headers := clientToUse.Headers(); headers != nil {
+				loginClient.SetHeaders(headers)
+			}
+			if ah.wrapTTL > 0 {
+				loginClient.SetWrappingLookupFunc(func(string, string) string {
+					return ah.wrapTTL.String()
+				})
 			}
+			for key, values := range header {
+				for _, value := range values {
+					loginClient.AddHeader(key, value)
+				}
+			}
+			clientToUse = loginClient
 		}
 
 		secret, err := clientToUse.Logical().Write(path, data)
 		// Check errors/sanity
 		if err != nil {
-			ah.logger.Error("error authenticating", "error", err, "backoff", backoff.Seconds())
+			ah.logger.Error("error authenticating", "error", err, "backoff", backoff.current.Seconds())
 			backoffOrQuit(ctx, backoff)
 			continue
 		}
@@ -159,21 +290,23 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 		switch {
 		case ah.wrapTTL > 0:
 			if secret.WrapInfo == nil {
-				ah.logger.Error("authentication returned nil wrap info", "backoff", backoff.Seconds())
+				ah.logger.Error("authentication returned nil wrap info", "backoff", backoff.current.Seconds())
 				backoffOrQuit(ctx, backoff)
 				continue
 			}
 			if secret.WrapInfo.Token == "" {
-				ah.logger.Error("authentication returned empty wrapped client token", "backoff", backoff.Seconds())
+				ah.logger.Error("authentication returned empty wrapped client token", "backoff", backoff.current.Seconds())
 				backoffOrQuit(ctx, backoff)
 				continue
 			}
 			wrappedResp, err := jsonutil.EncodeJSON(secret.WrapInfo)
 			if err != nil {
-				ah.logger.Error("failed to encode wrapinfo", "error", err, "backoff", backoff.Seconds())
+				ah.logger.Error("failed to encode wrapinfo", "error", err, "backoff", backoff.current.Seconds())
 				backoffOrQuit(ctx, backoff)
 				continue
 			}
+			backoff.reset()
+			ah.setTokenStatus(secret.WrapInfo.TTL)
 			ah.logger.Info("authentication successful, sending wrapped token to sinks and pausing")
 			ah.OutputCh <- string(wrappedResp)
 			if ah.enableTemplateTokenCh {
@@ -182,6 +315,11 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 
 			am.CredSuccess()
 
+			if ah.exitAfterAuth {
+				ah.logger.Info("exit after auth set, stopping auth handler")
+				return
+			}
+
 			select {
 			case <-ctx.Done():
 				ah.logger.Info("shutdown triggered")
@@ -194,15 +332,21 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 
 		default:
 			if secret == nil || secret.Auth == nil {
-				ah.logger.Error("authentication returned nil auth info", "backoff", backoff.Seconds())
+				ah.logger.Error("authentication returned nil auth info", "backoff", backoff.current.Seconds())
 				backoffOrQuit(ctx, backoff)
 				continue
 			}
 			if secret.Auth.ClientToken == "" {
-				ah.logger.Error("authentication returned empty client token", "backoff", backoff.Seconds())
+				ah.logger.Error("authentication returned empty client token", "backoff", backoff.current.Seconds())
 				backoffOrQuit(ctx, backoff)
 				continue
 			}
+			if !reauthRequested {
+				backoff.reset()
+			}
+			reauthRequested = false
+			token = secret.Auth.ClientToken
+			ah.setTokenStatus(secret.Auth.LeaseDuration)
 			ah.logger.Info("authentication successful, sending token to sinks")
 			ah.OutputCh <- secret.Auth.ClientToken
 			if ah.enableTemplateTokenCh {
@@ -210,6 +354,11 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 			}
 
 			am.CredSuccess()
+
+			if ah.exitAfterAuth {
+				ah.logger.Info("exit after auth set, stopping auth handler")
+				return
+			}
 		}
 
 		if watcher != nil {
@@ -220,7 +369,7 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 			Secret: secret,
 		})
 		if err != nil {
-			ah.logger.Error("error creating lifetime watcher, backing off and retrying", "error", err, "backoff", backoff.Seconds())
+			ah.logger.Error("error creating lifetime watcher, backing off and retrying", "error", err, "backoff", backoff.current.Seconds())
 			backoffOrQuit(ctx, backoff)
 			continue
 		}
@@ -240,17 +389,100 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) {
 			case err := <-watcher.DoneCh():
 				ah.logger.Info("lifetime watcher done channel triggered")
 				if err != nil {
-					ah.logger.Error("error renewing token", "error", err)
+					ah.logger.Error("error renewing token, backing off before re-authenticating", "error", err, "backoff", backoff.current.Seconds())
+					backoffOrQuit(ctx, backoff)
 				}
 				break LifetimeWatcherLoop
 
-			case <-watcher.RenewCh():
+			case renewal := <-watcher.RenewCh():
 				ah.logger.Info("renewed auth token")
+				if renewal != nil && renewal.Secret != nil && renewal.Secret.Auth != nil {
+					ah.setTokenStatus(renewal.Secret.Auth.LeaseDuration)
+				}
 
 			case <-credCh:
 				ah.logger.Info("auth method found new credentials, re-authenticating")
 				break LifetimeWatcherLoop
+
+			case <-ah.ReauthCh:
+				ah.logger.Warn("token failed validation, backing off before re-authenticating", "backoff", backoff.current.Seconds())
+				watcher.Stop()
+				ah.clearTokenStatus()
+				reauthRequested = true
+				backoffOrQuit(ctx, backoff)
+				break LifetimeWatcherLoop
 			}
 		}
 	}
 }
+
+// TokenStatus returns whether the handler holds a token that hasn't expired,
+// and its remaining TTL. The TTL is zero for tokens that don't expire. If the
+// handler wraps its tokens, the status is that of the last wrapping token.
+func (ah *AuthHandler) TokenStatus() (bool, time.Duration) {
+	ah.statusLock.RLock()
+	defer ah.statusLock.RUnlock()
+
+	if !ah.hasToken {
+		return false, 0
+	}
+	if ah.tokenExpiry.IsZero() {
+		return true, 0
+	}
+
+	ttl := time.Until(ah.tokenExpiry)
+	if ttl <= 0 {
+		return false, 0
+	}
+	return true, ttl
+}
+
+// setTokenStatus records that the handler holds a token expiring after the
+// given number of seconds, or never if zero.
+func (ah *AuthHandler) setTokenStatus(ttl int) {
+	ah.statusLock.Lock()
+	defer ah.statusLock.Unlock()
+
+	ah.hasToken = true
+	ah.tokenExpiry = time.Time{}
+	if ttl > 0 {
+		ah.tokenExpiry = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+}
+
+func (ah *AuthHandler) clearTokenStatus() {
+	ah.statusLock.Lock()
+	defer ah.statusLock.Unlock()
+
+	ah.hasToken = false
+	ah.tokenExpiry = time.Time{}
+}
+
+// revokeToken revokes the token with the auth/token/revoke-self endpoint.
+// Failures are logged, since the handler is stopping anyway.
+func (ah *AuthHandler) revokeToken(token string) {
+	if token == "" {
+		return
+	}
+	// Batch tokens can't be revoked, and are recognizable by their prefix
+	if strings.HasPrefix(token, "b.") {
+		ah.logger.Info("not revoking batch token on shutdown")
+		return
+	}
+
+	client, err := ah.client.Clone()
+	if err != nil {
+		ah.logger.Error("error creating client to revoke token on shutdown", "error", err)
+		return
+	}
+	if headers := ah.client.Headers(); headers != nil {
+		client.SetHeaders(headers)
+	}
+	client.SetToken(token)
+
+	if err := client.Auth().Token().RevokeSelf(""); err != nil {
+		ah.logger.Error("error revoking token on shutdown", "error", err)
+		return
+	}
+	ah.logger.Info("revoked token on shutdown")
+}
@@ -2,14 +2,20 @@ package auth
 
 import (
 	"context"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-test/deep"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/builtin/credential/userpass"
 	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/vault"
@@ -100,3 +106,160 @@ consumption:
 		}
 	}
 }
+
+func TestAuthHandler_ExitAfterAuth(t *testing.T) {
+	logger := logging.NewVaultLogger(hclog.Trace)
+	coreConfig := &vault.CoreConfig{
+		Logger: logger,
+		CredentialBackends: map[string]logical.Factory{
+			"userpass": userpass.Factory,
+		},
+	}
+	cluster := vault.NewTestCluster(t, coreConfig, &vault.TestClusterOptions{
+		HandlerFunc: vaulthttp.Handler,
+	})
+	cluster.Start()
+	defer cluster.Cleanup()
+
+	vault.TestWaitActive(t, cluster.Cores[0].Core)
+	client := cluster.Cores[0].Client
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:        logger.Named("auth.handler"),
+		Client:        client,
+		ExitAfterAuth: true,
+	})
+
+	am := newUserpassTestMethod(t, client)
+	go ah.Run(ctx, am)
+
+	select {
+	case token := <-ah.OutputCh:
+		if token == "" {
+			t.Fatal("expected a token")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+
+	// The handler stops on its own, without the context being canceled
+	select {
+	case <-ah.DoneCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("auth handler did not exit after auth")
+	}
+
+	if _, ok := <-ah.OutputCh; ok {
+		t.Fatal("expected output channel to be closed")
+	}
+}
+
+func TestAuthHandler_RevokeOnShutdown(t *testing.T) {
+	for _, token := range []string{"s.service", "b.batch"} {
+		t.Run(token, func(t *testing.T) {
+			var l sync.Mutex
+			var revoked []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/auth/fake/login":
+					w.Write([]byte(`{"auth": {"client_token": "` + token + `", "lease_duration": 3600}}`))
+				case "/v1/auth/token/revoke-self":
+					l.Lock()
+					revoked = append(revoked, r.Header.Get(consts.AuthHeaderName))
+					l.Unlock()
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			config := api.DefaultConfig()
+			config.Address = server.URL
+			client, err := api.NewClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:           logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:           client,
+				RevokeOnShutdown: true,
+			})
+
+			go ah.Run(ctx, &fakeTestMethod{conf: &AuthConfig{MountPath: "auth/fake"}})
+
+			select {
+			case <-ah.OutputCh:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for token")
+			}
+
+			cancelFunc()
+			select {
+			case <-ah.DoneCh:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for auth handler to stop")
+			}
+
+			l.Lock()
+			defer l.Unlock()
+			expected := []string{token}
+			// Batch tokens can't be revoked
+			if strings.HasPrefix(token, "b.") {
+				expected = nil
+			}
+			if diff := deep.Equal(revoked, expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestAgentBackoff(t *testing.T) {
+	min := 1 * time.Second
+	max := 30 * time.Second
+	b := newAgentBackoff(min, max, rand.New(rand.NewSource(1)))
+
+	if b.current != min {
+		t.Fatalf("expected initial backoff of %s, got %s", min, b.current)
+	}
+
+	// Backoff grows until it is bounded by the max value, with jitter trimming
+	// at most a quarter of the doubled value
+	prev := b.current
+	for i := 0; i < 20; i++ {
+		b.next()
+
+		if b.current < min || b.current > max {
+			t.Fatalf("backoff %s out of bounds [%s, %s]", b.current, min, max)
+		}
+
+		expected := 2 * prev
+		if expected > max {
+			expected = max
+		}
+		if b.current > expected || b.current < expected*3/4 {
+			t.Fatalf("expected backoff in [%s, %s], got %s", expected*3/4, expected, b.current)
+		}
+		if expected < max && b.current <= prev {
+			t.Fatalf("expected backoff to increase from %s, got %s", prev, b.current)
+		}
+		prev = b.current
+	}
+
+	if b.current < max*3/4 {
+		t.Fatalf("expected backoff to reach the max value, got %s", b.current)
+	}
+
+	b.reset()
+	if b.current != min {
+		t.Fatalf("expected backoff of %s after reset, got %s", min, b.current)
+	}
+}
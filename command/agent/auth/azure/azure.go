@@ -31,6 +31,11 @@ type azureMethod struct {
 
 	role     string
 	resource string
+	clientID string
+
+	// The metadata endpoints are overridden in tests
+	instanceEndpoint string
+	identityEndpoint string
 }
 
 func NewAzureAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
@@ -42,8 +47,10 @@ func NewAzureAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 	}
 
 	a := &azureMethod{
-		logger:    conf.Logger,
-		mountPath: conf.MountPath,
+		logger:           conf.Logger,
+		mountPath:        conf.MountPath,
+		instanceEndpoint: instanceEndpoint,
+		identityEndpoint: identityEndpoint,
 	}
 
 	roleRaw, ok := conf.Config["role"]
@@ -64,6 +71,14 @@ func NewAzureAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 		return nil, errors.New("could not convert 'resource' config value to string")
 	}
 
+	clientIDRaw, ok := conf.Config["client_id"]
+	if ok {
+		a.clientID, ok = clientIDRaw.(string)
+		if !ok {
+			return nil, errors.New("could not convert 'client_id' config value to string")
+		}
+	}
+
 	switch {
 	case a.role == "":
 		return nil, errors.New("'role' value is empty")
@@ -87,7 +102,7 @@ func (a *azureMethod) Authenticate(ctx context.Context, client *api.Client) (ret
 		}
 	}
 
-	body, err := getMetadataInfo(ctx, instanceEndpoint, "")
+	body, err := getMetadataInfo(ctx, a.instanceEndpoint, "", "")
 	if err != nil {
 		retErr = err
 		return
@@ -104,7 +119,9 @@ func (a *azureMethod) Authenticate(ctx context.Context, client *api.Client) (ret
 		AccessToken string `json:"access_token"`
 	}
 
-	body, err = getMetadataInfo(ctx, identityEndpoint, a.resource)
+	// The client ID selects a user-assigned identity; without it the
+	// system-assigned identity is used
+	body, err = getMetadataInfo(ctx, a.identityEndpoint, a.resource, a.clientID)
 	if err != nil {
 		retErr = err
 		return
@@ -139,7 +156,7 @@ func (a *azureMethod) CredSuccess() {
 func (a *azureMethod) Shutdown() {
 }
 
-func getMetadataInfo(ctx context.Context, endpoint, resource string) ([]byte, error) {
+func getMetadataInfo(ctx context.Context, endpoint, resource, clientID string) ([]byte, error) {
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return nil, err
@@ -150,6 +167,9 @@ func getMetadataInfo(ctx context.Context, endpoint, resource string) ([]byte, er
 	if resource != "" {
 		q.Add("resource", resource)
 	}
+	if clientID != "" {
+		q.Add("client_id", clientID)
+	}
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("Metadata", "true")
 	req.Header.Set("User-Agent", useragent.String())
@@ -0,0 +1,124 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+// testIMDS returns a fake instance metadata service, which only issues tokens
+// for the system-assigned identity and the user-assigned identity "client1"
+func testIMDS(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Header.Get("Metadata") != "true" || q.Get("api-version") != apiVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/metadata/instance":
+			w.Write([]byte(`{"compute": {"name": "vm1", "resourceGroupName": "rg1", "subscriptionId": "sub1", "vmScaleSetName": "vmss1"}}`))
+		case "/metadata/identity/oauth2/token":
+			if q.Get("resource") != "https://management.azure.com/" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			switch q.Get("client_id") {
+			case "":
+				w.Write([]byte(`{"access_token": "system-token"}`))
+			case "client1":
+				w.Write([]byte(`{"access_token": "client1-token"}`))
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_request", "error_description": "Identity not found"}`))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestAzureAuth(t *testing.T) {
+	imds := testIMDS(t)
+	defer imds.Close()
+
+	testCases := map[string]struct {
+		clientID  string
+		jwt       string
+		expectErr bool
+	}{
+		"system_assigned": {
+			jwt: "system-token",
+		},
+		"user_assigned": {
+			clientID: "client1",
+			jwt:      "client1-token",
+		},
+		"unknown_identity": {
+			clientID:  "client2",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			config := map[string]interface{}{
+				"role":     "test-role",
+				"resource": "https://management.azure.com/",
+			}
+			if tc.clientID != "" {
+				config["client_id"] = tc.clientID
+			}
+
+			a, err := NewAzureAuthMethod(&auth.AuthConfig{
+				Logger:    logging.NewVaultLogger(hclog.Trace),
+				MountPath: "auth/azure",
+				Config:    config,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Point the method at the fake metadata service
+			am := a.(*azureMethod)
+			am.instanceEndpoint = imds.URL + "/metadata/instance"
+			am.identityEndpoint = imds.URL + "/metadata/identity/oauth2/token"
+
+			path, _, data, err := am.Authenticate(context.Background(), nil)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if path != "auth/azure/login" {
+				t.Fatalf("unexpected login path: %q", path)
+			}
+
+			expected := map[string]interface{}{
+				"role":                "test-role",
+				"vm_name":             "vm1",
+				"vmss_name":           "vmss1",
+				"resource_group_name": "rg1",
+				"subscription_id":     "sub1",
+				"jwt":                 tc.jwt,
+			}
+			if !reflect.DeepEqual(data, expected) {
+				t.Fatalf("unexpected login data:\nexpected: %#v\ngot: %#v", expected, data)
+			}
+		})
+	}
+}
@@ -6,17 +6,25 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 )
 
 type certMethod struct {
 	logger    hclog.Logger
 	mountPath string
 	name      string
+
+	caCert     string
+	clientCert string
+	clientKey  string
 }
 
+var _ auth.AuthMethodWithClient = (*certMethod)(nil)
+
 func NewCertAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 	if conf == nil {
 		return nil, errors.New("empty config")
@@ -40,6 +48,25 @@ func NewCertAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 		if !ok {
 			return nil, errors.New("could not convert 'name' config value to string")
 		}
+
+		for key, value := range map[string]*string{
+			"ca_cert":     &c.caCert,
+			"client_cert": &c.clientCert,
+			"client_key":  &c.clientKey,
+		} {
+			raw, ok := conf.Config[key]
+			if !ok {
+				continue
+			}
+			*value, ok = raw.(string)
+			if !ok {
+				return nil, fmt.Errorf("could not convert '%s' config value to string", key)
+			}
+		}
+	}
+
+	if (c.clientCert == "") != (c.clientKey == "") {
+		return nil, errors.New("'client_cert' and 'client_key' must be set together")
 	}
 
 	return c, nil
@@ -57,6 +84,40 @@ func (c *certMethod) Authenticate(_ context.Context, client *api.Client) (string
 	return fmt.Sprintf("%s/login", c.mountPath), nil, authMap, nil
 }
 
+// AuthClient returns a client that presents the configured certificate, or
+// the given client if no certificate is configured. The certificate is read
+// from disk on every authentication, so that rotated certificates are
+// picked up.
+func (c *certMethod) AuthClient(client *api.Client) (*api.Client, error) {
+	if c.clientCert == "" && c.caCert == "" {
+		return client, nil
+	}
+
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, config.Error
+	}
+	config.Address = client.Address()
+
+	if err := config.ConfigureTLS(&api.TLSConfig{
+		CACert:     c.caCert,
+		ClientCert: c.clientCert,
+		ClientKey:  c.clientKey,
+	}); err != nil {
+		return nil, errwrap.Wrapf("error loading TLS configuration: {{err}}", err)
+	}
+
+	authClient, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if ns := client.Headers().Get(consts.NamespaceHeaderName); ns != "" {
+		authClient.SetNamespace(ns)
+	}
+
+	return authClient, nil
+}
+
 func (c *certMethod) NewCreds() chan struct{} {
 	return nil
 }
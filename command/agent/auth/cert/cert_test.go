@@ -0,0 +1,183 @@
+package cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+// writeTestClientCert writes a self-signed client certificate with the given
+// common name, and its key, to dir.
+func writeTestClientCert(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client-key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestCertAuth_ClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault-agent-cert-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The server issues tokens named after the common name of the client
+	// certificate presented
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/cert/login" || len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["name"] != "web" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token": r.TLS.PeerCertificates[0].Subject.CommonName,
+			},
+		})
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := writeTestClientCert(t, dir, "client1")
+
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	am, err := NewCertAuthMethod(&auth.AuthConfig{
+		Logger:    logging.NewVaultLogger(hclog.Trace),
+		MountPath: "auth/cert",
+		Config: map[string]interface{}{
+			"name":        "web",
+			"ca_cert":     caPath,
+			"client_cert": certPath,
+			"client_key":  keyPath,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func() string {
+		t.Helper()
+
+		path, _, data, err := am.Authenticate(context.Background(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authClient, err := am.(auth.AuthMethodWithClient).AuthClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err := authClient.Logical().Write(path, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret.Auth.ClientToken
+	}
+
+	if token := login(); token != "client1" {
+		t.Fatalf("expected to log in as client1, got %q", token)
+	}
+
+	// A rotated certificate is used for the next authentication
+	writeTestClientCert(t, dir, "client2")
+	if token := login(); token != "client2" {
+		t.Fatalf("expected to log in as client2, got %q", token)
+	}
+}
+
+func TestCertAuth_NoClientCert(t *testing.T) {
+	client, err := api.NewClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	am, err := NewCertAuthMethod(&auth.AuthConfig{
+		Logger:    logging.NewVaultLogger(hclog.Trace),
+		MountPath: "auth/cert",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a certificate of its own the method uses the agent's client
+	authClient, err := am.(auth.AuthMethodWithClient).AuthClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authClient != client {
+		t.Fatal("expected the agent's client to be used")
+	}
+
+	_, err = NewCertAuthMethod(&auth.AuthConfig{
+		Logger:    logging.NewVaultLogger(hclog.Trace),
+		MountPath: "auth/cert",
+		Config: map[string]interface{}{
+			"client_cert": "/path/to/cert.pem",
+		},
+	})
+	if err == nil {
+		t.Fatal("expected an error when client_key is missing")
+	}
+}
@@ -36,6 +36,10 @@ type gcpMethod struct {
 	serviceAccount string
 	project        string
 	jwtExp         int64
+
+	// identityEndpoint is the metadata server endpoint used to fetch the
+	// instance identity token. It is overridden in tests.
+	identityEndpoint string
 }
 
 func NewGCPAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
@@ -49,9 +53,10 @@ func NewGCPAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 	var err error
 
 	g := &gcpMethod{
-		logger:         conf.Logger,
-		mountPath:      conf.MountPath,
-		serviceAccount: "default",
+		logger:           conf.Logger,
+		mountPath:        conf.MountPath,
+		serviceAccount:   "default",
+		identityEndpoint: identityEndpoint,
 	}
 
 	typeRaw, ok := conf.Config["type"]
@@ -128,7 +133,7 @@ func (g *gcpMethod) Authenticate(ctx context.Context, client *api.Client) (retPa
 
 		// Fetch token
 		{
-			req, err := http.NewRequest("GET", fmt.Sprintf(identityEndpoint, g.serviceAccount), nil)
+			req, err := http.NewRequest("GET", fmt.Sprintf(g.identityEndpoint, g.serviceAccount), nil)
 			if err != nil {
 				retErr = errwrap.Wrapf("error creating request: {{err}}", err)
 				return
@@ -154,6 +159,10 @@ func (g *gcpMethod) Authenticate(ctx context.Context, client *api.Client) (retPa
 				retErr = errwrap.Wrapf("error reading instance token response body: {{err}}", err)
 				return
 			}
+			if resp.StatusCode != http.StatusOK {
+				retErr = fmt.Errorf("error fetching instance token: unexpected status code %d: %s", resp.StatusCode, jwtBytes)
+				return
+			}
 
 			jwt = string(jwtBytes)
 		}
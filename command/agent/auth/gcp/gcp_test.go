@@ -0,0 +1,116 @@
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func TestGCPAuth_GCE(t *testing.T) {
+	const testJWT = "header.payload.signature"
+
+	client, err := api.NewClient(&api.Config{Address: "https://vault.example.com:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake metadata server that only hands out identity tokens for the
+	// expected service account and audience
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Metadata-Flavor") != "Google":
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path != "/computeMetadata/v1/instance/service-accounts/test@project.iam.gserviceaccount.com/identity":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Query().Get("audience") != "https://vault.example.com:8200/vault/test-role" || r.URL.Query().Get("format") != "full":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.Write([]byte(testJWT))
+		}
+	}))
+	defer metadata.Close()
+
+	testCases := map[string]struct {
+		serviceAccount string
+		expectErr      bool
+	}{
+		"valid": {
+			serviceAccount: "test@project.iam.gserviceaccount.com",
+		},
+		"unknown_service_account": {
+			serviceAccount: "other@project.iam.gserviceaccount.com",
+			expectErr:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			a, err := NewGCPAuthMethod(&auth.AuthConfig{
+				Logger:    logging.NewVaultLogger(hclog.Trace),
+				MountPath: "auth/gcp",
+				Config: map[string]interface{}{
+					"type":            "gce",
+					"role":            "test-role",
+					"service_account": tc.serviceAccount,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Point the method at the fake metadata server
+			g := a.(*gcpMethod)
+			g.identityEndpoint = metadata.URL + "/computeMetadata/v1/instance/service-accounts/%s/identity"
+
+			path, _, data, err := g.Authenticate(context.Background(), client)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if path != "auth/gcp/login" {
+				t.Fatalf("unexpected login path: %q", path)
+			}
+			if data["role"] != "test-role" {
+				t.Fatalf("unexpected role: %v", data["role"])
+			}
+			if data["jwt"] != testJWT {
+				t.Fatalf("unexpected jwt: %v", data["jwt"])
+			}
+		})
+	}
+}
+
+func TestGCPAuth_Config(t *testing.T) {
+	testCases := map[string]map[string]interface{}{
+		"missing_type":    {"role": "test-role"},
+		"invalid_type":    {"type": "aws", "role": "test-role"},
+		"missing_role":    {"type": "gce"},
+		"empty_role":      {"type": "iam", "role": ""},
+		"invalid_jwt_exp": {"type": "iam", "role": "test-role", "jwt_exp": "soon"},
+	}
+
+	for name, config := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewGCPAuthMethod(&auth.AuthConfig{
+				Logger:    logging.NewVaultLogger(hclog.Trace),
+				MountPath: "auth/gcp",
+				Config:    config,
+			})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
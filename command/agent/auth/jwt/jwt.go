@@ -11,9 +11,11 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/errwrap"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
 )
 
 type jwtMethod struct {
@@ -29,6 +31,11 @@ type jwtMethod struct {
 	ticker          *time.Ticker
 	once            *sync.Once
 	latestToken     *atomic.Value
+
+	// removeJWTAfterReading causes the JWT file to be removed once it has
+	// been read. It can be disabled for files managed by another process,
+	// such as Kubernetes projected service account tokens.
+	removeJWTAfterReading bool
 }
 
 func NewJWTAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
@@ -49,6 +56,8 @@ func NewJWTAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 		credSuccessGate: make(chan struct{}),
 		once:            new(sync.Once),
 		latestToken:     new(atomic.Value),
+
+		removeJWTAfterReading: true,
 	}
 	j.latestToken.Store("")
 
@@ -70,6 +79,14 @@ func NewJWTAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 		return nil, errors.New("could not convert 'role' config value to string")
 	}
 
+	if removeJWTAfterReadingRaw, ok := conf.Config["remove_jwt_after_reading"]; ok {
+		removeJWTAfterReading, err := parseutil.ParseBool(removeJWTAfterReadingRaw)
+		if err != nil {
+			return nil, errwrap.Wrapf("error parsing 'remove_jwt_after_reading' value: {{err}}", err)
+		}
+		j.removeJWTAfterReading = removeJWTAfterReading
+	}
+
 	switch {
 	case j.path == "":
 		return nil, errors.New("'path' value is empty")
@@ -158,9 +175,21 @@ func (j *jwtMethod) ingressToken() {
 		return
 	}
 
-	j.logger.Debug("new jwt file found")
-
-	if !fi.Mode().IsRegular() {
+	switch {
+	case fi.Mode().IsRegular():
+	case fi.Mode()&os.ModeSymlink != 0 && !j.removeJWTAfterReading:
+		// Files that are kept, such as projected service account tokens, are
+		// often symlinks to the current version of the file
+		fi, err = os.Stat(j.path)
+		if err != nil {
+			j.logger.Error("error encountered stat'ing jwt file", "error", err)
+			return
+		}
+		if !fi.Mode().IsRegular() {
+			j.logger.Error("jwt file is not a regular file")
+			return
+		}
+	default:
 		j.logger.Error("jwt file is not a regular file")
 		return
 	}
@@ -176,9 +205,18 @@ func (j *jwtMethod) ingressToken() {
 		j.logger.Warn("empty jwt file read")
 
 	default:
+		// Files that aren't removed are read on every check, so only log
+		// when the token changes
+		if string(token) != j.latestToken.Load().(string) {
+			j.logger.Debug("new jwt file found")
+		}
 		j.latestToken.Store(string(token))
 	}
 
+	if !j.removeJWTAfterReading {
+		return
+	}
+
 	if err := os.Remove(j.path); err != nil {
 		j.logger.Error("error removing jwt file", "error", err)
 	}
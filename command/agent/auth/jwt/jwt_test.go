@@ -0,0 +1,144 @@
+package jwt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func TestJWTAuth_RotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault-agent-jwt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Like a projected service account token, the configured path is a
+	// symlink to the current version of the file
+	tokenPath := filepath.Join(dir, "token")
+	writeToken := func(version, jwt string) {
+		t.Helper()
+
+		versionPath := filepath.Join(dir, version)
+		if err := ioutil.WriteFile(versionPath, []byte(jwt), 0600); err != nil {
+			t.Fatal(err)
+		}
+		linkPath := tokenPath + ".tmp"
+		if err := os.Symlink(versionPath, linkPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(linkPath, tokenPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	am, err := NewJWTAuthMethod(&auth.AuthConfig{
+		Logger:    logging.NewVaultLogger(hclog.Trace),
+		MountPath: "auth/jwt",
+		Config: map[string]interface{}{
+			"path":                     tokenPath,
+			"role":                     "test-role",
+			"remove_jwt_after_reading": false,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer am.Shutdown()
+
+	// A missing file is an error the auth handler retries after backing off
+	if _, _, _, err := am.Authenticate(context.Background(), nil); err == nil {
+		t.Fatal("expected error when the jwt file doesn't exist yet")
+	}
+
+	// So is an empty one
+	writeToken("v0", "")
+	if _, _, _, err := am.Authenticate(context.Background(), nil); err == nil {
+		t.Fatal("expected error when the jwt file is empty")
+	}
+
+	writeToken("v1", "jwt1")
+	path, _, data, err := am.Authenticate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "auth/jwt/login" {
+		t.Fatalf("unexpected login path: %q", path)
+	}
+	if data["role"] != "test-role" || data["jwt"] != "jwt1" {
+		t.Fatalf("unexpected login data: %v", data)
+	}
+	am.CredSuccess()
+
+	// The file is kept, and rotating it signals new credentials
+	if _, err := os.Stat(tokenPath); err != nil {
+		t.Fatalf("expected the jwt file to be kept: %v", err)
+	}
+	writeToken("v2", "jwt2")
+	select {
+	case <-am.NewCreds():
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotated jwt was not detected")
+	}
+
+	_, _, data, err = am.Authenticate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["jwt"] != "jwt2" {
+		t.Fatalf("expected the rotated jwt, got: %v", data["jwt"])
+	}
+}
+
+func TestJWTAuth_RemoveAfterReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault-agent-jwt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("jwt1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	am, err := NewJWTAuthMethod(&auth.AuthConfig{
+		Logger:    logging.NewVaultLogger(hclog.Trace),
+		MountPath: "auth/jwt",
+		Config: map[string]interface{}{
+			"path": tokenPath,
+			"role": "test-role",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer am.Shutdown()
+
+	_, _, data, err := am.Authenticate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["jwt"] != "jwt1" {
+		t.Fatalf("unexpected jwt: %v", data["jwt"])
+	}
+
+	// By default the file is consumed, and the last token read is kept
+	if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the jwt file to be removed, got: %v", err)
+	}
+	_, _, data, err = am.Authenticate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["jwt"] != "jwt1" {
+		t.Fatalf("unexpected jwt: %v", data["jwt"])
+	}
+}
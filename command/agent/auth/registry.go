@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// AuthMethodFactory creates an auth method from its configuration.
+type AuthMethodFactory func(*AuthConfig) (AuthMethod, error)
+
+var (
+	authMethodsLock sync.RWMutex
+	authMethods     = make(map[string]AuthMethodFactory)
+)
+
+// RegisterAuthMethod makes an auth method available to auto-auth under the
+// given type. It returns an error if the type is already registered.
+func RegisterAuthMethod(methodType string, factory AuthMethodFactory) error {
+	if methodType == "" {
+		return fmt.Errorf("auth method type must not be empty")
+	}
+	if factory == nil {
+		return fmt.Errorf("factory of auth method %q must not be nil", methodType)
+	}
+
+	authMethodsLock.Lock()
+	defer authMethodsLock.Unlock()
+
+	if _, ok := authMethods[methodType]; ok {
+		return fmt.Errorf("auth method %q is already registered", methodType)
+	}
+	authMethods[methodType] = factory
+	return nil
+}
+
+// NewAuthMethod creates an auth method of the given type, using the factory
+// registered for it.
+func NewAuthMethod(methodType string, conf *AuthConfig) (AuthMethod, error) {
+	authMethodsLock.RLock()
+	factory, ok := authMethods[methodType]
+	authMethodsLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown auth method %q", methodType)
+	}
+	return factory(conf)
+}
+
+// RegisteredAuthMethods returns the sorted types of the registered auth
+// methods.
+func RegisteredAuthMethods() []string {
+	authMethodsLock.RLock()
+	defer authMethodsLock.RUnlock()
+
+	types := make([]string, 0, len(authMethods))
+	for methodType := range authMethods {
+		types = append(types, methodType)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+)
+
+type fakeTestMethod struct {
+	conf *AuthConfig
+}
+
+func (f *fakeTestMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return f.conf.MountPath + "/login", nil, nil, nil
+}
+
+func (f *fakeTestMethod) NewCreds() chan struct{} {
+	return nil
+}
+
+func (f *fakeTestMethod) CredSuccess() {
+}
+
+func (f *fakeTestMethod) Shutdown() {
+}
+
+func TestRegisterAuthMethod(t *testing.T) {
+	factory := func(conf *AuthConfig) (AuthMethod, error) {
+		return &fakeTestMethod{conf: conf}, nil
+	}
+
+	if err := RegisterAuthMethod("fake-test", factory); err != nil {
+		t.Fatal(err)
+	}
+	if !strutil.StrListContains(RegisteredAuthMethods(), "fake-test") {
+		t.Fatalf("fake-test not in registered methods: %v", RegisteredAuthMethods())
+	}
+
+	method, err := NewAuthMethod("fake-test", &AuthConfig{MountPath: "auth/fake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _, _, err := method.Authenticate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "auth/fake/login" {
+		t.Fatalf("bad: path: %q", path)
+	}
+
+	// Types can't be registered twice
+	if err := RegisterAuthMethod("fake-test", factory); err == nil {
+		t.Fatal("expected error registering a type twice")
+	}
+	if err := RegisterAuthMethod("", factory); err == nil {
+		t.Fatal("expected error registering an empty type")
+	}
+
+	if _, err := NewAuthMethod("missing-test", &AuthConfig{}); err == nil {
+		t.Fatal("expected error creating an unregistered type")
+	}
+}
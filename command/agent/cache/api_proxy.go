@@ -3,9 +3,24 @@ package cache
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
 	hclog "github.com/hashicorp/go-hclog"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+)
+
+const (
+	// defaultProxyMaxRetries is the number of times an idempotent request is
+	// retried if no limit is configured, matching the API client's default.
+	defaultProxyMaxRetries = 2
+
+	defaultProxyRetryWaitMin = 500 * time.Millisecond
+	defaultProxyRetryWaitMax = 5 * time.Second
 )
 
 // APIProxy is an implementation of the proxier interface that is used to
@@ -13,20 +28,76 @@ import (
 type APIProxy struct {
 	client *api.Client
 	logger hclog.Logger
+
+	maxRetries          int
+	retryableWritePaths []string
+	retryWaitMin        time.Duration
+	retryWaitMax        time.Duration
+	metricSink          metrics.MetricSink
 }
 
 type APIProxyConfig struct {
 	Client *api.Client
 	Logger hclog.Logger
+
+	// MaxRetries is the number of times an idempotent request is retried when
+	// Vault can't be reached or responds with a server error. Defaults to 2 if
+	// zero; a negative value disables retrying.
+	MaxRetries int
+
+	// RetryableWritePaths is a list of request paths, which may contain glob
+	// patterns, of writes that are safe to retry. Other writes are never
+	// retried.
+	RetryableWritePaths []string
+
+	// MetricSink, if set, receives the proxy's request latency and error
+	// metrics.
+	MetricSink metrics.MetricSink
+
+	// UpstreamTimeout is the timeout of each request forwarded to Vault. If
+	// zero, the timeout of Client is used.
+	UpstreamTimeout time.Duration
+
+	// MaxIdleConns is the number of idle connections to Vault kept open for
+	// reuse. If zero, the setting of Client's transport is used.
+	MaxIdleConns int
+
+	// IdleConnTimeout is how long an idle connection to Vault is kept open.
+	// If zero, the setting of Client's transport is used.
+	IdleConnTimeout time.Duration
 }
 
 func NewAPIProxy(config *APIProxyConfig) (Proxier, error) {
 	if config.Client == nil {
 		return nil, fmt.Errorf("nil API client")
 	}
+
+	maxRetries := config.MaxRetries
+	switch {
+	case maxRetries == 0:
+		maxRetries = defaultProxyMaxRetries
+	case maxRetries < 0:
+		maxRetries = 0
+	}
+
+	metricSink := config.MetricSink
+	if metricSink == nil {
+		metricSink = &metrics.BlackholeSink{}
+	}
+
+	client, err := newProxyClient(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &APIProxy{
-		client: config.Client,
-		logger: config.Logger,
+		client:              client,
+		logger:              config.Logger,
+		maxRetries:          maxRetries,
+		retryableWritePaths: config.RetryableWritePaths,
+		retryWaitMin:        defaultProxyRetryWaitMin,
+		retryWaitMax:        defaultProxyRetryWaitMax,
+		metricSink:          metricSink,
 	}, nil
 }
 
@@ -37,6 +108,10 @@ func (ap *APIProxy) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 	}
 	client.SetToken(req.Token)
 
+	// Retries are handled below, since only idempotent requests may be
+	// retried
+	client.SetMaxRetries(0)
+
 	// http.Transport will transparently request gzip and decompress the response, but only if
 	// the client doesn't manually set the header. Removing any Accept-Encoding header allows the
 	// transparent compression to occur.
@@ -46,15 +121,68 @@ func (ap *APIProxy) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 	fwReq := client.NewRequest(req.Request.Method, req.Request.URL.Path)
 	fwReq.BodyBytes = req.RequestBody
 
+	// The wrap TTL requested by the client takes precedence over any the
+	// agent's client would set, so that the wrapped response is passed back
+	// to it unchanged
+	if wrapTTL := req.Request.Header.Get("X-Vault-Wrap-TTL"); wrapTTL != "" {
+		fwReq.WrapTTL = wrapTTL
+	}
+
 	query := req.Request.URL.Query()
 	if len(query) != 0 {
 		fwReq.Params = query
 	}
 
-	// Make the request to Vault and get the response
-	ap.logger.Info("forwarding request", "method", req.Request.Method, "path", req.Request.URL.Path)
+	retryable := ap.isRetryable(req.Request)
+
+	start := time.Now()
+	defer func() {
+		ap.metricSink.AddSample(metricKeyProxyRequest, float32(time.Since(start).Seconds()*1000))
+	}()
+
+	var resp *api.Response
+	for attempt := 0; ; attempt++ {
+		// Make the request to Vault and get the response
+		ap.logger.Info("forwarding request", "method", req.Request.Method, "path", req.Request.URL.Path)
+
+		resp, err = client.RawRequestWithContext(ctx, fwReq)
+
+		if !retryable || attempt >= ap.maxRetries || !shouldRetryProxiedRequest(resp, err) || ctx.Err() != nil {
+			break
+		}
+
+		var httpResp *http.Response
+		if resp != nil {
+			httpResp = resp.Response
+		}
+		wait := retryablehttp.DefaultBackoff(ap.retryWaitMin, ap.retryWaitMax, attempt, httpResp)
+
+		// Don't wait past the request's deadline; the failure is returned
+		// instead
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			break
+		}
+
+		ap.logger.Warn("upstream request failed, retrying", "method", req.Request.Method, "path", req.Request.URL.Path, "attempt", attempt+1, "backoff", wait.String(), "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			// Return the last failure
+			timer.Stop()
+		case <-timer.C:
+			if resp != nil {
+				resp.Body.Close()
+			}
+			continue
+		}
+		break
+	}
+
+	if err != nil {
+		ap.metricSink.IncrCounter(metricKeyProxyError, 1)
+	}
 
-	resp, err := client.RawRequestWithContext(ctx, fwReq)
 	if resp == nil && err != nil {
 		// We don't want to cache nil responses, so we simply return the error
 		return nil, err
@@ -70,3 +198,65 @@ func (ap *APIProxy) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 	// Bubble back the api.Response as well for error checking/handling at the handler layer.
 	return sendResponse, err
 }
+
+// newProxyClient returns a client for forwarding requests with the same
+// configuration as config.Client, but with its own transport and timeout so
+// that the proxy's settings don't affect the caller's client or vice versa.
+func newProxyClient(config *APIProxyConfig) (*api.Client, error) {
+	clientConfig := config.Client.CloneConfig()
+
+	if transport, ok := clientConfig.HttpClient.Transport.(*http.Transport); ok {
+		transport = transport.Clone()
+		if config.MaxIdleConns > 0 {
+			// All requests go to the same Vault server
+			transport.MaxIdleConns = config.MaxIdleConns
+			transport.MaxIdleConnsPerHost = config.MaxIdleConns
+		}
+		if config.IdleConnTimeout > 0 {
+			transport.IdleConnTimeout = config.IdleConnTimeout
+		}
+
+		httpClient := *clientConfig.HttpClient
+		httpClient.Transport = transport
+		clientConfig.HttpClient = &httpClient
+	}
+
+	if config.UpstreamTimeout > 0 {
+		clientConfig.Timeout = config.UpstreamTimeout
+	}
+
+	return api.NewClient(clientConfig)
+}
+
+// isRetryable returns true if the request can be safely sent more than once.
+// Reads are idempotent, while writes are only retried if their path has been
+// configured as safe to retry.
+func (ap *APIProxy) isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, "LIST":
+		return true
+	}
+
+	if len(ap.retryableWritePaths) == 0 {
+		return false
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	return strutil.StrListContainsGlob(ap.retryableWritePaths, path)
+}
+
+// shouldRetryProxiedRequest returns true if the request failed in a way that
+// may succeed on another attempt, such as a connection error or a server error
+// during a leader election.
+func shouldRetryProxiedRequest(resp *api.Response, err error) bool {
+	if resp == nil || resp.Response == nil {
+		return err != nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
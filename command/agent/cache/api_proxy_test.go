@@ -1,8 +1,13 @@
 package cache
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
@@ -93,3 +98,214 @@ func TestAPIProxy_queryParams(t *testing.T) {
 		t.Fatalf("exptected standby to return 200, got: %v", resp.Response.StatusCode)
 	}
 }
+
+func testFlakyUpstream(t *testing.T, failures int) (*api.Client, *int32, func()) {
+	t.Helper()
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(atomic.AddInt32(&attempts, 1)) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"value": "bar"}}`))
+	}))
+
+	config := api.DefaultConfig()
+	config.Address = ts.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+
+	return client, &attempts, ts.Close
+}
+
+func testNewRetryingProxy(t *testing.T, client *api.Client, retryableWritePaths []string) *APIProxy {
+	t.Helper()
+
+	proxier, err := NewAPIProxy(&APIProxyConfig{
+		Client:              client,
+		Logger:              logging.NewVaultLogger(hclog.Trace),
+		RetryableWritePaths: retryableWritePaths,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ap := proxier.(*APIProxy)
+	ap.retryWaitMin = 10 * time.Millisecond
+	ap.retryWaitMax = 50 * time.Millisecond
+	return ap
+}
+
+func TestAPIProxy_RetryIdempotent(t *testing.T) {
+	client, attempts, cleanup := testFlakyUpstream(t, 1)
+	defer cleanup()
+
+	proxier := testNewRetryingProxy(t, client, nil)
+
+	resp, err := proxier.Send(context.Background(), &SendRequest{
+		Request: httptest.NewRequest("GET", "http://example.com/v1/secret/foo", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Response.StatusCode)
+	}
+	if got := atomic.LoadInt32(attempts); got != 2 {
+		t.Fatalf("expected 2 attempts, got %d", got)
+	}
+}
+
+func TestAPIProxy_NoRetryNonIdempotent(t *testing.T) {
+	client, attempts, cleanup := testFlakyUpstream(t, 1)
+	defer cleanup()
+
+	proxier := testNewRetryingProxy(t, client, []string{"sys/wrapping/*"})
+
+	// Writes are not retried
+	resp, err := proxier.Send(context.Background(), &SendRequest{
+		Request:     httptest.NewRequest("PUT", "http://example.com/v1/secret/foo", strings.NewReader(`{"value": "bar"}`)),
+		RequestBody: []byte(`{"value": "bar"}`),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if resp == nil || resp.Response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the upstream failure to be returned, got: %#v", resp)
+	}
+	if got := atomic.LoadInt32(attempts); got != 1 {
+		t.Fatalf("expected 1 attempt, got %d", got)
+	}
+
+	// Unless they have been configured as safe to retry
+	atomic.StoreInt32(attempts, 0)
+	resp, err = proxier.Send(context.Background(), &SendRequest{
+		Request: httptest.NewRequest("PUT", "http://example.com/v1/sys/wrapping/lookup", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Response.StatusCode)
+	}
+	if got := atomic.LoadInt32(attempts); got != 2 {
+		t.Fatalf("expected 2 attempts, got %d", got)
+	}
+}
+
+func TestAPIProxy_RetryBounded(t *testing.T) {
+	client, attempts, cleanup := testFlakyUpstream(t, 10)
+	defer cleanup()
+
+	proxier := testNewRetryingProxy(t, client, nil)
+
+	_, err := proxier.Send(context.Background(), &SendRequest{
+		Request: httptest.NewRequest("GET", "http://example.com/v1/secret/foo", nil),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got := atomic.LoadInt32(attempts); got != defaultProxyMaxRetries+1 {
+		t.Fatalf("expected %d attempts, got %d", defaultProxyMaxRetries+1, got)
+	}
+
+	// Retries stop once the request's deadline would be exceeded
+	atomic.StoreInt32(attempts, 0)
+	proxier.retryWaitMin = time.Second
+	proxier.retryWaitMax = time.Second
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelFunc()
+	_, err = proxier.Send(ctx, &SendRequest{
+		Request: httptest.NewRequest("GET", "http://example.com/v1/secret/foo", nil),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got := atomic.LoadInt32(attempts); got != 1 {
+		t.Fatalf("expected 1 attempt, got %d", got)
+	}
+}
+
+func TestAPIProxy_WrapTTL(t *testing.T) {
+	// The upstream echoes the requested wrap TTL back
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"wrap_info": {"token": "wrappingtoken", "creation_path": "secret/foo", "ttl": "` + r.Header.Get("X-Vault-Wrap-TTL") + `"}}`))
+	}))
+	defer ts.Close()
+
+	config := api.DefaultConfig()
+	config.Address = ts.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client's wrap TTL must not override the one requested through the
+	// proxy
+	client.SetWrappingLookupFunc(func(string, string) string { return "1m" })
+
+	proxier := testNewRetryingProxy(t, client, nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/v1/secret/foo", nil)
+	req.Header.Set("X-Vault-Wrap-TTL", "5m")
+	resp, err := proxier.Send(context.Background(), &SendRequest{
+		Request: req,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(resp.ResponseBody), `"ttl": "5m"`) {
+		t.Fatalf("expected the requested wrap TTL to be passed through, got: %s", resp.ResponseBody)
+	}
+}
+
+func TestAPIProxy_UpstreamTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"value": "bar"}}`))
+	}))
+	defer ts.Close()
+
+	config := api.DefaultConfig()
+	config.Address = ts.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxier, err := NewAPIProxy(&APIProxyConfig{
+		Client:          client,
+		Logger:          logging.NewVaultLogger(hclog.Trace),
+		MaxRetries:      -1,
+		UpstreamTimeout: 50 * time.Millisecond,
+		MaxIdleConns:    5,
+		IdleConnTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proxy's settings don't change the caller's client
+	if transport := config.HttpClient.Transport.(*http.Transport); transport.MaxIdleConns == 5 || transport.IdleConnTimeout == time.Minute {
+		t.Fatal("expected the caller's transport to be unchanged")
+	}
+
+	agent := httptest.NewServer(Handler(context.Background(), logging.NewVaultLogger(hclog.Trace), proxier, nil, true))
+	defer agent.Close()
+
+	resp, err := http.Get(agent.URL + "/v1/secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+}
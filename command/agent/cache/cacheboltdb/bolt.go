@@ -0,0 +1,275 @@
+package cacheboltdb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/errwrap"
+	hclog "github.com/hashicorp/go-hclog"
+	wrapping "github.com/hashicorp/go-kms-wrapping"
+	aeadwrapper "github.com/hashicorp/go-kms-wrapping/wrappers/aead"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DatabaseFileName is the name of the file holding the persisted cache
+	// within the configured directory.
+	DatabaseFileName = "vault-agent-cache.db"
+
+	// indexBucketName is the bucket holding the encrypted cache indexes,
+	// keyed by index ID.
+	indexBucketName = "indexes"
+
+	// metaBucketName is the bucket holding the wrapped encryption key.
+	metaBucketName = "meta"
+
+	// encryptionKeyName is the key of the wrapped encryption key within the
+	// meta bucket. It's also used as additional data when wrapping the key.
+	encryptionKeyName = "encryption_key"
+)
+
+// BoltStorage persists serialized cache indexes to a BoltDB file. Each entry is
+// encrypted with AES-GCM using a randomly generated key, which is stored in
+// the same file after being wrapped by the configured wrapper. The entries can
+// thus be read back after a restart regardless of the auto-auth token in use.
+type BoltStorage struct {
+	db     *bolt.DB
+	logger hclog.Logger
+	aead   cipher.AEAD
+}
+
+// BoltStorageConfig is the configuration for initializing a new BoltStorage.
+type BoltStorageConfig struct {
+	// Path is the directory in which the database file is created.
+	Path   string
+	Logger hclog.Logger
+
+	// Wrapper wraps the encryption key persisted along with the entries.
+	Wrapper wrapping.Wrapper
+}
+
+// NewBoltStorage opens the database file within the configured directory,
+// creating it if it doesn't exist yet.
+func NewBoltStorage(config *BoltStorageConfig) (*BoltStorage, error) {
+	if config == nil {
+		return nil, errors.New("nil configuration provided")
+	}
+	if config.Path == "" {
+		return nil, errors.New("path must be provided")
+	}
+	if config.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+	if config.Wrapper == nil {
+		return nil, errors.New("nil wrapper provided")
+	}
+
+	if err := os.MkdirAll(config.Path, 0700); err != nil {
+		return nil, errwrap.Wrapf("failed to create cache persistence directory: {{err}}", err)
+	}
+
+	dbPath := filepath.Join(config.Path, DatabaseFileName)
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("failed to open cache persistence file %q: {{err}}", dbPath), err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{indexBucketName, metaBucketName} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errwrap.Wrapf("failed to create bucket: {{err}}", err)
+	}
+
+	b := &BoltStorage{
+		db:     db,
+		logger: config.Logger,
+	}
+	if err := b.loadKey(config.Wrapper); err != nil {
+		db.Close()
+		return nil, errwrap.Wrapf("failed to load encryption key: {{err}}", err)
+	}
+
+	return b, nil
+}
+
+// NewKeyFileWrapper returns a wrapper using the AES-256 key held base64-encoded
+// in the given file.
+func NewKeyFileWrapper(path string) (wrapping.Wrapper, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("failed to read key file %q: {{err}}", path), err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("failed to decode key file %q: {{err}}", path), err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key file %q must hold a base64-encoded 256-bit key", path)
+	}
+
+	wrapper := aeadwrapper.NewWrapper(nil)
+	if err := wrapper.SetAESGCMKeyBytes(key); err != nil {
+		return nil, err
+	}
+	return wrapper, nil
+}
+
+// loadKey unwraps the persisted encryption key, generating and persisting a
+// new one if there is none yet. If the persisted key can't be unwrapped, e.g.
+// because the wrapper's key changed, the entries encrypted with it are
+// discarded along with it.
+func (b *BoltStorage) loadKey(wrapper wrapping.Wrapper) error {
+	var key []byte
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucketName))
+
+		if wrapped := meta.Get([]byte(encryptionKeyName)); wrapped != nil {
+			blobInfo := new(wrapping.EncryptedBlobInfo)
+			err := proto.Unmarshal(wrapped, blobInfo)
+			if err == nil {
+				key, err = wrapper.Decrypt(context.Background(), blobInfo, []byte(encryptionKeyName))
+			}
+			if err == nil {
+				return nil
+			}
+
+			b.logger.Warn("failed to unwrap the persisted encryption key; discarding the persisted cache", "error", err)
+			if err := tx.DeleteBucket([]byte(indexBucketName)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(indexBucketName)); err != nil {
+				return err
+			}
+		}
+
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return err
+		}
+		blobInfo, err := wrapper.Encrypt(context.Background(), key, []byte(encryptionKeyName))
+		if err != nil {
+			return errwrap.Wrapf("failed to wrap encryption key: {{err}}", err)
+		}
+		wrapped, err := proto.Marshal(blobInfo)
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(encryptionKeyName), wrapped)
+	})
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	b.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// Set encrypts and stores the given value under the given ID.
+func (b *BoltStorage) Set(id string, value []byte) error {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	// The ID is used as additional data so that entries can't be swapped
+	ciphertext := b.aead.Seal(nonce, nonce, value, []byte(id))
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(indexBucketName)).Put([]byte(id), ciphertext)
+	})
+}
+
+// Delete removes the value stored under the given ID, if any.
+func (b *BoltStorage) Delete(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(indexBucketName)).Delete([]byte(id))
+	})
+}
+
+// GetAll returns all the decrypted values. Entries that can't be decrypted
+// are removed.
+func (b *BoltStorage) GetAll() ([][]byte, error) {
+	var values [][]byte
+	var invalid [][]byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(indexBucketName)).ForEach(func(k, v []byte) error {
+			value, err := decrypt(b.aead, k, v)
+			if err != nil {
+				b.logger.Debug("discarding persisted cache entry that could not be decrypted", "id", string(k), "error", err)
+				invalid = append(invalid, append([]byte(nil), k...))
+				return nil
+			}
+			values = append(values, value)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(invalid) > 0 {
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(indexBucketName))
+			for _, k := range invalid {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// Clear removes all the stored values.
+func (b *BoltStorage) Clear() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(indexBucketName)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte(indexBucketName))
+		return err
+	})
+}
+
+// Close closes the underlying database file.
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
+
+func decrypt(aead cipher.AEAD, id, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], id)
+}
@@ -0,0 +1,189 @@
+package cacheboltdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	hclog "github.com/hashicorp/go-hclog"
+	wrapping "github.com/hashicorp/go-kms-wrapping"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testKeyFile writes a random key to a key file within the given directory,
+// and returns its path.
+func testKeyFile(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testBoltStorage(t *testing.T, path string, keyFile string) *BoltStorage {
+	t.Helper()
+
+	wrapper, err := NewKeyFileWrapper(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBoltStorage(&BoltStorageConfig{
+		Path:    path,
+		Logger:  logging.NewVaultLogger(hclog.Trace),
+		Wrapper: wrapper,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-cache-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := testKeyFile(t, dir, "key")
+	b := testBoltStorage(t, dir, keyFile)
+
+	for _, id := range []string{"foo", "bar", "baz"} {
+		if err := b.Set(id, []byte("value-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete("baz"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values are read back after reopening the file
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b = testBoltStorage(t, dir, keyFile)
+
+	values, err := b.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(values))
+	}
+	found := map[string]bool{}
+	for _, v := range values {
+		found[string(v)] = true
+	}
+	if !found["value-foo"] || !found["value-bar"] {
+		t.Fatalf("unexpected values: %v", found)
+	}
+
+	// The values are not readable once the key file changes, and are
+	// discarded
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b = testBoltStorage(t, dir, testKeyFile(t, dir, "otherkey"))
+	defer b.Close()
+
+	values, err = b.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("expected values to have been discarded, got %d", len(values))
+	}
+
+	// Clear removes everything
+	if err := b.Set("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	values, err = b.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("expected no values after clear, got %d", len(values))
+	}
+}
+
+func TestBoltStorage_WrappedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-cache-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := testKeyFile(t, dir, "key")
+	b := testBoltStorage(t, dir, keyFile)
+	defer b.Close()
+
+	wrapper, err := NewKeyFileWrapper(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The persisted key is only readable through the wrapper
+	var key []byte
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		wrapped := tx.Bucket([]byte(metaBucketName)).Get([]byte(encryptionKeyName))
+		if wrapped == nil {
+			t.Fatal("expected the encryption key to be persisted")
+		}
+		blobInfo := new(wrapping.EncryptedBlobInfo)
+		if err := proto.Unmarshal(wrapped, blobInfo); err != nil {
+			return err
+		}
+		key, err = wrapper.Decrypt(context.Background(), blobInfo, []byte(encryptionKeyName))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 {
+		t.Fatalf("expected a 256-bit key, got %d bytes", len(key))
+	}
+}
+
+func TestNewKeyFileWrapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-cache-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewKeyFileWrapper(testKeyFile(t, dir, "key")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range map[string]string{
+		"short":  base64.StdEncoding.EncodeToString([]byte("tooshort")),
+		"base64": "not base64!",
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewKeyFileWrapper(path); err == nil {
+			t.Fatalf("expected an error for a %s key", name)
+		}
+	}
+
+	if _, err := NewKeyFileWrapper(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected an error for a missing key file")
+	}
+}
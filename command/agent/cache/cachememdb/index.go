@@ -1,6 +1,12 @@
 package cachememdb
 
-import "context"
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+)
 
 // Index holds the response to be cached along with multiple other values that
 // serve as pointers to refer back to this index.
@@ -44,10 +50,41 @@ type Index struct {
 	// Response is the serialized response object that the agent is caching.
 	Response []byte
 
+	// RequestMethod is the HTTP method of the request that resulted in the
+	// response held by this index.
+	RequestMethod string
+
+	// RequestToken is the token used to make the request that resulted in
+	// the response held by this index. It is used to renew the secret.
+	RequestToken string
+
+	// RequestHeader is the header of the request that resulted in the
+	// response held by this index. It is used to renew the secret.
+	RequestHeader http.Header
+
+	// Expiry is the time at which the secret held by this index expires if it
+	// isn't renewed. A zero value means that it doesn't expire.
+	Expiry time.Time
+
 	// RenewCtxInfo holds the context and the corresponding cancel func for the
 	// goroutine that manages the renewal of the secret belonging to the
 	// response in this index.
-	RenewCtxInfo *ContextInfo
+	RenewCtxInfo *ContextInfo `json:"-"`
+}
+
+// Serialize encodes the index for persistence. The renewal context is not
+// part of the encoded value.
+func (i *Index) Serialize() ([]byte, error) {
+	return jsonutil.EncodeJSON(i)
+}
+
+// Deserialize decodes an index encoded by Serialize.
+func Deserialize(indexBytes []byte) (*Index, error) {
+	index := new(Index)
+	if err := jsonutil.DecodeJSON(indexBytes, index); err != nil {
+		return nil, err
+	}
+	return index, nil
 }
 
 type IndexName uint32
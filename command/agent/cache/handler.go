@@ -59,6 +59,8 @@ func Handler(ctx context.Context, logger hclog.Logger, proxier Proxier, inmemSin
 				copyHeader(w.Header(), resp.Response.Header)
 				w.WriteHeader(resp.Response.StatusCode)
 				io.Copy(w, resp.Response.Body)
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				logical.RespondError(w, http.StatusGatewayTimeout, errwrap.Wrapf("timed out waiting for the response: {{err}}", err))
 			} else {
 				logical.RespondError(w, http.StatusInternalServerError, errwrap.Wrapf("failed to get the response: {{err}}", err))
 			}
@@ -100,6 +102,12 @@ func setHeaders(w http.ResponseWriter, resp *SendResponse) {
 
 			// Update the date value
 			w.Header().Set("Date", time.Now().Format(http.TimeFormat))
+
+			// Signal that the entry was served because the upstream request
+			// failed
+			if resp.CacheMeta.Stale {
+				w.Header().Set("Warning", staleWarningHeaderValue)
+			}
 		}
 
 		w.Header().Set("X-Cache", xCacheVal)
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// AutoAuthStatus reports the status of the auto-auth token.
+type AutoAuthStatus interface {
+	// TokenStatus returns whether a valid token is held, and its remaining
+	// TTL. The TTL is zero for tokens that don't expire.
+	TokenStatus() (bool, time.Duration)
+}
+
+// HealthResponse is the response of the health endpoint.
+type HealthResponse struct {
+	Healthy  bool             `json:"healthy"`
+	AutoAuth *AutoAuthHealth  `json:"auto_auth,omitempty"`
+	Cache    *LeaseCacheStats `json:"cache,omitempty"`
+}
+
+// AutoAuthHealth is the status of the auto-auth token.
+type AutoAuthHealth struct {
+	HasToken bool `json:"has_token"`
+	TokenTTL int  `json:"token_ttl"`
+}
+
+// HealthHandler returns a handler reporting the status of the auto-auth token
+// and the statistics of the cache. Either of them may be nil if not
+// configured. The agent is healthy if auto-auth isn't configured or holds a
+// valid token; otherwise the handler responds with a 503.
+func HealthHandler(status AutoAuthStatus, leaseCache *LeaseCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			logical.RespondError(w, http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		resp := &HealthResponse{
+			Healthy: true,
+		}
+		if status != nil {
+			hasToken, ttl := status.TokenStatus()
+			resp.AutoAuth = &AutoAuthHealth{
+				HasToken: hasToken,
+				TokenTTL: int(ttl.Seconds()),
+			}
+			resp.Healthy = hasToken
+		}
+		if leaseCache != nil {
+			resp.Cache = leaseCache.Stats()
+		}
+
+		code := http.StatusOK
+		if !resp.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	})
+}
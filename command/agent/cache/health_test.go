@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+type healthTestMethod struct{}
+
+func (m *healthTestMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return "auth/fake/login", nil, nil, nil
+}
+
+func (m *healthTestMethod) NewCreds() chan struct{} {
+	return nil
+}
+
+func (m *healthTestMethod) CredSuccess() {
+}
+
+func (m *healthTestMethod) Shutdown() {
+}
+
+func TestHealthHandler(t *testing.T) {
+	// Logins are held until released, so that the health can be checked
+	// before the first token
+	loginCh := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/fake/login" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		<-loginCh
+		w.Write([]byte(`{"auth": {"client_token": "s.token", "lease_duration": 3600}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ah := auth.NewAuthHandler(&auth.AuthHandlerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client: client,
+	})
+	go ah.Run(ctx, &healthTestMethod{})
+
+	handler := HealthHandler(ah, testNewLeaseCache(t, nil))
+	health := func() (int, *HealthResponse) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/agent/v1/health", nil))
+
+		resp := new(HealthResponse)
+		if err := json.NewDecoder(rr.Body).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Code, resp
+	}
+
+	code, resp := health()
+	if code != http.StatusServiceUnavailable || resp.Healthy {
+		t.Fatalf("expected unhealthy before the first token, got %d: %#v", code, resp)
+	}
+	if resp.AutoAuth == nil || resp.AutoAuth.HasToken {
+		t.Fatalf("bad: auto-auth status: %#v", resp.AutoAuth)
+	}
+	if resp.Cache == nil || resp.Cache.Entries != 0 {
+		t.Fatalf("bad: cache stats: %#v", resp.Cache)
+	}
+
+	close(loginCh)
+	select {
+	case <-ah.OutputCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+
+	code, resp = health()
+	if code != http.StatusOK || !resp.Healthy {
+		t.Fatalf("expected healthy after the first token, got %d: %#v", code, resp)
+	}
+	if !resp.AutoAuth.HasToken || resp.AutoAuth.TokenTTL <= 0 || resp.AutoAuth.TokenTTL > 3600 {
+		t.Fatalf("bad: auto-auth status: %#v", resp.AutoAuth)
+	}
+
+	// Without auto-auth, the agent is healthy
+	rr := httptest.NewRecorder()
+	HealthHandler(nil, nil).ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/agent/v1/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 without auto-auth, got %d", rr.Code)
+	}
+}
@@ -11,13 +11,18 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/errwrap"
 	hclog "github.com/hashicorp/go-hclog"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/cache/cacheboltdb"
 	cachememdb "github.com/hashicorp/vault/command/agent/cache/cachememdb"
 	"github.com/hashicorp/vault/helper/namespace"
 	nshelper "github.com/hashicorp/vault/helper/namespace"
@@ -40,6 +45,10 @@ const (
 	vaultPathLeaseRevoke         = "/v1/sys/leases/revoke"
 	vaultPathLeaseRevokeForce    = "/v1/sys/leases/revoke-force"
 	vaultPathLeaseRevokePrefix   = "/v1/sys/leases/revoke-prefix"
+
+	// staleWarningHeaderValue is the Warning header value set on responses that
+	// are served from stale cache entries, as defined in RFC 7234.
+	staleWarningHeaderValue = `110 - "Response is Stale"`
 )
 
 var (
@@ -76,8 +85,58 @@ type LeaseCache struct {
 	l           *sync.RWMutex
 
 	// idLocks is used during cache lookup to ensure that identical requests made
-	// in parallel won't trigger multiple renewal goroutines.
+	// in parallel won't trigger multiple renewal goroutines. The write lock is
+	// held while a missed request is forwarded, so concurrent identical
+	// requests wait for it and are served the cached response rather than each
+	// making an upstream request.
 	idLocks []*locksutil.LockEntry
+
+	// staleIfError is the maximum duration for which an evicted response can
+	// be served if the upstream request fails. A zero value disables serving
+	// stale responses.
+	staleIfError time.Duration
+
+	// staleResponses holds the serialized responses of evicted entries, keyed
+	// by index ID, that may be served if the upstream request fails.
+	staleResponses map[string]*staleResponse
+	staleLock      sync.Mutex
+
+	// staticSecretTTL is the duration for which responses that aren't lease
+	// backed, such as KV v2 reads, are cached. A zero value disables caching
+	// them.
+	staticSecretTTL time.Duration
+
+	// revokeOnEvict makes the cache revoke the leases it drops when the cache
+	// is cleared or an entry is evicted to make room for a new one.
+	revokeOnEvict bool
+
+	// metricSink receives the cache's metrics. entries is the number of
+	// cached responses, reported as a gauge. hits and misses count the
+	// requests served from the cache and forwarded, reported by Stats.
+	metricSink metrics.MetricSink
+	entries    int64
+	hits       int64
+	misses     int64
+
+	// lru tracks the usage of the cached responses, keyed by index ID, when
+	// the number of entries is capped. The least recently used entry is
+	// evicted when the cap is reached.
+	lru *lru.Cache
+
+	// storage, if set, persists the cached indexes so that they survive a
+	// restart of the agent. shutdownCtx is the context the agent cancels on
+	// shutdown, in which case the persisted indexes are retained.
+	storage     *cacheboltdb.BoltStorage
+	shutdownCtx context.Context
+	persistLock sync.Mutex
+	restored    bool
+}
+
+// staleResponse is a serialized response that has been evicted from the cache
+// along with the time of its eviction.
+type staleResponse struct {
+	response  []byte
+	evictedAt time.Time
 }
 
 // LeaseCacheConfig is the configuration for initializing a new
@@ -87,6 +146,33 @@ type LeaseCacheConfig struct {
 	BaseContext context.Context
 	Proxier     Proxier
 	Logger      hclog.Logger
+
+	// StaleIfError is the maximum duration after eviction for which a cached
+	// response is served if forwarding the request to Vault fails.
+	StaleIfError time.Duration
+
+	// StaticSecretTTL is the duration for which KV v2 reads, which aren't lease
+	// backed, are cached. A write to the same path through the cache evicts
+	// them early. A zero value disables caching them.
+	StaticSecretTTL time.Duration
+
+	// MetricSink, if set, receives the cache's hit, miss, eviction, entry
+	// count and renewal error metrics.
+	MetricSink metrics.MetricSink
+
+	// RevokeOnEvict, if set, makes the cache revoke the leases of the entries
+	// dropped by a cache clear or by the max entries cap, rather than leaving
+	// them to expire. Revocation is best-effort; failures are only logged.
+	RevokeOnEvict bool
+
+	// MaxEntries is the maximum number of cached responses. When the cap is
+	// reached, the least recently used response is evicted and the renewal
+	// of its secret is stopped. A zero value means no limit.
+	MaxEntries int
+
+	// Storage is an optional persistent store for the cached indexes. The
+	// stored indexes are restored once the auto-auth token is registered.
+	Storage *cacheboltdb.BoltStorage
 }
 
 // NewLeaseCache creates a new instance of a LeaseCache.
@@ -103,6 +189,18 @@ func NewLeaseCache(conf *LeaseCacheConfig) (*LeaseCache, error) {
 		return nil, fmt.Errorf("nil API client")
 	}
 
+	if conf.StaleIfError < 0 {
+		return nil, fmt.Errorf("stale if error duration must not be negative")
+	}
+
+	if conf.MaxEntries < 0 {
+		return nil, fmt.Errorf("max entries must not be negative")
+	}
+
+	if conf.StaticSecretTTL < 0 {
+		return nil, fmt.Errorf("static secret TTL must not be negative")
+	}
+
 	db, err := cachememdb.New()
 	if err != nil {
 		return nil, err
@@ -111,15 +209,55 @@ func NewLeaseCache(conf *LeaseCacheConfig) (*LeaseCache, error) {
 	// Create a base context for the lease cache layer
 	baseCtxInfo := cachememdb.NewContextInfo(conf.BaseContext)
 
-	return &LeaseCache{
-		client:      conf.Client,
-		proxier:     conf.Proxier,
-		logger:      conf.Logger,
-		db:          db,
-		baseCtxInfo: baseCtxInfo,
-		l:           &sync.RWMutex{},
-		idLocks:     locksutil.CreateLocks(),
-	}, nil
+	c := &LeaseCache{
+		client:          conf.Client,
+		proxier:         conf.Proxier,
+		logger:          conf.Logger,
+		db:              db,
+		baseCtxInfo:     baseCtxInfo,
+		l:               &sync.RWMutex{},
+		idLocks:         locksutil.CreateLocks(),
+		staleIfError:    conf.StaleIfError,
+		staleResponses:  make(map[string]*staleResponse),
+		storage:         conf.Storage,
+		shutdownCtx:     conf.BaseContext,
+		staticSecretTTL: conf.StaticSecretTTL,
+		metricSink:      conf.MetricSink,
+		revokeOnEvict:   conf.RevokeOnEvict,
+	}
+
+	if c.metricSink == nil {
+		c.metricSink = &metrics.BlackholeSink{}
+	}
+
+	if conf.MaxEntries > 0 {
+		c.lru, err = lru.NewWithEvict(conf.MaxEntries, c.onLRUEvict)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// onLRUEvict is called when an entry is dropped from the LRU. If the entry is
+// still cached, it was evicted to make room for a new one, so the renewal of
+// its secret is stopped, which in turn evicts it from the cache.
+func (c *LeaseCache) onLRUEvict(key, value interface{}) {
+	id := key.(string)
+
+	index, err := c.db.Get(cachememdb.IndexNameID, id)
+	if err != nil {
+		c.logger.Error("failed to look up evicted index", "id", id, "error", err)
+		return
+	}
+	if index == nil {
+		return
+	}
+
+	c.logger.Debug("max entries reached; evicting least recently used entry", "id", id, "path", index.RequestPath)
+	c.revokeEvictedLeases(index)
+	index.RenewCtxInfo.CancelFunc()
 }
 
 // checkCacheForRequest checks the cache for a particular request based on its
@@ -135,14 +273,20 @@ func (c *LeaseCache) checkCacheForRequest(id string) (*SendResponse, error) {
 	}
 
 	// Cached request is found, deserialize the response
-	reader := bufio.NewReader(bytes.NewReader(index.Response))
+	return c.deserializeCachedResponse(index.Response)
+}
+
+// deserializeCachedResponse creates a *SendResponse out of a serialized cached
+// response and populates its cache metadata.
+func (c *LeaseCache) deserializeCachedResponse(cachedResponse []byte) (*SendResponse, error) {
+	reader := bufio.NewReader(bytes.NewReader(cachedResponse))
 	resp, err := http.ReadResponse(reader, nil)
 	if err != nil {
 		c.logger.Error("failed to deserialize response", "error", err)
 		return nil, err
 	}
 
-	sendResp, err := NewSendResponse(&api.Response{Response: resp}, index.Response)
+	sendResp, err := NewSendResponse(&api.Response{Response: resp}, cachedResponse)
 	if err != nil {
 		c.logger.Error("failed to create new send response", "error", err)
 		return nil, err
@@ -184,6 +328,9 @@ func (c *LeaseCache) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 	}
 	if sendResp != nil {
 		c.logger.Debug("returning cached response", "path", req.Request.URL.Path)
+		c.touchLRU(id)
+		c.metricSink.IncrCounter(metricKeyCacheHit, 1)
+		atomic.AddInt64(&c.hits, 1)
 		return sendResp, nil
 	}
 
@@ -203,17 +350,44 @@ func (c *LeaseCache) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 	// will be the one performing the cache write.
 	if sendResp != nil {
 		c.logger.Debug("returning cached response", "method", req.Request.Method, "path", req.Request.URL.Path)
+		c.touchLRU(id)
+		c.metricSink.IncrCounter(metricKeyCacheHit, 1)
+		atomic.AddInt64(&c.hits, 1)
 		return sendResp, nil
 	}
 
+	c.metricSink.IncrCounter(metricKeyCacheMiss, 1)
+	atomic.AddInt64(&c.misses, 1)
+
 	c.logger.Debug("forwarding request", "method", req.Request.Method, "path", req.Request.URL.Path)
 
 	// Pass the request down and get a response
 	resp, err := c.proxier.Send(ctx, req)
+	if isUpstreamFailure(resp, err) {
+		// If a response for this request was recently evicted, serve it in
+		// place of the failure.
+		staleResp, staleErr := c.checkStaleResponse(id)
+		if staleErr != nil {
+			return nil, staleErr
+		}
+		if staleResp != nil {
+			c.logger.Warn("upstream request failed; returning stale response", "method", req.Request.Method, "path", req.Request.URL.Path, "error", err)
+			return staleResp, nil
+		}
+	}
 	if err != nil {
 		return resp, err
 	}
 
+	// A successful write supersedes the static responses cached for reads of
+	// the same path or KV v2 secret
+	if c.staticSecretTTL > 0 && isWriteRequest(req.Request) && resp.Response.StatusCode < 300 {
+		if err := c.invalidateStaticResponses(req); err != nil {
+			c.logger.Error("failed to invalidate cached static responses", "error", err)
+			return nil, err
+		}
+	}
+
 	// If this is a non-2xx or if the returned response does not contain JSON payload,
 	// we skip caching
 	if resp.Response.StatusCode >= 300 || resp.Response.Header.Get("Content-Type") != "application/json" {
@@ -230,9 +404,12 @@ func (c *LeaseCache) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 
 	// Build the index to cache based on the response received
 	index := &cachememdb.Index{
-		ID:          id,
-		Namespace:   namespace,
-		RequestPath: req.Request.URL.Path,
+		ID:            id,
+		Namespace:     namespace,
+		RequestPath:   req.Request.URL.Path,
+		RequestMethod: req.Request.Method,
+		RequestToken:  req.Token,
+		RequestHeader: req.Request.Header,
 	}
 
 	secret, err := api.ParseSecret(bytes.NewReader(resp.ResponseBody))
@@ -258,19 +435,46 @@ func (c *LeaseCache) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 		return resp, nil
 	}
 
+	// Wrapping tokens are single use and can't be renewed, so wrapped
+	// responses are returned as is and never cached
+	if secret.WrapInfo != nil {
+		c.logger.Debug("pass-through response; response is wrapped", "method", req.Request.Method, "path", req.Request.URL.Path)
+		return resp, nil
+	}
+
+	// KV v2 reads aren't lease backed, so they are cached for a fixed duration
+	// rather than for as long as a lease is renewed
+	isStatic := c.staticSecretTTL > 0 && req.Request.Method == http.MethodGet && isKVv2Response(secret)
+
 	// Short-circuit if the secret is not renewable
 	tokenRenewable, err := secret.TokenIsRenewable()
 	if err != nil {
 		c.logger.Error("failed to parse renewable param", "error", err)
 		return nil, err
 	}
-	if !secret.Renewable && !tokenRenewable {
+	if !isStatic && !secret.Renewable && !tokenRenewable {
 		c.logger.Debug("pass-through response; secret not renewable", "method", req.Request.Method, "path", req.Request.URL.Path)
 		return resp, nil
 	}
 
 	var renewCtxInfo *cachememdb.ContextInfo
 	switch {
+	case isStatic:
+		c.logger.Debug("processing static secret response", "method", req.Request.Method, "path", req.Request.URL.Path)
+		entry, err := c.db.Get(cachememdb.IndexNameToken, req.Token)
+		if err != nil {
+			return nil, err
+		}
+		// As with leases, only responses for tokens managed by the agent are
+		// cached, so that they are evicted when the token is revoked
+		if entry == nil {
+			c.logger.Debug("pass-through static secret response; token not managed by agent", "method", req.Request.Method, "path", req.Request.URL.Path)
+			return resp, nil
+		}
+
+		renewCtxInfo = cachememdb.NewContextInfo(entry.RenewCtxInfo.Ctx)
+		index.LeaseToken = req.Token
+
 	case secret.LeaseID != "":
 		c.logger.Debug("processing lease response", "method", req.Request.Method, "path", req.Request.URL.Path)
 		entry, err := c.db.Get(cachememdb.IndexNameToken, req.Token)
@@ -341,6 +545,10 @@ func (c *LeaseCache) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 
 	// Set the index's Response
 	index.Response = respBytes.Bytes()
+	index.Expiry = secretExpiry(secret, time.Now())
+	if isStatic {
+		index.Expiry = time.Now().Add(c.staticSecretTTL)
+	}
 
 	// Store the index ID in the lifetimewatcher context
 	renewCtx := context.WithValue(renewCtxInfo.Ctx, contextIndexID, index.ID)
@@ -360,12 +568,236 @@ func (c *LeaseCache) Send(ctx context.Context, req *SendRequest) (*SendResponse,
 		return nil, err
 	}
 
-	// Start renewing the secret in the response
-	go c.startRenewing(renewCtx, index, req, secret)
+	c.addEntries(1)
+
+	// A fresh response supersedes any stale one held for this request
+	c.removeStaleResponse(id)
+
+	c.persistIndex(index)
+
+	c.addLRU(index)
+
+	// Start renewing the secret in the response, or expiring the static one
+	if isStatic {
+		go c.startStaticExpiry(renewCtx, index, req)
+	} else {
+		go c.startRenewing(renewCtx, index, req, secret)
+	}
 
 	return resp, nil
 }
 
+// isKVv2Response returns true if the secret has the shape of a KV v2 read,
+// which holds the secret's data and metadata without being lease backed.
+func isKVv2Response(secret *api.Secret) bool {
+	if secret.LeaseID != "" || secret.Auth != nil || secret.Data == nil {
+		return false
+	}
+
+	if _, ok := secret.Data["data"]; !ok {
+		return false
+	}
+
+	metadata, ok := secret.Data["metadata"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasVersion := metadata["version"]
+	_, hasCreatedTime := metadata["created_time"]
+
+	return hasVersion && hasCreatedTime
+}
+
+// isWriteRequest returns true if the request may modify the data at its path.
+func isWriteRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, "LIST":
+		return false
+	}
+	return true
+}
+
+// invalidateStaticResponses evicts the static responses cached for the path
+// of the given request, and for the data path of the KV v2 secret it may
+// change.
+func (c *LeaseCache) invalidateStaticResponses(req *SendRequest) error {
+	namespace := req.Request.Header.Get(consts.NamespaceHeaderName)
+	if namespace == "" {
+		namespace = "root/"
+	}
+
+	paths := append([]string{req.Request.URL.Path}, kvV2DataPaths(req.Request.URL.Path)...)
+	for _, path := range paths {
+		indexes, err := c.db.GetByPrefix(cachememdb.IndexNameRequestPath, namespace, path)
+		if err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			// Static responses are the ones holding neither a lease nor a token
+			if index.RequestPath != path || index.Lease != "" || index.Token != "" {
+				continue
+			}
+			c.logger.Debug("invalidating cached static response", "method", req.Request.Method, "path", path)
+			index.RenewCtxInfo.CancelFunc()
+		}
+	}
+
+	return nil
+}
+
+// kvV2WriteEndpoints are the KV v2 endpoints, other than data, whose writes
+// change what reading the data of a secret returns.
+var kvV2WriteEndpoints = map[string]bool{
+	"delete":   true,
+	"undelete": true,
+	"destroy":  true,
+	"metadata": true,
+}
+
+// kvV2DataPaths returns the data paths of the KV v2 secrets that a write to
+// the given path may change. The mount of the path isn't known, so every
+// segment that could be a KV v2 endpoint followed by a secret's key is
+// replaced with data.
+func kvV2DataPaths(path string) []string {
+	var paths []string
+	segments := strings.Split(path, "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if !kvV2WriteEndpoints[segments[i]] || segments[i+1] == "" {
+			continue
+		}
+		dataSegments := make([]string, len(segments))
+		copy(dataSegments, segments)
+		dataSegments[i] = "data"
+		paths = append(paths, strings.Join(dataSegments, "/"))
+	}
+	return paths
+}
+
+// isUpstreamFailure returns true if the response received from the underlying
+// Proxier indicates that Vault could not be reached or was unable to serve the
+// request.
+func isUpstreamFailure(resp *SendResponse, err error) bool {
+	if resp == nil || resp.Response == nil || resp.Response.Response == nil {
+		return err != nil
+	}
+
+	switch resp.Response.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// checkStaleResponse returns the stale response held for the given index ID if
+// it was evicted within the configured stale if error duration.
+func (c *LeaseCache) checkStaleResponse(id string) (*SendResponse, error) {
+	if c.staleIfError == 0 {
+		return nil, nil
+	}
+
+	c.staleLock.Lock()
+	stale, ok := c.staleResponses[id]
+	if ok && time.Since(stale.evictedAt) > c.staleIfError {
+		delete(c.staleResponses, id)
+		ok = false
+	}
+	c.staleLock.Unlock()
+
+	if !ok {
+		return nil, nil
+	}
+
+	sendResp, err := c.deserializeCachedResponse(stale.response)
+	if err != nil {
+		return nil, err
+	}
+	sendResp.CacheMeta.Stale = true
+
+	return sendResp, nil
+}
+
+// storeStaleResponse holds on to the response of an evicted index so that it
+// can be served if the upstream request fails. Expired stale responses are
+// pruned along the way.
+func (c *LeaseCache) storeStaleResponse(id string, response []byte) {
+	if c.staleIfError == 0 || len(response) == 0 {
+		return
+	}
+
+	c.staleLock.Lock()
+	defer c.staleLock.Unlock()
+
+	now := time.Now()
+	for staleID, stale := range c.staleResponses {
+		if now.Sub(stale.evictedAt) > c.staleIfError {
+			delete(c.staleResponses, staleID)
+		}
+	}
+
+	c.staleResponses[id] = &staleResponse{
+		response:  response,
+		evictedAt: now,
+	}
+}
+
+// removeStaleResponse drops the stale response held for the given index ID.
+func (c *LeaseCache) removeStaleResponse(id string) {
+	c.staleLock.Lock()
+	delete(c.staleResponses, id)
+	c.staleLock.Unlock()
+}
+
+// flushStaleResponses drops all the stale responses.
+func (c *LeaseCache) flushStaleResponses() {
+	c.staleLock.Lock()
+	c.staleResponses = make(map[string]*staleResponse)
+	c.staleLock.Unlock()
+}
+
+// addEntries adjusts the number of cached responses and reports it.
+func (c *LeaseCache) addEntries(delta int64) {
+	entries := atomic.AddInt64(&c.entries, delta)
+	c.metricSink.SetGauge(metricKeyCacheEntries, float32(entries))
+}
+
+// LeaseCacheStats are the statistics of a lease cache.
+type LeaseCacheStats struct {
+	// Entries is the number of cached responses.
+	Entries int64 `json:"entries"`
+
+	// Hits and Misses are the numbers of requests served from the cache and
+	// forwarded since the agent started.
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// Stats returns the statistics of the cache.
+func (c *LeaseCache) Stats() *LeaseCacheStats {
+	return &LeaseCacheStats{
+		Entries: atomic.LoadInt64(&c.entries),
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+	}
+}
+
+// addLRU starts tracking the usage of a cached index, which may evict the
+// least recently used one.
+func (c *LeaseCache) addLRU(index *cachememdb.Index) {
+	if c.lru == nil {
+		return
+	}
+	c.lru.Add(index.ID, nil)
+}
+
+// touchLRU marks the cached index as recently used.
+func (c *LeaseCache) touchLRU(id string) {
+	if c.lru == nil {
+		return
+	}
+	c.lru.Get(id)
+}
+
 func (c *LeaseCache) createCtxInfo(ctx context.Context) *cachememdb.ContextInfo {
 	if ctx == nil {
 		c.l.RLock()
@@ -375,15 +807,66 @@ func (c *LeaseCache) createCtxInfo(ctx context.Context) *cachememdb.ContextInfo
 	return cachememdb.NewContextInfo(ctx)
 }
 
+// evictIndex removes the index from the cache once the goroutine managing its
+// lifetime returns. If retainStale is set, the evicted response may still be
+// served if the upstream request fails.
+func (c *LeaseCache) evictIndex(ctx context.Context, index *cachememdb.Index, req *SendRequest, retainStale bool) {
+	id := ctx.Value(contextIndexID).(string)
+	c.logger.Debug("evicting index from cache", "id", id, "method", req.Request.Method, "path", req.Request.URL.Path)
+
+	// The index is gone already if the whole cache was cleared
+	existing, err := c.db.Get(cachememdb.IndexNameID, id)
+	if err != nil {
+		c.logger.Error("failed to look up index", "id", id, "error", err)
+		return
+	}
+	err = c.db.Evict(cachememdb.IndexNameID, id)
+	if err != nil {
+		c.logger.Error("failed to evict index", "id", id, "error", err)
+		return
+	}
+	if existing != nil {
+		c.addEntries(-1)
+		c.metricSink.IncrCounter(metricKeyCacheEvict, 1)
+	}
+	if retainStale {
+		c.storeStaleResponse(id, index.Response)
+	}
+	c.removePersistedIndex(id)
+	if c.lru != nil {
+		c.lru.Remove(id)
+	}
+}
+
+// startStaticExpiry evicts a static response from the cache once its TTL has
+// elapsed, or earlier if its context is canceled.
+func (c *LeaseCache) startStaticExpiry(ctx context.Context, index *cachememdb.Index, req *SendRequest) {
+	var retainStale bool
+	defer func() {
+		c.evictIndex(ctx, index, req, retainStale)
+	}()
+
+	timer := time.NewTimer(c.staticSecretTTL)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		c.logger.Debug("context cancelled; evicting static response", "path", req.Request.URL.Path)
+	case <-index.RenewCtxInfo.DoneCh:
+		c.logger.Debug("done channel closed")
+	case <-timer.C:
+		retainStale = true
+		c.logger.Debug("static response expired; evicting from cache", "path", req.Request.URL.Path)
+	}
+}
+
 func (c *LeaseCache) startRenewing(ctx context.Context, index *cachememdb.Index, req *SendRequest, secret *api.Secret) {
+	// retainStale is set when the lifetime watcher stops on its own, as
+	// opposed to the entry being revoked or cleared, in which case the evicted
+	// response may still be served if the upstream request fails.
+	var retainStale bool
 	defer func() {
-		id := ctx.Value(contextIndexID).(string)
-		c.logger.Debug("evicting index from cache", "id", id, "method", req.Request.Method, "path", req.Request.URL.Path)
-		err := c.db.Evict(cachememdb.IndexNameID, id)
-		if err != nil {
-			c.logger.Error("failed to evict index", "id", id, "error", err)
-			return
-		}
+		c.evictIndex(ctx, index, req, retainStale)
 	}()
 
 	client, err := c.client.Clone()
@@ -416,14 +899,17 @@ func (c *LeaseCache) startRenewing(ctx context.Context, index *cachememdb.Index,
 			return
 		case err := <-watcher.DoneCh():
 			// This case covers renewal completion and renewal errors
+			retainStale = true
 			if err != nil {
 				c.logger.Error("failed to renew secret", "error", err)
+				c.metricSink.IncrCounter(metricKeyCacheRenewalError, 1)
 				return
 			}
 			c.logger.Debug("renewal halted; evicting from cache", "path", req.Request.URL.Path)
 			return
-		case <-watcher.RenewCh():
+		case renewal := <-watcher.RenewCh():
 			c.logger.Debug("secret renewed", "path", req.Request.URL.Path)
+			c.updateExpiry(index, renewal)
 		case <-index.RenewCtxInfo.DoneCh:
 			// This case indicates the renewal process to shutdown and evict
 			// the cache entry. This is triggered when a specific secret
@@ -526,6 +1012,9 @@ func (c *LeaseCache) handleCacheClear(ctx context.Context, in *cacheClearInput)
 		if err != nil {
 			return err
 		}
+		if !in.Revoked {
+			c.revokeEvictedLeases(indexes...)
+		}
 		for _, index := range indexes {
 			index.RenewCtxInfo.CancelFunc()
 		}
@@ -546,6 +1035,9 @@ func (c *LeaseCache) handleCacheClear(ctx context.Context, in *cacheClearInput)
 
 		c.logger.Debug("canceling context of index attached to token")
 
+		if !in.Revoked {
+			c.revokeEvictedLeases(index)
+		}
 		index.RenewCtxInfo.CancelFunc()
 
 	case "token_accessor":
@@ -565,6 +1057,9 @@ func (c *LeaseCache) handleCacheClear(ctx context.Context, in *cacheClearInput)
 
 		c.logger.Debug("canceling context of index attached to accessor")
 
+		if !in.Revoked {
+			c.revokeEvictedLeases(index)
+		}
 		index.RenewCtxInfo.CancelFunc()
 
 	case "lease":
@@ -584,9 +1079,20 @@ func (c *LeaseCache) handleCacheClear(ctx context.Context, in *cacheClearInput)
 
 		c.logger.Debug("canceling context of index attached to accessor")
 
+		if !in.Revoked {
+			c.revokeEvictedLeases(index)
+		}
 		index.RenewCtxInfo.CancelFunc()
 
 	case "all":
+		if !in.Revoked {
+			indexes, err := c.db.GetByPrefix(cachememdb.IndexNameLease, "")
+			if err != nil {
+				return err
+			}
+			c.revokeEvictedLeases(indexes...)
+		}
+
 		// Cancel the base context which triggers all the goroutines to
 		// stop and evict entries from cache.
 		c.logger.Debug("canceling base context")
@@ -604,6 +1110,25 @@ func (c *LeaseCache) handleCacheClear(ctx context.Context, in *cacheClearInput)
 		if err := c.db.Flush(); err != nil {
 			return err
 		}
+		atomic.StoreInt64(&c.entries, 0)
+		c.metricSink.SetGauge(metricKeyCacheEntries, 0)
+
+		// Drop the stale responses as well, since they must not outlive an
+		// explicit clear of the cache
+		c.flushStaleResponses()
+
+		if c.lru != nil {
+			c.lru.Purge()
+		}
+
+		if c.storage != nil {
+			c.persistLock.Lock()
+			err := c.storage.Clear()
+			c.persistLock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
 
 	default:
 		return errInvalidType
@@ -614,6 +1139,80 @@ func (c *LeaseCache) handleCacheClear(ctx context.Context, in *cacheClearInput)
 	return nil
 }
 
+// revokeEvictedLeases revokes, if revoke on evict is enabled, the leases held
+// by the given indexes and by the indexes of the tokens they hold, all of
+// which are dropped along with them. The revocations are made in the
+// background so that they don't hold up the eviction, and failures are only
+// logged.
+func (c *LeaseCache) revokeEvictedLeases(indexes ...*cachememdb.Index) {
+	if !c.revokeOnEvict {
+		return
+	}
+
+	var leases []*cachememdb.Index
+	for _, index := range indexes {
+		leases = append(leases, c.collectLeases(index)...)
+	}
+	if len(leases) == 0 {
+		return
+	}
+
+	go func() {
+		for _, index := range leases {
+			client, err := c.client.Clone()
+			if err != nil {
+				c.logger.Error("failed to create API client to revoke evicted lease", "error", err)
+				return
+			}
+			client.SetToken(index.LeaseToken)
+			client.SetHeaders(index.RequestHeader)
+
+			if err := client.Sys().Revoke(index.Lease); err != nil {
+				c.logger.Warn("failed to revoke evicted lease", "lease_id", index.Lease, "error", err)
+				continue
+			}
+			c.logger.Debug("revoked evicted lease", "lease_id", index.Lease)
+		}
+	}()
+}
+
+// collectLeases returns the indexes of the leases that are evicted along with
+// the given index: the index itself if it holds a lease, or those of the
+// leases created by the token it holds and by that token's children.
+func (c *LeaseCache) collectLeases(index *cachememdb.Index) []*cachememdb.Index {
+	if index.Lease != "" {
+		return []*cachememdb.Index{index}
+	}
+	if index.Token == "" {
+		return nil
+	}
+
+	indexes, err := c.db.GetByPrefix(cachememdb.IndexNameLeaseToken, index.Token)
+	if err != nil {
+		c.logger.Error("failed to look up leases of evicted token", "error", err)
+		return nil
+	}
+
+	// Static responses are tied to the token as well, but have no lease
+	var leases []*cachememdb.Index
+	for _, lease := range indexes {
+		if lease.Lease != "" {
+			leases = append(leases, lease)
+		}
+	}
+
+	children, err := c.db.GetByPrefix(cachememdb.IndexNameTokenParent, index.Token)
+	if err != nil {
+		c.logger.Error("failed to look up children of evicted token", "error", err)
+		return leases
+	}
+	for _, child := range children {
+		leases = append(leases, c.collectLeases(child)...)
+	}
+
+	return leases
+}
+
 // handleRevocationRequest checks whether the originating request is a
 // revocation request, and if so perform applicable cache cleanups.
 // Returns true is this is a revocation request.
@@ -645,8 +1244,9 @@ func (c *LeaseCache) handleRevocationRequest(ctx context.Context, req *SendReque
 		// Clear the cache entry associated with the token and all the other
 		// entries belonging to the leases derived from this token.
 		in := &cacheClearInput{
-			Type:  "token",
-			Token: token,
+			Type:    "token",
+			Token:   token,
+			Revoked: true,
 		}
 		if err := c.handleCacheClear(ctx, in); err != nil {
 			return false, err
@@ -656,8 +1256,9 @@ func (c *LeaseCache) handleRevocationRequest(ctx context.Context, req *SendReque
 		// Clear the cache entry associated with the token and all the other
 		// entries belonging to the leases derived from this token.
 		in := &cacheClearInput{
-			Type:  "token",
-			Token: req.Token,
+			Type:    "token",
+			Token:   req.Token,
+			Revoked: true,
 		}
 		if err := c.handleCacheClear(ctx, in); err != nil {
 			return false, err
@@ -680,6 +1281,7 @@ func (c *LeaseCache) handleRevocationRequest(ctx context.Context, req *SendReque
 		in := &cacheClearInput{
 			Type:          "token_accessor",
 			TokenAccessor: accessor,
+			Revoked:       true,
 		}
 		if err := c.handleCacheClear(ctx, in); err != nil {
 			return false, err
@@ -754,8 +1356,9 @@ func (c *LeaseCache) handleRevocationRequest(ctx context.Context, req *SendReque
 			return false, fmt.Errorf("expected lease_id the request body to be string")
 		}
 		in := &cacheClearInput{
-			Type:  "lease",
-			Lease: leaseID,
+			Type:    "lease",
+			Lease:   leaseID,
+			Revoked: true,
 		}
 		if err := c.handleCacheClear(ctx, in); err != nil {
 			return false, err
@@ -915,9 +1518,286 @@ func (c *LeaseCache) RegisterAutoAuthToken(token string) error {
 		return err
 	}
 
+	if c.storage != nil {
+		if err := c.restoreOnce(); err != nil {
+			c.logger.Error("failed to restore the persisted cache", "error", err)
+			return err
+		}
+	}
+
 	return nil
 }
 
+// secretExpiry returns the time at which the secret expires if it isn't
+// renewed, or a zero time if it doesn't expire.
+func secretExpiry(secret *api.Secret, from time.Time) time.Time {
+	ttl := secret.LeaseDuration
+	if secret.Auth != nil {
+		ttl = secret.Auth.LeaseDuration
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return from.Add(time.Duration(ttl) * time.Second)
+}
+
+// persistIndex writes the index to the persistent storage, if one is
+// configured. Failures are logged, since the in-memory cache remains usable.
+func (c *LeaseCache) persistIndex(index *cachememdb.Index) {
+	if c.storage == nil {
+		return
+	}
+
+	c.persistLock.Lock()
+	defer c.persistLock.Unlock()
+
+	c.persistIndexLocked(index)
+}
+
+func (c *LeaseCache) persistIndexLocked(index *cachememdb.Index) {
+	// Only indexes holding a lease or token response are persisted; the
+	// auto-auth token's index is registered again on startup, and static
+	// responses are short lived.
+	if len(index.Response) == 0 || (index.Lease == "" && index.Token == "") {
+		return
+	}
+
+	indexBytes, err := index.Serialize()
+	if err != nil {
+		c.logger.Error("failed to serialize index", "id", index.ID, "error", err)
+		return
+	}
+	if err := c.storage.Set(index.ID, indexBytes); err != nil {
+		c.logger.Error("failed to persist index", "id", index.ID, "error", err)
+	}
+}
+
+// removePersistedIndex removes the index from the persistent storage, unless
+// the agent is shutting down, in which case it is retained to be restored on
+// the next start.
+func (c *LeaseCache) removePersistedIndex(id string) {
+	if c.storage == nil {
+		return
+	}
+
+	if c.shutdownCtx != nil && c.shutdownCtx.Err() != nil {
+		return
+	}
+
+	c.persistLock.Lock()
+	defer c.persistLock.Unlock()
+
+	if err := c.storage.Delete(id); err != nil {
+		c.logger.Error("failed to remove persisted index", "id", id, "error", err)
+	}
+}
+
+// updateExpiry records the new expiry of a renewed secret in the persistent
+// storage.
+func (c *LeaseCache) updateExpiry(index *cachememdb.Index, renewal *api.RenewOutput) {
+	if c.storage == nil || renewal == nil || renewal.Secret == nil {
+		return
+	}
+
+	c.persistLock.Lock()
+	defer c.persistLock.Unlock()
+
+	index.Expiry = secretExpiry(renewal.Secret, renewal.RenewedAt)
+	c.persistIndexLocked(index)
+}
+
+// restoreOnce restores the persisted indexes the first time an auto-auth
+// token is registered. Restoring waits for the token, since the persisted
+// tokens created with it are only restored if it's still managed by the agent.
+func (c *LeaseCache) restoreOnce() error {
+	c.persistLock.Lock()
+	defer c.persistLock.Unlock()
+
+	if c.restored {
+		return nil
+	}
+	c.restored = true
+	return c.restore()
+}
+
+// restoredIndex is a persisted index along with the secret parsed out of its
+// response and the token its renewal context should be derived from.
+type restoredIndex struct {
+	index       *cachememdb.Index
+	secret      *api.Secret
+	parentToken string
+}
+
+// restore loads the persisted indexes into the cache and resumes the renewal
+// of their secrets. Expired indexes, and those whose token is no longer
+// managed by the agent, are discarded.
+func (c *LeaseCache) restore() error {
+	values, err := c.storage.GetAll()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var tokens, leases []*restoredIndex
+	for _, value := range values {
+		index, err := cachememdb.Deserialize(value)
+		if err != nil {
+			c.logger.Error("failed to deserialize persisted index", "error", err)
+			continue
+		}
+
+		if !index.Expiry.IsZero() && now.After(index.Expiry) {
+			c.logger.Debug("discarding expired persisted index", "id", index.ID, "path", index.RequestPath)
+			c.discardPersistedIndex(index.ID)
+			continue
+		}
+
+		secret, err := parseCachedSecret(index.Response)
+		if err != nil || secret == nil {
+			c.logger.Error("failed to parse secret from persisted index", "id", index.ID, "error", err)
+			c.discardPersistedIndex(index.ID)
+			continue
+		}
+
+		switch {
+		case index.Lease != "":
+			leases = append(leases, &restoredIndex{
+				index:       index,
+				secret:      secret,
+				parentToken: index.LeaseToken,
+			})
+		case secret.Auth != nil:
+			ri := &restoredIndex{
+				index:  index,
+				secret: secret,
+			}
+			if !secret.Auth.Orphan {
+				ri.parentToken = index.RequestToken
+			}
+			tokens = append(tokens, ri)
+		default:
+			c.discardPersistedIndex(index.ID)
+		}
+	}
+
+	// Restore the tokens before the leases, and parent tokens before their
+	// children, so that each renewal context is derived from the context of
+	// the token it belongs to.
+	for len(tokens) > 0 {
+		pending := make(map[string]bool, len(tokens))
+		for _, ri := range tokens {
+			pending[ri.index.Token] = true
+		}
+
+		var deferred []*restoredIndex
+		for _, ri := range tokens {
+			if ri.parentToken != "" && pending[ri.parentToken] {
+				deferred = append(deferred, ri)
+				continue
+			}
+			c.restoreIndex(ri)
+			delete(pending, ri.index.Token)
+		}
+
+		// No progress can be made, so the remaining tokens can't be
+		// restored
+		if len(deferred) == len(tokens) {
+			for _, ri := range deferred {
+				c.discardPersistedIndex(ri.index.ID)
+			}
+			break
+		}
+		tokens = deferred
+	}
+
+	for _, ri := range leases {
+		c.restoreIndex(ri)
+	}
+
+	return nil
+}
+
+// restoreIndex stores a persisted index in the cache and starts renewing its
+// secret.
+func (c *LeaseCache) restoreIndex(ri *restoredIndex) {
+	index := ri.index
+
+	existing, err := c.db.Get(cachememdb.IndexNameID, index.ID)
+	if err != nil {
+		c.logger.Error("failed to look up index", "id", index.ID, "error", err)
+		return
+	}
+	if existing != nil {
+		return
+	}
+
+	var parentCtx context.Context
+	if ri.parentToken != "" {
+		entry, err := c.db.Get(cachememdb.IndexNameToken, ri.parentToken)
+		if err != nil {
+			c.logger.Error("failed to look up parent token of persisted index", "id", index.ID, "error", err)
+			return
+		}
+		// As when caching a response, the secret is only managed by the agent
+		// if the token it belongs to is
+		if entry == nil {
+			c.logger.Debug("discarding persisted index; token not managed by agent", "id", index.ID, "path", index.RequestPath)
+			c.discardPersistedIndex(index.ID)
+			return
+		}
+		parentCtx = entry.RenewCtxInfo.Ctx
+	}
+
+	renewCtxInfo := c.createCtxInfo(parentCtx)
+	renewCtx := context.WithValue(renewCtxInfo.Ctx, contextIndexID, index.ID)
+	index.RenewCtxInfo = &cachememdb.ContextInfo{
+		Ctx:        renewCtx,
+		CancelFunc: renewCtxInfo.CancelFunc,
+		DoneCh:     renewCtxInfo.DoneCh,
+	}
+
+	if err := c.db.Set(index); err != nil {
+		c.logger.Error("failed to restore persisted index", "id", index.ID, "error", err)
+		renewCtxInfo.CancelFunc()
+		return
+	}
+
+	c.logger.Debug("restored persisted index", "id", index.ID, "method", index.RequestMethod, "path", index.RequestPath)
+
+	c.addEntries(1)
+
+	c.addLRU(index)
+
+	req := &SendRequest{
+		Token: index.RequestToken,
+		Request: &http.Request{
+			Method: index.RequestMethod,
+			URL:    &url.URL{Path: index.RequestPath},
+			Header: index.RequestHeader,
+		},
+	}
+	go c.startRenewing(renewCtx, index, req, ri.secret)
+}
+
+// discardPersistedIndex removes an index that can't be restored from the
+// persistent storage. It is called with the persist lock held.
+func (c *LeaseCache) discardPersistedIndex(id string) {
+	if err := c.storage.Delete(id); err != nil {
+		c.logger.Error("failed to remove persisted index", "id", id, "error", err)
+	}
+}
+
+// parseCachedSecret parses the secret out of a serialized cached response.
+func parseCachedSecret(cachedResponse []byte) (*api.Secret, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(cachedResponse)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return api.ParseSecret(resp.Body)
+}
+
 type cacheClearInput struct {
 	Type string
 
@@ -926,6 +1806,11 @@ type cacheClearInput struct {
 	Token         string
 	TokenAccessor string
 	Lease         string
+
+	// Revoked is set if the matching entries have been revoked in Vault
+	// already, so that they aren't revoked again when revoke on evict is
+	// enabled.
+	Revoked bool
 }
 
 func parseCacheClearInput(req *cacheClearRequest) (*cacheClearInput, error) {
@@ -2,16 +2,27 @@ package cache
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/vault/command/agent/cache/cacheboltdb"
 	"github.com/hashicorp/vault/command/agent/cache/cachememdb"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/go-test/deep"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
@@ -168,6 +179,123 @@ func TestLeaseCache_SendCacheable(t *testing.T) {
 	}
 }
 
+// countingProxier counts the requests sent upstream and delays them, so that
+// concurrent requests overlap
+type countingProxier struct {
+	count    int32
+	delay    time.Duration
+	response string
+}
+
+func (p *countingProxier) Send(ctx context.Context, req *SendRequest) (*SendResponse, error) {
+	atomic.AddInt32(&p.count, 1)
+	time.Sleep(p.delay)
+	return newTestSendResponse(http.StatusOK, p.response), nil
+}
+
+func TestLeaseCache_SendConcurrent(t *testing.T) {
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxier := &countingProxier{
+		delay:    100 * time.Millisecond,
+		response: `{"lease_id": "foo", "renewable": true, "data": {"value": "foo"}}`,
+	}
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:      client,
+		BaseContext: context.Background(),
+		Proxier:     proxier,
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	const numRequests = 50
+	var wg sync.WaitGroup
+	errCh := make(chan error, numRequests)
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := lc.Send(context.Background(), &SendRequest{
+				Token:   "autoauthtoken",
+				Request: httptest.NewRequest("GET", "http://example.com/v1/sample/api", nil),
+			})
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if !strings.Contains(string(resp.ResponseBody), `"value": "foo"`) {
+				errCh <- fmt.Errorf("unexpected response: %s", resp.ResponseBody)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	// All requests share the response of a single upstream request
+	if count := atomic.LoadInt32(&proxier.count); count != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", count)
+	}
+}
+
+func TestLeaseCache_SendWrapped(t *testing.T) {
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxier := &countingProxier{
+		response: `{"wrap_info": {"token": "wrappingtoken", "accessor": "wrappingaccessor", "ttl": 300, "creation_path": "sample/api"}}`,
+	}
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:      client,
+		BaseContext: context.Background(),
+		Proxier:     proxier,
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/v1/sample/api", nil)
+		req.Header.Set("X-Vault-Wrap-TTL", "5m")
+		resp, err := lc.Send(context.Background(), &SendRequest{
+			Token:   "autoauthtoken",
+			Request: req,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secret, err := api.ParseSecret(resp.Response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret.WrapInfo == nil || secret.WrapInfo.Token != "wrappingtoken" || secret.WrapInfo.Accessor != "wrappingaccessor" {
+			t.Fatalf("expected the wrapping info to be returned unchanged, got: %#v", secret.WrapInfo)
+		}
+	}
+
+	// Wrapped responses are not cached, so both requests went upstream
+	if count := atomic.LoadInt32(&proxier.count); count != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", count)
+	}
+	if entries, err := lc.db.GetByPrefix(cachememdb.IndexNameRequestPath, "root/", "/v1/sample/api"); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no cached entries, got: %v (err: %v)", entries, err)
+	}
+}
+
 func TestLeaseCache_SendNonCacheable(t *testing.T) {
 	responses := []*SendResponse{
 		newTestSendResponse(http.StatusOK, `{"value": "output"}`),
@@ -289,6 +417,117 @@ func TestLeaseCache_SendNonCacheableNonTokenLease(t *testing.T) {
 	}
 }
 
+func TestLeaseCache_StaleIfError(t *testing.T) {
+	// Vault is unavailable, so the renewal of the cached lease fails and the
+	// entry gets evicted
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	config := api.DefaultConfig()
+	config.Address = ts.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := []*SendResponse{
+		newTestSendResponse(http.StatusOK, `{"lease_id": "foo", "renewable": true, "data": {"value": "foo"}}`),
+		newTestSendResponse(http.StatusServiceUnavailable, `{"errors": ["Vault is sealed"]}`),
+		newTestSendResponse(http.StatusServiceUnavailable, `{"errors": ["Vault is sealed"]}`),
+	}
+
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:       client,
+		BaseContext:  context.Background(),
+		Proxier:      newMockProxier(responses),
+		Logger:       logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+		StaleIfError: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	newReq := func() *SendRequest {
+		return &SendRequest{
+			Token:   "autoauthtoken",
+			Request: httptest.NewRequest("GET", "http://example.com/v1/sample/api", strings.NewReader(`{"value": "input"}`)),
+		}
+	}
+
+	resp, err := lc.Send(context.Background(), newReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response.StatusCode != http.StatusOK {
+		t.Fatalf("expected a fresh response, got status %d", resp.Response.StatusCode)
+	}
+
+	id, err := computeIndexID(newReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the entry to be evicted
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		index, err := lc.db.Get(cachememdb.IndexNameID, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the entry to be evicted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The upstream fails, so the stale response is served
+	resp, err = lc.Send(context.Background(), newReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response.StatusCode != http.StatusOK {
+		t.Fatalf("expected stale response, got status %d", resp.Response.StatusCode)
+	}
+	if !resp.CacheMeta.Hit || !resp.CacheMeta.Stale {
+		t.Fatalf("expected a stale cache hit, got: %#v", resp.CacheMeta)
+	}
+	if !strings.Contains(string(resp.ResponseBody), `"value": "foo"`) {
+		t.Fatalf("unexpected stale response body: %s", resp.ResponseBody)
+	}
+
+	rr := httptest.NewRecorder()
+	setHeaders(rr, resp)
+	if rr.Header().Get("Warning") != staleWarningHeaderValue {
+		t.Fatalf("expected stale warning header, got: %q", rr.Header().Get("Warning"))
+	}
+	if rr.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected cache hit header, got: %q", rr.Header().Get("X-Cache"))
+	}
+
+	// Once the stale response is older than the max staleness, the upstream
+	// failure is returned
+	lc.staleLock.Lock()
+	lc.staleResponses[id].evictedAt = time.Now().Add(-2 * time.Minute)
+	lc.staleLock.Unlock()
+
+	resp, err = lc.Send(context.Background(), newReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected upstream failure, got status %d", resp.Response.StatusCode)
+	}
+	if resp.CacheMeta != nil && resp.CacheMeta.Stale {
+		t.Fatal("expected response not to be stale")
+	}
+}
+
 func TestLeaseCache_HandleCacheClear(t *testing.T) {
 	lc := testNewLeaseCache(t, nil)
 
@@ -363,6 +602,828 @@ func TestLeaseCache_HandleCacheClear(t *testing.T) {
 	}
 }
 
+func TestLeaseCache_MaxEntries(t *testing.T) {
+	responses := []*SendResponse{
+		newTestSendResponse(http.StatusCreated, `{"auth": {"client_token": "token1", "renewable": true, "lease_duration": 600}}`),
+		newTestSendResponse(http.StatusCreated, `{"auth": {"client_token": "token2", "renewable": true, "lease_duration": 600}}`),
+		newTestSendResponse(http.StatusCreated, `{"auth": {"client_token": "token3", "renewable": true, "lease_duration": 600}}`),
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:      client,
+		BaseContext: context.Background(),
+		Proxier:     newMockProxier(responses),
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+		MaxEntries:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	send := func(path string) *SendResponse {
+		t.Helper()
+		resp, err := lc.Send(context.Background(), &SendRequest{
+			Token:   "autoauthtoken",
+			Request: httptest.NewRequest("GET", "http://example.com/v1/sample/"+path, strings.NewReader(`{"value": "input"}`)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	send("1")
+	send("2")
+
+	// Use the first entry so that the second one is the least recently used
+	if resp := send("1"); resp.CacheMeta == nil || !resp.CacheMeta.Hit {
+		t.Fatal("expected a cached response")
+	}
+
+	index2, err := lc.db.Get(cachememdb.IndexNameToken, "token2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index2 == nil {
+		t.Fatal("expected token2 to be cached")
+	}
+
+	// Inserting beyond the cap evicts the least recently used entry and
+	// stops its renewal
+	send("3")
+
+	select {
+	case <-index2.RenewCtxInfo.Ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected renewal of the evicted entry to be stopped")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		index, err := lc.db.Get(cachememdb.IndexNameToken, "token2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected token2 to be evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, token := range []string{"token1", "token3"} {
+		index, err := lc.db.Get(cachememdb.IndexNameToken, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index == nil {
+			t.Fatalf("expected %s to still be cached", token)
+		}
+	}
+	if lc.lru.Len() != 2 {
+		t.Fatalf("expected 2 tracked entries, got %d", lc.lru.Len())
+	}
+
+	// A negative limit is rejected
+	_, err = NewLeaseCache(&LeaseCacheConfig{
+		Client:      client,
+		BaseContext: context.Background(),
+		Proxier:     newMockProxier(nil),
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+		MaxEntries:  -1,
+	})
+	if err == nil {
+		t.Fatal("expected error for negative max entries")
+	}
+}
+
+func TestLeaseCache_Metrics(t *testing.T) {
+	responses := []*SendResponse{
+		newTestSendResponse(http.StatusCreated, `{"auth": {"client_token": "testtoken", "renewable": true, "lease_duration": 600}}`),
+		newTestSendResponse(http.StatusOK, `{"value": "output"}`),
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := metrics.NewInmemSink(10*time.Second, time.Minute)
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:      client,
+		BaseContext: context.Background(),
+		Proxier:     newMockProxier(responses),
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+		MetricSink:  sink,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	send := func(path string) {
+		t.Helper()
+		_, err := lc.Send(context.Background(), &SendRequest{
+			Token:   "autoauthtoken",
+			Request: httptest.NewRequest("GET", "http://example.com/v1/sample/"+path, strings.NewReader(`{"value": "input"}`)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first request is a miss and its response is cached, the second is
+	// served from the cache, and the third isn't cacheable
+	send("token")
+	send("token")
+	send("uncached")
+
+	data := sink.Data()
+	if len(data) == 0 {
+		t.Fatal("expected metrics to be recorded")
+	}
+	intv := data[len(data)-1]
+
+	if hit := intv.Counters["agent.cache.hit"]; hit.AggregateSample == nil || hit.Count != 1 {
+		t.Fatalf("expected 1 cache hit, got: %#v", hit)
+	}
+	if miss := intv.Counters["agent.cache.miss"]; miss.AggregateSample == nil || miss.Count != 2 {
+		t.Fatalf("expected 2 cache misses, got: %#v", miss)
+	}
+	if entries := intv.Gauges["agent.cache.entries"]; entries.Value != 1 {
+		t.Fatalf("expected 1 cache entry, got: %v", entries.Value)
+	}
+
+	// Clearing the cache evicts the entry
+	if err := lc.handleCacheClear(context.Background(), &cacheClearInput{Type: "all"}); err != nil {
+		t.Fatal(err)
+	}
+	intv = sink.Data()[len(sink.Data())-1]
+	if entries := intv.Gauges["agent.cache.entries"]; entries.Value != 0 {
+		t.Fatalf("expected no cache entries, got: %v", entries.Value)
+	}
+}
+
+func TestLeaseCache_RevokeOnEvict(t *testing.T) {
+	// Record the revocations made against the upstream
+	revoked := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/leases/revoke" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get(consts.AuthHeaderName) != "autoauthtoken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		revoked <- body["lease_id"].(string)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	testRevokeOnEvict := func(t *testing.T, revokeOnEvict bool, in *cacheClearInput) string {
+		t.Helper()
+
+		responses := []*SendResponse{
+			newTestSendResponse(http.StatusOK, `{"lease_id": "foo", "renewable": true, "lease_duration": 600, "data": {"value": "foo"}}`),
+		}
+
+		config := api.DefaultConfig()
+		config.Address = ts.URL
+		client, err := api.NewClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lc, err := NewLeaseCache(&LeaseCacheConfig{
+			Client:        client,
+			BaseContext:   context.Background(),
+			Proxier:       newMockProxier(responses),
+			Logger:        logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+			RevokeOnEvict: revokeOnEvict,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc.RegisterAutoAuthToken("autoauthtoken")
+
+		_, err = lc.Send(context.Background(), &SendRequest{
+			Token:   "autoauthtoken",
+			Request: httptest.NewRequest("GET", "http://example.com/v1/sample/api", strings.NewReader(`{"value": "input"}`)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := lc.handleCacheClear(context.Background(), in); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case lease := <-revoked:
+			return lease
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	for _, in := range []*cacheClearInput{
+		{Type: "lease", Lease: "foo"},
+		{Type: "token", Token: "autoauthtoken"},
+		{Type: "request_path", RequestPath: "/v1/sample/api"},
+		{Type: "all"},
+	} {
+		t.Run(in.Type, func(t *testing.T) {
+			if lease := testRevokeOnEvict(t, true, in); lease != "foo" {
+				t.Fatalf("expected lease foo to be revoked, got: %q", lease)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		if lease := testRevokeOnEvict(t, false, &cacheClearInput{Type: "lease", Lease: "foo"}); lease != "" {
+			t.Fatalf("expected no revocation, got: %q", lease)
+		}
+	})
+
+	// Leases revoked through the agent aren't revoked again
+	t.Run("revoked upstream", func(t *testing.T) {
+		if lease := testRevokeOnEvict(t, true, &cacheClearInput{Type: "lease", Lease: "foo", Revoked: true}); lease != "" {
+			t.Fatalf("expected no revocation, got: %q", lease)
+		}
+	})
+}
+
+func TestLeaseCache_StaticSecret(t *testing.T) {
+	kvResponse := func(value string, version int) *SendResponse {
+		return newTestSendResponse(http.StatusOK, fmt.Sprintf(`{"data": {"data": {"value": %q}, "metadata": {"version": %d, "created_time": "2020-01-01T00:00:00Z"}}}`, value, version))
+	}
+	responses := []*SendResponse{
+		kvResponse("first", 1),
+		newTestSendResponse(http.StatusOK, `{"data": {"version": 2, "created_time": "2020-01-01T00:00:01Z"}}`),
+		kvResponse("second", 2),
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:          client,
+		BaseContext:     context.Background(),
+		Proxier:         newMockProxier(responses),
+		Logger:          logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+		StaticSecretTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	urlPath := "http://example.com/v1/secret/data/foo"
+	read := func() *SendResponse {
+		t.Helper()
+		resp, err := lc.Send(context.Background(), &SendRequest{
+			Token:   "autoauthtoken",
+			Request: httptest.NewRequest("GET", urlPath, nil),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The second read is served from the cache
+	if resp := read(); resp.CacheMeta != nil && resp.CacheMeta.Hit {
+		t.Fatal("expected a proxied response")
+	}
+	resp := read()
+	if resp.CacheMeta == nil || !resp.CacheMeta.Hit {
+		t.Fatal("expected a cached response")
+	}
+	if !strings.Contains(string(resp.ResponseBody), "first") {
+		t.Fatalf("unexpected cached response: %s", resp.ResponseBody)
+	}
+
+	// A write to the same path invalidates the cached read
+	_, err = lc.Send(context.Background(), &SendRequest{
+		Token:       "autoauthtoken",
+		Request:     httptest.NewRequest("PUT", urlPath, strings.NewReader(`{"data": {"value": "second"}}`)),
+		RequestBody: []byte(`{"data": {"value": "second"}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		indexes, err := lc.db.GetByPrefix(cachememdb.IndexNameRequestPath, "root/", "/v1/secret/data/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(indexes) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected cached read to be invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp = read()
+	if resp.CacheMeta != nil && resp.CacheMeta.Hit {
+		t.Fatal("expected a fresh response")
+	}
+	if !strings.Contains(string(resp.ResponseBody), "second") {
+		t.Fatalf("unexpected response: %s", resp.ResponseBody)
+	}
+}
+
+func TestLeaseCache_StaticSecret_KVv2Endpoints(t *testing.T) {
+	for endpoint, method := range map[string]string{
+		"delete":   "POST",
+		"undelete": "POST",
+		"destroy":  "POST",
+		"metadata": "DELETE",
+	} {
+		t.Run(endpoint, func(t *testing.T) {
+			responses := []*SendResponse{
+				newTestSendResponse(http.StatusOK, `{"data": {"data": {"value": "foo"}, "metadata": {"version": 1, "created_time": "2020-01-01T00:00:00Z"}}}`),
+				newTestSendResponse(http.StatusNoContent, ""),
+			}
+
+			client, err := api.NewClient(api.DefaultConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			lc, err := NewLeaseCache(&LeaseCacheConfig{
+				Client:          client,
+				BaseContext:     context.Background(),
+				Proxier:         newMockProxier(responses),
+				Logger:          logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+				StaticSecretTTL: time.Minute,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lc.RegisterAutoAuthToken("autoauthtoken")
+
+			_, err = lc.Send(context.Background(), &SendRequest{
+				Token:   "autoauthtoken",
+				Request: httptest.NewRequest("GET", "http://example.com/v1/secret/data/foo", nil),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A write to another endpoint of the same secret invalidates the
+			// cached read of its data
+			body := `{"versions": [1]}`
+			_, err = lc.Send(context.Background(), &SendRequest{
+				Token:       "autoauthtoken",
+				Request:     httptest.NewRequest(method, "http://example.com/v1/secret/"+endpoint+"/foo", strings.NewReader(body)),
+				RequestBody: []byte(body),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				indexes, err := lc.db.GetByPrefix(cachememdb.IndexNameRequestPath, "root/", "/v1/secret/data/foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(indexes) == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("expected cached read to be invalidated")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestKVv2DataPaths(t *testing.T) {
+	for path, expected := range map[string][]string{
+		"/v1/secret/data/foo":          nil,
+		"/v1/secret/delete/foo":        {"/v1/secret/data/foo"},
+		"/v1/secret/undelete/foo/bar":  {"/v1/secret/data/foo/bar"},
+		"/v1/team/kv/destroy/foo":      {"/v1/team/kv/data/foo"},
+		"/v1/secret/metadata/foo":      {"/v1/secret/data/foo"},
+		"/v1/secret/metadata/":         nil,
+		"/v1/metadata/delete/metadata": {"/v1/data/delete/metadata", "/v1/metadata/data/metadata"},
+	} {
+		if actual := kvV2DataPaths(path); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%s: expected %v, got %v", path, expected, actual)
+		}
+	}
+}
+
+func TestLeaseCache_StaticSecret_Expiry(t *testing.T) {
+	responses := []*SendResponse{
+		newTestSendResponse(http.StatusOK, `{"data": {"data": {"value": "foo"}, "metadata": {"version": 1, "created_time": "2020-01-01T00:00:00Z"}}}`),
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:          client,
+		BaseContext:     context.Background(),
+		Proxier:         newMockProxier(responses),
+		Logger:          logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+		StaticSecretTTL: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	_, err = lc.Send(context.Background(), &SendRequest{
+		Token:   "autoauthtoken",
+		Request: httptest.NewRequest("GET", "http://example.com/v1/secret/data/foo", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, err := lc.db.GetByPrefix(cachememdb.IndexNameRequestPath, "root/", "/v1/secret/data/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 {
+		t.Fatalf("expected response to be cached, got %d entries", len(indexes))
+	}
+
+	// The entry is evicted once the TTL elapses
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		indexes, err := lc.db.GetByPrefix(cachememdb.IndexNameRequestPath, "root/", "/v1/secret/data/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(indexes) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected static response to expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaseCache_StaticSecret_Disabled(t *testing.T) {
+	responses := []*SendResponse{
+		newTestSendResponse(http.StatusOK, `{"data": {"data": {"value": "foo"}, "metadata": {"version": 1, "created_time": "2020-01-01T00:00:00Z"}}}`),
+	}
+	lc := testNewLeaseCache(t, responses)
+	lc.RegisterAutoAuthToken("autoauthtoken")
+
+	_, err := lc.Send(context.Background(), &SendRequest{
+		Token:   "autoauthtoken",
+		Request: httptest.NewRequest("GET", "http://example.com/v1/secret/data/foo", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, err := lc.db.GetByPrefix(cachememdb.IndexNameRequestPath, "root/", "/v1/secret/data/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 0 {
+		t.Fatalf("expected response not to be cached, got %d entries", len(indexes))
+	}
+}
+
+func testNewPersistentLeaseCache(t *testing.T, ctx context.Context, storage *cacheboltdb.BoltStorage, responses []*SendResponse) *LeaseCache {
+	t.Helper()
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc, err := NewLeaseCache(&LeaseCacheConfig{
+		Client:      client,
+		BaseContext: ctx,
+		Proxier:     newMockProxier(responses),
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("cache.leasecache"),
+		Storage:     storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lc
+}
+
+// testNewBoltStorage opens the persistent storage in the given directory,
+// wrapping its key with a key file kept in the same directory.
+func testNewBoltStorage(t *testing.T, path string) *cacheboltdb.BoltStorage {
+	t.Helper()
+
+	keyFile := filepath.Join(path, "cache.key")
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wrapper, err := cacheboltdb.NewKeyFileWrapper(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := cacheboltdb.NewBoltStorage(&cacheboltdb.BoltStorageConfig{
+		Path:    path,
+		Logger:  logging.NewVaultLogger(hclog.Trace).Named("cache.storage"),
+		Wrapper: wrapper,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage
+}
+
+func TestLeaseCache_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-cache-persistence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	responses := []*SendResponse{
+		newTestSendResponse(http.StatusCreated, `{"auth": {"client_token": "testtoken", "renewable": true, "lease_duration": 600}}`),
+		newTestSendResponse(http.StatusOK, `{"lease_id": "foo", "renewable": true, "lease_duration": 600, "data": {"value": "foo"}}`),
+	}
+
+	tokenURL := "http://example.com/v1/sample/token"
+	leaseURL := "http://example.com/v1/sample/lease"
+	newTokenReq := func() *SendRequest {
+		return &SendRequest{
+			Token:   "autoauthtoken",
+			Request: httptest.NewRequest("GET", tokenURL, strings.NewReader(`{"value": "input"}`)),
+		}
+	}
+	newLeaseReq := func() *SendRequest {
+		return &SendRequest{
+			Token:   "testtoken",
+			Request: httptest.NewRequest("GET", leaseURL, strings.NewReader(`{"value": "input"}`)),
+		}
+	}
+
+	// Populate the cache
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	storage := testNewBoltStorage(t, dir)
+	lc := testNewPersistentLeaseCache(t, ctx, storage, responses)
+	if err := lc.RegisterAutoAuthToken("autoauthtoken"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*SendRequest{newTokenReq(), newLeaseReq()} {
+		resp, err := lc.Send(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.CacheMeta != nil && resp.CacheMeta.Hit {
+			t.Fatal("expected a proxied response")
+		}
+	}
+
+	// Simulate a restart of the agent
+	cancelFunc()
+	time.Sleep(100 * time.Millisecond)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	defer cancelFunc()
+	storage = testNewBoltStorage(t, dir)
+
+	// No responses are available from the proxier, so the requests can only
+	// succeed if they are served from the restored cache
+	lc = testNewPersistentLeaseCache(t, ctx, storage, nil)
+	if err := lc.RegisterAutoAuthToken("autoauthtoken"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, req := range []*SendRequest{newTokenReq(), newLeaseReq()} {
+		resp, err := lc.Send(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.CacheMeta == nil || !resp.CacheMeta.Hit {
+			t.Fatal("expected a cached response")
+		}
+		if resp.Response.StatusCode != responses[i].Response.StatusCode {
+			t.Fatalf("expected status code %d, got %d", responses[i].Response.StatusCode, resp.Response.StatusCode)
+		}
+	}
+
+	// The lease's renewal context is derived from the restored token's
+	index, err := lc.db.Get(cachememdb.IndexNameLease, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index == nil {
+		t.Fatal("expected lease to be restored")
+	}
+	if err := lc.handleCacheClear(context.Background(), &cacheClearInput{Type: "token", Token: "testtoken"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-index.RenewCtxInfo.Ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected lease renewal to stop along with its token")
+	}
+
+	cancelFunc()
+	time.Sleep(100 * time.Millisecond)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseCache_Persistence_DifferentToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-cache-persistence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	responses := []*SendResponse{
+		newTestSendResponse(http.StatusCreated, `{"auth": {"client_token": "testtoken", "renewable": true, "orphan": true, "lease_duration": 600}}`),
+		newTestSendResponse(http.StatusCreated, `{"auth": {"client_token": "childtoken", "renewable": true, "lease_duration": 600}}`),
+		newTestSendResponse(http.StatusOK, `{"lease_id": "foo", "renewable": true, "lease_duration": 600, "data": {"value": "foo"}}`),
+	}
+	newReq := func(token, path string) *SendRequest {
+		return &SendRequest{
+			Token:   token,
+			Request: httptest.NewRequest("GET", "http://example.com/v1/sample/"+path, strings.NewReader(`{"value": "input"}`)),
+		}
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	storage := testNewBoltStorage(t, dir)
+	lc := testNewPersistentLeaseCache(t, ctx, storage, responses)
+	if err := lc.RegisterAutoAuthToken("autoauthtoken"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*SendRequest{newReq("autoauthtoken", "orphan"), newReq("autoauthtoken", "child"), newReq("testtoken", "lease")} {
+		if _, err := lc.Send(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancelFunc()
+	time.Sleep(100 * time.Millisecond)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After re-authenticating with another token, the entries that don't
+	// depend on the previous auto-auth token are restored
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	defer cancelFunc()
+	storage = testNewBoltStorage(t, dir)
+	defer storage.Close()
+
+	lc = testNewPersistentLeaseCache(t, ctx, storage, nil)
+	if err := lc.RegisterAutoAuthToken("otherautoauthtoken"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*SendRequest{newReq("autoauthtoken", "orphan"), newReq("testtoken", "lease")} {
+		resp, err := lc.Send(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.CacheMeta == nil || !resp.CacheMeta.Hit {
+			t.Fatalf("expected a cached response for %s", req.Request.URL.Path)
+		}
+	}
+
+	// The child of the previous auto-auth token is no longer managed by the
+	// agent, and is discarded
+	index, err := lc.db.Get(cachememdb.IndexNameToken, "childtoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != nil {
+		t.Fatal("expected the child token not to be restored")
+	}
+
+	values, err := storage.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected 2 persisted entries, got %d", len(values))
+	}
+}
+
+func TestLeaseCache_HandleCacheClear_FreshRead(t *testing.T) {
+	for _, clearType := range []string{"all", "token", "request_path", "lease"} {
+		t.Run(clearType, func(t *testing.T) {
+			responses := []*SendResponse{
+				newTestSendResponse(http.StatusOK, `{"lease_id": "foo", "renewable": true, "lease_duration": 600, "data": {"value": "first"}}`),
+				newTestSendResponse(http.StatusOK, `{"lease_id": "foo", "renewable": true, "lease_duration": 600, "data": {"value": "second"}}`),
+			}
+			lc := testNewLeaseCache(t, responses)
+			lc.RegisterAutoAuthToken("autoauthtoken")
+
+			ts := httptest.NewServer(lc.HandleCacheClear(context.Background()))
+			defer ts.Close()
+
+			read := func() *SendResponse {
+				t.Helper()
+				resp, err := lc.Send(context.Background(), &SendRequest{
+					Token:   "autoauthtoken",
+					Request: httptest.NewRequest("GET", "http://example.com/v1/sample/api", strings.NewReader(`{"value": "input"}`)),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp
+			}
+
+			// The second read is served from the cache
+			read()
+			if resp := read(); resp.CacheMeta == nil || !resp.CacheMeta.Hit {
+				t.Fatal("expected a cached response")
+			}
+
+			var value string
+			switch clearType {
+			case "token":
+				value = "autoauthtoken"
+			case "request_path":
+				value = "/v1/sample/api"
+			case "lease":
+				value = "foo"
+			}
+			reqBody := fmt.Sprintf(`{"type": "%s", "value": "%s"}`, clearType, value)
+			resp, err := http.Post(ts.URL, "application/json", strings.NewReader(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status code mismatch: expected = %v, got = %v", http.StatusOK, resp.StatusCode)
+			}
+
+			// Wait for the entry to be evicted by its renewal goroutine
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				index, err := lc.db.Get(cachememdb.IndexNameLease, "foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if index == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("expected cached entry to be cleared")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// The next read is forwarded rather than served from the cache
+			sendResp := read()
+			if sendResp.CacheMeta != nil && sendResp.CacheMeta.Hit {
+				t.Fatal("expected a fresh response")
+			}
+			if !strings.Contains(string(sendResp.ResponseBody), "second") {
+				t.Fatalf("expected the second upstream response, got: %s", sendResp.ResponseBody)
+			}
+		})
+	}
+}
+
 func TestCache_DeriveNamespaceAndRevocationPath(t *testing.T) {
 	tests := []struct {
 		name             string
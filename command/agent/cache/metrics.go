@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+
+	metrics "github.com/armon/go-metrics"
+	prommetrics "github.com/armon/go-metrics/prometheus"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	metricKeyCacheHit          = []string{"agent", "cache", "hit"}
+	metricKeyCacheMiss         = []string{"agent", "cache", "miss"}
+	metricKeyCacheEvict        = []string{"agent", "cache", "evict"}
+	metricKeyCacheEntries      = []string{"agent", "cache", "entries"}
+	metricKeyCacheRenewalError = []string{"agent", "cache", "renewal", "error"}
+	metricKeyProxyRequest      = []string{"agent", "proxy", "request"}
+	metricKeyProxyError        = []string{"agent", "proxy", "error"}
+)
+
+// NewPrometheusMetricSink creates a metric sink along with the registry
+// gathering its metrics, which can be served using MetricsHandler.
+func NewPrometheusMetricSink() (metrics.MetricSink, *prometheus.Registry, error) {
+	// A dedicated registry is used rather than the default one, so that only
+	// the agent's metrics are exposed
+	registry := prometheus.NewRegistry()
+	sink := &prommetrics.PrometheusSink{}
+	if err := registry.Register(sink); err != nil {
+		return nil, nil, err
+	}
+
+	return sink, registry, nil
+}
+
+// MetricsHandler returns a handler serving the gathered metrics in the
+// Prometheus text format.
+func MetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			logical.RespondError(w, http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		metricFamilies, err := gatherer.Gather()
+		if err != nil {
+			logical.RespondError(w, http.StatusInternalServerError, errwrap.Wrapf("failed to gather metrics: {{err}}", err))
+			return
+		}
+
+		buf := &bytes.Buffer{}
+		enc := expfmt.NewEncoder(buf, expfmt.FmtText)
+		for _, mf := range metricFamilies {
+			if err := enc.Encode(mf); err != nil {
+				logical.RespondError(w, http.StatusInternalServerError, errwrap.Wrapf("failed to encode metrics: {{err}}", err))
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	sink, registry, err := NewPrometheusMetricSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.IncrCounter(metricKeyCacheHit, 1)
+	sink.SetGauge(metricKeyCacheEntries, 3)
+
+	handler := MetricsHandler(registry)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/agent/v1/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+
+	body, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"agent_cache_hit 1", "agent_cache_entries 3"} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("expected %q in response, got:\n%s", expected, body)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "http://example.com/agent/v1/metrics", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", rr.Code)
+	}
+}
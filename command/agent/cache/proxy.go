@@ -31,11 +31,12 @@ type SendResponse struct {
 }
 
 // CacheMeta contains metadata information about the response,
-// such as whether it was a cache hit or miss, and the age of the
-// cached entry.
+// such as whether it was a cache hit or miss, the age of the
+// cached entry, and whether the entry was served stale.
 type CacheMeta struct {
-	Hit bool
-	Age time.Duration
+	Hit   bool
+	Age   time.Duration
+	Stale bool
 }
 
 // Proxier is the interface implemented by different components that are
@@ -20,11 +20,14 @@ import (
 	"github.com/hashicorp/vault/command/agent/sink"
 	"github.com/hashicorp/vault/command/agent/sink/file"
 	"github.com/hashicorp/vault/command/agent/sink/inmem"
+	"github.com/hashicorp/vault/helper/testhelpers/teststorage"
 	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/physical/raft"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/vault"
+	testinginterface "github.com/mitchellh/go-testing-interface"
 )
 
 const policyAutoAuthAppRole = `
@@ -38,6 +41,44 @@ path "/auth/token/create" {
 `
 
 func TestCache_UsingAutoAuthToken(t *testing.T) {
+	testhelperAutoAuth(t, nil)
+}
+
+// TestCache_UsingAutoAuthToken_Raft runs the same flow against a cluster using
+// raft storage, where every write has to be applied through the raft log
+// before it is visible
+func TestCache_UsingAutoAuthToken_Raft(t *testing.T) {
+	testhelperAutoAuth(t, raftDevBackendSetup)
+}
+
+// raftDevBackendSetup sets up a raft cluster like teststorage.RaftBackendSetup,
+// but with each node's raft log kept in memory using dev mode
+func raftDevBackendSetup(conf *vault.CoreConfig, opts *vault.TestClusterOptions) {
+	teststorage.RaftBackendSetup(conf, opts)
+	opts.PhysicalFactory = func(t testinginterface.T, coreIdx int, logger hclog.Logger) *vault.PhysicalBackendBundle {
+		backend, err := raft.NewRaftBackend(map[string]string{
+			"dev_mode":               "true",
+			"node_id":                fmt.Sprintf("core-%d", coreIdx),
+			"performance_multiplier": "8",
+		}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &vault.PhysicalBackendBundle{
+			Backend: backend,
+			Cleanup: func() {
+				// Removes the temporary dev mode directory
+				backend.(*raft.RaftBackend).Close()
+			},
+		}
+	}
+}
+
+// testhelperAutoAuth exercises auto-auth and the lease cache against a test
+// cluster. If setup is non-nil it is used to configure the cluster's physical
+// backend.
+func testhelperAutoAuth(t *testing.T, setup teststorage.ClusterSetupMutator) {
 	var err error
 	logger := logging.NewVaultLogger(log.Trace)
 	coreConfig := &vault.CoreConfig{
@@ -52,9 +93,14 @@ func TestCache_UsingAutoAuthToken(t *testing.T) {
 		},
 	}
 
-	cluster := vault.NewTestCluster(t, coreConfig, &vault.TestClusterOptions{
+	opts := &vault.TestClusterOptions{
 		HandlerFunc: vaulthttp.Handler,
-	})
+	}
+	if setup != nil {
+		setup(coreConfig, opts)
+	}
+
+	cluster := vault.NewTestCluster(t, coreConfig, opts)
 
 	cluster.Start()
 	defer cluster.Cleanup()
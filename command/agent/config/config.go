@@ -44,9 +44,17 @@ type Vault struct {
 
 // Cache contains any configuration needed for Cache mode
 type Cache struct {
-	UseAutoAuthTokenRaw interface{} `hcl:"use_auto_auth_token"`
-	UseAutoAuthToken    bool        `hcl:"-"`
-	ForceAutoAuthToken  bool        `hcl:"-"`
+	UseAutoAuthTokenRaw interface{}   `hcl:"use_auto_auth_token"`
+	UseAutoAuthToken    bool          `hcl:"-"`
+	ForceAutoAuthToken  bool          `hcl:"-"`
+	StaleIfErrorRaw     interface{}   `hcl:"stale_if_error"`
+	StaleIfError        time.Duration `hcl:"-"`
+	PersistPath         string        `hcl:"persist_path"`
+	PersistKeyFile      string        `hcl:"persist_key_file"`
+	MaxEntries          int           `hcl:"max_entries"`
+	StaticSecretTTLRaw  interface{}   `hcl:"static_secret_ttl"`
+	StaticSecretTTL     time.Duration `hcl:"-"`
+	RevokeOnEvict       bool          `hcl:"revoke_on_evict"`
 }
 
 // AutoAuth is the configured authentication method and sinks
@@ -54,6 +62,14 @@ type AutoAuth struct {
 	Method *Method `hcl:"-"`
 	Sinks  []*Sink `hcl:"sinks"`
 
+	// ValidateToken causes tokens to be looked up before they are written to
+	// the sinks, re-authenticating if the lookup fails.
+	ValidateToken bool `hcl:"validate_token"`
+
+	// RevokeOnShutdown causes the token to be revoked when the agent shuts
+	// down.
+	RevokeOnShutdown bool `hcl:"revoke_on_shutdown"`
+
 	// NOTE: This is unsupported outside of testing and may disappear at any
 	// time.
 	EnableReauthOnNewCredentials bool `hcl:"enable_reauth_on_new_credentials"`
@@ -61,12 +77,16 @@ type AutoAuth struct {
 
 // Method represents the configuration for the authentication backend
 type Method struct {
-	Type       string
-	MountPath  string        `hcl:"mount_path"`
-	WrapTTLRaw interface{}   `hcl:"wrap_ttl"`
-	WrapTTL    time.Duration `hcl:"-"`
-	Namespace  string        `hcl:"namespace"`
-	Config     map[string]interface{}
+	Type          string
+	MountPath     string        `hcl:"mount_path"`
+	WrapTTLRaw    interface{}   `hcl:"wrap_ttl"`
+	WrapTTL       time.Duration `hcl:"-"`
+	MinBackoffRaw interface{}   `hcl:"min_backoff"`
+	MinBackoff    time.Duration `hcl:"-"`
+	MaxBackoffRaw interface{}   `hcl:"max_backoff"`
+	MaxBackoff    time.Duration `hcl:"-"`
+	Namespace     string        `hcl:"namespace"`
+	Config        map[string]interface{}
 }
 
 // Sink defines a location to write the authenticated token
@@ -154,6 +174,13 @@ func LoadConfig(path string) (*Config, error) {
 				return nil, fmt.Errorf("cache.use_auto_auth_token is true and auto_auth uses wrapping")
 			}
 		}
+
+		if result.Cache.PersistPath != "" && !result.Cache.UseAutoAuthToken {
+			return nil, fmt.Errorf("cache.persist_path requires cache.use_auto_auth_token to be set")
+		}
+		if result.Cache.PersistPath != "" && result.Cache.PersistKeyFile == "" {
+			return nil, fmt.Errorf("cache.persist_path requires cache.persist_key_file to be set")
+		}
 	}
 
 	if result.AutoAuth != nil {
@@ -162,6 +189,24 @@ func LoadConfig(path string) (*Config, error) {
 			len(result.Templates) == 0 {
 			return nil, fmt.Errorf("auto_auth requires at least one sink or at least one template or cache.use_auto_auth_token=true")
 		}
+
+		if result.AutoAuth.ValidateToken {
+			if result.AutoAuth.Method.WrapTTL > 0 {
+				return nil, fmt.Errorf("auto_auth.validate_token is true and auto_auth uses wrapping")
+			}
+			if result.ExitAfterAuth {
+				return nil, fmt.Errorf("auto_auth.validate_token can't be used with exit_after_auth")
+			}
+		}
+
+		if result.AutoAuth.RevokeOnShutdown {
+			if result.AutoAuth.Method.WrapTTL > 0 {
+				return nil, fmt.Errorf("auto_auth.revoke_on_shutdown is true and auto_auth uses wrapping")
+			}
+			if result.ExitAfterAuth {
+				return nil, fmt.Errorf("auto_auth.revoke_on_shutdown can't be used with exit_after_auth")
+			}
+		}
 	}
 
 	err = parseVault(result, list)
@@ -244,6 +289,20 @@ func parseCache(result *Config, list *ast.ObjectList) error {
 		}
 	}
 
+	if c.StaleIfErrorRaw != nil {
+		if c.StaleIfError, err = parseutil.ParseDurationSecond(c.StaleIfErrorRaw); err != nil {
+			return err
+		}
+		c.StaleIfErrorRaw = nil
+	}
+
+	if c.StaticSecretTTLRaw != nil {
+		if c.StaticSecretTTL, err = parseutil.ParseDurationSecond(c.StaticSecretTTLRaw); err != nil {
+			return err
+		}
+		c.StaticSecretTTLRaw = nil
+	}
+
 	result.Cache = &c
 	return nil
 }
@@ -339,6 +398,26 @@ func parseMethod(result *Config, list *ast.ObjectList) error {
 		m.WrapTTLRaw = nil
 	}
 
+	if m.MinBackoffRaw != nil {
+		var err error
+		if m.MinBackoff, err = parseutil.ParseDurationSecond(m.MinBackoffRaw); err != nil {
+			return err
+		}
+		m.MinBackoffRaw = nil
+	}
+
+	if m.MaxBackoffRaw != nil {
+		var err error
+		if m.MaxBackoff, err = parseutil.ParseDurationSecond(m.MaxBackoffRaw); err != nil {
+			return err
+		}
+		m.MaxBackoffRaw = nil
+	}
+
+	if m.MinBackoff > 0 && m.MaxBackoff > 0 && m.MinBackoff > m.MaxBackoff {
+		return errors.New("min_backoff cannot be greater than max_backoff")
+	}
+
 	// Canonicalize namespace path if provided
 	m.Namespace = namespace.Canonicalize(m.Namespace)
 
@@ -66,6 +66,11 @@ func TestLoadConfigFile_AgentCache(t *testing.T) {
 			UseAutoAuthToken:    true,
 			UseAutoAuthTokenRaw: true,
 			ForceAutoAuthToken:  false,
+			StaleIfError:        5 * time.Minute,
+			PersistPath:         "/tmp/agent-cache",
+			PersistKeyFile:      "/tmp/agent-cache.key",
+			StaticSecretTTL:     time.Minute,
+			RevokeOnEvict:       true,
 		},
 		Vault: &Vault{
 			Address:          "http://127.0.0.1:1111",
@@ -201,6 +206,49 @@ func TestLoadConfigFile_Method_Wrapping(t *testing.T) {
 	}
 }
 
+func TestLoadConfigFile_Method_Backoff(t *testing.T) {
+	config, err := LoadConfig("./test-fixtures/config-method-backoff.hcl")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := &Config{
+		SharedConfig: &configutil.SharedConfig{
+			PidFile: "./pidfile",
+		},
+		AutoAuth: &AutoAuth{
+			Method: &Method{
+				Type:       "aws",
+				MountPath:  "auth/aws",
+				MinBackoff: 5 * time.Second,
+				MaxBackoff: 2 * time.Minute,
+				Config: map[string]interface{}{
+					"role": "foobar",
+				},
+			},
+			Sinks: []*Sink{
+				{
+					Type: "file",
+					Config: map[string]interface{}{
+						"path": "/tmp/file-foo",
+					},
+				},
+			},
+		},
+	}
+
+	if diff := deep.Equal(config, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestLoadConfigFile_Bad_Method_Backoff(t *testing.T) {
+	_, err := LoadConfig("./test-fixtures/bad-config-method-backoff.hcl")
+	if err == nil {
+		t.Fatal("LoadConfig should return an error when min_backoff is greater than max_backoff")
+	}
+}
+
 func TestLoadConfigFile_AgentCache_NoAutoAuth(t *testing.T) {
 	config, err := LoadConfig("./test-fixtures/config-cache-no-auto_auth.hcl")
 	if err != nil {
@@ -234,6 +282,20 @@ func TestLoadConfigFile_Bad_AgentCache_InconsisentAutoAuth(t *testing.T) {
 	}
 }
 
+func TestLoadConfigFile_Bad_AgentCache_PersistNoAutoAuthToken(t *testing.T) {
+	_, err := LoadConfig("./test-fixtures/bad-config-cache-persist-no-auto_auth-token.hcl")
+	if err == nil {
+		t.Fatal("LoadConfig should return an error when persist_path is set without use_auto_auth_token")
+	}
+}
+
+func TestLoadConfigFile_Bad_AgentCache_PersistNoKeyFile(t *testing.T) {
+	_, err := LoadConfig("./test-fixtures/bad-config-cache-persist-no-key-file.hcl")
+	if err == nil {
+		t.Fatal("LoadConfig should return an error when persist_path is set without persist_key_file")
+	}
+}
+
 func TestLoadConfigFile_Bad_AgentCache_ForceAutoAuthNoMethod(t *testing.T) {
 	_, err := LoadConfig("./test-fixtures/bad-config-cache-inconsistent-auto_auth.hcl")
 	if err == nil {
@@ -276,6 +338,13 @@ func TestLoadConfigFile_Bad_AgentCache_AutoAuth_Method_wrapping(t *testing.T) {
 	}
 }
 
+func TestLoadConfigFile_Bad_AutoAuth_Validate_Method_wrapping(t *testing.T) {
+	_, err := LoadConfig("./test-fixtures/bad-config-auto_auth-validate-method-wrapping.hcl")
+	if err == nil {
+		t.Fatal("LoadConfig should return an error when auth_auth.method.wrap_ttl nonzero and auto_auth.validate_token=true")
+	}
+}
+
 func TestLoadConfigFile_AgentCache_AutoAuth_NoSink(t *testing.T) {
 	config, err := LoadConfig("./test-fixtures/config-cache-auto_auth-no-sink.hcl")
 	if err != nil {
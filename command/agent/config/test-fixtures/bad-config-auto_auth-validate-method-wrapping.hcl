@@ -0,0 +1,20 @@
+pid_file = "./pidfile"
+
+auto_auth {
+	validate_token = true
+
+	method {
+		type = "aws"
+		wrap_ttl = 300
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink {
+		type = "file"
+		config = {
+			path = "/tmp/file-foo"
+		}
+	}
+}
@@ -0,0 +1,19 @@
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "aws"
+		min_backoff = "10m"
+		max_backoff = "1m"
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink {
+		type = "file"
+		config = {
+			path = "/tmp/file-foo"
+		}
+	}
+}
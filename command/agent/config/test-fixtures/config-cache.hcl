@@ -21,6 +21,11 @@ auto_auth {
 
 cache {
 	use_auto_auth_token = true
+	stale_if_error = "5m"
+	persist_path = "/tmp/agent-cache"
+	persist_key_file = "/tmp/agent-cache.key"
+	static_secret_ttl = "1m"
+	revoke_on_evict = true
 }
 
 listener "unix" {
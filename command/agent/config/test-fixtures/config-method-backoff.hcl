@@ -0,0 +1,19 @@
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "aws"
+		min_backoff = "5s"
+		max_backoff = 120
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink {
+		type = "file"
+		config = {
+			path = "/tmp/file-foo"
+		}
+	}
+}
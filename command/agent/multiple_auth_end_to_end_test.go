@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	credAppRole "github.com/hashicorp/vault/builtin/credential/approle"
+	"github.com/hashicorp/vault/command/agent/auth"
+	agentapprole "github.com/hashicorp/vault/command/agent/auth/approle"
+	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/command/agent/sink/file"
+	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/vault"
+)
+
+// TestMultipleAuthHandlersEndToEnd runs two auth handlers for different
+// approle roles concurrently, sharing a client, each writing to its own sink.
+func TestMultipleAuthHandlersEndToEnd(t *testing.T) {
+	logger := logging.NewVaultLogger(log.Trace)
+	coreConfig := &vault.CoreConfig{
+		DisableMlock: true,
+		DisableCache: true,
+		Logger:       log.NewNullLogger(),
+		CredentialBackends: map[string]logical.Factory{
+			"approle": credAppRole.Factory,
+		},
+	}
+
+	cluster := vault.NewTestCluster(t, coreConfig, &vault.TestClusterOptions{
+		HandlerFunc: vaulthttp.Handler,
+	})
+
+	cluster.Start()
+	defer cluster.Cleanup()
+
+	vault.TestWaitActive(t, cluster.Cores[0].Core)
+
+	client := cluster.Cores[0].Client
+
+	err := client.Sys().EnableAuthWithOptions("approle", &api.EnableAuthOptions{
+		Type: "approle",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "vault-agent-multiple-auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The agent's client is shared by both handlers and never has its token
+	// set by the test
+	agentClient, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	timer := time.AfterFunc(30*time.Second, func() {
+		cancelFunc()
+	})
+	defer timer.Stop()
+
+	roles := []string{"role1", "role2"}
+	sinkPaths := make(map[string]string, len(roles))
+	for _, role := range roles {
+		_, err := client.Logical().Write("auth/approle/role/"+role, map[string]interface{}{
+			"token_ttl":     "6s",
+			"token_max_ttl": "30s",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Logical().Read(fmt.Sprintf("auth/approle/role/%s/role-id", role))
+		if err != nil {
+			t.Fatal(err)
+		}
+		roleIDPath := filepath.Join(tmpDir, role+".role-id")
+		if err := ioutil.WriteFile(roleIDPath, []byte(resp.Data["role_id"].(string)), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err = client.Logical().Write(fmt.Sprintf("auth/approle/role/%s/secret-id", role), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secretIDPath := filepath.Join(tmpDir, role+".secret-id")
+		if err := ioutil.WriteFile(secretIDPath, []byte(resp.Data["secret_id"].(string)), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		am, err := agentapprole.NewApproleAuthMethod(&auth.AuthConfig{
+			Logger:    logger.Named("auth.approle." + role),
+			MountPath: "auth/approle",
+			Config: map[string]interface{}{
+				"role_id_file_path":                   roleIDPath,
+				"secret_id_file_path":                 secretIDPath,
+				"remove_secret_id_file_after_reading": false,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ah := auth.NewAuthHandler(&auth.AuthHandlerConfig{
+			Logger: logger.Named("auth.handler." + role),
+			Client: agentClient,
+		})
+		go ah.Run(ctx, am)
+		defer func() {
+			<-ah.DoneCh
+		}()
+
+		sinkPaths[role] = filepath.Join(tmpDir, role+".token")
+		config := &sink.SinkConfig{
+			Logger: logger.Named("sink.file." + role),
+			Config: map[string]interface{}{
+				"path": sinkPaths[role],
+			},
+		}
+		fs, err := file.NewFileSink(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Sink = fs
+
+		ss := sink.NewSinkServer(&sink.SinkServerConfig{
+			Logger: logger.Named("sink.server." + role),
+			Client: agentClient,
+		})
+		go ss.Run(ctx, ah.OutputCh, []*sink.SinkConfig{config})
+		defer func() {
+			<-ss.DoneCh
+		}()
+	}
+
+	// This has to be after the other defers so it happens first
+	defer cancelFunc()
+
+	readToken := func(path string) string {
+		timeout := time.Now().Add(10 * time.Second)
+		for {
+			if time.Now().After(timeout) {
+				t.Fatalf("did not find a written token at %s after timeout", path)
+			}
+			val, err := ioutil.ReadFile(path)
+			if err == nil && len(val) > 0 {
+				return string(val)
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+
+	tokens := make(map[string]string, len(roles))
+	for _, role := range roles {
+		token := readToken(sinkPaths[role])
+
+		lookupClient, err := client.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lookupClient.SetToken(token)
+		secret, err := lookupClient.Auth().Token().LookupSelf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := secret.TokenMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta["role_name"] != role {
+			t.Fatalf("expected token for %s in its sink, got metadata: %v", role, meta)
+		}
+		tokens[role] = token
+	}
+	if tokens["role1"] == tokens["role2"] {
+		t.Fatal("expected distinct tokens for each role")
+	}
+
+	// Wait past the initial TTL; both tokens must have been renewed
+	// independently to still be valid
+	time.Sleep(8 * time.Second)
+	for _, role := range roles {
+		lookupClient, err := client.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lookupClient.SetToken(tokens[role])
+		if _, err := lookupClient.Auth().Token().LookupSelf(); err != nil {
+			t.Fatalf("expected token for %s to have been renewed: %v", role, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// +build !windows
+
+package fifo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+)
+
+const (
+	// defaultTimeout is how long a write waits for a reader to open the FIFO
+	defaultTimeout = 30 * time.Second
+
+	// openRetryInterval is how often opening the FIFO is retried while
+	// waiting for a reader
+	openRetryInterval = 50 * time.Millisecond
+)
+
+// fifoSink is a Sink implementation that writes a token to a named pipe so
+// that it is read exactly once and never persisted to disk
+type fifoSink struct {
+	path    string
+	mode    os.FileMode
+	timeout time.Duration
+	logger  hclog.Logger
+}
+
+// NewFIFOSink creates a new FIFO sink with the given configuration, creating
+// the FIFO if it does not exist
+func NewFIFOSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+
+	conf.Logger.Info("creating fifo sink")
+
+	f := &fifoSink{
+		logger:  conf.Logger,
+		mode:    0640,
+		timeout: defaultTimeout,
+	}
+
+	pathRaw, ok := conf.Config["path"]
+	if !ok {
+		return nil, errors.New("'path' not specified for fifo sink")
+	}
+	f.path, ok = pathRaw.(string)
+	if !ok {
+		return nil, errors.New("could not parse 'path' as string")
+	}
+
+	if modeRaw, ok := conf.Config["mode"]; ok {
+		mode, typeOK := modeRaw.(int)
+		if !typeOK {
+			return nil, errors.New("could not parse 'mode' as integer")
+		}
+		if os.FileMode(mode)&^os.ModePerm != 0 {
+			return nil, errors.New("'mode' must only contain permission bits")
+		}
+		f.mode = os.FileMode(mode)
+	}
+
+	if timeoutRaw, ok := conf.Config["timeout"]; ok {
+		timeout, err := parseutil.ParseDurationSecond(timeoutRaw)
+		if err != nil {
+			return nil, errwrap.Wrapf("could not parse 'timeout': {{err}}", err)
+		}
+		if timeout <= 0 {
+			return nil, errors.New("'timeout' must be greater than zero")
+		}
+		f.timeout = timeout
+	}
+
+	if err := f.ensureFIFO(); err != nil {
+		return nil, err
+	}
+
+	f.logger.Info("fifo sink configured", "path", f.path, "mode", f.mode, "timeout", f.timeout)
+
+	return f, nil
+}
+
+// ensureFIFO creates the FIFO at the configured path if it does not exist,
+// and verifies that an existing file is a FIFO.
+func (f *fifoSink) ensureFIFO() error {
+	fi, err := os.Lstat(f.path)
+	switch {
+	case err == nil:
+		if fi.Mode()&os.ModeNamedPipe == 0 {
+			return fmt.Errorf("%s exists and is not a fifo", f.path)
+		}
+		return nil
+	case !os.IsNotExist(err):
+		return errwrap.Wrapf(fmt.Sprintf("error stat-ing %s: {{err}}", f.path), err)
+	}
+
+	if err := syscall.Mkfifo(f.path, uint32(f.mode)); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("error creating fifo %s: {{err}}", f.path), err)
+	}
+
+	// Set the mode explicitly since the one given to mkfifo is subject to
+	// the umask
+	if err := os.Chmod(f.path, f.mode); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("error setting mode on %s: {{err}}", f.path), err)
+	}
+
+	return nil
+}
+
+// WriteToken implements the Server interface and writes the token to the
+// FIFO. It waits up to the configured timeout for a reader to open the other
+// end, and opens the FIFO anew for every token so readers can come and go.
+func (f *fifoSink) WriteToken(token string) error {
+	f.logger.Trace("enter write_token", "path", f.path)
+	defer f.logger.Trace("exit write_token", "path", f.path)
+
+	// Recreate the FIFO if it was removed since the sink was created
+	if err := f.ensureFIFO(); err != nil {
+		return err
+	}
+
+	// Opening a FIFO for writing in non-blocking mode fails with ENXIO while
+	// there is no reader, which allows bounding the wait
+	deadline := time.Now().Add(f.timeout)
+	var file *os.File
+	for {
+		var err error
+		file, err = os.OpenFile(f.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			break
+		}
+		if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.ENXIO {
+			return errwrap.Wrapf(fmt.Sprintf("error opening fifo %s for writing: {{err}}", f.path), err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for a reader on fifo %s", f.timeout, f.path)
+		}
+		time.Sleep(openRetryInterval)
+	}
+
+	_, err := file.WriteString(token)
+	if err != nil {
+		file.Close()
+		return errwrap.Wrapf(fmt.Sprintf("error writing to fifo %s: {{err}}", f.path), err)
+	}
+
+	if err := file.Close(); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("error closing fifo %s: {{err}}", f.path), err)
+	}
+
+	f.logger.Info("token written", "path", f.path)
+	return nil
+}
@@ -0,0 +1,123 @@
+// +build !windows
+
+package fifo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func testFIFOSink(t *testing.T) (sink.Sink, string, string) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	tmpDir, err := ioutil.TempDir("", "vault-agent-fifo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmpDir, "token")
+	s, err := NewFIFOSink(&sink.SinkConfig{
+		Logger: log.Named("sink.fifo"),
+		Config: map[string]interface{}{
+			"path":    path,
+			"mode":    0600,
+			"timeout": "1s",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, path, tmpDir
+}
+
+func readFIFO(path string) <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		tokenBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			ch <- err.Error()
+			return
+		}
+		ch <- string(tokenBytes)
+	}()
+	return ch
+}
+
+func TestFIFOSink(t *testing.T) {
+	s, path, tmpDir := testFIFOSink(t)
+	defer os.RemoveAll(tmpDir)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("expected %s to be a fifo", path)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("wrong file mode was detected at %s: %s", path, fi.Mode())
+	}
+
+	// Write twice so the FIFO is reopened after the first reader is done
+	for i := 0; i < 2; i++ {
+		uuidStr, _ := uuid.GenerateUUID()
+		readCh := readFIFO(path)
+		if err := s.WriteToken(uuidStr); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case token := <-readCh:
+			if token != uuidStr {
+				t.Fatalf("expected %s, got %s", uuidStr, token)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out reading token")
+		}
+	}
+}
+
+func TestFIFOSink_NoReader(t *testing.T) {
+	s, _, tmpDir := testFIFOSink(t)
+	defer os.RemoveAll(tmpDir)
+
+	start := time.Now()
+	if err := s.WriteToken("foobar"); err == nil {
+		t.Fatal("expected error writing without a reader")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("write did not time out in time")
+	}
+}
+
+func TestFIFOSink_NotFIFO(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "vault-agent-fifo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "token")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFIFOSink(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		Config: map[string]interface{}{
+			"path": path,
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error for a regular file")
+	}
+}
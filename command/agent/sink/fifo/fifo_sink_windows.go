@@ -0,0 +1,13 @@
+package fifo
+
+import (
+	"errors"
+
+	"github.com/hashicorp/vault/command/agent/sink"
+)
+
+// NewFIFOSink is not supported on Windows, which lacks named pipes with
+// filesystem semantics
+func NewFIFOSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	return nil, errors.New("fifo sink is not supported on windows")
+}
@@ -5,19 +5,50 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/hashicorp/errwrap"
 	hclog "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+)
+
+const (
+	// FormatRaw writes the token as is
+	FormatRaw = "raw"
+
+	// FormatJSON writes the token as a JSON object, along with its accessor
+	// and expiration time when they can be looked up
+	FormatJSON = "json"
+
+	// FormatEnv writes the token as a VAULT_TOKEN environment variable
+	// assignment
+	FormatEnv = "env"
 )
 
 // fileSink is a Sink implementation that writes a token to a file
 type fileSink struct {
 	path   string
 	mode   os.FileMode
+	uid    int
+	gid    int
+	format string
 	logger hclog.Logger
+
+	// client is used to look up the accessor and expiration of tokens
+	// written in the JSON format. It is nil if the token can't be looked up,
+	// e.g. because it is response-wrapped or encrypted before being written.
+	client *api.Client
+}
+
+// jsonToken is the content written by the JSON format
+type jsonToken struct {
+	Token      string `json:"token"`
+	Accessor   string `json:"accessor,omitempty"`
+	ExpireTime string `json:"expire_time,omitempty"`
 }
 
 // NewFileSink creates a new file sink with the given configuration
@@ -31,6 +62,9 @@ func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 	f := &fileSink{
 		logger: conf.Logger,
 		mode:   0640,
+		uid:    -1,
+		gid:    -1,
+		format: FormatRaw,
 	}
 
 	pathRaw, ok := conf.Config["path"]
@@ -46,8 +80,18 @@ func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 
 	if modeRaw, ok := conf.Config["mode"]; ok {
 		f.logger.Debug("verifying override for default file sink mode")
-		mode, typeOK := modeRaw.(int)
-		if !typeOK {
+		var mode int
+		switch modeRaw := modeRaw.(type) {
+		case int:
+			mode = modeRaw
+		case string:
+			// Allow the mode to be given as an octal string, e.g. "0640"
+			parsed, err := strconv.ParseUint(modeRaw, 8, 32)
+			if err != nil {
+				return nil, errors.New("could not parse 'mode' as an octal string")
+			}
+			mode = int(parsed)
+		default:
 			return nil, errors.New("could not parse 'mode' as integer")
 		}
 
@@ -59,11 +103,48 @@ func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 		f.mode = os.FileMode(mode)
 	}
 
+	for _, key := range []string{"uid", "gid"} {
+		idRaw, ok := conf.Config[key]
+		if !ok {
+			continue
+		}
+		id, typeOK := idRaw.(int)
+		if !typeOK || id < 0 {
+			return nil, fmt.Errorf("could not parse '%s' as a non-negative integer", key)
+		}
+
+		f.logger.Debug("overriding default file sink ownership", key, id)
+		if key == "uid" {
+			f.uid = id
+		} else {
+			f.gid = id
+		}
+	}
+
+	if formatRaw, ok := conf.Config["format"]; ok {
+		format, ok := formatRaw.(string)
+		if !ok {
+			return nil, errors.New("could not parse 'format' as string")
+		}
+		switch format {
+		case FormatRaw, FormatJSON, FormatEnv:
+		default:
+			return nil, fmt.Errorf("unsupported 'format' %q, must be one of %q, %q or %q", format, FormatRaw, FormatJSON, FormatEnv)
+		}
+		f.format = format
+	}
+
+	// Wrapped and encrypted tokens are opaque, so only plain tokens are
+	// looked up
+	if f.format == FormatJSON && conf.WrapTTL == 0 && conf.DHType == "" {
+		f.client = conf.Client
+	}
+
 	if err := f.WriteToken(""); err != nil {
 		return nil, errwrap.Wrapf("error during write check: {{err}}", err)
 	}
 
-	f.logger.Info("file sink configured", "path", f.path, "mode", f.mode)
+	f.logger.Info("file sink configured", "path", f.path, "mode", f.mode, "uid", f.uid, "gid", f.gid, "format", f.format)
 
 	return f, nil
 }
@@ -91,9 +172,14 @@ func (f *fileSink) WriteToken(token string) error {
 		return errwrap.Wrapf(fmt.Sprintf("error opening temp file in dir %s for writing: {{err}}", targetDir), err)
 	}
 
-	valToWrite := token
-	if token == "" {
-		valToWrite = u
+	valToWrite := u
+	if token != "" {
+		valToWrite, err = f.formatToken(token)
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return errwrap.Wrapf("error formatting token: {{err}}", err)
+		}
 	}
 
 	_, err = tmpFile.WriteString(valToWrite)
@@ -109,6 +195,22 @@ func (f *fileSink) WriteToken(token string) error {
 		return errwrap.Wrapf(fmt.Sprintf("error closing %s: {{err}}", tmpFile.Name()), err)
 	}
 
+	// Set the mode explicitly since the one given on open is subject to the
+	// umask, and the ownership if configured. A zero mode leaves the file mode
+	// untouched.
+	if f.mode != 0 {
+		if err := os.Chmod(tmpFile.Name(), f.mode); err != nil {
+			os.Remove(tmpFile.Name())
+			return errwrap.Wrapf(fmt.Sprintf("error setting mode on %s: {{err}}", tmpFile.Name()), err)
+		}
+	}
+	if f.uid != -1 || f.gid != -1 {
+		if err := os.Chown(tmpFile.Name(), f.uid, f.gid); err != nil {
+			os.Remove(tmpFile.Name())
+			return errwrap.Wrapf(fmt.Sprintf("error setting ownership on %s: {{err}}", tmpFile.Name()), err)
+		}
+	}
+
 	// Now, if we were just doing a write check (blank token), remove the file
 	// and exit; otherwise, atomically rename it
 	if token == "" {
@@ -127,3 +229,52 @@ func (f *fileSink) WriteToken(token string) error {
 	f.logger.Info("token written", "path", f.path)
 	return nil
 }
+
+// formatToken shapes the token according to the configured format
+func (f *fileSink) formatToken(token string) (string, error) {
+	switch f.format {
+	case FormatJSON:
+		out := &jsonToken{
+			Token: token,
+		}
+		if f.client != nil {
+			f.lookupToken(out)
+		}
+		m, err := jsonutil.EncodeJSON(out)
+		if err != nil {
+			return "", err
+		}
+		return string(m), nil
+	case FormatEnv:
+		return fmt.Sprintf("%s=%s\n", api.EnvVaultToken, token), nil
+	default:
+		return token, nil
+	}
+}
+
+// lookupToken fills in the token's accessor and expiration time. These are
+// best effort, so failures are logged and the token is written without them.
+func (f *fileSink) lookupToken(out *jsonToken) {
+	client, err := f.client.Clone()
+	if err != nil {
+		f.logger.Warn("error cloning client to look up token", "error", err)
+		return
+	}
+	client.SetToken(out.Token)
+
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		f.logger.Warn("error looking up token, writing it without its accessor and expiration", "error", err)
+		return
+	}
+	if secret == nil || secret.Data == nil {
+		return
+	}
+
+	if accessor, ok := secret.Data["accessor"].(string); ok {
+		out.Accessor = accessor
+	}
+	if expireTime, ok := secret.Data["expire_time"].(string); ok {
+		out.ExpireTime = expireTime
+	}
+}
@@ -3,13 +3,18 @@ package file
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 )
 
@@ -142,3 +147,144 @@ func TestFileSinkMode(t *testing.T) {
 		t.Fatalf("expected %s, got %s", uuidStr, string(fileBytes))
 	}
 }
+
+func TestFileSinkModeAndOwnership(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("%s.", fileServerTestDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "token")
+
+	// Group write would be masked out by a typical umask if the mode were not
+	// set explicitly
+	config := &sink.SinkConfig{
+		Logger: log.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": path,
+			"mode": "0660",
+			"uid":  os.Getuid(),
+			"gid":  os.Getgid(),
+		},
+	}
+
+	fs, err := NewFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uuidStr, _ := uuid.GenerateUUID()
+	if err := fs.WriteToken(uuidStr); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != os.FileMode(0660) {
+		t.Fatalf("wrong file mode was detected at %s: %s", path, fi.Mode())
+	}
+
+	// Invalid values are rejected at construction
+	for _, conf := range []map[string]interface{}{
+		{"path": path, "mode": "rw-r-----"},
+		{"path": path, "mode": "0999"},
+		{"path": path, "mode": int(os.ModeDir | 0755)},
+		{"path": path, "uid": -2},
+		{"path": path, "gid": "wheel"},
+	} {
+		_, err := NewFileSink(&sink.SinkConfig{
+			Logger: log.Named("sink.file"),
+			Config: conf,
+		})
+		if err == nil {
+			t.Fatalf("expected error for config: %v", conf)
+		}
+	}
+}
+
+func TestFileSinkFormat(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("%s.", fileServerTestDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "token")
+
+	// Serve lookup-self for the JSON format's accessor and expiration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" || r.Header.Get(consts.AuthHeaderName) != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"accessor": "accessor", "expire_time": "2020-08-01T00:00:00Z"}}`))
+	}))
+	defer server.Close()
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		format   string
+		client   *api.Client
+		wrapTTL  time.Duration
+		expected string
+	}{
+		{"default", "", client, 0, "s.token"},
+		{"raw", FormatRaw, client, 0, "s.token"},
+		{"env", FormatEnv, client, 0, "VAULT_TOKEN=s.token\n"},
+		{"json", FormatJSON, client, 0, `{"token":"s.token","accessor":"accessor","expire_time":"2020-08-01T00:00:00Z"}` + "\n"},
+		{"json without client", FormatJSON, nil, 0, `{"token":"s.token"}` + "\n"},
+		{"json wrapped", FormatJSON, client, time.Minute, `{"token":"s.token"}` + "\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := map[string]interface{}{
+				"path": path,
+			}
+			if tc.format != "" {
+				conf["format"] = tc.format
+			}
+
+			fs, err := NewFileSink(&sink.SinkConfig{
+				Logger:  log.Named("sink.file"),
+				Config:  conf,
+				Client:  tc.client,
+				WrapTTL: tc.wrapTTL,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.WriteToken("s.token"); err != nil {
+				t.Fatal(err)
+			}
+
+			fileBytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(fileBytes) != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, string(fileBytes))
+			}
+		})
+	}
+
+	// Unknown formats are rejected at construction
+	_, err = NewFileSink(&sink.SinkConfig{
+		Logger: log.Named("sink.file"),
+		Config: map[string]interface{}{"path": path, "format": "yaml"},
+	})
+	if err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
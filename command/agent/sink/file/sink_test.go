@@ -5,14 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/auth"
 	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/helper/dhutil"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 )
 
@@ -119,3 +126,256 @@ func TestSinkServerRetry(t *testing.T) {
 	cancelFunc()
 	<-ss.DoneCh
 }
+
+func TestSinkServer_ExitAfterAuth(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs, path := testFileSink(t, log)
+	defer os.RemoveAll(path)
+	b := &badSink{logger: log.Named("bad")}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:        log.Named("sink.server"),
+		ExitAfterAuth: true,
+	})
+
+	in := make(chan string, 1)
+	sinks := []*sink.SinkConfig{fs, &sink.SinkConfig{Sink: b}}
+	go ss.Run(ctx, in, sinks)
+
+	// The auth handler sends a single token and then closes its output
+	// channel; a failing sink should be retried rather than exiting
+	in <- "bad"
+	close(in)
+
+	time.Sleep(3 * time.Second)
+	select {
+	case <-ss.DoneCh:
+		t.Fatal("sink server exited before all sinks were written")
+	default:
+	}
+	if atomic.LoadUint32(&b.tryCount) < 1 {
+		t.Fatal("bad try count")
+	}
+
+	fileBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/token", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileBytes) != "bad" {
+		t.Fatalf("expected bad, got %s", string(fileBytes))
+	}
+}
+
+func TestSinkServer_ExitAfterAuth_Success(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs, path := testFileSink(t, log)
+	defer os.RemoveAll(path)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:        log.Named("sink.server"),
+		ExitAfterAuth: true,
+	})
+
+	uuidStr, _ := uuid.GenerateUUID()
+	in := make(chan string, 1)
+	go ss.Run(ctx, in, []*sink.SinkConfig{fs})
+
+	in <- uuidStr
+	close(in)
+
+	// The server should stop on its own once the token has been written
+	select {
+	case <-ss.DoneCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sink server did not exit after writing the token")
+	}
+
+	fileBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/token", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileBytes) != uuidStr {
+		t.Fatalf("expected %s, got %s", uuidStr, string(fileBytes))
+	}
+}
+
+func TestSinkServer_DHEncryption(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	for _, deriveKey := range []bool{false, true} {
+		fs, path := testFileSink(t, log)
+		defer os.RemoveAll(path)
+
+		// Write out the reader's public key for the sink to encrypt against
+		pub, pri, err := dhutil.GeneratePublicPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeyInfo, err := jsonutil.EncodeJSON(&dhutil.PublicKeyInfo{Curve25519PublicKey: pub})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dhPath := filepath.Join(path, "dh-pub")
+		if err := ioutil.WriteFile(dhPath, pubKeyInfo, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		fs.DHType = "curve25519"
+		fs.DHPath = dhPath
+		fs.DeriveKey = deriveKey
+		fs.AAD = "foobar"
+
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		ss := sink.NewSinkServer(&sink.SinkServerConfig{
+			Logger: log.Named("sink.server"),
+		})
+
+		uuidStr, _ := uuid.GenerateUUID()
+		in := make(chan string)
+		go ss.Run(ctx, in, []*sink.SinkConfig{fs})
+
+		// Seed a token
+		in <- uuidStr
+
+		// Give it time to finish writing
+		time.Sleep(1 * time.Second)
+
+		cancelFunc()
+		<-ss.DoneCh
+
+		fileBytes, err := ioutil.ReadFile(filepath.Join(path, "token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fileBytes) == uuidStr {
+			t.Fatal("expected token to be encrypted")
+		}
+
+		// Decrypt using the reader's private key and the sink's public key
+		resp := new(dhutil.Envelope)
+		if err := jsonutil.DecodeJSON(fileBytes, resp); err != nil {
+			t.Fatal(err)
+		}
+		aesKey, err := dhutil.GenerateSharedSecret(pri, resp.Curve25519PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deriveKey {
+			aesKey, err = dhutil.DeriveSharedKey(aesKey, resp.Curve25519PublicKey, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		plaintext, err := dhutil.DecryptAES(aesKey, resp.EncryptedPayload, resp.Nonce, []byte("foobar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != uuidStr {
+			t.Fatalf("expected %s, got %s", uuidStr, string(plaintext))
+		}
+
+		// Decryption fails with the wrong AAD
+		if _, err := dhutil.DecryptAES(aesKey, resp.EncryptedPayload, resp.Nonce, []byte("bad")); err == nil {
+			t.Fatal("expected decryption with mismatched AAD to fail")
+		}
+	}
+}
+
+type testLoginMethod struct{}
+
+func (testLoginMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return "auth/test/login", nil, nil, nil
+}
+
+func (testLoginMethod) NewCreds() chan struct{} { return nil }
+func (testLoginMethod) CredSuccess()            {}
+func (testLoginMethod) Shutdown()               {}
+
+func TestSinkServer_Validate(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	// The first token issued can't be looked up, the second one can
+	var logins int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/test/login":
+			token := "invalid"
+			if atomic.AddInt32(&logins, 1) > 1 {
+				token = "valid"
+			}
+			fmt.Fprintf(w, `{"auth": {"client_token": %q, "lease_duration": 3600}}`, token)
+		case "/v1/auth/token/lookup-self":
+			if r.Header.Get("X-Vault-Token") != "valid" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"id": "valid"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	config := api.DefaultConfig()
+	config.Address = ts.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, path := testFileSink(t, log)
+	defer os.RemoveAll(path)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ah := auth.NewAuthHandler(&auth.AuthHandlerConfig{
+		Logger:     log.Named("auth.handler"),
+		Client:     client,
+		MinBackoff: 100 * time.Millisecond,
+	})
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:   log.Named("sink.server"),
+		Client:   client,
+		Validate: true,
+		ReauthCh: ah.ReauthCh,
+	})
+
+	go ah.Run(ctx, testLoginMethod{})
+	go ss.Run(ctx, ah.OutputCh, []*sink.SinkConfig{fs})
+
+	tokenPath := filepath.Join(path, "token")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		fileBytes, err := ioutil.ReadFile(tokenPath)
+		if err == nil {
+			// The invalid token must never be written
+			if string(fileBytes) != "valid" {
+				t.Fatalf("unexpected token written: %q", string(fileBytes))
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("valid token was not written")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if got := atomic.LoadInt32(&logins); got != 2 {
+		t.Fatalf("expected 2 logins, got %d", got)
+	}
+}
@@ -2,6 +2,8 @@ package inmem
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/command/agent/cache"
@@ -9,12 +11,32 @@ import (
 	"go.uber.org/atomic"
 )
 
+// TokenRecord is a token written to the sink, along with the time it was
+// written.
+type TokenRecord struct {
+	Token     string
+	WrittenAt time.Time
+}
+
+// HistoryReader is implemented by the sinks created using NewWithHistory.
+type HistoryReader interface {
+	// TokenHistory returns the retained tokens, from oldest to newest.
+	TokenHistory() []TokenRecord
+}
+
 // inmemSink retains the auto-auth token in memory and exposes it via
 // sink.SinkReader interface.
 type inmemSink struct {
 	logger     hclog.Logger
 	token      *atomic.String
 	leaseCache *cache.LeaseCache
+
+	// history is a ring buffer of the last tokens written to the sink, next
+	// being the index of the next record to write
+	historyLock sync.Mutex
+	history     []TokenRecord
+	next        int
+	full        bool
 }
 
 // New creates a new instance of inmemSink.
@@ -30,9 +52,39 @@ func New(conf *sink.SinkConfig, leaseCache *cache.LeaseCache) (sink.Sink, error)
 	}, nil
 }
 
+// NewWithHistory creates a new instance of inmemSink that also retains the
+// last historySize tokens written to it, exposed via the HistoryReader
+// interface.
+func NewWithHistory(conf *sink.SinkConfig, leaseCache *cache.LeaseCache, historySize int) (sink.Sink, error) {
+	if historySize <= 0 {
+		return nil, errors.New("history size must be positive")
+	}
+
+	s, err := New(conf, leaseCache)
+	if err != nil {
+		return nil, err
+	}
+	s.(*inmemSink).history = make([]TokenRecord, historySize)
+
+	return s, nil
+}
+
 func (s *inmemSink) WriteToken(token string) error {
 	s.token.Store(token)
 
+	if s.history != nil {
+		s.historyLock.Lock()
+		s.history[s.next] = TokenRecord{
+			Token:     token,
+			WrittenAt: time.Now(),
+		}
+		s.next = (s.next + 1) % len(s.history)
+		if s.next == 0 {
+			s.full = true
+		}
+		s.historyLock.Unlock()
+	}
+
 	if s.leaseCache != nil {
 		s.leaseCache.RegisterAutoAuthToken(token)
 	}
@@ -43,3 +95,16 @@ func (s *inmemSink) WriteToken(token string) error {
 func (s *inmemSink) Token() string {
 	return s.token.Load()
 }
+
+func (s *inmemSink) TokenHistory() []TokenRecord {
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+
+	if !s.full {
+		return append([]TokenRecord(nil), s.history[:s.next]...)
+	}
+
+	records := make([]TokenRecord, 0, len(s.history))
+	records = append(records, s.history[s.next:]...)
+	return append(records, s.history[:s.next]...)
+}
@@ -0,0 +1,74 @@
+package inmem
+
+import (
+	"fmt"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func TestInmemSink_TokenHistory(t *testing.T) {
+	config := &sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+	}
+
+	s, err := NewWithHistory(config, nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := s.(HistoryReader)
+
+	if records := history.TokenHistory(); len(records) != 0 {
+		t.Fatalf("expected no history, got: %v", records)
+	}
+
+	// Simulate the auto-auth token being renewed a few times
+	for i := 1; i <= 5; i++ {
+		if err := s.WriteToken(fmt.Sprintf("token-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+
+		records := history.TokenHistory()
+		expectedLen := i
+		if expectedLen > 3 {
+			expectedLen = 3
+		}
+		if len(records) != expectedLen {
+			t.Fatalf("expected %d records, got: %v", expectedLen, records)
+		}
+
+		// Records are ordered from oldest to newest, ending with the latest
+		// token
+		for j, record := range records {
+			expected := fmt.Sprintf("token-%d", i-expectedLen+j+1)
+			if record.Token != expected {
+				t.Fatalf("expected record %d to be %q, got: %v", j, expected, records)
+			}
+			if j > 0 && record.WrittenAt.Before(records[j-1].WrittenAt) {
+				t.Fatalf("records out of order: %v", records)
+			}
+		}
+	}
+
+	if token := s.(sink.SinkReader).Token(); token != "token-5" {
+		t.Fatalf("expected latest token, got %q", token)
+	}
+
+	// Sinks created without history don't retain any
+	s, err = New(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteToken("token"); err != nil {
+		t.Fatal(err)
+	}
+	if records := s.(HistoryReader).TokenHistory(); len(records) != 0 {
+		t.Fatalf("expected no history, got: %v", records)
+	}
+
+	if _, err := NewWithHistory(config, nil, 0); err == nil {
+		t.Fatal("expected an error for an empty history")
+	}
+}
@@ -0,0 +1,193 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/sink"
+)
+
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCACert    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// defaultKey is the key in the secret's data the token is written to if
+	// none is configured
+	defaultKey = "token"
+)
+
+// SecretClient updates keys in a Kubernetes secret.
+type SecretClient interface {
+	PatchSecret(namespace, name string, data map[string][]byte) error
+}
+
+// kubernetesSink is a Sink implementation that writes a token to a key in a
+// Kubernetes secret
+type kubernetesSink struct {
+	namespace  string
+	secretName string
+	key        string
+	client     SecretClient
+	logger     hclog.Logger
+}
+
+// NewKubernetesSink creates a new Kubernetes secret sink with the given
+// configuration. If client is nil, a client using the pod's in-cluster
+// configuration is created.
+func NewKubernetesSink(conf *sink.SinkConfig, client SecretClient) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+
+	conf.Logger.Info("creating kubernetes sink")
+
+	k := &kubernetesSink{
+		logger: conf.Logger,
+		key:    defaultKey,
+		client: client,
+	}
+
+	for _, field := range []struct {
+		name     string
+		target   *string
+		required bool
+	}{
+		{"namespace", &k.namespace, true},
+		{"secret_name", &k.secretName, true},
+		{"key", &k.key, false},
+	} {
+		valRaw, ok := conf.Config[field.name]
+		if !ok {
+			if field.required {
+				return nil, fmt.Errorf("'%s' not specified for kubernetes sink", field.name)
+			}
+			continue
+		}
+		val, ok := valRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("could not parse '%s' as string", field.name)
+		}
+		if val == "" {
+			return nil, fmt.Errorf("'%s' is empty", field.name)
+		}
+		*field.target = val
+	}
+
+	if k.client == nil {
+		var err error
+		k.client, err = newInClusterClient()
+		if err != nil {
+			return nil, errwrap.Wrapf("error creating in-cluster kubernetes client: {{err}}", err)
+		}
+	}
+
+	k.logger.Info("kubernetes sink configured", "namespace", k.namespace, "secret_name", k.secretName, "key", k.key)
+
+	return k, nil
+}
+
+// WriteToken implements the Server interface and writes the token to the
+// configured key of the secret, leaving any other keys untouched.
+func (k *kubernetesSink) WriteToken(token string) error {
+	k.logger.Trace("enter write_token", "namespace", k.namespace, "secret_name", k.secretName)
+	defer k.logger.Trace("exit write_token", "namespace", k.namespace, "secret_name", k.secretName)
+
+	err := k.client.PatchSecret(k.namespace, k.secretName, map[string][]byte{
+		k.key: []byte(token),
+	})
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("error writing token to secret %s/%s: {{err}}", k.namespace, k.secretName), err)
+	}
+
+	k.logger.Info("token written", "namespace", k.namespace, "secret_name", k.secretName)
+	return nil
+}
+
+// inClusterClient is a SecretClient talking to the Kubernetes API server using
+// the pod's service account.
+type inClusterClient struct {
+	host      string
+	tokenFile string
+	client    *http.Client
+}
+
+func newInClusterClient() (*inClusterClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside a kubernetes cluster; KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	caCert, err := ioutil.ReadFile(serviceAccountCACert)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading service account CA certificate: {{err}}", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("could not parse service account CA certificate")
+	}
+
+	return &inClusterClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountTokenFile,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: pool,
+				},
+			},
+		},
+	}, nil
+}
+
+// PatchSecret merges the given data into the secret's existing data.
+func (c *inClusterClient) PatchSecret(namespace, name string, data map[string][]byte) error {
+	// The service account token may be rotated, so it is read on each request
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return errwrap.Wrapf("error reading service account token: {{err}}", err)
+	}
+
+	// []byte values are base64 encoded when marshaled, as the API expects
+	body, err := json.Marshal(map[string]interface{}{
+		"data": data,
+	})
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", c.host, url.PathEscape(namespace), url.PathEscape(name))
+	req, err := http.NewRequest(http.MethodPatch, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d from kubernetes API: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+type fakeSecretClient struct {
+	secrets map[string]map[string][]byte
+	err     error
+}
+
+func (f *fakeSecretClient) PatchSecret(namespace, name string, data map[string][]byte) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	secret, ok := f.secrets[namespace+"/"+name]
+	if !ok {
+		return errors.New("secret not found")
+	}
+	for k, v := range data {
+		secret[k] = v
+	}
+	return nil
+}
+
+func TestKubernetesSink(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	client := &fakeSecretClient{
+		secrets: map[string]map[string][]byte{
+			"default/vault-token": {
+				"other": []byte("untouched"),
+			},
+		},
+	}
+
+	s, err := NewKubernetesSink(&sink.SinkConfig{
+		Logger: log.Named("sink.kubernetes"),
+		Config: map[string]interface{}{
+			"namespace":   "default",
+			"secret_name": "vault-token",
+			"key":         "vault_token",
+		},
+	}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.WriteToken("foobar"); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := client.secrets["default/vault-token"]
+	if string(secret["vault_token"]) != "foobar" {
+		t.Fatalf("expected token to be written, got: %q", secret["vault_token"])
+	}
+	if string(secret["other"]) != "untouched" {
+		t.Fatalf("expected other keys to be untouched, got: %q", secret["other"])
+	}
+
+	// Errors from the client are surfaced
+	client.err = errors.New("forbidden")
+	if err := s.WriteToken("foobar"); err == nil {
+		t.Fatal("expected error writing token")
+	}
+
+	// Invalid configs are rejected
+	for _, conf := range []map[string]interface{}{
+		{"secret_name": "vault-token"},
+		{"namespace": "default"},
+		{"namespace": "default", "secret_name": ""},
+		{"namespace": "default", "secret_name": "vault-token", "key": 1},
+	} {
+		_, err := NewKubernetesSink(&sink.SinkConfig{
+			Logger: log.Named("sink.kubernetes"),
+			Config: conf,
+		}, client)
+		if err == nil {
+			t.Fatalf("expected error for config: %v", conf)
+		}
+	}
+}
+
+func TestKubernetesSink_InClusterClient(t *testing.T) {
+	var gotMethod, gotPath, gotAuth, gotContentType string
+	var gotBody map[string]map[string][]byte
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		gotContentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "vault-agent-kubernetes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tokenFile := filepath.Join(tmpDir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("sa-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &inClusterClient{
+		host:      server.URL,
+		tokenFile: tokenFile,
+		client:    server.Client(),
+	}
+
+	if err := client.PatchSecret("default", "vault-token", map[string][]byte{"token": []byte("foobar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotMethod != http.MethodPatch {
+		t.Fatalf("bad method: %s", gotMethod)
+	}
+	if gotPath != "/api/v1/namespaces/default/secrets/vault-token" {
+		t.Fatalf("bad path: %s", gotPath)
+	}
+	if gotAuth != "Bearer sa-token" {
+		t.Fatalf("bad authorization header: %s", gotAuth)
+	}
+	if gotContentType != "application/merge-patch+json" {
+		t.Fatalf("bad content type: %s", gotContentType)
+	}
+	if string(gotBody["data"]["token"]) != "foobar" {
+		t.Fatalf("bad body: %#v", gotBody)
+	}
+}
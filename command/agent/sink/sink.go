@@ -44,6 +44,12 @@ type SinkServerConfig struct {
 	Client        *api.Client
 	Context       context.Context
 	ExitAfterAuth bool
+
+	// Validate causes each new token to be looked up before it is written to
+	// the sinks. A token that can't be looked up isn't written; instead a
+	// re-authentication is requested on ReauthCh.
+	Validate bool
+	ReauthCh chan<- struct{}
 }
 
 // SinkServer is responsible for pushing tokens to sinks
@@ -54,6 +60,8 @@ type SinkServer struct {
 	random        *rand.Rand
 	exitAfterAuth bool
 	remaining     *int32
+	validate      bool
+	reauthCh      chan<- struct{}
 }
 
 func NewSinkServer(conf *SinkServerConfig) *SinkServer {
@@ -64,6 +72,8 @@ func NewSinkServer(conf *SinkServerConfig) *SinkServer {
 		random:        rand.New(rand.NewSource(int64(time.Now().Nanosecond()))),
 		exitAfterAuth: conf.ExitAfterAuth,
 		remaining:     new(int32),
+		validate:      conf.Validate,
+		reauthCh:      conf.ReauthCh,
 	}
 
 	return ss
@@ -114,9 +124,22 @@ func (ss *SinkServer) Run(ctx context.Context, incoming chan string, sinks []*Si
 		case <-ctx.Done():
 			return
 
-		case token := <-incoming:
+		case token, ok := <-incoming:
+			if !ok {
+				// The auth handler has stopped, so no new tokens will arrive;
+				// keep delivering any pending writes
+				incoming = nil
+				continue
+			}
 			if len(sinks) > 0 {
 				if token != *latestToken {
+					if ss.validate {
+						if err := ss.validateToken(token); err != nil {
+							ss.logger.Error("token failed validation, not writing to sinks and requesting re-authentication", "error", err)
+							ss.requestReauth()
+							continue
+						}
+					}
 
 					// Drain the existing funcs
 				drainLoop:
@@ -170,6 +193,42 @@ func (ss *SinkServer) Run(ctx context.Context, incoming chan string, sinks []*Si
 	}
 }
 
+// validateToken looks up the token to make sure it is usable before it is
+// distributed.
+func (ss *SinkServer) validateToken(token string) error {
+	client, err := ss.client.Clone()
+	if err != nil {
+		return errwrap.Wrapf("error deriving client for validation: {{err}}", err)
+	}
+	if headers := ss.client.Headers(); headers != nil {
+		client.SetHeaders(headers)
+	}
+	client.SetToken(token)
+
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		return errwrap.Wrapf("error looking up token: {{err}}", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return errors.New("empty response from token lookup")
+	}
+
+	return nil
+}
+
+// requestReauth asks the auth handler for a new token, unless a request is
+// already pending.
+func (ss *SinkServer) requestReauth() {
+	if ss.reauthCh == nil {
+		return
+	}
+
+	select {
+	case ss.reauthCh <- struct{}{}:
+	default:
+	}
+}
+
 func (s *SinkConfig) encryptToken(token string) (string, error) {
 	var aesKey []byte
 	var err error
@@ -0,0 +1,244 @@
+package websocket
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/errwrap"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/sink"
+)
+
+const (
+	// defaultAddress is the address the sink listens on if none is
+	// configured. It is bound to the loopback interface so that tokens are
+	// only served to local processes.
+	defaultAddress = "127.0.0.1:8300"
+
+	// writeTimeout bounds how long sending a token to a single client may
+	// take before the client is disconnected
+	writeTimeout = 10 * time.Second
+)
+
+// websocketSink is a Sink implementation that serves the latest token to
+// clients connected over a WebSocket, pushing every new token as it is
+// written
+type websocketSink struct {
+	logger   hclog.Logger
+	secret   string
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+
+	l       sync.Mutex
+	token   string
+	clients map[*client]struct{}
+	closed  bool
+}
+
+// client is a single WebSocket connection. notifyCh is signaled whenever a
+// new token is available; pending notifications are coalesced so that slow
+// clients only ever receive the latest token.
+type client struct {
+	conn     *websocket.Conn
+	notifyCh chan struct{}
+	doneCh   chan struct{}
+}
+
+// NewWebSocketSink creates a new WebSocket sink with the given configuration
+// and starts listening for clients
+func NewWebSocketSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+
+	conf.Logger.Info("creating websocket sink")
+
+	w := &websocketSink{
+		logger:  conf.Logger,
+		clients: make(map[*client]struct{}),
+	}
+
+	address := defaultAddress
+	if addressRaw, ok := conf.Config["address"]; ok {
+		address, ok = addressRaw.(string)
+		if !ok {
+			return nil, errors.New("could not parse 'address' as string")
+		}
+		if address == "" {
+			return nil, errors.New("'address' must not be empty")
+		}
+	}
+
+	if secretRaw, ok := conf.Config["secret"]; ok {
+		w.secret, ok = secretRaw.(string)
+		if !ok {
+			return nil, errors.New("could not parse 'secret' as string")
+		}
+	}
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("error listening on %s: {{err}}", address), err)
+	}
+	w.listener = ln
+
+	w.server = &http.Server{
+		Handler:           w,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          w.logger.StandardLogger(nil),
+	}
+	go w.server.Serve(ln)
+
+	w.logger.Info("websocket sink configured", "address", ln.Addr().String(), "secret", w.secret != "")
+
+	return w, nil
+}
+
+// ServeHTTP upgrades authorized requests to a WebSocket and streams tokens to
+// the client until it disconnects or the sink is closed
+func (w *websocketSink) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !w.authorized(req) {
+		w.logger.Warn("rejected unauthorized client", "remote_addr", req.RemoteAddr)
+		http.Error(resp, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := w.upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		// The upgrader has already replied to the client
+		w.logger.Warn("error upgrading connection", "remote_addr", req.RemoteAddr, "error", err)
+		return
+	}
+
+	c := &client{
+		conn:     conn,
+		notifyCh: make(chan struct{}, 1),
+		doneCh:   make(chan struct{}),
+	}
+
+	w.l.Lock()
+	if w.closed {
+		w.l.Unlock()
+		conn.Close()
+		return
+	}
+	w.clients[c] = struct{}{}
+	if w.token != "" {
+		c.notify()
+	}
+	w.l.Unlock()
+
+	w.logger.Debug("client connected", "remote_addr", req.RemoteAddr)
+
+	// Messages from clients are ignored, but reading is required to process
+	// control frames and notice when the client goes away
+	go func() {
+		defer close(c.doneCh)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	w.writeLoop(c)
+
+	w.l.Lock()
+	delete(w.clients, c)
+	w.l.Unlock()
+	conn.Close()
+
+	w.logger.Debug("client disconnected", "remote_addr", req.RemoteAddr)
+}
+
+// writeLoop sends the latest token to the client every time it is notified
+func (w *websocketSink) writeLoop(c *client) {
+	var sent string
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-c.notifyCh:
+		}
+
+		w.l.Lock()
+		token := w.token
+		w.l.Unlock()
+		if token == sent {
+			continue
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, []byte(token)); err != nil {
+			w.logger.Warn("error writing token to client", "remote_addr", c.conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		sent = token
+	}
+}
+
+// authorized checks the shared secret, if one is configured, which clients
+// send as a bearer token in the Authorization header
+func (w *websocketSink) authorized(req *http.Request) bool {
+	if w.secret == "" {
+		return true
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	provided := strings.TrimPrefix(auth, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(w.secret)) == 1
+}
+
+// notify signals the client that a new token is available without blocking
+func (c *client) notify() {
+	select {
+	case c.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// WriteToken implements the Server interface and pushes the token to all
+// connected clients. Clients connecting later receive it immediately.
+func (w *websocketSink) WriteToken(token string) error {
+	w.logger.Trace("enter write_token")
+	defer w.logger.Trace("exit write_token")
+
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	if w.closed {
+		return errors.New("websocket sink is closed")
+	}
+
+	w.token = token
+	for c := range w.clients {
+		c.notify()
+	}
+
+	w.logger.Info("token written", "clients", len(w.clients))
+	return nil
+}
+
+// Close stops listening and disconnects all clients
+func (w *websocketSink) Close() error {
+	w.l.Lock()
+	w.closed = true
+	for c := range w.clients {
+		c.conn.Close()
+	}
+	w.l.Unlock()
+
+	return w.server.Close()
+}
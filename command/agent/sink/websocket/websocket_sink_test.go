@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func TestWebSocketSink(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	s, err := NewWebSocketSink(&sink.SinkConfig{
+		Logger: log.Named("sink.websocket"),
+		Config: map[string]interface{}{
+			"address": "127.0.0.1:0",
+			"secret":  "shared-secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := s.(*websocketSink)
+	defer ws.Close()
+
+	url := "ws://" + ws.listener.Addr().String()
+
+	// Clients without the shared secret are rejected
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Authorization": []string{"Bearer wrong-secret"},
+	})
+	if err == nil {
+		t.Fatal("expected an error connecting with the wrong secret")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized response, got: %v", resp)
+	}
+
+	if err := s.WriteToken("token-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Authorization": []string{"Bearer shared-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	readToken := func() string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != websocket.TextMessage {
+			t.Fatalf("expected a text message, got type %d", msgType)
+		}
+		return string(msg)
+	}
+
+	// The current token is sent as soon as the client connects
+	if token := readToken(); token != "token-1" {
+		t.Fatalf("expected initial token, got %q", token)
+	}
+
+	// Updates are pushed to connected clients
+	if err := s.WriteToken("token-2"); err != nil {
+		t.Fatal(err)
+	}
+	if token := readToken(); token != "token-2" {
+		t.Fatalf("expected updated token, got %q", token)
+	}
+
+	// Closing the sink disconnects clients and rejects further writes
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if err := s.WriteToken("token-3"); err == nil {
+		t.Fatal("expected an error writing to a closed sink")
+	}
+}
+
+func TestWebSocketSink_Config(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	for name, config := range map[string]map[string]interface{}{
+		"bad address type": {"address": 8300},
+		"empty address":    {"address": ""},
+		"bad secret type":  {"address": "127.0.0.1:0", "secret": 1},
+		"bad address":      {"address": "not an address"},
+	} {
+		if _, err := NewWebSocketSink(&sink.SinkConfig{
+			Logger: log,
+			Config: config,
+		}); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
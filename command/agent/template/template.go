@@ -26,6 +26,11 @@ type ServerConfig struct {
 	VaultConf     *config.Vault
 	ExitAfterAuth bool
 
+	// ProxyAddress is the address of an agent listener serving the cache. If
+	// set, templates read secrets through it instead of directly from Vault,
+	// so that they share the agent's lease cache and renewals.
+	ProxyAddress string
+
 	Namespace string
 
 	// LogLevel is needed to set the internal Consul Template Runner's log level
@@ -132,7 +137,12 @@ func (ts *Server) Run(ctx context.Context, incoming chan string, templates []*ct
 			ts.runner.Stop()
 			return
 
-		case token := <-incoming:
+		case token, ok := <-incoming:
+			if !ok {
+				// The auth handler has stopped, so no new tokens will arrive
+				incoming = nil
+				continue
+			}
 			if token != *latestToken {
 				ts.logger.Info("template server received new token")
 				ts.runner.Stop()
@@ -202,6 +212,9 @@ func newRunnerConfig(sc *ServerConfig, templates ctconfig.TemplateConfigs) (*ctc
 	conf.Vault.RenewToken = pointerutil.BoolPtr(false)
 	conf.Vault.Token = pointerutil.StringPtr("")
 	conf.Vault.Address = &sc.VaultConf.Address
+	if sc.ProxyAddress != "" {
+		conf.Vault.Address = &sc.ProxyAddress
+	}
 
 	if sc.Namespace != "" {
 		conf.Vault.Namespace = &sc.Namespace
@@ -217,7 +230,8 @@ func newRunnerConfig(sc *ServerConfig, templates ctconfig.TemplateConfigs) (*ctc
 		ServerName: pointerutil.StringPtr(""),
 	}
 
-	if strings.HasPrefix(sc.VaultConf.Address, "https") || sc.VaultConf.CACert != "" {
+	// The proxy listener is local to the agent and doesn't use TLS
+	if sc.ProxyAddress == "" && (strings.HasPrefix(sc.VaultConf.Address, "https") || sc.VaultConf.CACert != "") {
 		skipVerify := sc.VaultConf.TLSSkipVerify
 		verify := !skipVerify
 		conf.Vault.SSL = &ctconfig.SSLConfig{
@@ -5,13 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	ctconfig "github.com/hashicorp/consul-template/config"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/cache"
 	"github.com/hashicorp/vault/command/agent/config"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/helper/pointerutil"
@@ -162,6 +168,107 @@ func TestServerRun(t *testing.T) {
 	}
 }
 
+// TestServerRun_ProxyAddress renders a template through the agent's cache and
+// checks that it is re-rendered when the secret changes
+func TestServerRun_ProxyAddress(t *testing.T) {
+	logger := logging.NewVaultLogger(hclog.Trace)
+
+	var value atomic.Value
+	value.Store("bar")
+	vaultServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/foo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"lease_duration": 1, "data": {"value": %q}}`, value.Load())
+	}))
+	defer vaultServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := api.NewClient(&api.Config{Address: vaultServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiProxy, err := cache.NewAPIProxy(&cache.APIProxyConfig{
+		Client: client,
+		Logger: logger.Named("apiproxy"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaseCache, err := cache.NewLeaseCache(&cache.LeaseCacheConfig{
+		Client:      client,
+		BaseContext: ctx,
+		Proxier:     apiProxy,
+		Logger:      logger.Named("leasecache"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "agent-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dstFile := filepath.Join(tmpDir, "render")
+
+	// The agent serves the cache to templates on a unix socket
+	socketPath := filepath.Join(tmpDir, "proxy.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentServer := &http.Server{Handler: cache.Handler(ctx, logger, leaseCache, nil, true)}
+	go agentServer.Serve(ln)
+	defer agentServer.Close()
+
+	server := NewServer(&ServerConfig{
+		Logger: logger,
+		// Vault itself is unreachable, so secrets must be read via the proxy
+		VaultConf: &config.Vault{
+			Address: "http://127.0.0.1:0",
+		},
+		ProxyAddress: "unix://" + socketPath,
+		LogLevel:     hclog.Trace,
+		LogWriter:    hclog.DefaultOutput,
+	})
+
+	templateTokenCh := make(chan string, 1)
+	go server.Run(ctx, templateTokenCh, []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(`{{ with secret "kv/foo" }}{{ .Data.value }}{{ end }}`),
+			Destination: pointerutil.StringPtr(dstFile),
+		},
+	})
+	templateTokenCh <- "test"
+
+	waitForContents := func(expected string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			content, err := ioutil.ReadFile(dstFile)
+			if err == nil && string(content) == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected rendered contents %q, got %q (error: %v)", expected, content, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	waitForContents("bar")
+
+	value.Store("baz")
+	waitForContents("baz")
+
+	cancel()
+	<-server.DoneCh
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, jsonResponse)
 }
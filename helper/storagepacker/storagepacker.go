@@ -1,12 +1,22 @@
 package storagepacker
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/armon/go-metrics"
 	"github.com/golang/protobuf/proto"
@@ -14,8 +24,10 @@ import (
 	"github.com/hashicorp/go-hclog"
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/helper/compressutil"
+	"github.com/hashicorp/vault/sdk/helper/cryptoutil"
 	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/physical"
 )
 
 const (
@@ -23,16 +35,177 @@ const (
 	// StoragePackerBucketsPrefix is the default storage key prefix under which
 	// bucket data will be stored.
 	StoragePackerBucketsPrefix = "packer/buckets/"
+
+	// compressionSampleSize is the size of the sample of large buckets that is
+	// compressed first to decide whether compressing the whole bucket is
+	// worthwhile.
+	compressionSampleSize = 16 * 1024
+
+	// importBatchSize is the number of items ImportItems stores at once.
+	importBatchSize = 1000
+
+	// maxExportedItemSize is the maximum size of an item ImportItems accepts,
+	// to avoid allocating arbitrary amounts of memory for corrupted input.
+	maxExportedItemSize = 256 * 1024 * 1024
+
+	// DefaultMaxItemIDLength is the maximum length of an item ID accepted by
+	// DefaultItemIDValidator.
+	DefaultMaxItemIDLength = 512
+
+	// HashTypeMD5 distributes items using MD5. This is the default, and is
+	// assumed for packers created before the hash type was persisted.
+	HashTypeMD5 = "md5"
+
+	// HashTypeSHA256 distributes items using SHA-256.
+	HashTypeSHA256 = "sha2-256"
+
+	// HashTypeBlake2b256 distributes items using BLAKE2b-256.
+	HashTypeBlake2b256 = "blake2b-256"
+
+	// ItemChangePut is the operation passed to Config.OnItemChange for items
+	// that were stored.
+	ItemChangePut = "put"
+
+	// ItemChangeDelete is the operation passed to Config.OnItemChange for
+	// items that were deleted.
+	ItemChangeDelete = "delete"
+)
+
+// hashFuncs maps the supported hash types to their implementation.
+var hashFuncs = map[string]func(string) []byte{
+	HashTypeMD5: func(key string) []byte {
+		sum := md5.Sum([]byte(key))
+		return sum[:]
+	},
+	HashTypeSHA256: func(key string) []byte {
+		sum := sha256.Sum256([]byte(key))
+		return sum[:]
+	},
+	HashTypeBlake2b256: cryptoutil.Blake2b256Hash,
+}
+
+var (
+	// ErrMaxItemsReached is returned by PutItem when storing a new item would
+	// exceed the configured maximum number of items.
+	ErrMaxItemsReached = errors.New("maximum number of items in the storage packer reached")
+
+	// ErrVersionMismatch is returned by PutItemCAS when the stored item's
+	// version differs from the expected one.
+	ErrVersionMismatch = errors.New("storage packer item version does not match")
+
+	// ErrReadOnly is returned by the methods that modify items of a packer
+	// created in read-only mode.
+	ErrReadOnly = errors.New("storage packer is read-only")
 )
 
+// Config is used to configure a storage packer.
+type Config struct {
+	// View is the storage to be used by the packer.
+	View logical.Storage
+
+	// Logger is the logger to be used by the packer.
+	Logger log.Logger
+
+	// ViewPrefix is the prefix under which buckets are stored. Defaults to
+	// StoragePackerBucketsPrefix.
+	ViewPrefix string
+
+	// ItemIDValidator is used to validate item IDs in PutItem. Defaults to
+	// DefaultItemIDValidator.
+	ItemIDValidator func(string) error
+
+	// MaxItems, if non-zero, is the maximum number of items the packer will
+	// hold. Updates to existing items are always allowed.
+	MaxItems int
+
+	// HashType is the hash used to distribute items across buckets. Defaults
+	// to HashTypeMD5. Changing it would scatter existing items, so it is
+	// persisted and a packer created with a different hash type fails to
+	// load.
+	HashType string
+
+	// LockStripes is the number of locks that guard the buckets, which must
+	// be a power of two. Defaults to locksutil.LockCount. Buckets sharing a
+	// lock can't be updated concurrently, so more stripes reduce contention
+	// under high concurrency at the cost of memory. It is fixed for the
+	// lifetime of the packer.
+	LockStripes int
+
+	// SkipCompressionAboveRatio, if non-zero, stores buckets uncompressed
+	// when compressing them would leave more than this ratio of their size,
+	// e.g. because items hold already compressed or encrypted data. Large
+	// buckets are decided on by compressing a sample of them. Buckets are
+	// always readable regardless of whether they were compressed.
+	SkipCompressionAboveRatio float64
+
+	// ReadOnly, if set, makes every method that would write to storage fail
+	// with ErrReadOnly, so that the packer can safely be used on nodes that
+	// must not modify the shared storage, like standbys. The persisted config
+	// is still verified.
+	ReadOnly bool
+
+	// OnItemChange, if set, is called with ItemChangePut or ItemChangeDelete
+	// and the item ID for every item that was stored or deleted, once the
+	// change is persisted. It is called after the bucket locks are released,
+	// so it may use the packer.
+	OnItemChange func(op, itemID string)
+}
+
+// persistedConfig is the part of the packer configuration that has to stay
+// the same over the lifetime of the stored data.
+type persistedConfig struct {
+	HashType string `json:"hash_type"`
+}
+
+// DefaultItemIDValidator rejects item IDs that are longer than
+// DefaultMaxItemIDLength, are not valid UTF-8 or contain control characters.
+func DefaultItemIDValidator(itemID string) error {
+	if len(itemID) > DefaultMaxItemIDLength {
+		return fmt.Errorf("item ID exceeds maximum length of %d", DefaultMaxItemIDLength)
+	}
+
+	if !utf8.ValidString(itemID) {
+		return fmt.Errorf("item ID is not valid UTF-8")
+	}
+
+	for _, r := range itemID {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("item ID contains control characters")
+		}
+	}
+
+	return nil
+}
+
 // StoragePacker packs items into a specific number of buckets by hashing
 // its identifier and indexing on it. Currently this supports only 256 bucket entries and
 // hence relies on the first byte of the hash value for indexing.
 type StoragePacker struct {
-	view         logical.Storage
-	logger       log.Logger
-	storageLocks []*locksutil.LockEntry
-	viewPrefix   string
+	view            logical.Storage
+	logger          log.Logger
+	storageLocks    []*locksutil.LockEntry
+	viewPrefix      string
+	itemIDValidator func(string) error
+	hashFunc        func(string) []byte
+
+	// skipCompressionAboveRatio is the compression ratio above which buckets
+	// are stored uncompressed, if non-zero.
+	skipCompressionAboveRatio float64
+
+	readOnly     bool
+	onItemChange func(op, itemID string)
+
+	// maxItems is the maximum number of items allowed in the packer. When
+	// set, itemCount tracks the number of items currently stored.
+	maxItems      int
+	itemCount     int
+	itemCountLock sync.Mutex
+
+	// pendingConfig is the config to persist with the first write, if none
+	// was persisted yet. It isn't written when the packer is created, since
+	// the storage may not be writable yet, e.g. while a mount is set up.
+	pendingConfig *persistedConfig
+	configLock    sync.Mutex
 }
 
 // View returns the storage view configured to be used by the packer
@@ -46,7 +219,7 @@ func (s *StoragePacker) GetBucket(key string) (*Bucket, error) {
 		return nil, fmt.Errorf("missing bucket key")
 	}
 
-	lock := locksutil.LockForKey(s.storageLocks, key)
+	lock := s.lockForKey(key)
 	lock.RLock()
 	defer lock.RUnlock()
 
@@ -111,17 +284,41 @@ func (s *Bucket) upsert(item *Item) error {
 	return nil
 }
 
+// lockIndexForKey returns the index of the lock stripe guarding the given
+// bucket key.
+func (s *StoragePacker) lockIndexForKey(key string) int {
+	hash := cryptoutil.Blake2b256Hash(key)
+	return int(binary.BigEndian.Uint32(hash[:4]) & uint32(len(s.storageLocks)-1))
+}
+
+// lockForKey returns the lock guarding the given bucket key.
+func (s *StoragePacker) lockForKey(key string) *locksutil.LockEntry {
+	return s.storageLocks[s.lockIndexForKey(key)]
+}
+
+// locksForKeys returns the locks guarding the given bucket keys, without
+// duplicates and in the order of the stripes so that they can be acquired
+// without deadlocking.
+func (s *StoragePacker) locksForKeys(keys []string) []*locksutil.LockEntry {
+	lockIndexes := make(map[int]struct{}, len(keys))
+	for _, key := range keys {
+		lockIndexes[s.lockIndexForKey(key)] = struct{}{}
+	}
+
+	locks := make([]*locksutil.LockEntry, 0, len(lockIndexes))
+	for i, lock := range s.storageLocks {
+		if _, ok := lockIndexes[i]; ok {
+			locks = append(locks, lock)
+		}
+	}
+
+	return locks
+}
+
 // BucketKey returns the storage key of the bucket where the given item will be
 // stored.
 func (s *StoragePacker) BucketKey(itemID string) string {
-	hf := md5.New()
-	input := []byte(itemID)
-	n, err := hf.Write(input)
-	// Make linter happy
-	if err != nil || n != len(input) {
-		return ""
-	}
-	index := uint8(hf.Sum(nil)[0])
+	index := uint8(s.hashFunc(itemID)[0])
 	return s.viewPrefix + strconv.Itoa(int(index))
 }
 
@@ -132,6 +329,9 @@ func (s *StoragePacker) DeleteItem(_ context.Context, itemID string) error {
 
 func (s *StoragePacker) DeleteMultipleItems(ctx context.Context, logger hclog.Logger, itemIDs []string) error {
 	defer metrics.MeasureSince([]string{"storage_packer", "delete_items"}, time.Now())
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	if len(itemIDs) == 0 {
 		return nil
 	}
@@ -157,7 +357,12 @@ func (s *StoragePacker) DeleteMultipleItems(ctx context.Context, logger hclog.Lo
 		bucket[id] = struct{}{}
 	}
 
-	locks := locksutil.LocksForKeys(s.storageLocks, lockKeys)
+	// Deferred before the locks are acquired so that it runs once they are
+	// released
+	var deleted []string
+	defer func() { s.notifyItemChanges(ItemChangeDelete, deleted) }()
+
+	locks := s.locksForKeys(lockKeys)
 	for _, lock := range locks {
 		lock.Lock()
 		defer lock.Unlock()
@@ -195,8 +400,10 @@ func (s *StoragePacker) DeleteMultipleItems(ctx context.Context, logger hclog.Lo
 		}
 
 		// Look for a matching storage entries and delete them from the list.
+		var removed []string
 		for i := 0; i < len(bucket.Items); i++ {
 			if _, ok := itemsToRemove[bucket.Items[i].ID]; ok {
+				removed = append(removed, bucket.Items[i].ID)
 				bucket.Items[i] = bucket.Items[len(bucket.Items)-1]
 				bucket.Items = bucket.Items[:len(bucket.Items)-1]
 
@@ -211,9 +418,14 @@ func (s *StoragePacker) DeleteMultipleItems(ctx context.Context, logger hclog.Lo
 			return ctx.Err()
 		}
 
-		err = s.putBucket(ctx, bucket)
-		if err != nil {
-			return err
+		// Missing items are ignored, so there may be nothing to persist
+		if len(removed) > 0 {
+			err = s.putBucket(ctx, bucket)
+			if err != nil {
+				return err
+			}
+			s.adjustItemCount(-len(removed))
+			deleted = append(deleted, removed...)
 		}
 
 		newPctDone := idx * 100.0 / len(byBucket)
@@ -230,40 +442,83 @@ func (s *StoragePacker) DeleteMultipleItems(ctx context.Context, logger hclog.Lo
 
 func (s *StoragePacker) putBucket(ctx context.Context, bucket *Bucket) error {
 	defer metrics.MeasureSince([]string{"storage_packer", "put_bucket"}, time.Now())
+
+	compressedBucket, err := s.encodeBucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	if err := s.persistConfig(ctx); err != nil {
+		return err
+	}
+
+	// Store the compressed value
+	err = s.view.Put(ctx, &logical.StorageEntry{
+		Key:   bucket.Key,
+		Value: compressedBucket,
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to persist packed storage entry: {{err}}", err)
+	}
+
+	return nil
+}
+
+// encodeBucket validates the bucket and returns its storage representation,
+// which is compressed unless compression is skipped for it
+func (s *StoragePacker) encodeBucket(bucket *Bucket) ([]byte, error) {
 	if bucket == nil {
-		return fmt.Errorf("nil bucket entry")
+		return nil, fmt.Errorf("nil bucket entry")
 	}
 
 	if bucket.Key == "" {
-		return fmt.Errorf("missing key")
+		return nil, fmt.Errorf("missing key")
 	}
 
 	if !strings.HasPrefix(bucket.Key, s.viewPrefix) {
-		return fmt.Errorf("incorrect prefix; bucket entry key should have %q prefix", s.viewPrefix)
+		return nil, fmt.Errorf("incorrect prefix; bucket entry key should have %q prefix", s.viewPrefix)
 	}
 
 	marshaledBucket, err := proto.Marshal(bucket)
 	if err != nil {
-		return errwrap.Wrapf("failed to marshal bucket: {{err}}", err)
+		return nil, errwrap.Wrapf("failed to marshal bucket: {{err}}", err)
 	}
 
-	compressedBucket, err := compressutil.Compress(marshaledBucket, &compressutil.CompressionConfig{
-		Type: compressutil.CompressionTypeSnappy,
-	})
+	// Compress a sample of large buckets first, to avoid compressing all of
+	// a bucket that won't get any smaller
+	if s.skipCompressionAboveRatio != 0 && len(marshaledBucket) > 2*compressionSampleSize {
+		compressedSample, err := compressBucket(marshaledBucket[:compressionSampleSize])
+		if err != nil {
+			return nil, err
+		}
+		if float64(len(compressedSample))/compressionSampleSize > s.skipCompressionAboveRatio {
+			return marshaledBucket, nil
+		}
+	}
+
+	compressedBucket, err := compressBucket(marshaledBucket)
 	if err != nil {
-		return errwrap.Wrapf("failed to compress packed bucket: {{err}}", err)
+		return nil, err
 	}
 
-	// Store the compressed value
-	err = s.view.Put(ctx, &logical.StorageEntry{
-		Key:   bucket.Key,
-		Value: compressedBucket,
+	// The marshaled bucket always starts with the tag of its key, which
+	// compressutil.Decompress doesn't mistake for a compression canary
+	if s.skipCompressionAboveRatio != 0 && float64(len(compressedBucket))/float64(len(marshaledBucket)) > s.skipCompressionAboveRatio {
+		return marshaledBucket, nil
+	}
+
+	return compressedBucket, nil
+}
+
+func compressBucket(marshaledBucket []byte) ([]byte, error) {
+	compressedBucket, err := compressutil.Compress(marshaledBucket, &compressutil.CompressionConfig{
+		Type: compressutil.CompressionTypeSnappy,
 	})
 	if err != nil {
-		return errwrap.Wrapf("failed to persist packed storage entry: {{err}}", err)
+		return nil, errwrap.Wrapf("failed to compress packed bucket: {{err}}", err)
 	}
 
-	return nil
+	return compressedBucket, nil
 }
 
 // GetItem fetches the storage entry for a given key from its corresponding
@@ -296,10 +551,43 @@ func (s *StoragePacker) GetItem(itemID string) (*Item, error) {
 	return nil, nil
 }
 
-// PutItem stores the given item in its respective bucket
+// HasItem returns whether an item with the given ID is stored, without
+// returning the item itself.
+func (s *StoragePacker) HasItem(_ context.Context, itemID string) (bool, error) {
+	defer metrics.MeasureSince([]string{"storage_packer", "has_item"}, time.Now())
+
+	if itemID == "" {
+		return false, fmt.Errorf("empty item ID")
+	}
+
+	bucket, err := s.GetBucket(s.BucketKey(itemID))
+	if err != nil {
+		return false, errwrap.Wrapf("failed to read packed storage item: {{err}}", err)
+	}
+	if bucket == nil {
+		return false, nil
+	}
+
+	for _, item := range bucket.Items {
+		if item.ID == itemID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// PutItem stores the given item in its respective bucket. The stored item's
+// version is one more than the version of the item it replaces, or 1 for a
+// new item. Once the item is persisted, the caller's item.Version is set to
+// the stored version.
 func (s *StoragePacker) PutItem(_ context.Context, item *Item) error {
 	defer metrics.MeasureSince([]string{"storage_packer", "put_item"}, time.Now())
 
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
 	if item == nil {
 		return fmt.Errorf("nil item")
 	}
@@ -308,6 +596,10 @@ func (s *StoragePacker) PutItem(_ context.Context, item *Item) error {
 		return fmt.Errorf("missing ID in item")
 	}
 
+	if err := s.itemIDValidator(item.ID); err != nil {
+		return errwrap.Wrapf("invalid item ID: {{err}}", err)
+	}
+
 	var err error
 	bucketKey := s.BucketKey(item.ID)
 
@@ -315,10 +607,15 @@ func (s *StoragePacker) PutItem(_ context.Context, item *Item) error {
 		Key: bucketKey,
 	}
 
+	// Deferred before the lock is acquired so that it runs once it is
+	// released
+	var stored []string
+	defer func() { s.notifyItemChanges(ItemChangePut, stored) }()
+
 	// In this case, we persist the storage entry regardless of the read
 	// storageEntry below is nil or not. Hence, directly acquire write lock
 	// even to read the entry.
-	lock := locksutil.LockForKey(s.storageLocks, bucketKey)
+	lock := s.lockForKey(bucketKey)
 	lock.Lock()
 	defer lock.Unlock()
 
@@ -328,11 +625,16 @@ func (s *StoragePacker) PutItem(_ context.Context, item *Item) error {
 		return errwrap.Wrapf("failed to read packed storage bucket entry: {{err}}", err)
 	}
 
+	// Only update the caller's item once it is persisted
+	updated := proto.Clone(item).(*Item)
+	updated.Version = 1
+
+	isNew := true
 	if storageEntry == nil {
 		// If the bucket entry does not exist, this will be the only item the
 		// bucket that is going to be persisted.
 		bucket.Items = []*Item{
-			item,
+			updated,
 		}
 	} else {
 		uncompressedData, notCompressed, err := compressutil.Decompress(storageEntry.Value)
@@ -348,21 +650,677 @@ func (s *StoragePacker) PutItem(_ context.Context, item *Item) error {
 			return errwrap.Wrapf("failed to decode packed storage entry: {{err}}", err)
 		}
 
-		err = bucket.upsert(item)
+		for _, bucketItem := range bucket.Items {
+			if bucketItem.ID == item.ID {
+				isNew = false
+				updated.Version = bucketItem.GetVersion() + 1
+				break
+			}
+		}
+
+		err = bucket.upsert(updated)
 		if err != nil {
 			return errwrap.Wrapf("failed to update entry in packed storage entry: {{err}}", err)
 		}
 	}
 
-	return s.putBucket(context.Background(), bucket)
+	// Reserve a slot for the new item before persisting it
+	if isNew {
+		if err := s.reserveItems(1); err != nil {
+			return err
+		}
+	}
+
+	if err := s.putBucket(context.Background(), bucket); err != nil {
+		if isNew {
+			s.adjustItemCount(-1)
+		}
+		return err
+	}
+	item.Version = updated.Version
+	stored = []string{item.ID}
+
+	return nil
+}
+
+// PutItemCAS stores the given item only if the version of the stored item
+// is expectedVersion. Otherwise ErrVersionMismatch is returned and nothing is
+// written. An expectedVersion of 0 matches an item that doesn't exist yet:
+// every write through the packer stores a version of at least 1, so the only
+// stored items with version 0 are ones written before versions were tracked.
+// On success the stored version, and the caller's item.Version, is
+// expectedVersion + 1.
+func (s *StoragePacker) PutItemCAS(ctx context.Context, item *Item, expectedVersion uint64) error {
+	defer metrics.MeasureSince([]string{"storage_packer", "put_item_cas"}, time.Now())
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	if item == nil {
+		return fmt.Errorf("nil item")
+	}
+
+	if item.ID == "" {
+		return fmt.Errorf("missing ID in item")
+	}
+
+	if err := s.itemIDValidator(item.ID); err != nil {
+		return errwrap.Wrapf("invalid item ID: {{err}}", err)
+	}
+
+	bucketKey := s.BucketKey(item.ID)
+
+	// Deferred before the lock is acquired so that it runs once it is
+	// released
+	var stored []string
+	defer func() { s.notifyItemChanges(ItemChangePut, stored) }()
+
+	lock := s.lockForKey(bucketKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucket := &Bucket{
+		Key: bucketKey,
+	}
+
+	storageEntry, err := s.view.Get(ctx, bucketKey)
+	if err != nil {
+		return errwrap.Wrapf("failed to read packed storage bucket entry: {{err}}", err)
+	}
+	if storageEntry != nil {
+		uncompressedData, notCompressed, err := compressutil.Decompress(storageEntry.Value)
+		if err != nil {
+			return errwrap.Wrapf("failed to decompress packed storage entry: {{err}}", err)
+		}
+		if notCompressed {
+			uncompressedData = storageEntry.Value
+		}
+
+		err = proto.Unmarshal(uncompressedData, bucket)
+		if err != nil {
+			return errwrap.Wrapf("failed to decode packed storage entry: {{err}}", err)
+		}
+	}
+
+	var existing *Item
+	for _, bucketItem := range bucket.Items {
+		if bucketItem.ID == item.ID {
+			existing = bucketItem
+			break
+		}
+	}
+
+	// Items that don't exist yet have version 0
+	if existing.GetVersion() != expectedVersion {
+		return ErrVersionMismatch
+	}
+
+	isNew := existing == nil
+	if isNew {
+		if err := s.reserveItems(1); err != nil {
+			return err
+		}
+	}
+
+	// Only update the caller's item once it is persisted
+	updated := proto.Clone(item).(*Item)
+	updated.Version = expectedVersion + 1
+	if err := bucket.upsert(updated); err != nil {
+		if isNew {
+			s.adjustItemCount(-1)
+		}
+		return errwrap.Wrapf("failed to update entry in packed storage entry: {{err}}", err)
+	}
+
+	if err := s.putBucket(ctx, bucket); err != nil {
+		if isNew {
+			s.adjustItemCount(-1)
+		}
+		return err
+	}
+
+	item.Version = updated.Version
+	stored = []string{item.ID}
+
+	return nil
+}
+
+// PutItemsTxn stores the given items, updating every affected bucket at
+// once. If the storage view implements physical.Transactional all buckets
+// are written in a single transaction, so either all items are stored or
+// none are. Otherwise the buckets are written one after the other. Items are
+// versioned like in PutItem, and the Version of each caller's item is set
+// once its bucket is persisted.
+func (s *StoragePacker) PutItemsTxn(ctx context.Context, items []*Item) error {
+	defer metrics.MeasureSince([]string{"storage_packer", "put_items_txn"}, time.Now())
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	// Sort the items by the bucket they will be stored in
+	lockKeys := make([]string, 0)
+	byBucket := make(map[string][]*Item)
+	for _, item := range items {
+		if item == nil {
+			return fmt.Errorf("nil item")
+		}
+
+		if item.ID == "" {
+			return fmt.Errorf("missing ID in item")
+		}
+
+		if err := s.itemIDValidator(item.ID); err != nil {
+			return errwrap.Wrapf("invalid item ID: {{err}}", err)
+		}
+
+		bucketKey := s.BucketKey(item.ID)
+		if _, ok := byBucket[bucketKey]; !ok {
+			lockKeys = append(lockKeys, bucketKey)
+		}
+		byBucket[bucketKey] = append(byBucket[bucketKey], item)
+	}
+
+	// Deferred before the locks are acquired so that it runs once they are
+	// released
+	var stored []string
+	defer func() { s.notifyItemChanges(ItemChangePut, stored) }()
+
+	locks := s.locksForKeys(lockKeys)
+	for _, lock := range locks {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	// Load every affected bucket and apply the updates in memory. The
+	// caller's items only get their new version once they are persisted.
+	versions := make(map[*Item]uint64, len(items))
+	buckets := make([]*Bucket, 0, len(byBucket))
+	newItems := make(map[string]int, len(byBucket))
+	totalNewItems := 0
+	for _, bucketKey := range lockKeys {
+		bucket := &Bucket{
+			Key: bucketKey,
+		}
+
+		storageEntry, err := s.view.Get(ctx, bucketKey)
+		if err != nil {
+			return errwrap.Wrapf("failed to read packed storage bucket entry: {{err}}", err)
+		}
+		if storageEntry != nil {
+			uncompressedData, notCompressed, err := compressutil.Decompress(storageEntry.Value)
+			if err != nil {
+				return errwrap.Wrapf("failed to decompress packed storage entry: {{err}}", err)
+			}
+			if notCompressed {
+				uncompressedData = storageEntry.Value
+			}
+
+			err = proto.Unmarshal(uncompressedData, bucket)
+			if err != nil {
+				return errwrap.Wrapf("failed to decode packed storage entry: {{err}}", err)
+			}
+		}
+
+		existing := make(map[string]uint64, len(bucket.Items))
+		for _, bucketItem := range bucket.Items {
+			existing[bucketItem.ID] = bucketItem.GetVersion()
+		}
+
+		for _, item := range byBucket[bucketKey] {
+			version, ok := existing[item.ID]
+			if !ok {
+				newItems[bucketKey]++
+			}
+			existing[item.ID] = version + 1
+			versions[item] = version + 1
+
+			updated := proto.Clone(item).(*Item)
+			updated.Version = version + 1
+			if err := bucket.upsert(updated); err != nil {
+				return errwrap.Wrapf("failed to update entry in packed storage entry: {{err}}", err)
+			}
+		}
+
+		totalNewItems += newItems[bucketKey]
+		buckets = append(buckets, bucket)
+	}
+
+	// Reserve slots for all new items before persisting them
+	if err := s.reserveItems(totalNewItems); err != nil {
+		return err
+	}
+
+	txn, ok := s.view.(physical.Transactional)
+	if !ok {
+		for i, bucket := range buckets {
+			if err := s.putBucket(ctx, bucket); err != nil {
+				// Release the slots of the items that weren't persisted
+				for _, unwritten := range buckets[i:] {
+					s.adjustItemCount(-newItems[unwritten.Key])
+				}
+				return err
+			}
+			for _, item := range byBucket[bucket.Key] {
+				item.Version = versions[item]
+				stored = append(stored, item.ID)
+			}
+		}
+		return nil
+	}
+
+	txnEntries := make([]*physical.TxnEntry, 0, len(buckets))
+	for _, bucket := range buckets {
+		compressedBucket, err := s.encodeBucket(bucket)
+		if err != nil {
+			s.adjustItemCount(-totalNewItems)
+			return err
+		}
+
+		txnEntries = append(txnEntries, &physical.TxnEntry{
+			Operation: physical.PutOperation,
+			Entry: &physical.Entry{
+				Key:   bucket.Key,
+				Value: compressedBucket,
+			},
+		})
+	}
+
+	if err := s.persistConfig(ctx); err != nil {
+		s.adjustItemCount(-totalNewItems)
+		return err
+	}
+	if err := txn.Transaction(ctx, txnEntries); err != nil {
+		s.adjustItemCount(-totalNewItems)
+		return errwrap.Wrapf("failed to persist packed storage entries: {{err}}", err)
+	}
+	for _, item := range items {
+		item.Version = versions[item]
+		stored = append(stored, item.ID)
+	}
+
+	return nil
+}
+
+// notifyItemChanges calls the OnItemChange callback, if any, for each of the
+// given items.
+func (s *StoragePacker) notifyItemChanges(op string, itemIDs []string) {
+	if s.onItemChange == nil {
+		return
+	}
+
+	for _, itemID := range itemIDs {
+		s.onItemChange(op, itemID)
+	}
+}
+
+// reserveItems increments the item count by n, failing if that would exceed
+// the maximum number of items.
+func (s *StoragePacker) reserveItems(n int) error {
+	if s.maxItems == 0 || n == 0 {
+		return nil
+	}
+
+	s.itemCountLock.Lock()
+	defer s.itemCountLock.Unlock()
+
+	if s.itemCount+n > s.maxItems {
+		return ErrMaxItemsReached
+	}
+	s.itemCount += n
+
+	return nil
+}
+
+// adjustItemCount adds delta to the item count if it is being tracked.
+func (s *StoragePacker) adjustItemCount(delta int) {
+	if s.maxItems == 0 {
+		return
+	}
+
+	s.itemCountLock.Lock()
+	s.itemCount += delta
+	s.itemCountLock.Unlock()
+}
+
+// ItemCount returns the number of items stored in the packer. If a maximum
+// number of items is configured the tracked count is returned, otherwise the
+// items are counted by reading every bucket.
+func (s *StoragePacker) ItemCount(ctx context.Context) (int, error) {
+	if s.maxItems != 0 {
+		s.itemCountLock.Lock()
+		defer s.itemCountLock.Unlock()
+		return s.itemCount, nil
+	}
+
+	return s.countItems(ctx)
+}
+
+// countItems reads every bucket and returns the total number of items.
+func (s *StoragePacker) countItems(ctx context.Context) (int, error) {
+	bucketKeys, err := s.view.List(ctx, s.viewPrefix)
+	if err != nil {
+		return 0, errwrap.Wrapf("failed to list packed storage buckets: {{err}}", err)
+	}
+
+	count := 0
+	for _, key := range bucketKeys {
+		bucket, err := s.GetBucket(s.viewPrefix + key)
+		if err != nil {
+			return 0, err
+		}
+		if bucket == nil {
+			continue
+		}
+		count += len(bucket.Items)
+	}
+
+	return count, nil
+}
+
+// VerifyReport describes the inconsistencies found by Verify.
+type VerifyReport struct {
+	// Buckets is the number of buckets that were checked.
+	Buckets int
+
+	// Items is the total number of items found in the buckets.
+	Items int
+
+	// InvalidBuckets maps the storage keys under the bucket prefix that don't
+	// hold a bucket the packer could have written to the reason why.
+	InvalidBuckets map[string]string
+
+	// MisplacedItems maps the IDs of items stored in a bucket other than the
+	// one they hash to, which GetItem can't find, to the key of the bucket
+	// they were found in.
+	MisplacedItems map[string]string
+
+	// DuplicateItems lists the IDs of items stored more than once in the same
+	// bucket.
+	DuplicateItems []string
+}
+
+// Consistent returns true if no inconsistencies were found.
+func (r *VerifyReport) Consistent() bool {
+	return len(r.InvalidBuckets) == 0 && len(r.MisplacedItems) == 0 && len(r.DuplicateItems) == 0
+}
+
+// Verify reads every bucket and checks that it is stored under a valid
+// bucket key, can be decoded, and only holds items that hash to it, each at
+// most once. Inconsistencies are returned in the report; an error is only
+// returned if storage can't be read.
+func (s *StoragePacker) Verify(ctx context.Context) (*VerifyReport, error) {
+	defer metrics.MeasureSince([]string{"storage_packer", "verify"}, time.Now())
+
+	report := &VerifyReport{
+		InvalidBuckets: make(map[string]string),
+		MisplacedItems: make(map[string]string),
+	}
+
+	keys, err := s.view.List(ctx, s.viewPrefix)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list packed storage buckets: {{err}}", err)
+	}
+
+	for _, key := range keys {
+		bucketKey := s.viewPrefix + key
+
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index >= bucketCount || strconv.Itoa(index) != key {
+			report.InvalidBuckets[bucketKey] = "not a valid bucket key"
+			continue
+		}
+
+		bucket, reason, err := s.verifyBucket(ctx, bucketKey)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			report.InvalidBuckets[bucketKey] = reason
+			continue
+		}
+		if bucket == nil {
+			continue
+		}
+
+		report.Buckets++
+		seen := make(map[string]struct{}, len(bucket.Items))
+		for _, item := range bucket.Items {
+			report.Items++
+
+			if _, ok := seen[item.ID]; ok {
+				report.DuplicateItems = append(report.DuplicateItems, item.ID)
+				continue
+			}
+			seen[item.ID] = struct{}{}
+
+			if s.BucketKey(item.ID) != bucketKey {
+				report.MisplacedItems[item.ID] = bucketKey
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// verifyBucket reads the bucket stored at the given key. If the bucket can't
+// be decoded or doesn't match its key, the reason is returned instead.
+func (s *StoragePacker) verifyBucket(ctx context.Context, bucketKey string) (*Bucket, string, error) {
+	lock := s.lockForKey(bucketKey)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	storageEntry, err := s.view.Get(ctx, bucketKey)
+	if err != nil {
+		return nil, "", errwrap.Wrapf("failed to read packed storage entry: {{err}}", err)
+	}
+	if storageEntry == nil {
+		return nil, "", nil
+	}
+
+	uncompressedData, notCompressed, err := compressutil.Decompress(storageEntry.Value)
+	if err != nil {
+		return nil, fmt.Sprintf("failed to decompress bucket: %s", err), nil
+	}
+	if notCompressed {
+		uncompressedData = storageEntry.Value
+	}
+
+	var bucket Bucket
+	if err := proto.Unmarshal(uncompressedData, &bucket); err != nil {
+		return nil, fmt.Sprintf("failed to decode bucket: %s", err), nil
+	}
+
+	if bucket.Key != bucketKey {
+		return nil, fmt.Sprintf("bucket has mismatched key %q", bucket.Key), nil
+	}
+
+	return &bucket, "", nil
+}
+
+// ExportItems writes every item stored in the packer to w, each encoded as
+// its varint length followed by the marshaled item. Buckets are read one at a
+// time, so items changed concurrently may or may not be included.
+func (s *StoragePacker) ExportItems(ctx context.Context, w io.Writer) error {
+	defer metrics.MeasureSince([]string{"storage_packer", "export_items"}, time.Now())
+
+	bucketKeys, err := s.view.List(ctx, s.viewPrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list packed storage buckets: {{err}}", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	lengthBuf := make([]byte, binary.MaxVarintLen64)
+	for _, key := range bucketKeys {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		bucket, err := s.GetBucket(s.viewPrefix + key)
+		if err != nil {
+			return err
+		}
+		if bucket == nil {
+			continue
+		}
+
+		for _, item := range bucket.Items {
+			marshaledItem, err := proto.Marshal(item)
+			if err != nil {
+				return errwrap.Wrapf("failed to marshal item: {{err}}", err)
+			}
+
+			n := binary.PutUvarint(lengthBuf, uint64(len(marshaledItem)))
+			if _, err := bw.Write(lengthBuf[:n]); err != nil {
+				return err
+			}
+			if _, err := bw.Write(marshaledItem); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ImportItems stores all items read from r, in the format written by
+// ExportItems. Items are stored in batches using PutItemsTxn, replacing
+// existing items with the same ID. If an error is returned, the batches
+// stored before it remain stored.
+func (s *StoragePacker) ImportItems(ctx context.Context, r io.Reader) error {
+	defer metrics.MeasureSince([]string{"storage_packer", "import_items"}, time.Now())
+
+	br := bufio.NewReader(r)
+	batch := make([]*Item, 0, importBatchSize)
+	for {
+		length, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errwrap.Wrapf("failed to read item length: {{err}}", err)
+		}
+		if length > maxExportedItemSize {
+			return fmt.Errorf("item of %d bytes exceeds the maximum size of %d bytes", length, maxExportedItemSize)
+		}
+
+		marshaledItem := make([]byte, length)
+		if _, err := io.ReadFull(br, marshaledItem); err != nil {
+			return errwrap.Wrapf("failed to read item: {{err}}", err)
+		}
+
+		item := new(Item)
+		if err := proto.Unmarshal(marshaledItem, item); err != nil {
+			return errwrap.Wrapf("failed to decode item: {{err}}", err)
+		}
+
+		batch = append(batch, item)
+		if len(batch) == importBatchSize {
+			if err := s.PutItemsTxn(ctx, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	return s.PutItemsTxn(ctx, batch)
+}
+
+// Estimate is the expected storage footprint of a number of items, as
+// computed by EstimateBuckets.
+type Estimate struct {
+	// Buckets is the expected number of buckets holding at least one item.
+	Buckets int
+
+	// ItemsPerBucket is the expected average number of items in a non-empty
+	// bucket.
+	ItemsPerBucket float64
+
+	// BucketSize is the expected average size in bytes of a non-empty bucket
+	// before compression.
+	BucketSize int
+
+	// StorageEntries is the expected total number of storage entries used by
+	// the packer, including its persisted config.
+	StorageEntries int
+}
+
+// EstimateBuckets estimates how the given number of items, of avgItemSize
+// bytes each when encoded, would be stored by the packer. Nothing is read
+// from or written to storage. Since items are spread uniformly over a fixed
+// number of buckets that are never split, the estimate only depends on the
+// number of items and their size.
+func (s *StoragePacker) EstimateBuckets(itemCount int, avgItemSize int) (*Estimate, error) {
+	if itemCount < 0 {
+		return nil, fmt.Errorf("item count must not be negative")
+	}
+	if avgItemSize < 0 {
+		return nil, fmt.Errorf("average item size must not be negative")
+	}
+
+	estimate := &Estimate{
+		StorageEntries: 1,
+	}
+	if itemCount == 0 {
+		return estimate, nil
+	}
+
+	// The expected number of buckets that at least one of the items hashes to
+	buckets := bucketCount * (1 - math.Pow(1-1.0/bucketCount, float64(itemCount)))
+	estimate.Buckets = int(math.Round(buckets))
+	if estimate.Buckets < 1 {
+		estimate.Buckets = 1
+	}
+	estimate.ItemsPerBucket = float64(itemCount) / buckets
+
+	// Every item is encoded with a one byte tag and the varint length of the
+	// item, and the bucket additionally holds its own key
+	encodedItemSize := 1 + varintSize(avgItemSize) + avgItemSize
+	keySize := len(s.viewPrefix) + len(strconv.Itoa(bucketCount-1))
+	estimate.BucketSize = int(math.Round(estimate.ItemsPerBucket*float64(encodedItemSize))) + 1 + varintSize(keySize) + keySize
+
+	estimate.StorageEntries += estimate.Buckets
+
+	return estimate, nil
+}
+
+// varintSize returns the number of bytes of the protobuf varint encoding of
+// n.
+func varintSize(n int) int {
+	size := 1
+	for n >= 0x80 {
+		n >>= 7
+		size++
+	}
+	return size
 }
 
 // NewStoragePacker creates a new storage packer for a given view
 func NewStoragePacker(view logical.Storage, logger log.Logger, viewPrefix string) (*StoragePacker, error) {
-	if view == nil {
+	return NewStoragePackerWithConfig(&Config{
+		View:       view,
+		Logger:     logger,
+		ViewPrefix: viewPrefix,
+	})
+}
+
+// NewStoragePackerWithConfig creates a new storage packer using the given
+// config
+func NewStoragePackerWithConfig(config *Config) (*StoragePacker, error) {
+	if config == nil {
+		return nil, fmt.Errorf("nil config")
+	}
+
+	if config.View == nil {
 		return nil, fmt.Errorf("nil view")
 	}
 
+	viewPrefix := config.ViewPrefix
 	if viewPrefix == "" {
 		viewPrefix = StoragePackerBucketsPrefix
 	}
@@ -371,13 +1329,136 @@ func NewStoragePacker(view logical.Storage, logger log.Logger, viewPrefix string
 		viewPrefix = viewPrefix + "/"
 	}
 
+	itemIDValidator := config.ItemIDValidator
+	if itemIDValidator == nil {
+		itemIDValidator = DefaultItemIDValidator
+	}
+
+	if config.MaxItems < 0 {
+		return nil, fmt.Errorf("max items must not be negative")
+	}
+
+	lockStripes := config.LockStripes
+	if lockStripes == 0 {
+		lockStripes = locksutil.LockCount
+	}
+	if lockStripes < 0 || lockStripes&(lockStripes-1) != 0 {
+		return nil, fmt.Errorf("lock stripes must be a power of two")
+	}
+	storageLocks := make([]*locksutil.LockEntry, lockStripes)
+	for i := range storageLocks {
+		storageLocks[i] = new(locksutil.LockEntry)
+	}
+
+	if config.SkipCompressionAboveRatio < 0 {
+		return nil, fmt.Errorf("skip compression above ratio must not be negative")
+	}
+
+	hashType := config.HashType
+	if hashType == "" {
+		hashType = HashTypeMD5
+	}
+	hashFunc, ok := hashFuncs[hashType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash type %q", hashType)
+	}
+
 	// Create a new packer object for the given view
 	packer := &StoragePacker{
-		view:         view,
-		viewPrefix:   viewPrefix,
-		logger:       logger,
-		storageLocks: locksutil.CreateLocks(),
+		view:            config.View,
+		viewPrefix:      viewPrefix,
+		logger:          config.Logger,
+		storageLocks:    storageLocks,
+		itemIDValidator: itemIDValidator,
+		hashFunc:        hashFunc,
+		maxItems:        config.MaxItems,
+
+		skipCompressionAboveRatio: config.SkipCompressionAboveRatio,
+		readOnly:                  config.ReadOnly,
+		onItemChange:              config.OnItemChange,
+	}
+
+	if err := packer.loadConfig(context.Background(), &persistedConfig{
+		HashType: hashType,
+	}); err != nil {
+		return nil, err
+	}
+
+	// Load the current number of items so the maximum can be enforced
+	if packer.maxItems != 0 {
+		count, err := packer.countItems(context.Background())
+		if err != nil {
+			return nil, errwrap.Wrapf("failed to count existing items: {{err}}", err)
+		}
+		packer.itemCount = count
 	}
 
 	return packer, nil
 }
+
+// configKey returns the storage key of the persisted packer configuration.
+// It is kept outside of the bucket prefix so listing buckets doesn't
+// return it.
+func (s *StoragePacker) configKey() string {
+	return strings.TrimSuffix(s.viewPrefix, "/") + "_config"
+}
+
+// loadConfig verifies that the given config matches the one persisted for
+// the packer's data. If there is none yet, it's persisted by the first write
+// of a bucket.
+func (s *StoragePacker) loadConfig(ctx context.Context, config *persistedConfig) error {
+	entry, err := s.view.Get(ctx, s.configKey())
+	if err != nil {
+		return errwrap.Wrapf("failed to read storage packer config: {{err}}", err)
+	}
+
+	if entry != nil {
+		var existing persistedConfig
+		if err := json.Unmarshal(entry.Value, &existing); err != nil {
+			return errwrap.Wrapf("failed to decode storage packer config: {{err}}", err)
+		}
+		if existing.HashType != config.HashType {
+			return fmt.Errorf("storage packer hash type %q does not match the persisted hash type %q", config.HashType, existing.HashType)
+		}
+		return nil
+	}
+
+	// Buckets written before the config was persisted were always
+	// distributed using MD5
+	bucketKeys, err := s.view.List(ctx, s.viewPrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list packed storage buckets: {{err}}", err)
+	}
+	if len(bucketKeys) > 0 && config.HashType != HashTypeMD5 {
+		return fmt.Errorf("storage packer hash type %q does not match the hash type %q of existing buckets", config.HashType, HashTypeMD5)
+	}
+
+	s.pendingConfig = config
+	return nil
+}
+
+// persistConfig persists the packer config if it wasn't persisted yet. It's
+// called before writing buckets, so that buckets are never stored without
+// the config they were distributed with.
+func (s *StoragePacker) persistConfig(ctx context.Context) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.pendingConfig == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(s.pendingConfig)
+	if err != nil {
+		return errwrap.Wrapf("failed to encode storage packer config: {{err}}", err)
+	}
+	if err := s.view.Put(ctx, &logical.StorageEntry{
+		Key:   s.configKey(),
+		Value: value,
+	}); err != nil {
+		return errwrap.Wrapf("failed to persist storage packer config: {{err}}", err)
+	}
+
+	s.pendingConfig = nil
+	return nil
+}
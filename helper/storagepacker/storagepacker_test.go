@@ -1,16 +1,30 @@
 package storagepacker
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
 	log "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/helper/identity"
+	"github.com/hashicorp/vault/sdk/helper/compressutil"
+	"github.com/hashicorp/vault/sdk/helper/cryptoutil"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/physical"
 )
 
 func BenchmarkStoragePacker(b *testing.B) {
@@ -64,6 +78,77 @@ func BenchmarkStoragePacker(b *testing.B) {
 	}
 }
 
+func BenchmarkStoragePacker_DeleteMultipleItems(b *testing.B) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	itemIDs := make([]string, 1000)
+	for i := range itemIDs {
+		itemIDs[i] = fmt.Sprintf("item%d", i)
+	}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, itemID := range itemIDs {
+			if err := storagePacker.PutItem(ctx, &Item{ID: itemID}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		if err := storagePacker.DeleteMultipleItems(ctx, nil, itemIDs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// slowStorage adds a delay to every write, like a remote storage backend
+// would, so that contention on the bucket locks becomes visible.
+type slowStorage struct {
+	logical.InmemStorage
+	delay time.Duration
+}
+
+func (s *slowStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	time.Sleep(s.delay)
+	return s.InmemStorage.Put(ctx, entry)
+}
+
+func BenchmarkStoragePacker_LockStripes(b *testing.B) {
+	for _, lockStripes := range []int{1, 16, 256, 4096} {
+		b.Run(fmt.Sprintf("%d stripes", lockStripes), func(b *testing.B) {
+			storagePacker, err := NewStoragePackerWithConfig(&Config{
+				View:        &slowStorage{delay: time.Millisecond},
+				Logger:      log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+				LockStripes: lockStripes,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx := context.Background()
+
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					itemID, err := uuid.GenerateUUID()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := storagePacker.PutItem(ctx, &Item{ID: itemID}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
 func TestStoragePacker(t *testing.T) {
 	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
 	if err != nil {
@@ -290,3 +375,1164 @@ func TestStoragePacker_DeleteMultiple_ALL(t *testing.T) {
 		}
 	}
 }
+
+// putCountingStorage counts the writes made to each key
+type putCountingStorage struct {
+	logical.InmemStorage
+	puts map[string]int
+}
+
+func (s *putCountingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	s.puts[entry.Key]++
+	return s.InmemStorage.Put(ctx, entry)
+}
+
+func TestStoragePacker_DeleteMultiple_Buckets(t *testing.T) {
+	view := &putCountingStorage{puts: make(map[string]int)}
+	storagePacker, err := NewStoragePacker(view, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	// Spread items over many buckets, with several items per bucket
+	byBucket := make(map[string][]string)
+	for i := 0; i < 1000; i++ {
+		itemID := fmt.Sprintf("item%d", i)
+		if err := storagePacker.PutItem(ctx, &Item{ID: itemID}); err != nil {
+			t.Fatal(err)
+		}
+		bucketKey := storagePacker.BucketKey(itemID)
+		byBucket[bucketKey] = append(byBucket[bucketKey], itemID)
+	}
+
+	// Delete every item of all but one bucket, along with items that were
+	// never stored
+	var keptBucket string
+	itemsToDelete := []string{"missing1", "missing2"}
+	for bucketKey, itemIDs := range byBucket {
+		if keptBucket == "" {
+			keptBucket = bucketKey
+			continue
+		}
+		itemsToDelete = append(itemsToDelete, itemIDs...)
+	}
+
+	view.puts = make(map[string]int)
+	if err := storagePacker.DeleteMultipleItems(ctx, nil, itemsToDelete); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each bucket an item was removed from is persisted exactly once, and
+	// buckets without removed items aren't persisted at all
+	for bucketKey := range byBucket {
+		expected := 1
+		if bucketKey == keptBucket {
+			expected = 0
+		}
+		if view.puts[bucketKey] != expected {
+			t.Fatalf("bad: writes to bucket %q; expected: %d\n actual: %d", bucketKey, expected, view.puts[bucketKey])
+		}
+	}
+
+	for bucketKey, itemIDs := range byBucket {
+		for _, itemID := range itemIDs {
+			fetchedItem, err := storagePacker.GetItem(itemID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bucketKey == keptBucket && fetchedItem == nil {
+				t.Fatalf("expected item %q to be kept", itemID)
+			}
+			if bucketKey != keptBucket && fetchedItem != nil {
+				t.Fatalf("expected item %q to be deleted", itemID)
+			}
+		}
+	}
+}
+
+func TestStoragePacker_ItemIDValidation(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	accepted := []string{
+		"item1",
+		"4e2b3c67-ae9c-41a7-b6ae-8d5ea3bc1b3e",
+		"ünïcödé",
+		strings.Repeat("a", DefaultMaxItemIDLength),
+	}
+	for _, id := range accepted {
+		if err := storagePacker.PutItem(ctx, &Item{ID: id}); err != nil {
+			t.Fatalf("expected item ID %q to be accepted: %v", id, err)
+		}
+	}
+
+	rejected := []string{
+		strings.Repeat("a", DefaultMaxItemIDLength+1),
+		"item\x00id",
+		"item\nid",
+		"\xff\xfe",
+	}
+	for _, id := range rejected {
+		if err := storagePacker.PutItem(ctx, &Item{ID: id}); err == nil {
+			t.Fatalf("expected item ID %q to be rejected", id)
+		}
+	}
+
+	// A custom validator replaces the default one
+	storagePacker, err = NewStoragePackerWithConfig(&Config{
+		View:   &logical.InmemStorage{},
+		Logger: log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		ItemIDValidator: func(id string) error {
+			if !strings.HasPrefix(id, "entity-") {
+				return fmt.Errorf("missing entity prefix")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storagePacker.PutItem(ctx, &Item{ID: "entity-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItem(ctx, &Item{ID: "group-1"}); err == nil {
+		t.Fatal("expected item ID to be rejected by custom validator")
+	}
+}
+
+func TestStoragePacker_MaxItems(t *testing.T) {
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:     &logical.InmemStorage{},
+		Logger:   log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		MaxItems: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := storagePacker.PutItem(ctx, &Item{ID: fmt.Sprintf("item%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := storagePacker.ItemCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("bad: item count; expected: 3\n actual: %d", count)
+	}
+
+	// Creating a new item at the cap should fail
+	err = storagePacker.PutItem(ctx, &Item{ID: "item3"})
+	if err != ErrMaxItemsReached {
+		t.Fatalf("expected ErrMaxItemsReached, got: %v", err)
+	}
+	fetchedItem, err := storagePacker.GetItem("item3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchedItem != nil {
+		t.Fatal("expected rejected item to not be stored")
+	}
+
+	// Updating an existing item at the cap should succeed
+	if err := storagePacker.PutItem(ctx, &Item{ID: "item1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting an item frees up a slot
+	if err := storagePacker.DeleteItem(ctx, "item0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItem(ctx, &Item{ID: "item3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err = storagePacker.ItemCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("bad: item count; expected: 3\n actual: %d", count)
+	}
+
+	// A new packer over the same storage picks up the existing count
+	storagePacker, err = NewStoragePackerWithConfig(&Config{
+		View:     storagePacker.View(),
+		Logger:   log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		MaxItems: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storagePacker.PutItem(ctx, &Item{ID: "item4"})
+	if err != ErrMaxItemsReached {
+		t.Fatalf("expected ErrMaxItemsReached, got: %v", err)
+	}
+}
+
+func TestStoragePacker_HashType(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+	logger := log.New(&log.LoggerOptions{Name: "storagepackertest"})
+
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:     view,
+		Logger:   logger,
+		HashType: HashTypeBlake2b256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items are distributed using the configured hash
+	expectedKey := StoragePackerBucketsPrefix + fmt.Sprint(cryptoutil.Blake2b256Hash("item1")[0])
+	if key := storagePacker.BucketKey("item1"); key != expectedKey {
+		t.Fatalf("bad: bucket key; expected: %q\n actual: %q", expectedKey, key)
+	}
+	if err := storagePacker.PutItem(ctx, &Item{ID: "item1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloading with the same hash works
+	storagePacker, err = NewStoragePackerWithConfig(&Config{
+		View:     view,
+		Logger:   logger,
+		HashType: HashTypeBlake2b256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchedItem, err := storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchedItem == nil {
+		t.Fatal("failed to read the stored item")
+	}
+
+	// Reloading with a different hash fails fast
+	for _, hashType := range []string{"", HashTypeMD5, HashTypeSHA256} {
+		_, err = NewStoragePackerWithConfig(&Config{
+			View:     view,
+			Logger:   logger,
+			HashType: hashType,
+		})
+		if err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Fatalf("expected a hash type mismatch error for %q, got: %v", hashType, err)
+		}
+	}
+
+	// Buckets written before the hash type was persisted use MD5
+	view = &logical.InmemStorage{}
+	storagePacker, err = NewStoragePacker(view, logger, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItem(ctx, &Item{ID: "item1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.Delete(ctx, storagePacker.configKey()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewStoragePackerWithConfig(&Config{
+		View:     view,
+		Logger:   logger,
+		HashType: HashTypeBlake2b256,
+	})
+	if err == nil {
+		t.Fatal("expected a hash type mismatch error for legacy buckets")
+	}
+	if _, err := NewStoragePacker(view, logger, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewStoragePackerWithConfig(&Config{
+		View:     &logical.InmemStorage{},
+		Logger:   logger,
+		HashType: "crc32",
+	}); err == nil {
+		t.Fatal("expected an error for an unsupported hash type")
+	}
+}
+
+func TestStoragePacker_PersistsConfig(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+
+	// Creating a packer doesn't write to storage, since it may not be
+	// writable yet, e.g. while a mount is set up
+	if _, err := NewStoragePacker(&readOnlyStorage{InmemStorage: view}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "packer/group/buckets"); err != nil {
+		t.Fatal(err)
+	}
+
+	storagePacker, err := NewStoragePacker(view, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "packer/group/buckets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := view.Get(ctx, "packer/group/buckets_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Fatal("expected the storage packer config not to be persisted before the first write")
+	}
+
+	// The config is persisted with the first item
+	if err := storagePacker.PutItem(ctx, &Item{ID: "item1"}); err != nil {
+		t.Fatal(err)
+	}
+	entry, err = view.Get(ctx, "packer/group/buckets_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		t.Fatal("expected the storage packer config to be persisted")
+	}
+	if entry.Key != storagePacker.configKey() {
+		t.Fatalf("bad: config key; expected: %q\n actual: %q", storagePacker.configKey(), entry.Key)
+	}
+
+	var config persistedConfig
+	if err := json.Unmarshal(entry.Value, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.HashType != HashTypeMD5 {
+		t.Fatalf("bad: hash type; expected: %q\n actual: %q", HashTypeMD5, config.HashType)
+	}
+
+	// The config is kept out of the bucket listing
+	bucketKeys, err := view.List(ctx, "packer/group/buckets/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range bucketKeys {
+		if strings.Contains(key, "config") {
+			t.Fatalf("expected only buckets, got: %v", bucketKeys)
+		}
+	}
+}
+
+// readOnlyStorage is an in-memory storage rejecting all writes
+type readOnlyStorage struct {
+	*logical.InmemStorage
+}
+
+func (s *readOnlyStorage) Put(context.Context, *logical.StorageEntry) error {
+	return logical.ErrReadOnly
+}
+
+func (s *readOnlyStorage) Delete(context.Context, string) error {
+	return logical.ErrReadOnly
+}
+
+// transactionalStorage is an in-memory storage supporting transactions that
+// fail without applying any operation if one of them is for failKey
+type transactionalStorage struct {
+	logical.InmemStorage
+	failKey string
+	txns    int
+}
+
+func (s *transactionalStorage) Transaction(ctx context.Context, txns []*physical.TxnEntry) error {
+	s.txns++
+
+	for _, txn := range txns {
+		if txn.Entry.Key == s.failKey {
+			return errors.New("simulated transaction failure")
+		}
+	}
+
+	for _, txn := range txns {
+		var err error
+		switch txn.Operation {
+		case physical.PutOperation:
+			err = s.Put(ctx, &logical.StorageEntry{
+				Key:   txn.Entry.Key,
+				Value: txn.Entry.Value,
+			})
+		case physical.DeleteOperation:
+			err = s.Delete(ctx, txn.Entry.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestStoragePacker_PutItemsTxn(t *testing.T) {
+	view := &transactionalStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:     view,
+		Logger:   log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		MaxItems: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if err := storagePacker.PutItem(ctx, &Item{ID: "existing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pick items landing in different buckets
+	var items []*Item
+	seen := make(map[string]struct{})
+	for i := 0; len(items) < 5; i++ {
+		itemID := fmt.Sprintf("item%d", i)
+		bucketKey := storagePacker.BucketKey(itemID)
+		if _, ok := seen[bucketKey]; ok {
+			continue
+		}
+		seen[bucketKey] = struct{}{}
+		items = append(items, &Item{ID: itemID})
+	}
+	items = append(items, &Item{ID: "existing"})
+
+	// A failure writing any of the buckets leaves all items unchanged
+	view.failKey = storagePacker.BucketKey(items[3].ID)
+	if err := storagePacker.PutItemsTxn(ctx, items); err == nil {
+		t.Fatal("expected an error")
+	}
+	if view.txns != 1 {
+		t.Fatalf("bad: transactions; expected: 1\n actual: %d", view.txns)
+	}
+	for _, item := range items[:5] {
+		fetchedItem, err := storagePacker.GetItem(item.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetchedItem != nil {
+			t.Fatalf("expected item %q not to be stored", item.ID)
+		}
+	}
+	count, err := storagePacker.ItemCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("bad: item count; expected: 1\n actual: %d", count)
+	}
+
+	// Without a failure all items are stored in a single transaction
+	view.failKey = ""
+	if err := storagePacker.PutItemsTxn(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	if view.txns != 2 {
+		t.Fatalf("bad: transactions; expected: 2\n actual: %d", view.txns)
+	}
+	for _, item := range items {
+		fetchedItem, err := storagePacker.GetItem(item.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetchedItem == nil {
+			t.Fatalf("expected item %q to be stored", item.ID)
+		}
+	}
+	count, err = storagePacker.ItemCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Fatalf("bad: item count; expected: 6\n actual: %d", count)
+	}
+
+	// Views without transaction support fall back to sequential writes
+	storagePacker, err = NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItemsTxn(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		fetchedItem, err := storagePacker.GetItem(item.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetchedItem == nil {
+			t.Fatalf("expected item %q to be stored", item.ID)
+		}
+	}
+}
+
+func TestStoragePacker_HasItem(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	for i := 0; i < 100; i += 2 {
+		if err := storagePacker.PutItem(ctx, &Item{ID: fmt.Sprintf("item%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// HasItem agrees with GetItem for present items, absent items in
+	// existing buckets and items in buckets that don't exist
+	for i := 0; i < 1000; i++ {
+		itemID := fmt.Sprintf("item%d", i)
+
+		exists, err := storagePacker.HasItem(ctx, itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetchedItem, err := storagePacker.GetItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != (fetchedItem != nil) {
+			t.Fatalf("bad: HasItem for %q; expected: %t\n actual: %t", itemID, fetchedItem != nil, exists)
+		}
+		if exists != (i < 100 && i%2 == 0) {
+			t.Fatalf("bad: HasItem for %q: %t", itemID, exists)
+		}
+	}
+
+	if _, err := storagePacker.HasItem(ctx, ""); err == nil {
+		t.Fatal("expected an error for an empty item ID")
+	}
+}
+
+func TestStoragePacker_PutItemCAS(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	// Only version 0 matches an item that doesn't exist yet
+	if err := storagePacker.PutItemCAS(ctx, &Item{ID: "item1"}, 1); err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch, got: %v", err)
+	}
+	item := &Item{ID: "item1"}
+	if err := storagePacker.PutItemCAS(ctx, item, 0); err != nil {
+		t.Fatal(err)
+	}
+	if item.Version != 1 {
+		t.Fatalf("bad: item version; expected: 1\n actual: %d", item.Version)
+	}
+
+	// Two writers read version 1; the first write wins and the stale one is
+	// rejected
+	first := &Item{ID: "item1", Message: mustMarshalAny(t, &identity.Entity{Name: "first"})}
+	stale := &Item{ID: "item1", Message: mustMarshalAny(t, &identity.Entity{Name: "stale"})}
+	if err := storagePacker.PutItemCAS(ctx, first, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItemCAS(ctx, stale, 1); err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch, got: %v", err)
+	}
+	if stale.Version != 0 {
+		t.Fatalf("expected rejected item's version to be unchanged, got: %d", stale.Version)
+	}
+
+	fetchedItem, err := storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchedItem.Version != 2 {
+		t.Fatalf("bad: item version; expected: 2\n actual: %d", fetchedItem.Version)
+	}
+	var entity identity.Entity
+	if err := ptypes.UnmarshalAny(fetchedItem.Message, &entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Name != "first" {
+		t.Fatalf("bad: entity name; expected: %q\n actual: %q", "first", entity.Name)
+	}
+
+	// Retrying with the current version succeeds
+	if err := storagePacker.PutItemCAS(ctx, stale, fetchedItem.Version); err != nil {
+		t.Fatal(err)
+	}
+	if stale.Version != 3 {
+		t.Fatalf("bad: item version; expected: 3\n actual: %d", stale.Version)
+	}
+
+	// Items written with PutItem are versioned too, so version 0 doesn't
+	// match them
+	for _, put := range []func(*Item) error{
+		func(item *Item) error { return storagePacker.PutItem(ctx, item) },
+		func(item *Item) error { return storagePacker.PutItemsTxn(ctx, []*Item{item}) },
+	} {
+		item := &Item{ID: "item2"}
+		if err := put(item); err != nil {
+			t.Fatal(err)
+		}
+		if err := storagePacker.PutItemCAS(ctx, &Item{ID: "item2"}, 0); err != ErrVersionMismatch {
+			t.Fatalf("expected ErrVersionMismatch, got: %v", err)
+		}
+		if err := storagePacker.PutItemCAS(ctx, &Item{ID: "item2"}, item.Version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetchedItem, err = storagePacker.GetItem("item2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchedItem.Version != 4 {
+		t.Fatalf("bad: item version; expected: 4\n actual: %d", fetchedItem.Version)
+	}
+}
+
+func mustMarshalAny(t *testing.T, message proto.Message) *any.Any {
+	t.Helper()
+
+	marshaled, err := ptypes.MarshalAny(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return marshaled
+}
+
+func TestStoragePacker_EstimateBuckets(t *testing.T) {
+	message := mustMarshalAny(t, &identity.Entity{
+		ID:   "00000000-0000-0000-0000-000000000000",
+		Name: "entity",
+		Metadata: map[string]string{
+			"team": "storage",
+		},
+	})
+
+	// Allow some deviation from the expected values, since actual items
+	// aren't perfectly uniformly distributed
+	withinTolerance := func(estimated, actual float64) bool {
+		return math.Abs(estimated-actual) <= 0.1*actual
+	}
+
+	for _, itemCount := range []int{100, 300, 3000} {
+		t.Run(fmt.Sprintf("%d items", itemCount), func(t *testing.T) {
+			ctx := context.Background()
+			view := &logical.InmemStorage{}
+			storagePacker, err := NewStoragePacker(view, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			items := make([]*Item, 0, itemCount)
+			for i := 0; i < itemCount; i++ {
+				items = append(items, &Item{
+					ID:      fmt.Sprintf("item%05d", i),
+					Message: message,
+				})
+			}
+			avgItemSize := proto.Size(items[0])
+
+			estimate, err := storagePacker.EstimateBuckets(itemCount, avgItemSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The estimate must not write anything
+			keys, err := logical.CollectKeys(ctx, view)
+			if err != nil {
+				t.Fatal(err)
+			}
+			initialEntries := len(keys)
+
+			if err := storagePacker.PutItemsTxn(ctx, items); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err = logical.CollectKeys(ctx, view)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucketKeys, err := view.List(ctx, StoragePackerBucketsPrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			totalSize := 0
+			for _, key := range bucketKeys {
+				bucket, err := storagePacker.GetBucket(StoragePackerBucketsPrefix + key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				totalSize += proto.Size(bucket)
+			}
+
+			if initialEntries != 0 {
+				t.Fatalf("expected nothing to be stored before the import, got %d entries", initialEntries)
+			}
+			if !withinTolerance(float64(estimate.Buckets), float64(len(bucketKeys))) {
+				t.Fatalf("estimated %d buckets, got %d", estimate.Buckets, len(bucketKeys))
+			}
+			if !withinTolerance(float64(estimate.StorageEntries), float64(len(keys))) {
+				t.Fatalf("estimated %d storage entries, got %d", estimate.StorageEntries, len(keys))
+			}
+			if actual := float64(itemCount) / float64(len(bucketKeys)); !withinTolerance(estimate.ItemsPerBucket, actual) {
+				t.Fatalf("estimated %f items per bucket, got %f", estimate.ItemsPerBucket, actual)
+			}
+			if actual := float64(totalSize) / float64(len(bucketKeys)); !withinTolerance(float64(estimate.BucketSize), actual) {
+				t.Fatalf("estimated buckets of %d bytes, got %f", estimate.BucketSize, actual)
+			}
+		})
+	}
+
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	estimate, err := storagePacker.EstimateBuckets(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Buckets != 0 || estimate.StorageEntries != 1 {
+		t.Fatalf("unexpected estimate for no items: %#v", estimate)
+	}
+
+	if _, err := storagePacker.EstimateBuckets(-1, 100); err == nil {
+		t.Fatal("expected an error for a negative item count")
+	}
+	if _, err := storagePacker.EstimateBuckets(100, -1); err == nil {
+		t.Fatal("expected an error for a negative item size")
+	}
+}
+
+func TestStoragePacker_LockStripes(t *testing.T) {
+	for _, lockStripes := range []int{-1, 3, 100} {
+		_, err := NewStoragePackerWithConfig(&Config{
+			View:        &logical.InmemStorage{},
+			Logger:      log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+			LockStripes: lockStripes,
+		})
+		if err == nil {
+			t.Fatalf("expected an error for %d lock stripes", lockStripes)
+		}
+	}
+
+	for _, lockStripes := range []int{0, 1, 4096} {
+		storagePacker, err := NewStoragePackerWithConfig(&Config{
+			View:        &logical.InmemStorage{},
+			Logger:      log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+			LockStripes: lockStripes,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := lockStripes
+		if expected == 0 {
+			expected = locksutil.LockCount
+		}
+		if len(storagePacker.storageLocks) != expected {
+			t.Fatalf("expected %d locks, got %d", expected, len(storagePacker.storageLocks))
+		}
+
+		// Updating items of many buckets at once must acquire every lock
+		// only once
+		var items []*Item
+		for i := 0; i < 1000; i++ {
+			items = append(items, &Item{ID: fmt.Sprintf("item%d", i)})
+		}
+		if err := storagePacker.PutItemsTxn(context.Background(), items); err != nil {
+			t.Fatal(err)
+		}
+		count, err := storagePacker.ItemCount(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(items) {
+			t.Fatalf("expected %d items, got %d", len(items), count)
+		}
+	}
+}
+
+func TestStoragePacker_Verify(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePacker(view, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []*Item
+	for i := 0; i < 100; i++ {
+		items = append(items, &Item{ID: fmt.Sprintf("item%d", i)})
+	}
+	if err := storagePacker.PutItemsTxn(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := storagePacker.Verify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() || report.Items != len(items) {
+		t.Fatalf("unexpected report: %#v", report)
+	}
+
+	putBucket := func(storageKey string, bucket *Bucket) {
+		t.Helper()
+		value, err := storagePacker.encodeBucket(bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := view.Put(ctx, &logical.StorageEntry{Key: storageKey, Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Store item0 a second time in its bucket, and item1 in another bucket
+	bucketKey := storagePacker.BucketKey("item0")
+	bucket, err := storagePacker.GetBucket(bucketKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket.Items = append(bucket.Items, &Item{ID: "item0"})
+	if storagePacker.BucketKey("item1") == bucketKey {
+		t.Fatal("expected item0 and item1 to be in different buckets")
+	}
+	bucket.Items = append(bucket.Items, &Item{ID: "item1"})
+	putBucket(bucketKey, bucket)
+
+	// Store entries that aren't valid buckets
+	invalidKey := StoragePackerBucketsPrefix + "256"
+	putBucket(invalidKey, &Bucket{Key: invalidKey})
+	corruptKey := StoragePackerBucketsPrefix + "corrupt"
+	if err := view.Put(ctx, &logical.StorageEntry{Key: corruptKey, Value: []byte("corrupt")}); err != nil {
+		t.Fatal(err)
+	}
+	var emptyIndex int
+	for emptyIndex = 0; emptyIndex < bucketCount; emptyIndex++ {
+		if entry, err := view.Get(ctx, StoragePackerBucketsPrefix+strconv.Itoa(emptyIndex)); err != nil {
+			t.Fatal(err)
+		} else if entry == nil {
+			break
+		}
+	}
+	mismatchedKey := StoragePackerBucketsPrefix + strconv.Itoa(emptyIndex)
+	putBucket(mismatchedKey, &Bucket{Key: bucketKey})
+
+	report, err = storagePacker.Verify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Consistent() {
+		t.Fatal("expected inconsistencies")
+	}
+	if report.Items != len(items)+2 {
+		t.Fatalf("expected %d items, got %d", len(items)+2, report.Items)
+	}
+	if !reflect.DeepEqual(report.DuplicateItems, []string{"item0"}) {
+		t.Fatalf("unexpected duplicate items: %v", report.DuplicateItems)
+	}
+	if !reflect.DeepEqual(report.MisplacedItems, map[string]string{"item1": bucketKey}) {
+		t.Fatalf("unexpected misplaced items: %v", report.MisplacedItems)
+	}
+	if len(report.InvalidBuckets) != 3 {
+		t.Fatalf("expected 3 invalid buckets, got: %v", report.InvalidBuckets)
+	}
+	for _, key := range []string{invalidKey, corruptKey, mismatchedKey} {
+		if _, ok := report.InvalidBuckets[key]; !ok {
+			t.Fatalf("expected %q to be reported as invalid, got: %v", key, report.InvalidBuckets)
+		}
+	}
+}
+
+func TestStoragePacker_SkipCompression(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := NewStoragePackerWithConfig(&Config{
+		View:                      &logical.InmemStorage{},
+		Logger:                    log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		SkipCompressionAboveRatio: -1,
+	})
+	if err == nil {
+		t.Fatal("expected an error for a negative ratio")
+	}
+
+	randomItem := func(id string, size int) *Item {
+		value := make([]byte, size)
+		if _, err := rand.Read(value); err != nil {
+			t.Fatal(err)
+		}
+		return &Item{ID: id, Message: &any.Any{TypeUrl: "random", Value: value}}
+	}
+	zeroItem := func(id string, size int) *Item {
+		return &Item{ID: id, Message: &any.Any{TypeUrl: "zero", Value: make([]byte, size)}}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		ratio      float64
+		item       *Item
+		compressed bool
+	}{
+		{"disabled", 0, randomItem("item", 1024), true},
+		{"random", 0.9, randomItem("item", 1024), false},
+		{"random sampled", 0.9, randomItem("item", 4*compressionSampleSize), false},
+		{"zero", 0.9, zeroItem("item", 1024), true},
+		{"zero sampled", 0.9, zeroItem("item", 4*compressionSampleSize), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			view := &logical.InmemStorage{}
+			storagePacker, err := NewStoragePackerWithConfig(&Config{
+				View:                      view,
+				Logger:                    log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+				SkipCompressionAboveRatio: tc.ratio,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := storagePacker.PutItem(ctx, tc.item); err != nil {
+				t.Fatal(err)
+			}
+
+			entry, err := view.Get(ctx, storagePacker.BucketKey(tc.item.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := entry.Value[0] == compressutil.CompressionCanarySnappy; compressed != tc.compressed {
+				t.Fatalf("expected compressed to be %t", tc.compressed)
+			}
+
+			fetchedItem, err := storagePacker.GetItem(tc.item.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fetchedItem == nil || !proto.Equal(fetchedItem, tc.item) {
+				t.Fatal("stored item doesn't match")
+			}
+		})
+	}
+}
+
+func TestStoragePacker_ReadOnly(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+
+	// A read-only packer doesn't even persist its config
+	if _, err := NewStoragePackerWithConfig(&Config{
+		View:     view,
+		Logger:   log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		ReadOnly: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := logical.CollectKeys(ctx, view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected nothing to be written, got: %v", keys)
+	}
+
+	storagePacker, err := NewStoragePacker(view, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItem(ctx, &Item{ID: "item1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	readOnlyPacker, err := NewStoragePackerWithConfig(&Config{
+		View:     view,
+		Logger:   log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		ReadOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, write := range map[string]func() error{
+		"PutItem": func() error {
+			return readOnlyPacker.PutItem(ctx, &Item{ID: "item2"})
+		},
+		"PutItemCAS": func() error {
+			return readOnlyPacker.PutItemCAS(ctx, &Item{ID: "item2"}, 0)
+		},
+		"PutItemsTxn": func() error {
+			return readOnlyPacker.PutItemsTxn(ctx, []*Item{{ID: "item2"}})
+		},
+		"DeleteItem": func() error {
+			return readOnlyPacker.DeleteItem(ctx, "item1")
+		},
+		"DeleteMultipleItems": func() error {
+			return readOnlyPacker.DeleteMultipleItems(ctx, nil, []string{"item1"})
+		},
+	} {
+		if err := write(); err != ErrReadOnly {
+			t.Fatalf("%s: expected ErrReadOnly, got: %v", name, err)
+		}
+	}
+
+	item, err := readOnlyPacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil {
+		t.Fatal("expected item1 to be readable")
+	}
+	for _, id := range []string{"item1", "item2"} {
+		ok, err := readOnlyPacker.HasItem(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (id == "item1") {
+			t.Fatalf("unexpected HasItem(%q): %t", id, ok)
+		}
+	}
+	count, err := readOnlyPacker.ItemCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 item, got %d", count)
+	}
+}
+
+func TestStoragePacker_OnItemChange(t *testing.T) {
+	ctx := context.Background()
+
+	var storagePacker *StoragePacker
+	var changes []string
+	onItemChange := func(op, itemID string) {
+		// The bucket locks must be released, so reading the item works
+		item, err := storagePacker.GetItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (item != nil) != (op == ItemChangePut) {
+			t.Fatalf("unexpected item for %s of %q: %v", op, itemID, item)
+		}
+		changes = append(changes, op+" "+itemID)
+	}
+
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:         &logical.InmemStorage{},
+		Logger:       log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		OnItemChange: onItemChange,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storagePacker.PutItem(ctx, &Item{ID: "item1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItemCAS(ctx, &Item{ID: "item2"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItemCAS(ctx, &Item{ID: "item2"}, 0); err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch, got: %v", err)
+	}
+	if err := storagePacker.PutItemsTxn(ctx, []*Item{{ID: "item3"}, {ID: "item4"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.DeleteItem(ctx, "item1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.DeleteMultipleItems(ctx, nil, []string{"item2", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"put item1",
+		"put item2",
+		"put item3",
+		"put item4",
+		"delete item1",
+		"delete item2",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestStoragePacker_ExportImportItems(t *testing.T) {
+	ctx := context.Background()
+
+	source, err := NewStoragePacker(&logical.InmemStorage{}, log.New(&log.LoggerOptions{Name: "storagepackertest"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []*Item
+	for i := 0; i < 2500; i++ {
+		items = append(items, &Item{
+			ID:      fmt.Sprintf("item%d", i),
+			Message: mustMarshalAny(t, &identity.Entity{Name: fmt.Sprintf("entity%d", i)}),
+		})
+	}
+	if err := source.PutItemsTxn(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.PutItemCAS(ctx, &Item{ID: "versioned"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := source.ExportItems(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.Bytes()
+
+	// The items are independent of how the packer distributes them
+	target, err := NewStoragePackerWithConfig(&Config{
+		View:       &logical.InmemStorage{},
+		Logger:     log.New(&log.LoggerOptions{Name: "storagepackertest"}),
+		ViewPrefix: "imported/",
+		HashType:   HashTypeSHA256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.ImportItems(ctx, bytes.NewReader(exported)); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := target.ItemCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(items)+1 {
+		t.Fatalf("expected %d items, got %d", len(items)+1, count)
+	}
+	for _, item := range items {
+		imported, err := target.GetItem(item.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported == nil || !proto.Equal(imported, item) {
+			t.Fatalf("imported item %q doesn't match", item.ID)
+		}
+	}
+	versioned, err := target.GetItem("versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versioned.GetVersion() != 1 {
+		t.Fatalf("expected the item version to be preserved, got %d", versioned.GetVersion())
+	}
+
+	// Truncated exports are rejected
+	if err := target.ImportItems(ctx, bytes.NewReader(exported[:len(exported)-1])); err == nil {
+		t.Fatal("expected an error for a truncated export")
+	}
+}
@@ -16,19 +16,26 @@ func PrepareMySQLTestContainer(t *testing.T, legacy bool, pw string) (cleanup fu
 		return func() {}, os.Getenv("MYSQL_URL")
 	}
 
-	pool, err := dockertest.NewPool("")
-	if err != nil {
-		t.Fatalf("Failed to connect to docker: %s", err)
-	}
-
 	imageVersion := "5.7"
 	if legacy {
 		imageVersion = "5.6"
 	}
 
-	resource, err := pool.Run("mysql", imageVersion, []string{"MYSQL_ROOT_PASSWORD=" + pw})
+	return PrepareTestContainerWithImage(t, "mysql", imageVersion, pw)
+}
+
+// PrepareTestContainerWithImage starts a container of the given MySQL
+// compatible image, such as mysql:8.0 or mariadb:10.5, with the given root
+// password.
+func PrepareTestContainerWithImage(t *testing.T, repository, tag, pw string) (cleanup func(), retURL string) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Fatalf("Failed to connect to docker: %s", err)
+	}
+
+	resource, err := pool.Run(repository, tag, []string{"MYSQL_ROOT_PASSWORD=" + pw})
 	if err != nil {
-		t.Fatalf("Could not start local MySQL docker container: %s", err)
+		t.Fatalf("Could not start local %s docker container: %s", repository, err)
 	}
 
 	cleanup = func() {
@@ -49,7 +56,7 @@ func PrepareMySQLTestContainer(t *testing.T, legacy bool, pw string) (cleanup fu
 		return db.Ping()
 	}); err != nil {
 		cleanup()
-		t.Fatalf("Could not connect to MySQL docker container: %s", err)
+		t.Fatalf("Could not connect to %s docker container: %s", repository, err)
 	}
 
 	return
@@ -0,0 +1,148 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// defaultApplyBatchSize is the maximum number of operations coalesced into a
+// single log when 'apply_batch_size' isn't set.
+const defaultApplyBatchSize = 128
+
+// applyBatcher coalesces the commands of concurrent writes into a single log,
+// so that they share the cost of a replication round trip. The first write of
+// a batch applies it on behalf of all of them as soon as no other batch is
+// being applied, or after linger at the latest, so that writes only wait for
+// each other under load. Since the operations of a log are applied to the FSM
+// in a single transaction, each write of a batch gets the same result.
+type applyBatcher struct {
+	// apply applies a log, normally RaftBackend.applyLog.
+	apply func(context.Context, *LogData) error
+
+	// maxOps and maxBytes bound the number of operations and the encoded
+	// size of a batch.
+	maxOps   int
+	maxBytes int
+
+	// linger is how long the first write of a batch waits for the batch
+	// being applied, if any, before applying its own anyway.
+	linger time.Duration
+
+	// applying holds a token while a batch is being applied.
+	applying chan struct{}
+
+	l       sync.Mutex
+	pending *applyBatch
+}
+
+// applyBatch is a batch of commands being collected or applied.
+type applyBatch struct {
+	command *LogData
+	size    int
+
+	// full is closed when no more commands can join the batch, to apply it
+	// without waiting for the rest of the linger.
+	full chan struct{}
+
+	// done is closed once the batch has been applied, and err set to its
+	// result.
+	done chan struct{}
+	err  error
+}
+
+func newApplyBatcher(apply func(context.Context, *LogData) error, maxOps, maxBytes int, linger time.Duration) *applyBatcher {
+	return &applyBatcher{
+		apply:    apply,
+		maxOps:   maxOps,
+		maxBytes: maxBytes,
+		linger:   linger,
+		applying: make(chan struct{}, 1),
+	}
+}
+
+// applyLog applies the command as part of a batch and returns the result of
+// the batch. Commands that can't fit in a batch are applied on their own.
+func (a *applyBatcher) applyLog(ctx context.Context, command *LogData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The encoding of a log is the concatenation of the encodings of its
+	// operations, so the sizes of the commands add up to the batch's
+	size := proto.Size(command)
+	if size > a.maxBytes || len(command.Operations) > a.maxOps {
+		return a.apply(ctx, command)
+	}
+
+	a.l.Lock()
+	if batch := a.pending; batch != nil {
+		if len(batch.command.Operations)+len(command.Operations) <= a.maxOps && batch.size+size <= a.maxBytes {
+			batch.command.Operations = append(batch.command.Operations, command.Operations...)
+			batch.size += size
+			if len(batch.command.Operations) == a.maxOps || batch.size == a.maxBytes {
+				a.closePending()
+			}
+			a.l.Unlock()
+
+			select {
+			case <-batch.done:
+				return batch.err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// The command doesn't fit, so apply the pending batch now and start
+		// a new one
+		a.closePending()
+	}
+
+	batch := &applyBatch{
+		command: &LogData{
+			Operations: append([]*LogOperation(nil), command.Operations...),
+		},
+		size: size,
+		full: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	a.pending = batch
+	a.l.Unlock()
+
+	// Other writes can join the batch while it waits for the one being
+	// applied
+	var applying bool
+	timer := time.NewTimer(a.linger)
+	select {
+	case a.applying <- struct{}{}:
+		applying = true
+	case <-batch.full:
+	case <-timer.C:
+	}
+	timer.Stop()
+
+	a.l.Lock()
+	if a.pending == batch {
+		a.pending = nil
+	}
+	a.l.Unlock()
+
+	// The batch is applied regardless of this write's context, since the
+	// other writes of the batch are waiting on it
+	batch.err = a.apply(context.Background(), batch.command)
+	close(batch.done)
+	if applying {
+		<-a.applying
+	}
+
+	return batch.err
+}
+
+// closePending stops commands from joining the pending batch. The caller must
+// hold the lock.
+func (a *applyBatcher) closePending() {
+	close(a.pending.full)
+	a.pending = nil
+}
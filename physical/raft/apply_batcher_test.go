@@ -0,0 +1,189 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/hashicorp/vault/sdk/physical"
+)
+
+func TestApplyBatcher_Results(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	// Batches fail if any of their operations is on a "fail" key. Applying
+	// takes a while, so that writes accumulate meanwhile.
+	var l sync.Mutex
+	batchOf := make(map[string]int)
+	var batchErrs []error
+	apply := func(ctx context.Context, command *LogData) error {
+		time.Sleep(10 * time.Millisecond)
+
+		l.Lock()
+		defer l.Unlock()
+
+		var err error
+		for _, op := range command.Operations {
+			if op.Key == "fail" {
+				err = errFailed
+			}
+		}
+		for _, op := range command.Operations {
+			batchOf[op.Key] = len(batchErrs)
+		}
+		batchErrs = append(batchErrs, err)
+		return err
+	}
+
+	batcher := newApplyBatcher(apply, 4, 1024, 100*time.Millisecond)
+
+	keys := []string{"fail"}
+	for i := 0; i < 15; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+
+	results := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			err := batcher.applyLog(context.Background(), &LogData{
+				Operations: []*LogOperation{
+					&LogOperation{OpType: putOp, Key: key, Value: []byte("value")},
+				},
+			})
+			l.Lock()
+			results[key] = err
+			l.Unlock()
+		}(key)
+	}
+	wg.Wait()
+
+	if len(batchErrs) >= len(keys) {
+		t.Fatalf("writes weren't batched: %d logs for %d writes", len(batchErrs), len(keys))
+	}
+	for _, key := range keys {
+		if expected := batchErrs[batchOf[key]]; results[key] != expected {
+			t.Fatalf("bad: result of %q; expected: %v\n actual: %v", key, expected, results[key])
+		}
+	}
+	if results["fail"] != errFailed {
+		t.Fatalf("bad: result of failed write: %v", results["fail"])
+	}
+
+	// Commands too large to be batched are applied on their own
+	large := &LogData{
+		Operations: []*LogOperation{
+			&LogOperation{OpType: putOp, Key: "large", Value: make([]byte, 2048)},
+		},
+	}
+	logs := len(batchErrs)
+	if err := batcher.applyLog(context.Background(), large); err != nil {
+		t.Fatal(err)
+	}
+	if len(batchErrs) != logs+1 || batchOf["large"] != logs {
+		t.Fatal("large command wasn't applied on its own")
+	}
+	if proto.Size(large) <= batcher.maxBytes {
+		t.Fatal("large command fits in a batch")
+	}
+
+	// Writes that give up waiting return their context's error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := batcher.applyLog(ctx, &LogData{
+		Operations: []*LogOperation{
+			&LogOperation{OpType: putOp, Key: "cancelled", Value: []byte("value")},
+		},
+	})
+	if err != context.Canceled {
+		t.Fatalf("bad: result of cancelled write: %v", err)
+	}
+}
+
+func TestRaft_ApplyBatching(t *testing.T) {
+	b, dir := getRaft(t, true, false)
+	defer os.RemoveAll(dir)
+
+	b.applyBatcher = newApplyBatcher(b.applyLog, defaultApplyBatchSize, int(b.maxEntrySize), 10*time.Millisecond)
+
+	ctx := context.Background()
+	start := b.AppliedIndex()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errCh <- b.Put(ctx, &physical.Entry{Key: fmt.Sprintf("key-%d", i), Value: []byte(fmt.Sprintf("value-%d", i))})
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if logs := b.AppliedIndex() - start; logs >= 100 {
+		t.Fatalf("writes weren't batched: %d logs for 100 writes", logs)
+	}
+
+	for i := 0; i < 100; i++ {
+		entry, err := b.Get(ctx, fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || string(entry.Value) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("bad: entry %d: %v", i, entry)
+		}
+	}
+}
+
+func BenchmarkApplyBatcher(b *testing.B) {
+	// Logs are applied one at a time, each paying for a replication round
+	// trip
+	var l sync.Mutex
+	apply := func(ctx context.Context, command *LogData) error {
+		l.Lock()
+		defer l.Unlock()
+		time.Sleep(100 * time.Microsecond)
+		return nil
+	}
+
+	bench := func(b *testing.B, batched bool) {
+		applyLog := apply
+		if batched {
+			applyLog = newApplyBatcher(apply, defaultApplyBatchSize, int(defaultMaxEntrySize), time.Millisecond).applyLog
+		}
+
+		ctx := context.Background()
+		command := &LogData{
+			Operations: []*LogOperation{
+				&LogOperation{OpType: putOp, Key: "key", Value: []byte("value")},
+			},
+		}
+
+		b.SetParallelism(32)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := applyLog(ctx, command); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("unbatched", func(b *testing.B) { bench(b, false) })
+	b.Run("batched", func(b *testing.B) { bench(b, true) })
+}
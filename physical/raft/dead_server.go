@@ -0,0 +1,216 @@
+package raft
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var (
+	// defaultDeadServerLastContactThreshold is how long a server may be
+	// unreachable before the dead server reconciler removes it, if
+	// 'dead_server_last_contact_threshold' is not configured.
+	defaultDeadServerLastContactThreshold = 24 * time.Hour
+
+	// deadServerCheckInterval is how often the leader looks for dead servers.
+	deadServerCheckInterval = 10 * time.Second
+)
+
+// ServerStatsSource reports when each server in the raft configuration was
+// last known to be reachable. It is used by the dead server reconciler to
+// decide which servers have gone away.
+type ServerStatsSource interface {
+	// LastContact returns the last time the server with the given ID was
+	// successfully contacted, and false if it has never been contacted.
+	LastContact(id raft.ServerID) (time.Time, bool)
+}
+
+// contactTrackingTransport wraps a raft transport and records the last time
+// each server responded to an AppendEntries RPC. The leader sends these as
+// heartbeats to every follower, so on the leader this tracks the
+// reachability of the whole cluster.
+type contactTrackingTransport struct {
+	raft.Transport
+
+	l           sync.RWMutex
+	lastContact map[raft.ServerID]time.Time
+}
+
+var _ ServerStatsSource = (*contactTrackingTransport)(nil)
+
+func newContactTrackingTransport(trans raft.Transport) *contactTrackingTransport {
+	return &contactTrackingTransport{
+		Transport:   trans,
+		lastContact: make(map[raft.ServerID]time.Time),
+	}
+}
+
+// AppendEntries implements raft.Transport and records successful contact
+// with the target server.
+func (t *contactTrackingTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	if err := t.Transport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+
+	t.l.Lock()
+	t.lastContact[id] = time.Now()
+	t.l.Unlock()
+
+	return nil
+}
+
+// Close closes the wrapped transport if it supports it, so that raft can
+// still release its resources on shutdown.
+func (t *contactTrackingTransport) Close() error {
+	if closeable, ok := t.Transport.(raft.WithClose); ok {
+		return closeable.Close()
+	}
+	return nil
+}
+
+// LastContact implements ServerStatsSource.
+func (t *contactTrackingTransport) LastContact(id raft.ServerID) (time.Time, bool) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	lastContact, ok := t.lastContact[id]
+	return lastContact, ok
+}
+
+// reset forgets all recorded contacts. Contacts are only recorded while this
+// node is leader, so when it becomes leader again the ones left over from an
+// earlier term are stale.
+func (t *contactTrackingTransport) reset() {
+	t.l.Lock()
+	t.lastContact = make(map[raft.ServerID]time.Time)
+	t.l.Unlock()
+}
+
+// SetServerStatsSource sets the source the dead server reconciler uses to
+// determine when servers were last reachable. By default the leader tracks
+// the heartbeats it sends to followers. It must be called before the cluster
+// is set up.
+func (b *RaftBackend) SetServerStatsSource(source ServerStatsSource) {
+	b.l.Lock()
+	b.serverStats = source
+	b.l.Unlock()
+}
+
+// reconcileDeadServers periodically removes servers that have been
+// unreachable for longer than the configured threshold from the raft
+// configuration until stopCh is closed. Only the leader makes changes, and
+// only when the remaining healthy voters still form a quorum.
+func (b *RaftBackend) reconcileDeadServers(raftObj *raft.Raft, stats ServerStatsSource, stopCh <-chan struct{}) {
+	// firstSeen records when servers the stats source has never contacted
+	// were first observed in the configuration, so that they are given the
+	// full threshold to become reachable.
+	firstSeen := make(map[raft.ServerID]time.Time)
+	isLeader := false
+
+	ticker := time.NewTicker(b.deadServerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+
+		if raftObj.State() != raft.Leader {
+			isLeader = false
+			continue
+		}
+
+		if !isLeader {
+			// A new leader starts counting again, without the contacts its
+			// transport recorded during an earlier term
+			isLeader = true
+			firstSeen = make(map[raft.ServerID]time.Time)
+			if tracker, ok := stats.(*contactTrackingTransport); ok {
+				tracker.reset()
+			}
+		}
+
+		if err := b.removeDeadServers(raftObj, stats, firstSeen); err != nil {
+			b.logger.Error("failed to remove dead servers", "error", err)
+		}
+	}
+}
+
+// removeDeadServers performs a single pass of the dead server reconciler.
+func (b *RaftBackend) removeDeadServers(raftObj *raft.Raft, stats ServerStatsSource, firstSeen map[raft.ServerID]time.Time) error {
+	future := raftObj.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	index := future.Index()
+	servers := future.Configuration().Servers
+
+	now := time.Now()
+	current := make(map[raft.ServerID]struct{}, len(servers))
+
+	var voters, healthyVoters int
+	var dead []raft.Server
+	for _, server := range servers {
+		current[server.ID] = struct{}{}
+
+		isDead := false
+		if server.ID != raft.ServerID(b.localID) {
+			lastContact, ok := stats.LastContact(server.ID)
+			if !ok {
+				if _, seen := firstSeen[server.ID]; !seen {
+					firstSeen[server.ID] = now
+				}
+				lastContact = firstSeen[server.ID]
+			}
+			isDead = now.Sub(lastContact) > b.deadServerThreshold
+		}
+
+		if server.Suffrage == raft.Voter {
+			voters++
+			if !isDead {
+				healthyVoters++
+			}
+		}
+		if isDead {
+			dead = append(dead, server)
+		}
+	}
+
+	for id := range firstSeen {
+		if _, ok := current[id]; !ok {
+			delete(firstSeen, id)
+		}
+	}
+
+	sort.Slice(dead, func(i, j int) bool { return dead[i].ID < dead[j].ID })
+
+	for _, server := range dead {
+		if server.Suffrage == raft.Voter {
+			// The healthy voters must be a majority of the current voters,
+			// so that the removal itself can be committed
+			if healthyVoters < voters/2+1 {
+				b.logger.Warn("not removing dead server, doing so would break quorum", "id", server.ID, "voters", voters, "healthy_voters", healthyVoters)
+				continue
+			}
+		}
+
+		b.logger.Info("removing dead server", "id", server.ID, "address", server.Address, "threshold", b.deadServerThreshold.String())
+
+		removeFuture := raftObj.RemoveServer(server.ID, index, 0)
+		if err := removeFuture.Error(); err != nil {
+			return err
+		}
+		index = removeFuture.Index()
+
+		if server.Suffrage == raft.Voter {
+			voters--
+		}
+		delete(firstSeen, server.ID)
+	}
+
+	return nil
+}
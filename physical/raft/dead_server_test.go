@@ -0,0 +1,183 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+type fakeServerStats struct {
+	l           sync.Mutex
+	lastContact map[raft.ServerID]time.Time
+}
+
+func (f *fakeServerStats) set(id string, lastContact time.Time) {
+	f.l.Lock()
+	f.lastContact[raft.ServerID(id)] = lastContact
+	f.l.Unlock()
+}
+
+func (f *fakeServerStats) LastContact(id raft.ServerID) (time.Time, bool) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	lastContact, ok := f.lastContact[id]
+	return lastContact, ok
+}
+
+func TestRaft_DeadServerCleanup(t *testing.T) {
+	raftDir, err := ioutil.TempDir("", "vault-raft-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(raftDir)
+
+	backendRaw, err := NewRaftBackend(map[string]string{
+		"path":                               raftDir,
+		"node_id":                            "raft1",
+		"dead_server_cleanup":                "true",
+		"dead_server_last_contact_threshold": "1m",
+	}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raft1 := backendRaw.(*RaftBackend)
+	raft1.deadServerCheckInterval = 50 * time.Millisecond
+
+	stats := &fakeServerStats{lastContact: make(map[raft.ServerID]time.Time)}
+	raft1.SetServerStatsSource(stats)
+
+	if err := raft1.Bootstrap([]Peer{{ID: raft1.NodeID(), Address: raft1.NodeID()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := raft1.SetupCluster(context.Background(), SetupOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	defer raft1.TeardownCluster(nil)
+	waitForLeader(t, raft1)
+
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir2)
+	raft3, dir3 := getRaft(t, false, true)
+	defer os.RemoveAll(dir3)
+
+	addPeer(t, raft1, raft2)
+	addPeer(t, raft1, raft3)
+
+	// Both followers are dead, so they can't be removed without breaking
+	// quorum
+	dead := time.Now().Add(-time.Hour)
+	stats.set(raft2.NodeID(), dead)
+	stats.set(raft3.NodeID(), dead)
+
+	servers := func() map[string]bool {
+		t.Helper()
+		config, err := raft1.GetConfiguration(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := make(map[string]bool)
+		for _, server := range config.Servers {
+			ret[server.NodeID] = true
+		}
+		return ret
+	}
+
+	time.Sleep(10 * raft1.deadServerCheckInterval)
+	if len(servers()) != 3 {
+		t.Fatalf("expected no servers to be removed without a quorum, got: %v", servers())
+	}
+
+	// Once raft2 is reachable again, raft3 can be removed safely
+	stats.set(raft2.NodeID(), time.Now().Add(time.Hour))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for servers()[raft3.NodeID()] {
+		if time.Now().After(deadline) {
+			t.Fatalf("dead server was not removed: %v", servers())
+		}
+		time.Sleep(raft1.deadServerCheckInterval)
+	}
+
+	if current := servers(); len(current) != 2 || !current[raft1.NodeID()] || !current[raft2.NodeID()] {
+		t.Fatalf("unexpected servers: %v", current)
+	}
+}
+
+func TestRaft_DeadServerCleanup_StaleContacts(t *testing.T) {
+	raftDir, err := ioutil.TempDir("", "vault-raft-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(raftDir)
+
+	backendRaw, err := NewRaftBackend(map[string]string{
+		"path":                               raftDir,
+		"node_id":                            "raft1",
+		"dead_server_cleanup":                "true",
+		"dead_server_last_contact_threshold": "1m",
+	}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raft1 := backendRaw.(*RaftBackend)
+	raft1.deadServerCheckInterval = 50 * time.Millisecond
+
+	// The tracker still holds a contact from a term in which this node was
+	// previously leader
+	tracker := newContactTrackingTransport(nil)
+	tracker.lastContact["raft2"] = time.Now().Add(-time.Hour)
+	raft1.SetServerStatsSource(tracker)
+
+	if err := raft1.Bootstrap([]Peer{{ID: raft1.NodeID(), Address: raft1.NodeID()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := raft1.SetupCluster(context.Background(), SetupOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	defer raft1.TeardownCluster(nil)
+	waitForLeader(t, raft1)
+
+	if err := raft1.raft.AddNonvoter("raft2", "raft2", 0, 0).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale contact must not get raft2 removed before the threshold has
+	// passed in the current term
+	time.Sleep(10 * raft1.deadServerCheckInterval)
+	config, err := raft1.GetConfiguration(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 2 {
+		t.Fatalf("expected raft2 not to be removed, got: %#v", config.Servers)
+	}
+	if _, ok := tracker.LastContact("raft2"); ok {
+		t.Fatal("expected the stale contact to be forgotten")
+	}
+}
+
+func TestRaft_DeadServerCleanup_Config(t *testing.T) {
+	raftDir, err := ioutil.TempDir("", "vault-raft-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(raftDir)
+
+	for key, value := range map[string]string{
+		"dead_server_cleanup":                "maybe",
+		"dead_server_last_contact_threshold": "0",
+	} {
+		conf := map[string]string{"path": raftDir, "node_id": "raft1"}
+		conf[key] = value
+		if _, err := NewRaftBackend(conf, hclog.NewNullLogger()); err == nil {
+			t.Fatalf("expected an error for %s=%q", key, value)
+		}
+	}
+}
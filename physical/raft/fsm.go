@@ -20,6 +20,7 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/go-raftchunking"
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/vault/helper/metricsutil"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
 	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/physical"
@@ -82,6 +83,10 @@ type FSM struct {
 	// retoreCb is called after we've restored a snapshot
 	restoreCb restoreCallback
 
+	// metricSink receives the FSM's operation counters and applied index
+	// gauge.
+	metricSink *metricsutil.ClusterMetricSink
+
 	chunker *raftchunking.ChunkingBatchingFSM
 }
 
@@ -103,6 +108,7 @@ func NewFSM(path string, logger log.Logger) (*FSM, error) {
 		latestTerm:   latestTerm,
 		latestIndex:  latestIndex,
 		latestConfig: latestConfig,
+		metricSink:   metricsutil.BlackholeSink(),
 	}
 
 	f.chunker = raftchunking.NewChunkingBatchingFSM(f, &FSMChunkStorage{
@@ -243,6 +249,18 @@ func (f *FSM) LatestState() (*IndexValue, *ConfigurationValue) {
 	}, f.latestConfig.Load().(*ConfigurationValue)
 }
 
+// countOperation adds n to the counter of the given FSM operation. Caller
+// should hold the read lock.
+func (f *FSM) countOperation(op string, n int) {
+	if n == 0 {
+		return
+	}
+
+	f.metricSink.IncrCounterWithLabels([]string{"raft_storage", "fsm", "operations"}, float32(n), []metricsutil.Label{
+		{Name: "op", Value: op},
+	})
+}
+
 // Delete deletes the given key from the bolt file.
 func (f *FSM) Delete(ctx context.Context, path string) error {
 	defer metrics.MeasureSince([]string{"raft_storage", "fsm", "delete"}, time.Now())
@@ -288,6 +306,8 @@ func (f *FSM) Get(ctx context.Context, path string) (*physical.Entry, error) {
 	f.l.RLock()
 	defer f.l.RUnlock()
 
+	f.countOperation("get", 1)
+
 	var valCopy []byte
 	var found bool
 
@@ -337,6 +357,8 @@ func (f *FSM) List(ctx context.Context, prefix string) ([]string, error) {
 	f.l.RLock()
 	defer f.l.RUnlock()
 
+	f.countOperation("list", 1)
+
 	var keys []string
 
 	err := f.db.View(func(tx *bolt.Tx) error {
@@ -362,6 +384,99 @@ func (f *FSM) List(ctx context.Context, prefix string) ([]string, error) {
 	return keys, err
 }
 
+// ListPage returns up to limit of the keys List would return for the prefix,
+// starting after the given key. Keys are returned in lexical order, so the
+// last key of a page can be used as after to fetch the next one. A limit of
+// zero or less returns all remaining keys.
+func (f *FSM) ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	defer metrics.MeasureSince([]string{"raft_storage", "fsm", "list_page"}, time.Now())
+
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	var keys []string
+
+	err := f.db.View(func(tx *bolt.Tx) error {
+		// Assume bucket exists and has keys
+		c := tx.Bucket(dataBucketName).Cursor()
+
+		prefixBytes := []byte(prefix)
+		seekBytes := prefixBytes
+		switch {
+		case strings.HasSuffix(after, "/"):
+			// Skip all the keys within the folder by seeking to the first key
+			// sorting after them
+			seekBytes = []byte(prefix + after[:len(after)-1] + string('/'+1))
+		case after != "":
+			seekBytes = []byte(prefix + after)
+		}
+
+		for k, _ := c.Seek(seekBytes); k != nil && bytes.HasPrefix(k, prefixBytes); k, _ = c.Next() {
+			if limit > 0 && len(keys) >= limit {
+				break
+			}
+
+			key := strings.TrimPrefix(string(k), prefix)
+			if i := strings.Index(key, "/"); i != -1 {
+				// Add truncated 'folder' paths. All the keys within a folder
+				// are adjacent, so it's enough to compare with the last one.
+				key = key[:i+1]
+				if len(keys) > 0 && keys[len(keys)-1] == key {
+					continue
+				}
+			}
+
+			if key <= after {
+				continue
+			}
+
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	return keys, err
+}
+
+// PrefixStats returns the number of keys under the prefix, at any depth, and
+// their total size, counting both the keys and their values.
+func (f *FSM) PrefixStats(ctx context.Context, prefix string) (int, int64, error) {
+	defer metrics.MeasureSince([]string{"raft_storage", "fsm", "prefix_stats"}, time.Now())
+
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	var count int
+	var size int64
+
+	err := f.db.View(func(tx *bolt.Tx) error {
+		// Assume bucket exists and has keys
+		c := tx.Bucket(dataBucketName).Cursor()
+
+		prefixBytes := []byte(prefix)
+		for k, v := c.Seek(prefixBytes); k != nil && bytes.HasPrefix(k, prefixBytes); k, v = c.Next() {
+			// Walking a large prefix can take a while, so check periodically
+			// whether the caller is still waiting
+			if count%1000 == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+
+			count++
+			size += int64(len(k) + len(v))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, size, nil
+}
+
 // Transaction writes all the operations in the provided transaction to the bolt
 // file.
 func (f *FSM) Transaction(ctx context.Context, txns []*physical.TxnEntry) error {
@@ -446,6 +561,7 @@ func (f *FSM) ApplyBatch(logs []*raft.Log) []interface{} {
 	f.l.RLock()
 	defer f.l.RUnlock()
 
+	var puts, deletes int
 	err = f.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(dataBucketName)
 		for _, commandRaw := range commands {
@@ -456,8 +572,10 @@ func (f *FSM) ApplyBatch(logs []*raft.Log) []interface{} {
 					switch op.OpType {
 					case putOp:
 						err = b.Put([]byte(op.Key), op.Value)
+						puts++
 					case deleteOp:
 						err = b.Delete([]byte(op.Key))
+						deletes++
 					case restoreCallbackOp:
 						if f.restoreCb != nil {
 							// Kick off the restore callback function in a go routine
@@ -498,10 +616,14 @@ func (f *FSM) ApplyBatch(logs []*raft.Log) []interface{} {
 		panic("failed to store data")
 	}
 
+	f.countOperation("put", puts)
+	f.countOperation("delete", deletes)
+
 	// If we advanced the latest value, update the in-memory representation too.
 	if len(logIndex) > 0 {
 		atomic.StoreUint64(f.latestTerm, lastLog.Term)
 		atomic.StoreUint64(f.latestIndex, lastLog.Index)
+		f.metricSink.SetGaugeWithLabels([]string{"raft_storage", "fsm", "applied_index"}, float32(lastLog.Index), nil)
 	}
 
 	// If one or more configuration changes were processed, store the latest one.
@@ -8,9 +8,11 @@ import (
 	"os"
 	"testing"
 
+	"github.com/go-test/deep"
 	proto "github.com/golang/protobuf/proto"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/vault/sdk/physical"
 )
 
 func getFSM(t testing.TB) (*FSM, string) {
@@ -125,3 +127,125 @@ func TestFSM_Batching(t *testing.T) {
 		t.Fatal("config wasn't updated")
 	}
 }
+
+func TestFSM_ListPage(t *testing.T) {
+	fsm, dir := getFSM(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+
+	expected := make(map[string]struct{})
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		// Every tenth entry is a folder holding several keys
+		if i%10 == 0 {
+			key = fmt.Sprintf("folder-%04d/", i)
+			for j := 0; j < 3; j++ {
+				if err := fsm.Put(ctx, &physical.Entry{Key: fmt.Sprintf("dir/%s%d", key, j), Value: []byte("value")}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else if err := fsm.Put(ctx, &physical.Entry{Key: "dir/" + key, Value: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = struct{}{}
+	}
+	if err := fsm.Put(ctx, &physical.Entry{Key: "other", Value: []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := fsm.List(ctx, "dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paged []string
+	after := ""
+	for {
+		page, err := fsm.ListPage(ctx, "dir/", after, 75)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 75 {
+			t.Fatalf("page exceeds the limit: %d keys", len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = page[len(page)-1]
+	}
+
+	if len(paged) != len(expected) {
+		t.Fatalf("bad: number of keys; expected: %d\n actual: %d", len(expected), len(paged))
+	}
+	for i, key := range paged {
+		if _, ok := expected[key]; !ok {
+			t.Fatalf("unexpected key %q", key)
+		}
+		if i > 0 && paged[i-1] >= key {
+			t.Fatalf("keys out of order: %q, %q", paged[i-1], key)
+		}
+	}
+	if diff := deep.Equal(paged, all); diff != nil {
+		t.Fatalf("paged list differs from full list: %v", diff)
+	}
+
+	// A non-positive limit returns all remaining keys
+	rest, err := fsm.ListPage(ctx, "dir/", paged[899], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(rest, paged[900:]); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestFSM_PrefixStats(t *testing.T) {
+	fsm, dir := getFSM(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+
+	expected := map[string]struct {
+		count int
+		size  int64
+	}{}
+	put := func(prefix, key string, value []byte) {
+		if err := fsm.Put(ctx, &physical.Entry{Key: prefix + key, Value: value}); err != nil {
+			t.Fatal(err)
+		}
+		stats := expected[prefix]
+		stats.count++
+		stats.size += int64(len(prefix) + len(key) + len(value))
+		expected[prefix] = stats
+	}
+
+	for i := 0; i < 50; i++ {
+		put("logical/", fmt.Sprintf("mount/key-%d", i), make([]byte, i))
+	}
+	for i := 0; i < 20; i++ {
+		put("sys/", fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+
+	for _, prefix := range []string{"logical/", "sys/"} {
+		count, size, err := fsm.PrefixStats(ctx, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected[prefix].count {
+			t.Fatalf("bad: %q count; expected: %d\n actual: %d", prefix, expected[prefix].count, count)
+		}
+		if size != expected[prefix].size {
+			t.Fatalf("bad: %q size; expected: %d\n actual: %d", prefix, expected[prefix].size, size)
+		}
+	}
+
+	count, size, err := fsm.PrefixStats(ctx, "missing/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 || size != 0 {
+		t.Fatalf("bad: stats of missing prefix: %d keys, %d bytes", count, size)
+	}
+}
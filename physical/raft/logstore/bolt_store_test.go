@@ -0,0 +1,77 @@
+package logstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestBoltStore_NoSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "raft.db")
+	store, err := New(Options{
+		Path:   path,
+		NoSync: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.conn.NoSync {
+		t.Fatal("expected NoSync to be set on the database")
+	}
+
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: []byte("first")},
+		{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("second")},
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(store *BoltStore) {
+		t.Helper()
+
+		for _, expected := range logs {
+			var out raft.Log
+			if err := store.GetLog(expected.Index, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Term != expected.Term || !bytes.Equal(out.Data, expected.Data) {
+				t.Fatalf("bad log at index %d: %#v", expected.Index, out)
+			}
+		}
+
+		val, err := store.Get([]byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != "value" {
+			t.Fatalf("bad value: %q", val)
+		}
+	}
+	verify(store)
+
+	// Data is still readable after a clean close and reopen
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = New(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	verify(store)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -22,14 +23,17 @@ import (
 	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/raft"
 	snapshot "github.com/hashicorp/raft-snapshot"
+	"github.com/hashicorp/vault/helper/metricsutil"
 	raftboltdb "github.com/hashicorp/vault/physical/raft/logstore"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
 	"github.com/hashicorp/vault/sdk/helper/tlsutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/physical"
 	"github.com/hashicorp/vault/vault/cluster"
 	"github.com/hashicorp/vault/vault/seal"
+	bolt "go.etcd.io/bbolt"
 )
 
 // EnvVaultRaftNodeID is used to fetch the Raft node ID from the environment.
@@ -55,6 +59,18 @@ var (
 	restoreOpDelayDuration = 5 * time.Second
 
 	defaultMaxEntrySize = uint64(2 * raftchunking.ChunkSize)
+
+	// healthMaxLastContact is how long a follower may go without hearing from
+	// the leader before HealthCheck reports it as unhealthy.
+	healthMaxLastContact = 10 * time.Second
+
+	// appliedIndexCheckInterval is how often WaitForApplied checks the
+	// applied index.
+	appliedIndexCheckInterval = 50 * time.Millisecond
+
+	// ErrNotLeader is returned when an operation that can only be performed by
+	// the raft leader is attempted on a follower.
+	ErrNotLeader = errors.New("operation can only be performed on the raft leader")
 )
 
 // RaftBackend implements the backend interfaces and uses the raft protocol to
@@ -79,6 +95,16 @@ type RaftBackend struct {
 	// regarding this node.
 	raftNotifyCh chan bool
 
+	// leaderSubscribers are the channels returned by LeaderCh that haven't
+	// been cancelled. Leadership changes read from raft are re-published to
+	// each of them as well as to raftNotifyCh.
+	leaderSubscribers     map[chan bool]struct{}
+	leaderSubscribersLock sync.Mutex
+
+	// leaderBroadcastStopCh is closed on teardown to stop re-publishing
+	// leadership changes.
+	leaderBroadcastStopCh chan struct{}
+
 	// streamLayer is the network layer used to connect the nodes in the raft
 	// cluster.
 	streamLayer *raftLayer
@@ -106,6 +132,10 @@ type RaftBackend struct {
 	// will be stored.
 	dataDir string
 
+	// removeDataDir is set when dataDir is a temporary directory created for
+	// dev mode, and causes it to be removed on Close.
+	removeDataDir bool
+
 	// localID is the ID for this node. This can either be configured in the
 	// config file, via a file on disk, or is otherwise randomly generated.
 	localID string
@@ -116,10 +146,38 @@ type RaftBackend struct {
 	// permitPool is used to limit the number of concurrent storage calls.
 	permitPool *physical.PermitPool
 
+	// applyTimeout bounds how long a write waits for its log to be applied.
+	// A zero value waits indefinitely.
+	applyTimeout time.Duration
+
 	// maxEntrySize imposes a size limit (in bytes) on a raft entry (put or transaction).
 	// It is suggested to use a value of 2x the Raft chunking size for optimal
 	// performance.
 	maxEntrySize uint64
+
+	// applyBatcher, if set, coalesces concurrent writes into shared logs.
+	applyBatcher *applyBatcher
+
+	// metricSink receives the apply latency and failure metrics. It defaults
+	// to a blackhole sink until SetMetricSink is called.
+	metricSink *metricsutil.ClusterMetricSink
+
+	// deadServerCleanup enables the reconciler that removes servers that
+	// have been unreachable for longer than deadServerThreshold.
+	deadServerCleanup       bool
+	deadServerThreshold     time.Duration
+	deadServerCheckInterval time.Duration
+
+	// bindAddr, if set, is the local IP address outgoing raft connections
+	// are bound to.
+	bindAddr net.IP
+
+	// serverStats is the source of server reachability used by the dead
+	// server reconciler. If nil, the leader's heartbeats are tracked.
+	serverStats ServerStatsSource
+
+	// deadServerStopCh stops the dead server reconciler.
+	deadServerStopCh chan struct{}
 }
 
 // LeaderJoinInfo contains information required by a node to join itself as a
@@ -219,14 +277,142 @@ func EnsurePath(path string, dir bool) error {
 
 // NewRaftBackend constructs a RaftBackend using the given directory
 func NewRaftBackend(conf map[string]string, logger log.Logger) (physical.Backend, error) {
+	var devMode bool
+	if devModeRaw, ok := conf["dev_mode"]; ok {
+		var err error
+		devMode, err = strconv.ParseBool(devModeRaw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'dev_mode': %w", err)
+		}
+	}
 
+	// In dev mode a path is optional; the FSM is placed in a temporary
+	// directory that is removed when the backend is closed.
+	var removeDataDir bool
 	path := os.Getenv(EnvVaultRaftPath)
 	if path == "" {
 		pathFromConfig, ok := conf["path"]
-		if !ok {
+		switch {
+		case ok:
+			path = pathFromConfig
+		case devMode:
+			tempDir, err := ioutil.TempDir("", "vault-raft-dev-")
+			if err != nil {
+				return nil, fmt.Errorf("failed to create dev mode directory: %w", err)
+			}
+			path = tempDir
+			removeDataDir = true
+		default:
 			return nil, fmt.Errorf("'path' must be set")
 		}
-		path = pathFromConfig
+	}
+
+	// Validate the raft tunables now rather than when the cluster is set up
+	validate := &RaftBackend{conf: conf, logger: logger}
+	if err := validate.applyConfigSettings(raft.DefaultConfig()); err != nil {
+		return nil, err
+	}
+
+	var applyTimeout time.Duration
+	if applyTimeoutCfg := conf["apply_timeout"]; len(applyTimeoutCfg) != 0 {
+		var err error
+		applyTimeout, err = parseutil.ParseDurationSecond(applyTimeoutCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'apply_timeout': %w", err)
+		}
+		if applyTimeout < 0 {
+			return nil, errors.New("'apply_timeout' must not be negative")
+		}
+	}
+
+	var applyBatchLinger time.Duration
+	if applyBatchLingerCfg := conf["apply_batch_linger"]; len(applyBatchLingerCfg) != 0 {
+		var err error
+		applyBatchLinger, err = parseutil.ParseDurationSecond(applyBatchLingerCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'apply_batch_linger': %w", err)
+		}
+		if applyBatchLinger < 0 {
+			return nil, errors.New("'apply_batch_linger' must not be negative")
+		}
+	}
+
+	applyBatchSize := defaultApplyBatchSize
+	if applyBatchSizeCfg := conf["apply_batch_size"]; len(applyBatchSizeCfg) != 0 {
+		i, err := strconv.Atoi(applyBatchSizeCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'apply_batch_size': %w", err)
+		}
+		if i <= 0 {
+			return nil, errors.New("'apply_batch_size' must be greater than zero")
+		}
+
+		applyBatchSize = i
+	}
+
+	logCacheSize := raftLogCacheSize
+	if logCacheSizeCfg := conf["log_cache_size"]; len(logCacheSizeCfg) != 0 {
+		i, err := strconv.Atoi(logCacheSizeCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'log_cache_size': %w", err)
+		}
+		if i <= 0 {
+			return nil, errors.New("'log_cache_size' must be greater than zero")
+		}
+
+		logCacheSize = i
+	}
+
+	var deadServerCleanup bool
+	if deadServerCleanupRaw, ok := conf["dead_server_cleanup"]; ok {
+		var err error
+		deadServerCleanup, err = strconv.ParseBool(deadServerCleanupRaw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'dead_server_cleanup': %w", err)
+		}
+	}
+
+	deadServerThreshold := defaultDeadServerLastContactThreshold
+	if thresholdCfg := conf["dead_server_last_contact_threshold"]; len(thresholdCfg) != 0 {
+		var err error
+		deadServerThreshold, err = parseutil.ParseDurationSecond(thresholdCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'dead_server_last_contact_threshold': %w", err)
+		}
+		if deadServerThreshold <= 0 {
+			return nil, errors.New("'dead_server_last_contact_threshold' must be greater than zero")
+		}
+	}
+
+	var bindAddr net.IP
+	if bindAddrCfg := conf["raft_bind_addr"]; len(bindAddrCfg) != 0 {
+		bindAddr = net.ParseIP(bindAddrCfg)
+		if bindAddr == nil {
+			return nil, fmt.Errorf("failed to parse 'raft_bind_addr': %q is not an IP address", bindAddrCfg)
+		}
+	}
+
+	snapshotCompression := conf["snapshot_compression"]
+	if err := validateSnapshotCompression(snapshotCompression); err != nil {
+		return nil, fmt.Errorf("failed to parse 'snapshot_compression': %w", err)
+	}
+
+	var walNoSync bool
+	if walNoSyncRaw, ok := conf["raft_wal_nosync"]; ok {
+		var err error
+		walNoSync, err = strconv.ParseBool(walNoSyncRaw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'raft_wal_nosync': %w", err)
+		}
+	}
+
+	var walMmapFlags int
+	if walMmapFlagsCfg := conf["raft_wal_mmap_flags"]; len(walMmapFlagsCfg) != 0 {
+		var err error
+		walMmapFlags, err = strconv.Atoi(walMmapFlagsCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'raft_wal_mmap_flags': %w", err)
+		}
 	}
 
 	// Create the FSM.
@@ -241,12 +427,19 @@ func NewRaftBackend(conf map[string]string, logger log.Logger) (physical.Backend
 	var stable raft.StableStore
 	var snap raft.SnapshotStore
 
-	var devMode bool
 	if devMode {
 		store := raft.NewInmemStore()
 		stable = store
 		log = store
-		snap = raft.NewInmemSnapshotStore()
+
+		// Snapshots are read directly out of the FSM, so the bolt snapshot
+		// store is still used alongside the FSM's database file.
+		snapshots, err := NewBoltSnapshotStore(path, logger.Named("snapshot"), fsm)
+		if err != nil {
+			return nil, err
+		}
+		snapshots.compression = snapshotCompression
+		snap = snapshots
 	} else {
 		// Create the base raft path.
 		path := filepath.Join(path, raftState)
@@ -254,15 +447,25 @@ func NewRaftBackend(conf map[string]string, logger log.Logger) (physical.Backend
 			return nil, err
 		}
 
+		if walNoSync {
+			logger.Warn("raft_wal_nosync is enabled: the raft log will not be fsynced to disk, which can lead to data loss or corruption if the host crashes. This should never be used in production.")
+		}
+
 		// Create the backend raft store for logs and stable storage.
-		store, err := raftboltdb.NewBoltStore(filepath.Join(path, "raft.db"))
+		store, err := raftboltdb.New(raftboltdb.Options{
+			Path: filepath.Join(path, "raft.db"),
+			BoltOptions: &bolt.Options{
+				MmapFlags: walMmapFlags,
+			},
+			NoSync: walNoSync,
+		})
 		if err != nil {
 			return nil, err
 		}
 		stable = store
 
 		// Wrap the store in a LogCache to improve performance.
-		cacheStore, err := raft.NewLogCache(raftLogCacheSize, store)
+		cacheStore, err := raft.NewLogCache(logCacheSize, store)
 		if err != nil {
 			return nil, err
 		}
@@ -273,6 +476,7 @@ func NewRaftBackend(conf map[string]string, logger log.Logger) (physical.Backend
 		if err != nil {
 			return nil, err
 		}
+		snapshots.compression = snapshotCompression
 		snap = snapshots
 	}
 
@@ -324,29 +528,53 @@ func NewRaftBackend(conf map[string]string, logger log.Logger) (physical.Backend
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse 'max_entry_size': %w", err)
 		}
+		if i <= 0 {
+			return nil, errors.New("'max_entry_size' must be greater than zero")
+		}
 
 		maxEntrySize = uint64(i)
 	}
 
-	return &RaftBackend{
-		logger:       logger,
-		fsm:          fsm,
-		raftInitCh:   make(chan struct{}),
-		conf:         conf,
-		logStore:     log,
-		stableStore:  stable,
-		snapStore:    snap,
-		dataDir:      path,
-		localID:      localID,
-		permitPool:   physical.NewPermitPool(physical.DefaultParallelOperations),
-		maxEntrySize: maxEntrySize,
-	}, nil
+	backend := &RaftBackend{
+		logger:        logger,
+		fsm:           fsm,
+		raftInitCh:    make(chan struct{}),
+		conf:          conf,
+		logStore:      log,
+		stableStore:   stable,
+		snapStore:     snap,
+		dataDir:       path,
+		removeDataDir: removeDataDir,
+		localID:       localID,
+		permitPool:    physical.NewPermitPool(physical.DefaultParallelOperations),
+		maxEntrySize:  maxEntrySize,
+		applyTimeout:  applyTimeout,
+		metricSink:    metricsutil.BlackholeSink(),
+		bindAddr:      bindAddr,
+
+		deadServerCleanup:       deadServerCleanup,
+		deadServerThreshold:     deadServerThreshold,
+		deadServerCheckInterval: deadServerCheckInterval,
+	}
+
+	// Writes are only batched if they're allowed to wait for each other
+	if applyBatchLinger > 0 {
+		backend.applyBatcher = newApplyBatcher(backend.applyLog, applyBatchSize, int(maxEntrySize), applyBatchLinger)
+	}
+
+	return backend, nil
 }
 
 // Close is used to gracefully close all file resources.  N.B. This method
 // should only be called if you are sure the RaftBackend will never be used
 // again.
 func (b *RaftBackend) Close() error {
+	// Shut down raft first, if it is running, so that nothing writes to the
+	// stores while they are being closed
+	if err := b.TeardownCluster(b.clusterListener()); err != nil {
+		return errwrap.Wrapf("failed to shut down raft: {{err}}", err)
+	}
+
 	b.l.Lock()
 	defer b.l.Unlock()
 
@@ -354,8 +582,17 @@ func (b *RaftBackend) Close() error {
 		return err
 	}
 
-	if err := b.stableStore.(*raftboltdb.BoltStore).Close(); err != nil {
-		return err
+	// The stable store is in memory when running in dev mode
+	if store, ok := b.stableStore.(*raftboltdb.BoltStore); ok {
+		if err := store.Close(); err != nil {
+			return err
+		}
+	}
+
+	if b.removeDataDir {
+		if err := os.RemoveAll(b.dataDir); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -420,14 +657,33 @@ func (b *RaftBackend) SetTLSKeyring(keyring *TLSKeyring) error {
 	return err
 }
 
-// SetServerAddressProvider sets a the address provider for determining the raft
-// node addresses. This is currently only used in tests.
+// SetServerAddressProvider sets the address provider for determining the raft
+// node addresses from their server IDs. It must be set before SetupCluster is
+// called to be used by the network transport.
 func (b *RaftBackend) SetServerAddressProvider(provider raft.ServerAddressProvider) {
 	b.l.Lock()
 	b.serverAddressProvider = provider
 	b.l.Unlock()
 }
 
+// newNetworkTransport creates the raft network transport on top of the given
+// stream layer. Server IDs are resolved to addresses using the configured
+// ServerAddressProvider, which requires raft protocol version 3 or above since
+// older versions identify servers by their address. This must be called with
+// the backend's lock held.
+func (b *RaftBackend) newNetworkTransport(stream raft.StreamLayer, protocolVersion raft.ProtocolVersion) *raft.NetworkTransport {
+	transConfig := &raft.NetworkTransportConfig{
+		Stream:  stream,
+		MaxPool: 3,
+		Timeout: 10 * time.Second,
+	}
+	if protocolVersion >= 3 {
+		transConfig.ServerAddressProvider = b.serverAddressProvider
+	}
+
+	return raft.NewNetworkTransportWithConfig(transConfig)
+}
+
 // Bootstrap prepares the given peers to be part of the raft cluster
 func (b *RaftBackend) Bootstrap(peers []Peer) error {
 	b.l.Lock()
@@ -466,6 +722,18 @@ func (b *RaftBackend) SetRestoreCallback(restoreCb restoreCallback) {
 	b.fsm.l.Unlock()
 }
 
+// SetMetricSink sets the sink the backend and its FSM emit apply and
+// operation metrics to. It should be called before the cluster is set up.
+func (b *RaftBackend) SetMetricSink(sink *metricsutil.ClusterMetricSink) {
+	b.l.Lock()
+	b.metricSink = sink
+	b.l.Unlock()
+
+	b.fsm.l.Lock()
+	b.fsm.metricSink = sink
+	b.fsm.l.Unlock()
+}
+
 func (b *RaftBackend) applyConfigSettings(config *raft.Config) error {
 	config.Logger = b.logger
 	multiplierRaw, ok := b.conf["performance_multiplier"]
@@ -474,31 +742,75 @@ func (b *RaftBackend) applyConfigSettings(config *raft.Config) error {
 		var err error
 		multiplier, err = strconv.Atoi(multiplierRaw)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to parse 'performance_multiplier': %w", err)
 		}
 	}
 	config.ElectionTimeout = config.ElectionTimeout * time.Duration(multiplier)
 	config.HeartbeatTimeout = config.HeartbeatTimeout * time.Duration(multiplier)
 	config.LeaderLeaseTimeout = config.LeaderLeaseTimeout * time.Duration(multiplier)
 
+	// Explicit timeouts override the ones scaled by the performance multiplier
+	timeouts := []struct {
+		key     string
+		value   *time.Duration
+		minimum time.Duration
+	}{
+		{"heartbeat_timeout", &config.HeartbeatTimeout, 5 * time.Millisecond},
+		{"election_timeout", &config.ElectionTimeout, 5 * time.Millisecond},
+		{"leader_lease_timeout", &config.LeaderLeaseTimeout, 5 * time.Millisecond},
+		{"commit_timeout", &config.CommitTimeout, time.Millisecond},
+	}
+	for _, timeout := range timeouts {
+		raw, ok := b.conf[timeout.key]
+		if !ok {
+			continue
+		}
+		value, err := parseutil.ParseDurationSecond(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s': %w", timeout.key, err)
+		}
+		if value < timeout.minimum {
+			return fmt.Errorf("'%s' must be at least %s", timeout.key, timeout.minimum)
+		}
+		*timeout.value = value
+	}
+
+	// These are checked by raft as well, but only once the cluster is set up
+	if config.ElectionTimeout < config.HeartbeatTimeout {
+		return fmt.Errorf("'election_timeout' (%s) must be greater than or equal to 'heartbeat_timeout' (%s)", config.ElectionTimeout, config.HeartbeatTimeout)
+	}
+	if config.LeaderLeaseTimeout > config.HeartbeatTimeout {
+		return fmt.Errorf("'leader_lease_timeout' (%s) must be less than or equal to 'heartbeat_timeout' (%s)", config.LeaderLeaseTimeout, config.HeartbeatTimeout)
+	}
+
 	snapThresholdRaw, ok := b.conf["snapshot_threshold"]
 	if ok {
-		var err error
-		snapThreshold, err := strconv.Atoi(snapThresholdRaw)
+		snapThreshold, err := strconv.ParseUint(snapThresholdRaw, 10, 64)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to parse 'snapshot_threshold': %w", err)
 		}
-		config.SnapshotThreshold = uint64(snapThreshold)
+		config.SnapshotThreshold = snapThreshold
+	}
+
+	snapIntervalRaw, ok := b.conf["snapshot_interval"]
+	if ok {
+		snapInterval, err := parseutil.ParseDurationSecond(snapIntervalRaw)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'snapshot_interval': %w", err)
+		}
+		if snapInterval <= 0 {
+			return errors.New("'snapshot_interval' must be greater than zero")
+		}
+		config.SnapshotInterval = snapInterval
 	}
 
 	trailingLogsRaw, ok := b.conf["trailing_logs"]
 	if ok {
-		var err error
-		trailingLogs, err := strconv.Atoi(trailingLogsRaw)
+		trailingLogs, err := strconv.ParseUint(trailingLogsRaw, 10, 64)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to parse 'trailing_logs': %w", err)
 		}
-		config.TrailingLogs = uint64(trailingLogs)
+		config.TrailingLogs = trailingLogs
 	}
 
 	config.NoSnapshotRestoreOnStart = true
@@ -523,6 +835,17 @@ type SetupOpts struct {
 	// RecoveryModeConfig is the configuration for the raft cluster in recovery
 	// mode.
 	RecoveryModeConfig *raft.Configuration
+
+	// NonVoter is used to specify this node is joining the cluster as a
+	// non-voter. The node is bootstrapped without a vote so that it never
+	// campaigns for leadership while waiting to receive the leader's
+	// configuration.
+	NonVoter bool
+
+	// TLSConfig, if set, overrides the TLS versions, cipher suites and curves
+	// of outgoing raft connections. Certificates are always taken from the
+	// cluster listener and TLSKeyring.
+	TLSConfig *tls.Config
 }
 
 func (b *RaftBackend) StartRecoveryCluster(ctx context.Context, peer Peer) error {
@@ -541,6 +864,55 @@ func (b *RaftBackend) StartRecoveryCluster(ctx context.Context, peer Peer) error
 	})
 }
 
+// RecoverCluster forcibly replaces the raft configuration stored on this node
+// with the given one. This is used to recover a cluster that lost quorum, by
+// calling it with the same configuration on every remaining node. It can only
+// be called while raft is not running; the new configuration takes effect on
+// the next SetupCluster.
+func (b *RaftBackend) RecoverCluster(ctx context.Context, configuration raft.Configuration) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.raft != nil {
+		return errors.New("raft recovery can only be performed while raft is not running")
+	}
+
+	if len(b.localID) == 0 {
+		return errors.New("no local node id configured")
+	}
+
+	for _, server := range configuration.Servers {
+		if !nonVotersAllowed && server.Suffrage == raft.Nonvoter {
+			return fmt.Errorf("raft recovery failed to parse configuration for node %q: setting `non_voter` is only supported in enterprise", server.ID)
+		}
+	}
+
+	raftConfig := raft.DefaultConfig()
+	if err := b.applyConfigSettings(raftConfig); err != nil {
+		return err
+	}
+	raftConfig.LocalID = raft.ServerID(b.localID)
+
+	// The transport is only recorded in the snapshot written by the
+	// recovery, so an in-memory one is enough
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(b.localID))
+
+	// The FSM already holds the data, so don't restore it from snapshots
+	b.fsm.SetNoopRestore(true)
+	defer b.fsm.SetNoopRestore(false)
+
+	b.logger.Info("raft recovery initiated", "config", configuration)
+
+	err := raft.RecoverCluster(raftConfig, b.fsm, b.logStore, b.stableStore, b.snapStore, transport, configuration)
+	if err != nil {
+		return errwrap.Wrapf("recovering raft cluster failed: {{err}}", err)
+	}
+
+	b.logger.Info("raft recovery completed")
+
+	return nil
+}
+
 func (b *RaftBackend) HasState() (bool, error) {
 	b.l.RLock()
 	defer b.l.RUnlock()
@@ -602,23 +974,20 @@ func (b *RaftBackend) SetupCluster(ctx context.Context, opts SetupOpts) error {
 		if err != nil {
 			return err
 		}
-		transConfig := &raft.NetworkTransportConfig{
-			Stream:                streamLayer,
-			MaxPool:               3,
-			Timeout:               10 * time.Second,
-			ServerAddressProvider: b.serverAddressProvider,
-		}
-		transport := raft.NewNetworkTransportWithConfig(transConfig)
+		streamLayer.bindAddr = b.bindAddr
+		streamLayer.tlsConfig = opts.TLSConfig
 
 		b.streamLayer = streamLayer
-		b.raftTransport = transport
+		b.raftTransport = b.newNetworkTransport(streamLayer, raftConfig.ProtocolVersion)
 	}
 
 	raftConfig.LocalID = raft.ServerID(b.localID)
 
-	// Set up a channel for reliable leader notifications.
+	// Set up a channel for reliable leader notifications. Notifications are
+	// fanned out to the HA lock and any LeaderCh subscribers.
+	raftLeaderCh := make(chan bool, 10)
+	raftConfig.NotifyCh = raftLeaderCh
 	raftNotifyCh := make(chan bool, 10)
-	raftConfig.NotifyCh = raftNotifyCh
 
 	// If we have a bootstrapConfig set we should bootstrap now.
 	if b.bootstrapConfig != nil {
@@ -626,6 +995,14 @@ func (b *RaftBackend) SetupCluster(ctx context.Context, opts SetupOpts) error {
 		// Unset the bootstrap config
 		b.bootstrapConfig = nil
 
+		if opts.NonVoter {
+			for i := range bootstrapConfig.Servers {
+				if bootstrapConfig.Servers[i].ID == raft.ServerID(b.localID) {
+					bootstrapConfig.Servers[i].Suffrage = raft.Nonvoter
+				}
+			}
+		}
+
 		// Bootstrap raft with our known cluster members.
 		if err := raft.BootstrapCluster(raftConfig, b.logStore, b.stableStore, b.snapStore, b.raftTransport, *bootstrapConfig); err != nil {
 			return err
@@ -675,7 +1052,17 @@ func (b *RaftBackend) SetupCluster(ctx context.Context, opts SetupOpts) error {
 		}
 	}
 
-	raftObj, err := raft.NewRaft(raftConfig, b.fsm.chunker, b.logStore, b.stableStore, b.snapStore, b.raftTransport)
+	// Track heartbeats to followers so that dead servers can be detected,
+	// unless another source of server stats has been provided
+	transport := b.raftTransport
+	serverStats := b.serverStats
+	if b.deadServerCleanup && serverStats == nil {
+		tracker := newContactTrackingTransport(transport)
+		transport = tracker
+		serverStats = tracker
+	}
+
+	raftObj, err := raft.NewRaft(raftConfig, b.fsm.chunker, b.logStore, b.stableStore, b.snapStore, transport)
 	b.fsm.SetNoopRestore(false)
 	if err != nil {
 		return err
@@ -707,6 +1094,14 @@ func (b *RaftBackend) SetupCluster(ctx context.Context, opts SetupOpts) error {
 	b.raft = raftObj
 	b.raftNotifyCh = raftNotifyCh
 
+	b.leaderBroadcastStopCh = make(chan struct{})
+	go b.broadcastLeadership(raftLeaderCh, raftNotifyCh, b.leaderBroadcastStopCh)
+
+	if b.deadServerCleanup {
+		b.deadServerStopCh = make(chan struct{})
+		go b.reconcileDeadServers(raftObj, serverStats, b.deadServerStopCh)
+	}
+
 	if b.streamLayer != nil {
 		// Add Handler to the cluster.
 		opts.ClusterListener.AddHandler(consts.RaftStorageALPN, b.streamLayer)
@@ -722,6 +1117,66 @@ func (b *RaftBackend) SetupCluster(ctx context.Context, opts SetupOpts) error {
 	return nil
 }
 
+// LeaderCh returns a channel that receives true when this node gains raft
+// leadership and false when it loses it. Each call returns a new subscription
+// that remains valid across cluster teardown and setup, until the returned
+// cancel func is called; the channel is then closed. Notifications are
+// dropped for subscribers that fall behind.
+func (b *RaftBackend) LeaderCh() (<-chan bool, func()) {
+	ch := make(chan bool, 10)
+
+	b.leaderSubscribersLock.Lock()
+	if b.leaderSubscribers == nil {
+		b.leaderSubscribers = make(map[chan bool]struct{})
+	}
+	b.leaderSubscribers[ch] = struct{}{}
+	b.leaderSubscribersLock.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.leaderSubscribersLock.Lock()
+			delete(b.leaderSubscribers, ch)
+			close(ch)
+			b.leaderSubscribersLock.Unlock()
+		})
+	}
+
+	return ch, cancel
+}
+
+// broadcastLeadership reads leadership changes from raft and re-publishes them
+// to the HA lock's notify channel and all LeaderCh subscribers until stopCh is
+// closed.
+func (b *RaftBackend) broadcastLeadership(raftLeaderCh <-chan bool, notifyCh chan<- bool, stopCh <-chan struct{}) {
+	for {
+		select {
+		case isLeader := <-raftLeaderCh:
+			// Subscribers are notified first, so that they aren't held up
+			// while the lock is slow to read
+			b.leaderSubscribersLock.Lock()
+			for ch := range b.leaderSubscribers {
+				select {
+				case ch <- isLeader:
+				default:
+					b.logger.Warn("dropping leadership notification for slow subscriber", "is_leader", isLeader)
+				}
+			}
+			b.leaderSubscribersLock.Unlock()
+
+			// The lock must see every transition, so this send blocks like
+			// raft's own notification does
+			select {
+			case notifyCh <- isLeader:
+			case <-stopCh:
+				return
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
 // TeardownCluster shuts down the raft cluster
 func (b *RaftBackend) TeardownCluster(clusterListener cluster.ClusterHook) error {
 	if clusterListener != nil {
@@ -740,6 +1195,16 @@ func (b *RaftBackend) TeardownCluster(clusterListener cluster.ClusterHook) error
 
 	b.raft = nil
 
+	if b.leaderBroadcastStopCh != nil {
+		close(b.leaderBroadcastStopCh)
+		b.leaderBroadcastStopCh = nil
+	}
+
+	if b.deadServerStopCh != nil {
+		close(b.deadServerStopCh)
+		b.deadServerStopCh = nil
+	}
+
 	// If we're tearing down, then we need to recreate the raftInitCh
 	b.raftInitCh = make(chan struct{})
 	b.l.Unlock()
@@ -775,8 +1240,27 @@ func (b *RaftBackend) AppliedIndex() uint64 {
 	return b.raft.AppliedIndex()
 }
 
+// WaitForApplied blocks until the log at the given index has been applied to
+// the FSM, or until ctx is done. A newly joined node can use it to wait until
+// it has caught up with an index known to the leader before serving reads.
+// If raft is not set up yet, it also waits for that.
+func (b *RaftBackend) WaitForApplied(ctx context.Context, index uint64) error {
+	ticker := time.NewTicker(appliedIndexCheckInterval)
+	defer ticker.Stop()
+
+	for b.AppliedIndex() < index {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
 // RemovePeer removes the given peer ID from the raft cluster. If the node is
-// ourselves we will give up leadership.
+// ourselves we will give up leadership. This must be called on the leader.
 func (b *RaftBackend) RemovePeer(ctx context.Context, peerID string) error {
 	b.l.RLock()
 	defer b.l.RUnlock()
@@ -785,11 +1269,100 @@ func (b *RaftBackend) RemovePeer(ctx context.Context, peerID string) error {
 		return errors.New("raft storage is not initialized")
 	}
 
-	future := b.raft.RemoveServer(raft.ServerID(peerID), 0, 0)
+	index, err := b.leaderConfigurationIndex()
+	if err != nil {
+		return err
+	}
+
+	future := b.raft.RemoveServer(raft.ServerID(peerID), index, 0)
 
 	return future.Error()
 }
 
+// RemoveSelf removes the local node from the raft configuration and then
+// shuts raft down, so that a decommissioned node doesn't linger as a failed
+// voter. It must be called on the leader: raft steps down once the
+// configuration without the node is committed, after which the remaining
+// servers elect a new leader. Followers can't change the configuration, so
+// they get ErrNotLeader and must be removed by the leader using RemovePeer.
+func (b *RaftBackend) RemoveSelf(ctx context.Context) error {
+	if err := b.removeSelf(ctx); err != nil {
+		return err
+	}
+
+	return b.TeardownCluster(b.clusterListener())
+}
+
+// clusterListener returns the cluster listener the stream layer was set up
+// with, or nil if raft uses an in-memory transport.
+func (b *RaftBackend) clusterListener() cluster.ClusterHook {
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	if b.streamLayer == nil {
+		return nil
+	}
+	return b.streamLayer.clusterListener
+}
+
+func (b *RaftBackend) removeSelf(ctx context.Context) error {
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	if b.raft == nil {
+		return errors.New("raft storage is not initialized")
+	}
+
+	index, err := b.leaderConfigurationIndex()
+	if err != nil {
+		return err
+	}
+
+	future := b.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	hasOtherVoter := false
+	for _, server := range future.Configuration().Servers {
+		if server.ID != raft.ServerID(b.localID) && server.Suffrage == raft.Voter {
+			hasOtherVoter = true
+			break
+		}
+	}
+	if !hasOtherVoter {
+		return errors.New("cannot remove the only voter from the raft cluster")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.raft.RemoveServer(raft.ServerID(b.localID), index, 0).Error()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leaderConfigurationIndex returns the index of the latest raft configuration,
+// which membership changes use to guard against racing with another change.
+// It returns ErrNotLeader if this node is not the raft leader. Caller should
+// hold the backend's read lock.
+func (b *RaftBackend) leaderConfigurationIndex() (uint64, error) {
+	if b.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+
+	future := b.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return 0, err
+	}
+
+	return future.Index(), nil
+}
+
 func (b *RaftBackend) GetConfiguration(ctx context.Context) (*RaftConfigurationResponse, error) {
 	b.l.RLock()
 	defer b.l.RUnlock()
@@ -823,7 +1396,75 @@ func (b *RaftBackend) GetConfiguration(ctx context.Context) (*RaftConfigurationR
 	return config, nil
 }
 
-// AddPeer adds a new server to the raft cluster
+// AddNonVoter adds a new non-voting server to the raft cluster. Non-voters
+// replicate the log and serve reads from their FSM, but never vote or become
+// leader. This must be called on the leader, and is only supported in
+// enterprise.
+func (b *RaftBackend) AddNonVoter(ctx context.Context, peerID, clusterAddr string) error {
+	if !nonVotersAllowed {
+		return errors.New("non-voting nodes not allowed")
+	}
+
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	if b.raft == nil {
+		return errors.New("raft storage is not initialized")
+	}
+
+	index, err := b.leaderConfigurationIndex()
+	if err != nil {
+		return err
+	}
+
+	b.logger.Debug("adding raft non-voter", "node_id", peerID, "cluster_addr", clusterAddr)
+
+	future := b.raft.AddNonvoter(raft.ServerID(peerID), raft.ServerAddress(clusterAddr), index, 0)
+	return future.Error()
+}
+
+// Stats returns the raft library's internal statistics for this node, such as
+// its state, term, and last log and applied indexes.
+func (b *RaftBackend) Stats() (map[string]string, error) {
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	if b.raft == nil {
+		return nil, errors.New("raft storage is not initialized")
+	}
+
+	return b.raft.Stats(), nil
+}
+
+// HealthCheck returns an error if this node is not in a serviceable state:
+// raft must be running, a leader must be known and, unless this node is the
+// leader, it must have heard from the leader recently.
+func (b *RaftBackend) HealthCheck(ctx context.Context) error {
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	if b.raft == nil {
+		return errors.New("raft storage is not initialized")
+	}
+
+	if b.raft.Leader() == "" {
+		return errors.New("no raft leader is known")
+	}
+
+	if b.raft.State() == raft.Leader {
+		return nil
+	}
+
+	lastContact := time.Since(b.raft.LastContact())
+	if lastContact > healthMaxLastContact {
+		return fmt.Errorf("last contact with the raft leader was %s ago", lastContact.Truncate(time.Millisecond))
+	}
+
+	return nil
+}
+
+// AddPeer adds a new voting server to the raft cluster. This must be called on
+// the leader.
 func (b *RaftBackend) AddPeer(ctx context.Context, peerID, clusterAddr string) error {
 	b.l.RLock()
 	defer b.l.RUnlock()
@@ -832,9 +1473,14 @@ func (b *RaftBackend) AddPeer(ctx context.Context, peerID, clusterAddr string) e
 		return errors.New("raft storage is not initialized")
 	}
 
+	index, err := b.leaderConfigurationIndex()
+	if err != nil {
+		return err
+	}
+
 	b.logger.Debug("adding raft peer", "node_id", peerID, "cluster_addr", clusterAddr)
 
-	future := b.raft.AddVoter(raft.ServerID(peerID), raft.ServerAddress(clusterAddr), 0, 0)
+	future := b.raft.AddVoter(raft.ServerID(peerID), raft.ServerAddress(clusterAddr), index, 0)
 	return future.Error()
 }
 
@@ -979,7 +1625,7 @@ func (b *RaftBackend) Delete(ctx context.Context, path string) error {
 	defer b.permitPool.Release()
 
 	b.l.RLock()
-	err := b.applyLog(ctx, command)
+	err := b.applyWrite(ctx, command)
 	b.l.RUnlock()
 	return err
 }
@@ -1008,6 +1654,67 @@ func (b *RaftBackend) Get(ctx context.Context, path string) (*physical.Entry, er
 	return entry, err
 }
 
+// GetConsistentOnLeader is like Get, but may only be called on the leader.
+// It first waits for every write committed before the call to be applied to
+// the FSM, so the read reflects all writes that completed before it. This is
+// done with a raft barrier, which requires leadership and a quorum: on
+// followers ErrNotLeader is returned, and an error is returned if the barrier
+// can't complete within the apply timeout or before ctx is done, rather than
+// serving stale data. Followers have no way to learn the leader's commit
+// index from here, so callers wanting a consistent read on a follower need to
+// forward it to the active node.
+func (b *RaftBackend) GetConsistentOnLeader(ctx context.Context, path string) (*physical.Entry, error) {
+	defer metrics.MeasureSince([]string{"raft-storage", "get-consistent"}, time.Now())
+
+	if err := b.barrier(ctx); err != nil {
+		return nil, err
+	}
+
+	return b.Get(ctx, path)
+}
+
+// barrier blocks until all preceding raft operations have been applied to the
+// FSM. It returns ErrNotLeader when this node is not the leader.
+func (b *RaftBackend) barrier(ctx context.Context) error {
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	if b.raft == nil {
+		return errors.New("raft storage backend is not initialized")
+	}
+
+	if b.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	barrierCtx := ctx
+	if b.applyTimeout > 0 {
+		var cancel context.CancelFunc
+		barrierCtx, cancel = context.WithTimeout(ctx, b.applyTimeout)
+		defer cancel()
+	}
+
+	future := b.raft.Barrier(b.applyTimeout)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- future.Error()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("raft barrier failed: %w", err)
+		}
+		return nil
+	case <-barrierCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("raft barrier timed out after %s: %w", b.applyTimeout, barrierCtx.Err())
+	}
+}
+
 // Put inserts an entry in the log for the put operation. It will return an
 // error if the resulting entry encoding exceeds the configured max_entry_size
 // or if the call to applyLog fails.
@@ -1027,7 +1734,7 @@ func (b *RaftBackend) Put(ctx context.Context, entry *physical.Entry) error {
 	defer b.permitPool.Release()
 
 	b.l.RLock()
-	err := b.applyLog(ctx, command)
+	err := b.applyWrite(ctx, command)
 	b.l.RUnlock()
 	return err
 }
@@ -1045,8 +1752,26 @@ func (b *RaftBackend) List(ctx context.Context, prefix string) ([]string, error)
 	return b.fsm.List(ctx, prefix)
 }
 
+// ListPage enumerates up to limit of the items under the prefix from the fsm,
+// starting after the given key. A limit of zero or less returns all remaining
+// items.
+func (b *RaftBackend) ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	defer metrics.MeasureSince([]string{"raft-storage", "list-page"}, time.Now())
+	if b.fsm == nil {
+		return nil, errors.New("raft: fsm not configured")
+	}
+
+	b.permitPool.Acquire()
+	defer b.permitPool.Release()
+
+	return b.fsm.ListPage(ctx, prefix, after, limit)
+}
+
 // Transaction applies all the given operations into a single log and
-// applies it.
+// applies it. The operations are never split across multiple logs since that
+// would break the atomicity of the transaction; if the serialized log exceeds
+// the configured max entry size, physical.ErrValueTooLarge is returned and
+// none of the operations are applied.
 func (b *RaftBackend) Transaction(ctx context.Context, txns []*physical.TxnEntry) error {
 	defer metrics.MeasureSince([]string{"raft-storage", "transaction"}, time.Now())
 	command := &LogData{
@@ -1073,19 +1798,37 @@ func (b *RaftBackend) Transaction(ctx context.Context, txns []*physical.TxnEntry
 	defer b.permitPool.Release()
 
 	b.l.RLock()
-	err := b.applyLog(ctx, command)
+	err := b.applyWrite(ctx, command)
 	b.l.RUnlock()
 	return err
 }
 
+// applyWrite applies the command of a write, batched with concurrent writes
+// if batching is enabled. Caller should hold the backend's read lock.
+func (b *RaftBackend) applyWrite(ctx context.Context, command *LogData) error {
+	if b.applyBatcher != nil {
+		return b.applyBatcher.applyLog(ctx, command)
+	}
+	return b.applyLog(ctx, command)
+}
+
 // applyLog will take a given log command and apply it to the raft log. applyLog
 // doesn't return until the log has been applied to a quorum of servers and is
 // persisted to the local FSM. Caller should hold the backend's read lock.
-func (b *RaftBackend) applyLog(ctx context.Context, command *LogData) error {
+func (b *RaftBackend) applyLog(ctx context.Context, command *LogData) (retErr error) {
 	if b.raft == nil {
 		return errors.New("raft storage backend is not initialized")
 	}
 
+	start := time.Now()
+	defer func() {
+		if retErr != nil {
+			b.metricSink.IncrCounterWithLabels([]string{"raft_storage", "apply_failures"}, 1, nil)
+			return
+		}
+		b.metricSink.MeasureSinceWithLabels([]string{"raft_storage", "apply"}, start, nil)
+	}()
+
 	commandBytes, err := proto.Marshal(command)
 	if err != nil {
 		return err
@@ -1098,18 +1841,47 @@ func (b *RaftBackend) applyLog(ctx context.Context, command *LogData) error {
 
 	defer metrics.AddSample([]string{"raft-storage", "entry_size"}, float32(cmdSize))
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Bound the total time spent waiting on the apply, not just the time
+	// spent enqueuing it, if a timeout is configured
+	applyCtx := ctx
+	if b.applyTimeout > 0 {
+		var cancel context.CancelFunc
+		applyCtx, cancel = context.WithTimeout(ctx, b.applyTimeout)
+		defer cancel()
+	}
+
 	var chunked bool
 	var applyFuture raft.ApplyFuture
 	switch {
 	case len(commandBytes) <= raftchunking.ChunkSize:
-		applyFuture = b.raft.Apply(commandBytes, 0)
+		applyFuture = b.raft.Apply(commandBytes, b.applyTimeout)
 	default:
 		chunked = true
-		applyFuture = raftchunking.ChunkingApply(commandBytes, nil, 0, b.raft.ApplyLog)
+		applyFuture = raftchunking.ChunkingApply(commandBytes, nil, b.applyTimeout, b.raft.ApplyLog)
 	}
 
-	if err := applyFuture.Error(); err != nil {
-		return err
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- applyFuture.Error()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == raft.ErrEnqueueTimeout {
+			return fmt.Errorf("raft apply timed out after %s: %w", b.applyTimeout, err)
+		}
+		if err != nil {
+			return err
+		}
+	case <-applyCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("raft apply timed out after %s: %w", b.applyTimeout, applyCtx.Err())
 	}
 
 	resp := applyFuture.Response()
@@ -1163,11 +1935,21 @@ type RaftLock struct {
 	value []byte
 
 	b *RaftBackend
+
+	// unlockCh is closed by Unlock to stop the leadership monitor started
+	// when the lock was acquired.
+	unlockCh chan struct{}
+	l        sync.Mutex
 }
 
 // monitorLeadership waits until we receive an update on the raftNotifyCh and
 // closes the leaderLost channel.
 func (l *RaftLock) monitorLeadership(stopCh <-chan struct{}, leaderNotifyCh <-chan bool) <-chan struct{} {
+	unlockCh := make(chan struct{})
+	l.l.Lock()
+	l.unlockCh = unlockCh
+	l.l.Unlock()
+
 	leaderLost := make(chan struct{})
 	go func() {
 		for {
@@ -1179,11 +1961,19 @@ func (l *RaftLock) monitorLeadership(stopCh <-chan struct{}, leaderNotifyCh <-ch
 				// always going to be false. The for loop should loop at most
 				// twice.
 				if !isLeader {
-					close(leaderLost)
+					// Leadership given up by Unlock isn't reported as lost,
+					// even if the notification is picked before unlockCh
+					select {
+					case <-unlockCh:
+					default:
+						close(leaderLost)
+					}
 					return
 				}
 			case <-stopCh:
 				return
+			case <-unlockCh:
+				return
 			}
 		}
 	}()
@@ -1260,17 +2050,51 @@ func (l *RaftLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
 			return nil, nil
 		}
 	}
-
-	return nil, nil
 }
 
-// Unlock gives up leadership.
+// Unlock gives up leadership by transferring it to another voter in the
+// cluster. If no other voter is available or the transfer is not supported,
+// leadership is retained and a warning is logged.
 func (l *RaftLock) Unlock() error {
-	if l.b.raft == nil {
+	// Stop monitoring leadership, since the lock is being released
+	l.l.Lock()
+	if l.unlockCh != nil {
+		close(l.unlockCh)
+		l.unlockCh = nil
+	}
+	l.l.Unlock()
+
+	l.b.l.RLock()
+	defer l.b.l.RUnlock()
+
+	if l.b.raft == nil || l.b.raft.State() != raft.Leader {
+		return nil
+	}
+
+	future := l.b.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	var hasOtherVoters bool
+	for _, server := range future.Configuration().Servers {
+		if server.Suffrage == raft.Voter && server.ID != raft.ServerID(l.b.localID) {
+			hasOtherVoters = true
+			break
+		}
+	}
+	if !hasOtherVoters {
+		l.b.logger.Warn("no other voters to transfer leadership to; retaining raft leadership")
+		return nil
+	}
+
+	err := l.b.raft.LeadershipTransfer().Error()
+	if err == raft.ErrUnsupportedProtocol {
+		l.b.logger.Warn("leadership transfer is not supported by the raft protocol version in use; retaining raft leadership")
 		return nil
 	}
 
-	return l.b.raft.LeadershipTransfer().Error()
+	return err
 }
 
 // Value reads the value of the lock. This informs us who is currently leader.
@@ -1284,8 +2108,23 @@ func (l *RaftLock) Value() (bool, string, error) {
 	}
 
 	value := string(e.Value)
-	// TODO: how to tell if held?
-	return true, value, nil
+
+	l.b.l.RLock()
+	defer l.b.l.RUnlock()
+
+	if l.b.raft == nil {
+		return false, value, nil
+	}
+
+	// On the leader, the lock is only held once the stored value is the one
+	// written by this lock; any other value is left over from a previous
+	// leader. Other nodes can't tell who wrote the value, so the lock is
+	// reported as held by the stored value as long as there is a leader.
+	if l.b.raft.State() == raft.Leader {
+		return value == string(l.value), value, nil
+	}
+
+	return l.b.raft.Leader() != "", value, nil
 }
 
 // sealer implements the snapshot.Sealer interface and is used in the snapshot
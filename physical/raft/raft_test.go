@@ -4,24 +4,31 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	cryptorand "crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/go-test/deep"
 	"github.com/golang/protobuf/proto"
 	hclog "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/vault/helper/metricsutil"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
 	"github.com/hashicorp/vault/sdk/physical"
+	"github.com/hashicorp/vault/vault/cluster"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -223,6 +230,157 @@ func TestRaft_Backend(t *testing.T) {
 	physical.ExerciseBackend(t, b)
 }
 
+func TestRaft_Backend_DevMode(t *testing.T) {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:  "raft-dev",
+		Level: hclog.Trace,
+	})
+
+	backendRaw, err := NewRaftBackend(map[string]string{
+		"dev_mode": "true",
+		"node_id":  "raft-dev",
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backendRaw.(*RaftBackend)
+
+	// No raft state should be written to disk in dev mode
+	if _, err := os.Stat(filepath.Join(b.dataDir, raftState, "raft.db")); !os.IsNotExist(err) {
+		t.Fatalf("expected no raft.db in dev mode, got: %v", err)
+	}
+
+	if err := b.Bootstrap([]Peer{{ID: b.NodeID(), Address: b.NodeID()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetupCluster(context.Background(), SetupOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, b)
+
+	entry := &physical.Entry{Key: "foo", Value: []byte("bar")}
+	if err := b.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := b.Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil || !bytes.Equal(out.Value, entry.Value) {
+		t.Fatalf("bad: expected: %#v\nactual: %#v", entry, out)
+	}
+
+	if err := b.TeardownCluster(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temporary directory is removed on close
+	if _, err := os.Stat(b.dataDir); !os.IsNotExist(err) {
+		t.Fatalf("expected dev mode directory to be removed, got: %v", err)
+	}
+}
+
+func TestRaft_Backend_Close(t *testing.T) {
+	raftDir, err := ioutil.TempDir("", "vault-raft-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(raftDir)
+
+	b, _ := getRaftWithDir(t, true, true, raftDir)
+
+	entry := &physical.Entry{Key: "foo", Value: []byte("bar")}
+	if err := b.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close shuts down the running cluster and releases the databases
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log store is opened without a timeout, so guard against blocking
+	// on its lock forever
+	type result struct {
+		b   *RaftBackend
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		backendRaw, err := NewRaftBackend(map[string]string{
+			"path":    raftDir,
+			"node_id": b.NodeID(),
+		}, hclog.NewNullLogger())
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		resultCh <- result{b: backendRaw.(*RaftBackend)}
+	}()
+
+	var b2 *RaftBackend
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		b2 = res.b
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out reopening the backend")
+	}
+	defer b2.Close()
+
+	out, err := b2.Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil || !bytes.Equal(out.Value, entry.Value) {
+		t.Fatalf("bad: expected: %#v\nactual: %#v", entry, out)
+	}
+
+	// Close also stops the raft handler of the cluster listener raft was set
+	// up with
+	b3, dir3 := getRaft(t, false, true)
+	defer os.RemoveAll(dir3)
+
+	raftTLSKey, err := GenerateTLSKey(cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterListener := &mockClusterHook{
+		address: &cluster.NetAddr{
+			Host: "127.0.0.1:8201",
+		},
+	}
+	if err := b3.Bootstrap([]Peer{{ID: b3.NodeID(), Address: clusterListener.address.String()}}); err != nil {
+		t.Fatal(err)
+	}
+	err = b3.SetupCluster(context.Background(), SetupOpts{
+		TLSKeyring: &TLSKeyring{
+			Keys:        []*TLSKey{raftTLSKey},
+			ActiveKeyID: raftTLSKey.ID,
+		},
+		ClusterListener: clusterListener,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clusterListener.hasHandler(consts.RaftStorageALPN) {
+		t.Fatal("expected raft handler to be added to the cluster listener")
+	}
+
+	if err := b3.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if clusterListener.hasHandler(consts.RaftStorageALPN) {
+		t.Fatal("expected raft handler to be stopped on close")
+	}
+}
+
 func TestRaft_Backend_LargeValue(t *testing.T) {
 	b, dir := getRaft(t, true, true)
 	defer os.RemoveAll(dir)
@@ -249,6 +407,50 @@ func TestRaft_Backend_LargeValue(t *testing.T) {
 	}
 }
 
+func TestRaft_Backend_MaxEntrySize(t *testing.T) {
+	b, dir := getRaft(t, true, true)
+	defer os.RemoveAll(dir)
+
+	b.maxEntrySize = 1024
+
+	small := &physical.Entry{Key: "small", Value: make([]byte, 100)}
+	if err := b.Put(context.Background(), small); err != nil {
+		t.Fatal(err)
+	}
+
+	large := &physical.Entry{Key: "large", Value: make([]byte, 2048)}
+	err := b.Put(context.Background(), large)
+	if err == nil || !strings.Contains(err.Error(), physical.ErrValueTooLarge) {
+		t.Fatalf("expected %q, got %v", physical.ErrValueTooLarge, err)
+	}
+
+	err = b.Transaction(context.Background(), []*physical.TxnEntry{
+		{Operation: physical.PutOperation, Entry: small},
+		{Operation: physical.PutOperation, Entry: large},
+	})
+	if err == nil || !strings.Contains(err.Error(), physical.ErrValueTooLarge) {
+		t.Fatalf("expected %q, got %v", physical.ErrValueTooLarge, err)
+	}
+
+	// Invalid sizes are rejected at construction
+	for _, size := range []string{"0", "-1", "large"} {
+		invalidDir, err := ioutil.TempDir("", "vault-raft-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(invalidDir)
+
+		_, err = NewRaftBackend(map[string]string{
+			"path":           invalidDir,
+			"node_id":        "raft1",
+			"max_entry_size": size,
+		}, hclog.NewNullLogger())
+		if err == nil {
+			t.Fatalf("expected error for max_entry_size %q", size)
+		}
+	}
+}
+
 func TestRaft_TransactionalBackend_LargeValue(t *testing.T) {
 	b, dir := getRaft(t, true, true)
 	defer os.RemoveAll(dir)
@@ -275,62 +477,649 @@ func TestRaft_TransactionalBackend_LargeValue(t *testing.T) {
 		t.Fatalf("expected %q, got %v", physical.ErrValueTooLarge, err)
 	}
 
-	out, err := b.Get(context.Background(), txns[0].Entry.Key)
+	out, err := b.Get(context.Background(), txns[0].Entry.Key)
+	if err != nil {
+		t.Fatalf("unexpected error after failed put: %v", err)
+	}
+	if out != nil {
+		t.Fatal("expected response entry to be nil after a failed put")
+	}
+}
+
+func TestRaft_TransactionalBackend_LargeTransaction(t *testing.T) {
+	b, dir := getRaft(t, true, true)
+	defer os.RemoveAll(dir)
+
+	b.maxEntrySize = 4096
+
+	// Each entry fits on its own, but together they exceed the max entry size
+	var txns []*physical.TxnEntry
+	for i := 0; i < 10; i++ {
+		value := make([]byte, 1024)
+		rand.Read(value)
+		txns = append(txns, &physical.TxnEntry{
+			Operation: physical.PutOperation,
+			Entry: &physical.Entry{
+				Key:   fmt.Sprintf("foo%d", i),
+				Value: value,
+			},
+		})
+	}
+
+	err := b.Transaction(context.Background(), txns)
+	if err == nil || !strings.Contains(err.Error(), physical.ErrValueTooLarge) {
+		t.Fatalf("expected %q, got %v", physical.ErrValueTooLarge, err)
+	}
+
+	// The transaction is not partially applied
+	for _, txn := range txns {
+		out, err := b.Get(context.Background(), txn.Entry.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != nil {
+			t.Fatalf("expected %q to not be written", txn.Entry.Key)
+		}
+	}
+
+	// The same entries can be written in transactions that fit
+	for i := 0; i < len(txns); i += 2 {
+		if err := b.Transaction(context.Background(), txns[i:i+2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRaft_Backend_ListPrefix(t *testing.T) {
+	b, dir := getRaft(t, true, true)
+	defer os.RemoveAll(dir)
+
+	physical.ExerciseBackend_ListPrefix(t, b)
+}
+
+func TestRaft_TransactionalBackend(t *testing.T) {
+	b, dir := getRaft(t, true, true)
+	defer os.RemoveAll(dir)
+
+	physical.ExerciseTransactionalBackend(t, b)
+}
+
+func TestRaft_HABackend(t *testing.T) {
+	t.Skip()
+	raft, dir := getRaft(t, true, true)
+	defer os.RemoveAll(dir)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir2)
+
+	// Add raft2 to the cluster
+	addPeer(t, raft, raft2)
+
+	physical.ExerciseHABackend(t, raft, raft2)
+}
+
+func TestRaft_Backend_ThreeNode(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	raft3, dir3 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+	defer os.RemoveAll(dir3)
+
+	// Add raft2 to the cluster
+	addPeer(t, raft1, raft2)
+
+	// Add raft3 to the cluster
+	addPeer(t, raft1, raft3)
+
+	physical.ExerciseBackend(t, raft1)
+
+	time.Sleep(10 * time.Second)
+	// Make sure all stores are the same
+	compareFSMs(t, raft1.fsm, raft2.fsm)
+	compareFSMs(t, raft1.fsm, raft3.fsm)
+}
+
+func TestRaft_ApplyTimeout(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	// Add raft2 to the cluster
+	addPeer(t, raft1, raft2)
+
+	raft1.applyTimeout = time.Second
+	raft2.applyTimeout = time.Second
+
+	// Writes on the follower fail rather than hang
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- raft2.Put(context.Background(), &physical.Entry{Key: "foo", Value: []byte("bar")})
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected error writing to a follower")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to follower did not fail in time")
+	}
+
+	// A cancelled context is honored
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := raft1.Put(ctx, &physical.Entry{Key: "foo", Value: []byte("bar")})
+	if err != context.Canceled {
+		t.Fatalf("expected context cancelled error, got: %v", err)
+	}
+
+	// Writes on the leader still succeed within the timeout
+	if err := raft1.Put(context.Background(), &physical.Entry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaft_GetConsistentOnLeader(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	addPeer(t, raft1, raft2)
+
+	// A consistent read on the leader reflects the completed write
+	for i := 0; i < 10; i++ {
+		value := []byte(fmt.Sprintf("value-%d", i))
+		if err := raft1.Put(context.Background(), &physical.Entry{Key: "foo", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+
+		entry, err := raft1.GetConsistentOnLeader(context.Background(), "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || !bytes.Equal(entry.Value, value) {
+			t.Fatalf("bad entry; expected: %q\n actual: %#v", value, entry)
+		}
+	}
+
+	// Consistent reads are only served by the leader
+	if _, err := raft2.GetConsistentOnLeader(context.Background(), "foo"); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader, got: %v", err)
+	}
+
+	// Without a quorum the read fails instead of returning stale data
+	raft1.applyTimeout = time.Second
+	raft2.TeardownCluster(nil)
+	if _, err := raft1.GetConsistentOnLeader(context.Background(), "foo"); err == nil {
+		t.Fatal("expected an error without a quorum")
+	}
+}
+
+func TestRaft_WALNoSync(t *testing.T) {
+	raftDir, err := ioutil.TempDir("", "vault-raft-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(raftDir)
+
+	conf := map[string]string{
+		"path":            raftDir,
+		"node_id":         "raft1",
+		"raft_wal_nosync": "true",
+	}
+
+	backendRaw, err := NewRaftBackend(conf, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raft1 := backendRaw.(*RaftBackend)
+
+	if err := raft1.Bootstrap([]Peer{{ID: raft1.NodeID(), Address: raft1.NodeID()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := raft1.SetupCluster(context.Background(), SetupOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	defer raft1.TeardownCluster(nil)
+	waitForLeader(t, raft1)
+
+	entry := &physical.Entry{Key: "foo", Value: []byte("bar")}
+	if err := raft1.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := raft1.Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil || !bytes.Equal(out.Value, entry.Value) {
+		t.Fatalf("bad entry: %#v", out)
+	}
+
+	// Invalid options are rejected
+	for key, value := range map[string]string{
+		"raft_wal_nosync":     "sometimes",
+		"raft_wal_mmap_flags": "populate",
+	} {
+		badConf := map[string]string{"path": raftDir, "node_id": "raft1"}
+		badConf[key] = value
+		if _, err := NewRaftBackend(badConf, hclog.NewNullLogger()); err == nil {
+			t.Fatalf("expected an error for %s=%q", key, value)
+		}
+	}
+}
+
+func TestRaft_GetConfiguration_Stats(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	defer os.RemoveAll(dir)
+
+	config, err := raft1.GetConfiguration(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 1 {
+		t.Fatalf("expected a single server in the configuration, got: %#v", config.Servers)
+	}
+	server := config.Servers[0]
+	if server.NodeID != raft1.NodeID() || !server.Leader || !server.Voter {
+		t.Fatalf("bad server in configuration: %#v", server)
+	}
+
+	stats, err := raft1.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["state"] != raft.Leader.String() {
+		t.Fatalf("expected leader state in stats, got: %q", stats["state"])
+	}
+
+	// Both fail once raft has been torn down
+	if err := raft1.TeardownCluster(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raft1.GetConfiguration(context.Background()); err == nil {
+		t.Fatal("expected error getting configuration without raft")
+	}
+	if _, err := raft1.Stats(); err == nil {
+		t.Fatal("expected error getting stats without raft")
+	}
+}
+
+func TestRaft_Metrics(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	defer os.RemoveAll(dir)
+
+	inmemSink := metrics.NewInmemSink(time.Hour, time.Hour)
+	raft1.SetMetricSink(metricsutil.NewClusterMetricSink("test-cluster", inmemSink))
+
+	if err := raft1.Put(context.Background(), &physical.Entry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raft1.Get(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes over the max entry size fail to apply
+	raft1.maxEntrySize = 10
+	if err := raft1.Put(context.Background(), &physical.Entry{Key: "foo", Value: make([]byte, 100)}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	intervals := inmemSink.Data()
+	if len(intervals) != 1 {
+		t.Fatalf("expected a single interval, got: %d", len(intervals))
+	}
+	data := intervals[0]
+
+	for key, expected := range map[string]float64{
+		"raft_storage.fsm.operations;op=put;cluster=test-cluster": 1,
+		"raft_storage.fsm.operations;op=get;cluster=test-cluster": 1,
+		"raft_storage.apply_failures;cluster=test-cluster":        1,
+	} {
+		if counter := data.Counters[key]; counter.Sum != expected {
+			t.Fatalf("bad: %s counter; expected: %f\n actual: %f", key, expected, counter.Sum)
+		}
+	}
+
+	apply := data.Samples["raft_storage.apply;cluster=test-cluster"]
+	if apply.Count != 1 || apply.Sum <= 0 {
+		t.Fatalf("expected a non-zero apply duration, got: %#v", apply.AggregateSample)
+	}
+
+	appliedIndex := data.Gauges["raft_storage.fsm.applied_index;cluster=test-cluster"]
+	if appliedIndex.Value != float32(raft1.AppliedIndex()) {
+		t.Fatalf("bad: applied index gauge; expected: %d\n actual: %f", raft1.AppliedIndex(), appliedIndex.Value)
+	}
+}
+
+func TestRaft_HealthCheck(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	// A bootstrapped single node is the leader and healthy
+	waitForLeader(t, raft1)
+	if err := raft1.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("expected leader to be healthy, got: %v", err)
+	}
+
+	// A follower in contact with the leader is healthy
+	addPeer(t, raft1, raft2)
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = raft2.HealthCheck(context.Background()); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected follower to be healthy, got: %v", err)
+	}
+
+	// A sealed node is unhealthy
+	if err := raft2.TeardownCluster(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := raft2.HealthCheck(context.Background()); err == nil {
+		t.Fatal("expected sealed node to be unhealthy")
+	}
+}
+
+func TestRaft_AddRemovePeer(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	// Add raft2 to the cluster
+	addPeer(t, raft1, raft2)
+
+	peers, err := raft1.Peers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(peers))
+	}
+	if peers[1].ID != raft2.NodeID() {
+		t.Fatalf("expected peer %q, got %q", raft2.NodeID(), peers[1].ID)
+	}
+
+	// Membership changes are rejected on a follower
+	err = raft2.AddPeer(context.Background(), "raft3", "raft3")
+	if err != ErrNotLeader {
+		t.Fatalf("expected %q, got %v", ErrNotLeader, err)
+	}
+	err = raft2.RemovePeer(context.Background(), raft1.NodeID())
+	if err != ErrNotLeader {
+		t.Fatalf("expected %q, got %v", ErrNotLeader, err)
+	}
+
+	// Remove raft2 from the cluster
+	if err := raft1.RemovePeer(context.Background(), raft2.NodeID()); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err = raft1.Peers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID != raft1.NodeID() {
+		t.Fatalf("unexpected peers after removal: %+v", peers)
+	}
+}
+
+func TestRaft_AddNonVoter(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	err := raft1.AddNonVoter(context.Background(), raft2.NodeID(), raft2.NodeID())
+	if !nonVotersAllowed {
+		if err == nil {
+			t.Fatal("expected an error adding a non-voter")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := raft1.Peers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raft2.Bootstrap(peers); err != nil {
+		t.Fatal(err)
+	}
+	if err := raft2.SetupCluster(context.Background(), SetupOpts{NonVoter: true}); err != nil {
+		t.Fatal(err)
+	}
+	connectPeers(raft1, raft2)
+
+	config, err := raft1.GetConfiguration(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 2 {
+		t.Fatalf("expected two servers in the configuration, got: %#v", config.Servers)
+	}
+	for _, server := range config.Servers {
+		switch server.NodeID {
+		case raft1.NodeID():
+			if !server.Voter {
+				t.Fatalf("expected leader to be a voter: %#v", server)
+			}
+		case raft2.NodeID():
+			if server.Voter {
+				t.Fatalf("expected non-voter: %#v", server)
+			}
+		default:
+			t.Fatalf("unexpected server: %#v", server)
+		}
+	}
+
+	// Adding non-voters is only allowed on the leader
+	if err := raft2.AddNonVoter(context.Background(), "raft3", "raft3"); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader, got: %v", err)
+	}
+
+	// The non-voter serves reads from its FSM
+	if err := raft1.Put(context.Background(), &physical.Entry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		entry, err := raft2.Get(context.Background(), "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != nil && string(entry.Value) == "bar" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("non-voter did not replicate the entry")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRaft_LeaderCh(t *testing.T) {
+	b, dir := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+
+	sub1, cancel1 := b.LeaderCh()
+	defer cancel1()
+	sub2, cancel2 := b.LeaderCh()
+	defer cancel2()
+
+	if err := b.Bootstrap([]Peer{{ID: b.NodeID(), Address: b.NodeID()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetupCluster(context.Background(), SetupOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, sub := range []<-chan bool{sub1, sub2} {
+		select {
+		case isLeader := <-sub:
+			if !isLeader {
+				t.Fatalf("subscriber %d: expected leadership gain", i)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("subscriber %d: timed out waiting for leadership notification", i)
+		}
+	}
+
+	// The HA lock still receives leadership notifications
+	lock, err := b.LockWith("core/lock", "raft1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderLost, err := lock.Lock(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaderLost == nil {
+		t.Fatal("expected to acquire the lock")
+	}
+
+	// Cancelled subscriptions are closed and no longer notified
+	cancel2()
+	cancel2()
+	if _, ok := <-sub2; ok {
+		t.Fatal("expected the cancelled subscription to be closed")
+	}
+	b.leaderSubscribersLock.Lock()
+	numSubscribers := len(b.leaderSubscribers)
+	b.leaderSubscribersLock.Unlock()
+	if numSubscribers != 1 {
+		t.Fatalf("expected 1 subscriber, got %d", numSubscribers)
+	}
+}
+
+func TestRaft_Lock_Unlock(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	// Add raft2 to the cluster
+	addPeer(t, raft1, raft2)
+
+	lock, err := raft1.LockWith("core/lock", "raft1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaderLost, err := lock.Lock(nil)
 	if err != nil {
-		t.Fatalf("unexpected error after failed put: %v", err)
+		t.Fatal(err)
 	}
-	if out != nil {
-		t.Fatal("expected response entry to be nil after a failed put")
+	if leaderLost == nil {
+		t.Fatal("expected to acquire the lock")
 	}
-}
-
-func TestRaft_Backend_ListPrefix(t *testing.T) {
-	b, dir := getRaft(t, true, true)
-	defer os.RemoveAll(dir)
-
-	physical.ExerciseBackend_ListPrefix(t, b)
-}
-
-func TestRaft_TransactionalBackend(t *testing.T) {
-	b, dir := getRaft(t, true, true)
-	defer os.RemoveAll(dir)
 
-	physical.ExerciseTransactionalBackend(t, b)
-}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
 
-func TestRaft_HABackend(t *testing.T) {
-	t.Skip()
-	raft, dir := getRaft(t, true, true)
-	defer os.RemoveAll(dir)
-	raft2, dir2 := getRaft(t, false, true)
-	defer os.RemoveAll(dir2)
+	// Leadership should move to raft2
+	if leader := waitForLeader(t, raft1, raft2); leader != raft2 {
+		t.Fatal("expected leadership to be transferred to raft2")
+	}
 
-	// Add raft2 to the cluster
-	addPeer(t, raft, raft2)
+	// The monitor goroutine is stopped on unlock, so the leader lost channel
+	// is never closed
+	select {
+	case <-leaderLost:
+		t.Fatal("expected leadership monitor to be stopped")
+	case <-time.After(time.Second):
+	}
 
-	physical.ExerciseHABackend(t, raft, raft2)
+	// Unlocking on a follower is a no-op
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestRaft_Backend_ThreeNode(t *testing.T) {
+func TestRaft_Lock_Value(t *testing.T) {
 	raft1, dir := getRaft(t, true, true)
 	raft2, dir2 := getRaft(t, false, true)
-	raft3, dir3 := getRaft(t, false, true)
 	defer os.RemoveAll(dir)
 	defer os.RemoveAll(dir2)
-	defer os.RemoveAll(dir3)
 
 	// Add raft2 to the cluster
 	addPeer(t, raft1, raft2)
 
-	// Add raft3 to the cluster
-	addPeer(t, raft1, raft3)
+	lock1, err := raft1.LockWith("core/lock", "raft1")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	physical.ExerciseBackend(t, raft1)
+	// Nothing is stored before the lock is acquired
+	held, value, err := lock1.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held || value != "" {
+		t.Fatalf("expected lock to be unheld, got held: %t, value: %q", held, value)
+	}
 
-	time.Sleep(10 * time.Second)
-	// Make sure all stores are the same
-	compareFSMs(t, raft1.fsm, raft2.fsm)
-	compareFSMs(t, raft1.fsm, raft3.fsm)
+	leaderLost, err := lock1.Lock(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaderLost == nil {
+		t.Fatal("expected to acquire the lock")
+	}
+
+	// The leader holding the lock reports it as held
+	held, value, err = lock1.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held || value != "raft1" {
+		t.Fatalf("expected lock to be held by raft1, got held: %t, value: %q", held, value)
+	}
+
+	// A lock on the leader with a different value is not held
+	other, err := raft1.LockWith("core/lock", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, value, err = other.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held || value != "raft1" {
+		t.Fatalf("expected lock to be unheld with value raft1, got held: %t, value: %q", held, value)
+	}
+
+	// The follower sees the lock held by the leader
+	lock2, err := raft2.LockWith("core/lock", "raft2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		held, value, err = lock2.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == "raft1" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !held || value != "raft1" {
+		t.Fatalf("expected follower to see lock held by raft1, got held: %t, value: %q", held, value)
+	}
 }
 
 func TestRaft_Recovery(t *testing.T) {
@@ -421,6 +1210,70 @@ func TestRaft_Recovery(t *testing.T) {
 	compareFSMs(t, raft1.fsm, raft4.fsm)
 }
 
+func TestRaft_RecoverCluster(t *testing.T) {
+	raft1, dir1 := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	raft3, dir3 := getRaft(t, false, true)
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+	defer os.RemoveAll(dir3)
+
+	addPeer(t, raft1, raft2)
+	addPeer(t, raft1, raft3)
+
+	if err := raft1.Put(context.Background(), &physical.Entry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recovery is refused while raft is running
+	recoveryConfig := raft.Configuration{
+		Servers: []raft.Server{
+			{
+				ID:      raft.ServerID(raft1.NodeID()),
+				Address: raft.ServerAddress(raft1.NodeID()),
+			},
+		},
+	}
+	if err := raft1.RecoverCluster(context.Background(), recoveryConfig); err == nil {
+		t.Fatal("expected an error recovering a running cluster")
+	}
+
+	// Lose quorum: only node 1 survives
+	raft1.TeardownCluster(nil)
+	raft2.TeardownCluster(nil)
+	raft3.TeardownCluster(nil)
+
+	if err := raft1.RecoverCluster(context.Background(), recoveryConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := raft1.SetupCluster(context.Background(), SetupOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, raft1)
+
+	peers, err := raft1.Peers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID != raft1.NodeID() {
+		t.Fatalf("expected a single peer after recovery, got: %#v", peers)
+	}
+
+	// The state written before the quorum loss is readable and the cluster
+	// accepts writes again
+	entry, err := raft1.Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || string(entry.Value) != "bar" {
+		t.Fatalf("bad entry after recovery: %#v", entry)
+	}
+	if err := raft1.Put(context.Background(), &physical.Entry{Key: "baz", Value: []byte("qux")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestRaft_TransactionalBackend_ThreeNode(t *testing.T) {
 	raft1, dir := getRaft(t, true, true)
 	raft2, dir2 := getRaft(t, false, true)
@@ -500,6 +1353,180 @@ func TestRaft_Backend_Performance(t *testing.T) {
 
 }
 
+func TestRaft_Backend_Timeouts(t *testing.T) {
+	b, dir := getRaft(t, true, false)
+	defer os.RemoveAll(dir)
+
+	b.conf = map[string]string{
+		"path":                   dir,
+		"performance_multiplier": "5",
+		"heartbeat_timeout":      "2s",
+		"election_timeout":       "3s",
+		"leader_lease_timeout":   "1500ms",
+		"commit_timeout":         "20ms",
+	}
+
+	localConfig := raft.DefaultConfig()
+	if err := b.applyConfigSettings(localConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if localConfig.HeartbeatTimeout != 2*time.Second {
+		t.Fatalf("bad: heartbeat timeout: %s", localConfig.HeartbeatTimeout)
+	}
+	if localConfig.ElectionTimeout != 3*time.Second {
+		t.Fatalf("bad: election timeout: %s", localConfig.ElectionTimeout)
+	}
+	if localConfig.LeaderLeaseTimeout != 1500*time.Millisecond {
+		t.Fatalf("bad: leader lease timeout: %s", localConfig.LeaderLeaseTimeout)
+	}
+	if localConfig.CommitTimeout != 20*time.Millisecond {
+		t.Fatalf("bad: commit timeout: %s", localConfig.CommitTimeout)
+	}
+
+	invalid := []map[string]string{
+		{"heartbeat_timeout": "soon"},
+		{"commit_timeout": "0s"},
+		{"election_timeout": "1ms"},
+		{"heartbeat_timeout": "20s"},
+		{"election_timeout": "2s", "heartbeat_timeout": "3s", "leader_lease_timeout": "1s"},
+		{"leader_lease_timeout": "2s", "heartbeat_timeout": "1s"},
+	}
+	for _, conf := range invalid {
+		b.conf = conf
+		if err := b.applyConfigSettings(raft.DefaultConfig()); err == nil {
+			t.Fatalf("expected error for config: %v", conf)
+		}
+	}
+}
+
+type testAddressProvider map[raft.ServerID]raft.ServerAddress
+
+func (p testAddressProvider) ServerAddr(id raft.ServerID) (raft.ServerAddress, error) {
+	addr, ok := p[id]
+	if !ok {
+		return "", fmt.Errorf("unknown server %q", id)
+	}
+	return addr, nil
+}
+
+// recordingStreamLayer is a raft.StreamLayer that records the addresses it
+// is asked to dial and fails every dial.
+type recordingStreamLayer struct {
+	net.Listener
+	dialed chan raft.ServerAddress
+}
+
+func (r *recordingStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	r.dialed <- address
+	return nil, errors.New("dial not supported")
+}
+
+func TestRaft_Backend_ServerAddressProvider(t *testing.T) {
+	b, dir := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+
+	b.SetServerAddressProvider(testAddressProvider{
+		"node2": "127.0.0.1:8201",
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &recordingStreamLayer{
+		Listener: listener,
+		dialed:   make(chan raft.ServerAddress, 2),
+	}
+
+	transport := b.newNetworkTransport(stream, raft.ProtocolVersionMax)
+	defer transport.Close()
+
+	// The provider's address is used instead of the stale one
+	var resp raft.AppendEntriesResponse
+	if err := transport.AppendEntries("node2", "127.0.0.1:9999", &raft.AppendEntriesRequest{}, &resp); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if addr := <-stream.dialed; addr != "127.0.0.1:8201" {
+		t.Fatalf("expected provider address to be dialed, got: %q", addr)
+	}
+
+	// Unknown servers fall back to the given address
+	if err := transport.AppendEntries("node3", "127.0.0.1:9999", &raft.AppendEntriesRequest{}, &resp); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if addr := <-stream.dialed; addr != "127.0.0.1:9999" {
+		t.Fatalf("expected fallback address to be dialed, got: %q", addr)
+	}
+}
+
+func TestRaft_Backend_SnapshotAndLogSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault-raft-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:  "raft",
+		Level: hclog.Trace,
+	})
+
+	backendRaw, err := NewRaftBackend(map[string]string{
+		"path":               dir,
+		"node_id":            "raft1",
+		"snapshot_threshold": "100",
+		"snapshot_interval":  "30s",
+		"trailing_logs":      "50",
+		"log_cache_size":     "64",
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backendRaw.(*RaftBackend)
+	defer b.Close()
+
+	localConfig := raft.DefaultConfig()
+	if err := b.applyConfigSettings(localConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if localConfig.SnapshotThreshold != 100 {
+		t.Fatalf("bad: snapshot threshold: %d", localConfig.SnapshotThreshold)
+	}
+	if localConfig.SnapshotInterval != 30*time.Second {
+		t.Fatalf("bad: snapshot interval: %s", localConfig.SnapshotInterval)
+	}
+	if localConfig.TrailingLogs != 50 {
+		t.Fatalf("bad: trailing logs: %d", localConfig.TrailingLogs)
+	}
+
+	// Invalid values are rejected at construction
+	invalid := []map[string]string{
+		{"snapshot_threshold": "-1"},
+		{"snapshot_interval": "0s"},
+		{"snapshot_interval": "soon"},
+		{"trailing_logs": "many"},
+		{"log_cache_size": "0"},
+		{"performance_multiplier": "fast"},
+		{"apply_batch_linger": "-1s"},
+		{"apply_batch_size": "0"},
+	}
+	for _, conf := range invalid {
+		invalidDir, err := ioutil.TempDir("", "vault-raft-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(invalidDir)
+
+		conf["path"] = invalidDir
+		conf["node_id"] = "raft1"
+		if _, err := NewRaftBackend(conf, logger); err == nil {
+			t.Fatalf("expected error for config: %v", conf)
+		}
+	}
+}
+
 func BenchmarkDB_Puts(b *testing.B) {
 	raft, dir := getRaft(b, true, false)
 	defer os.RemoveAll(dir)
@@ -572,3 +1599,98 @@ type discardCloser struct {
 
 func (d discardCloser) Close() error               { return nil }
 func (d discardCloser) CloseWithError(error) error { return nil }
+
+func TestRaft_WaitForApplied(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	addPeer(t, raft1, raft2)
+
+	for i := 0; i < 10; i++ {
+		if err := raft1.Put(context.Background(), &physical.Entry{Key: fmt.Sprintf("key%d", i), Value: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := raft1.AppliedIndex()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := raft2.WaitForApplied(ctx, index); err != nil {
+		t.Fatal(err)
+	}
+	if applied := raft2.AppliedIndex(); applied < index {
+		t.Fatalf("expected applied index of at least %d, got %d", index, applied)
+	}
+
+	// Every write up to the index can be read on the follower
+	for i := 0; i < 10; i++ {
+		entry, err := raft2.Get(context.Background(), fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			t.Fatalf("key%d was not replicated", i)
+		}
+	}
+
+	// Waiting for an index that is never reached stops with the context
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := raft2.WaitForApplied(ctx, index+1000); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+}
+
+func TestRaft_RemoveSelf(t *testing.T) {
+	raft1, dir := getRaft(t, true, true)
+	raft2, dir2 := getRaft(t, false, true)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir2)
+
+	addPeer(t, raft1, raft2)
+
+	if err := raft1.Put(context.Background(), &physical.Entry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the leader can change the configuration
+	if err := raft2.RemoveSelf(context.Background()); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader, got: %v", err)
+	}
+
+	if err := raft1.RemoveSelf(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if raft1.raft != nil {
+		t.Fatal("expected raft to be shut down")
+	}
+
+	// The remaining node forms a quorum on its own
+	waitForLeader(t, raft2)
+
+	config, err := raft2.GetConfiguration(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 1 || config.Servers[0].NodeID != raft2.NodeID() {
+		t.Fatalf("unexpected servers: %#v", config.Servers)
+	}
+
+	if err := raft2.Put(context.Background(), &physical.Entry{Key: "baz", Value: []byte("qux")}); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := raft2.Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || string(entry.Value) != "bar" {
+		t.Fatalf("unexpected entry: %#v", entry)
+	}
+
+	// The last voter can't remove itself
+	if err := raft2.RemoveSelf(context.Background()); err == nil {
+		t.Fatal("expected an error removing the only voter")
+	}
+}
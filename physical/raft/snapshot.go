@@ -52,6 +52,10 @@ type BoltSnapshotStore struct {
 	// database.
 	fsm *FSM
 
+	// compression is the compressutil type used to compress snapshots
+	// streamed out of the FSM. Empty disables compression.
+	compression string
+
 	logger log.Logger
 }
 
@@ -182,11 +186,20 @@ func (f *BoltSnapshotStore) openFromFSM() (*raft.SnapshotMeta, io.ReadCloser, er
 		return nil, nil, errors.New("no snapshot data")
 	}
 
-	// Stream data out of the FSM to calculate the size
+	// Stream data out of the FSM to calculate the size. The size must match
+	// the data that is sent, so the metadata stream is compressed as well.
 	readCloser, writeCloser := io.Pipe()
 	metaReadCloser, metaWriteCloser := io.Pipe()
+	sink, err := newCompressedSnapshotWriter(writeCloser, f.compression)
+	if err != nil {
+		return nil, nil, err
+	}
+	metaSink, err := newCompressedSnapshotWriter(metaWriteCloser, f.compression)
+	if err != nil {
+		return nil, nil, err
+	}
 	go func() {
-		f.fsm.writeTo(context.Background(), metaWriteCloser, writeCloser)
+		f.fsm.writeTo(context.Background(), metaSink, sink)
 	}()
 
 	// Compute the size
@@ -361,9 +374,19 @@ func (s *BoltSnapshotSink) writeBoltDBFile() error {
 		defer close(s.doneWritingCh)
 		defer boltDB.Close()
 
+		// Snapshots streamed from a leader may be compressed
+		snapshotReader, err := newDecompressedSnapshotReader(reader)
+		if err != nil {
+			s.logger.Error("snapshot write: failed to read snapshot header", "error", err)
+			s.writeError = err
+			reader.CloseWithError(err)
+			return
+		}
+		defer snapshotReader.Close()
+
 		// The delimted reader will parse full proto messages from the snapshot
 		// data.
-		protoReader := NewDelimitedReader(reader, math.MaxInt32)
+		protoReader := NewDelimitedReader(snapshotReader, math.MaxInt32)
 		defer protoReader.Close()
 
 		var done bool
@@ -0,0 +1,160 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/compressutil"
+)
+
+// snapshotCompressionMagic prefixes compressed snapshot streams and is
+// followed by the compressutil canary byte of the algorithm used. An
+// uncompressed stream starts with the varint length of a storage entry, which
+// is never zero since bolt doesn't allow empty keys, so the leading zero byte
+// can't be mistaken for the start of an uncompressed snapshot.
+var snapshotCompressionMagic = []byte{0x00, 'V', 'R', 'S'}
+
+// validateSnapshotCompression returns an error if the compression type isn't
+// supported for snapshots. An empty type disables compression.
+func validateSnapshotCompression(compressionType string) error {
+	switch compressionType {
+	case "", compressutil.CompressionTypeGzip, compressutil.CompressionTypeSnappy:
+		return nil
+	default:
+		return fmt.Errorf("unsupported snapshot compression type %q", compressionType)
+	}
+}
+
+// compressedSnapshotWriter compresses everything written to it into the
+// underlying pipe, after writing the compression header.
+type compressedSnapshotWriter struct {
+	pipe       *io.PipeWriter
+	compressor io.WriteCloser
+}
+
+var _ writeErrorCloser = (*compressedSnapshotWriter)(nil)
+
+// newCompressedSnapshotWriter returns a writer that compresses the snapshot
+// stream with the given algorithm, or the pipe itself if compressionType is
+// empty.
+func newCompressedSnapshotWriter(pipe *io.PipeWriter, compressionType string) (writeErrorCloser, error) {
+	var canary byte
+	var compressor io.WriteCloser
+
+	switch compressionType {
+	case "":
+		return pipe, nil
+	case compressutil.CompressionTypeGzip:
+		canary = compressutil.CompressionCanaryGzip
+		compressor = gzip.NewWriter(pipe)
+	case compressutil.CompressionTypeSnappy:
+		canary = compressutil.CompressionCanarySnappy
+		compressor = snappy.NewBufferedWriter(pipe)
+	default:
+		return nil, validateSnapshotCompression(compressionType)
+	}
+
+	header := make([]byte, 0, len(snapshotCompressionMagic)+1)
+	header = append(header, snapshotCompressionMagic...)
+	header = append(header, canary)
+
+	// The header is written lazily with the first write so that creating the
+	// writer doesn't block on the pipe's reader
+	return &compressedSnapshotWriter{
+		pipe: pipe,
+		compressor: &headerWriter{
+			WriteCloser: compressor,
+			pipe:        pipe,
+			header:      header,
+		},
+	}, nil
+}
+
+func (w *compressedSnapshotWriter) Write(p []byte) (int, error) {
+	return w.compressor.Write(p)
+}
+
+// Close flushes the compressed stream and closes the pipe.
+func (w *compressedSnapshotWriter) Close() error {
+	if err := w.compressor.Close(); err != nil {
+		w.pipe.CloseWithError(err)
+		return err
+	}
+	return w.pipe.Close()
+}
+
+// CloseWithError closes the pipe with the given error. A nil error closes the
+// stream successfully.
+func (w *compressedSnapshotWriter) CloseWithError(err error) error {
+	if err == nil {
+		return w.Close()
+	}
+	return w.pipe.CloseWithError(err)
+}
+
+// headerWriter writes header to pipe before the first write to, or close of,
+// the wrapped compressor.
+type headerWriter struct {
+	io.WriteCloser
+	pipe   io.Writer
+	header []byte
+}
+
+func (h *headerWriter) writeHeader() error {
+	if h.header == nil {
+		return nil
+	}
+	_, err := h.pipe.Write(h.header)
+	h.header = nil
+	return err
+}
+
+func (h *headerWriter) Write(p []byte) (int, error) {
+	if err := h.writeHeader(); err != nil {
+		return 0, err
+	}
+	return h.WriteCloser.Write(p)
+}
+
+func (h *headerWriter) Close() error {
+	if err := h.writeHeader(); err != nil {
+		return err
+	}
+	return h.WriteCloser.Close()
+}
+
+// newDecompressedSnapshotReader detects whether the snapshot stream starts
+// with a compression header and, if it does, returns a reader that
+// decompresses it. Uncompressed snapshots are returned as is.
+func newDecompressedSnapshotReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	header, err := br.Peek(len(snapshotCompressionMagic) + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(header) <= len(snapshotCompressionMagic) || !bytes.Equal(header[:len(snapshotCompressionMagic)], snapshotCompressionMagic) {
+		return &compressutil.CompressUtilReadCloser{Reader: br}, nil
+	}
+	if _, err := br.Discard(len(header)); err != nil {
+		return nil, err
+	}
+
+	switch canary := header[len(snapshotCompressionMagic)]; canary {
+	case compressutil.CompressionCanaryGzip:
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errwrap.Wrapf("failed to create gzip reader for snapshot: {{err}}", err)
+		}
+		return gzr, nil
+	case compressutil.CompressionCanarySnappy:
+		return &compressutil.CompressUtilReadCloser{Reader: snappy.NewReader(br)}, nil
+	default:
+		return nil, fmt.Errorf("unknown snapshot compression canary %q", canary)
+	}
+}
@@ -17,6 +17,7 @@ import (
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/vault/sdk/helper/compressutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/physical"
 	"github.com/hashicorp/vault/sdk/plugin/pb"
@@ -819,6 +820,114 @@ func TestBoltSnapshotStore_CreateInstallSnapshot(t *testing.T) {
 	}
 }
 
+func TestBoltSnapshotStore_Compression(t *testing.T) {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:  "raft",
+		Level: hclog.Info,
+	})
+
+	parent, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	fsm, err := NewFSM(parent, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsm.Close()
+
+	for i := 0; i < 5000; i++ {
+		err := fsm.Put(context.Background(), &physical.Entry{
+			Key:   fmt.Sprintf("key-%d", i),
+			Value: bytes.Repeat([]byte(fmt.Sprintf("value-%d", i)), 50),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fsm.witnessSnapshot(&raft.SnapshotMeta{Index: 100, Term: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uncompressedSize int64
+	for _, compression := range []string{"", compressutil.CompressionTypeGzip, compressutil.CompressionTypeSnappy} {
+		t.Run(fmt.Sprintf("compression=%q", compression), func(t *testing.T) {
+			snap, err := NewBoltSnapshotStore(filepath.Join(parent, "leader-"+compression), logger, fsm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			snap.compression = compression
+
+			// Stream the snapshot out of the FSM, as when sending it to a
+			// follower
+			meta, r, err := snap.Open(boltSnapshotID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+
+			if int64(len(data)) != meta.Size {
+				t.Fatalf("snapshot size %d does not match metadata size %d", len(data), meta.Size)
+			}
+			if compression == "" {
+				uncompressedSize = meta.Size
+				if bytes.HasPrefix(data, snapshotCompressionMagic) {
+					t.Fatal("expected an uncompressed snapshot")
+				}
+			} else if meta.Size >= uncompressedSize {
+				t.Fatalf("expected compressed snapshot to be smaller than %d, got %d", uncompressedSize, meta.Size)
+			}
+
+			// Install it on another node, which detects the compression
+			followerDir := filepath.Join(parent, "follower-"+compression)
+			if err := os.MkdirAll(followerDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			followerFSM, err := NewFSM(followerDir, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer followerFSM.Close()
+
+			followerSnap, err := NewBoltSnapshotStore(followerDir, logger, followerFSM)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, trans := raft.NewInmemTransport(raft.NewInmemAddr())
+			sink, err := followerSnap.Create(raft.SnapshotVersionMax, meta.Index, meta.Term, meta.Configuration, meta.ConfigurationIndex, trans)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sink.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, installer, err := followerSnap.Open(sink.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := followerFSM.Restore(installer); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := compareDBs(t, fsm.db, followerFSM.db, true); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
 func TestBoltSnapshotStore_CancelSnapshot(t *testing.T) {
 	// Create a test dir
 	dir, err := ioutil.TempDir("", "raft")
@@ -167,6 +167,12 @@ type raftLayer struct {
 	// TLS config
 	keyring         *TLSKeyring
 	clusterListener cluster.ClusterHook
+
+	// bindAddr and tlsConfig, if set, are the local address and the TLS
+	// protocol settings of outgoing connections. Connections are then dialed
+	// over TCP by the layer itself rather than by the cluster listener.
+	bindAddr  net.IP
+	tlsConfig *tls.Config
 }
 
 // NewRaftLayer creates a new raftLayer object. It parses the TLS information
@@ -377,6 +383,44 @@ func (l *raftLayer) Addr() net.Addr {
 
 // Dial is used to create a new outgoing connection
 func (l *raftLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
-	dialFunc := l.clusterListener.GetDialerFunc(context.Background(), consts.RaftStorageALPN)
-	return dialFunc(string(address), timeout)
+	if l.bindAddr == nil && l.tlsConfig == nil {
+		dialFunc := l.clusterListener.GetDialerFunc(context.Background(), consts.RaftStorageALPN)
+		return dialFunc(string(address), timeout)
+	}
+
+	ctx := context.Background()
+	tlsConfig, err := l.clusterListener.TLSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return nil, errors.New("no tls config found")
+	}
+
+	if l.tlsConfig != nil {
+		tlsConfig.MinVersion = l.tlsConfig.MinVersion
+		tlsConfig.MaxVersion = l.tlsConfig.MaxVersion
+		tlsConfig.CipherSuites = l.tlsConfig.CipherSuites
+		tlsConfig.CurvePreferences = l.tlsConfig.CurvePreferences
+	}
+
+	if serverName := l.ServerName(); serverName != "" {
+		tlsConfig.ServerName = serverName
+	}
+	if caCert := l.CACert(ctx); caCert != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(caCert)
+		tlsConfig.RootCAs = pool
+		tlsConfig.ClientCAs = pool
+	}
+	tlsConfig.NextProtos = []string{consts.RaftStorageALPN}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	if l.bindAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: l.bindAddr}
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", string(address), tlsConfig)
 }
@@ -4,23 +4,51 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"io/ioutil"
 	"net"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/vault/vault/cluster"
 )
 
 type mockClusterHook struct {
-	address net.Addr
+	address   net.Addr
+	tlsConfig *tls.Config
+
+	l        sync.Mutex
+	handlers map[string]cluster.Handler
 }
 
-func (*mockClusterHook) AddClient(alpn string, client cluster.Client)       {}
-func (*mockClusterHook) RemoveClient(alpn string)                           {}
-func (*mockClusterHook) AddHandler(alpn string, handler cluster.Handler)    {}
-func (*mockClusterHook) StopHandler(alpn string)                            {}
-func (*mockClusterHook) TLSConfig(ctx context.Context) (*tls.Config, error) { return nil, nil }
-func (m *mockClusterHook) Addr() net.Addr                                   { return m.address }
+func (*mockClusterHook) AddClient(alpn string, client cluster.Client) {}
+func (*mockClusterHook) RemoveClient(alpn string)                     {}
+func (m *mockClusterHook) AddHandler(alpn string, handler cluster.Handler) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.handlers == nil {
+		m.handlers = make(map[string]cluster.Handler)
+	}
+	m.handlers[alpn] = handler
+}
+func (m *mockClusterHook) StopHandler(alpn string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	delete(m.handlers, alpn)
+}
+func (m *mockClusterHook) hasHandler(alpn string) bool {
+	m.l.Lock()
+	defer m.l.Unlock()
+	_, ok := m.handlers[alpn]
+	return ok
+}
+func (m *mockClusterHook) Addr() net.Addr { return m.address }
+func (m *mockClusterHook) TLSConfig(ctx context.Context) (*tls.Config, error) {
+	return m.tlsConfig.Clone(), nil
+}
 func (*mockClusterHook) GetDialerFunc(ctx context.Context, alpnProto string) func(string, time.Duration) (net.Conn, error) {
 	return func(string, time.Duration) (net.Conn, error) {
 		return nil, nil
@@ -68,3 +96,101 @@ func TestStreamLayer_UnspecifiedIP(t *testing.T) {
 		t.Fatal("nil layer")
 	}
 }
+
+func TestStreamLayer_BindAddr(t *testing.T) {
+	raftTLSKey, err := GenerateTLSKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raftTLS := &TLSKeyring{
+		Keys:        []*TLSKey{raftTLSKey},
+		ActiveKeyID: raftTLSKey.ID,
+	}
+
+	m := &mockClusterHook{
+		address: &cluster.NetAddr{
+			Host: "127.0.0.1:8201",
+		},
+		tlsConfig: &tls.Config{},
+	}
+	layer, err := NewRaftLayer(nil, raftTLS, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.bindAddr = net.ParseIP("127.0.0.2")
+	layer.tlsConfig = &tls.Config{
+		MaxVersion: tls.VersionTLS12,
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return layer.ServerLookup(context.Background(), hello)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	remoteAddrCh := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+		remoteAddrCh <- conn.RemoteAddr()
+	}()
+
+	conn, err := layer.Dial(raft.ServerAddress(ln.Addr().String()), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	if state.Version != tls.VersionTLS12 {
+		t.Fatalf("expected the configured TLS version to be used, got %x", state.Version)
+	}
+
+	select {
+	case remoteAddr := <-remoteAddrCh:
+		if ip := remoteAddr.(*net.TCPAddr).IP; !ip.Equal(layer.bindAddr) {
+			t.Fatalf("expected connection from %s, got %s", layer.bindAddr, ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection")
+	}
+}
+
+func TestStreamLayer_BindAddrConfig(t *testing.T) {
+	raftDir, err := ioutil.TempDir("", "vault-raft-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(raftDir)
+
+	if _, err := NewRaftBackend(map[string]string{
+		"path":           raftDir,
+		"node_id":        "raft1",
+		"raft_bind_addr": "not-an-ip",
+	}, hclog.NewNullLogger()); err == nil {
+		t.Fatal("expected an error for an invalid raft_bind_addr")
+	}
+
+	backend, err := NewRaftBackend(map[string]string{
+		"path":           raftDir,
+		"node_id":        "raft1",
+		"raft_bind_addr": "10.0.0.1",
+	}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.(*RaftBackend).Close()
+
+	if ip := backend.(*RaftBackend).bindAddr; !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected bind address: %s", ip)
+	}
+}
@@ -2,17 +2,22 @@ package mysql
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/helper/random"
 	"github.com/hashicorp/vault/sdk/database/helper/connutil"
 	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
 	"github.com/hashicorp/vault/sdk/helper/parseutil"
@@ -31,10 +36,40 @@ type mySQLConnectionProducer struct {
 
 	TLSCertificateKeyData []byte `json:"tls_certificate_key" mapstructure:"tls_certificate_key" structs:"-"`
 	TLSCAData             []byte `json:"tls_ca"              mapstructure:"tls_ca"              structs:"-"`
+	TLSServerName         string `json:"tls_server_name"     mapstructure:"tls_server_name"     structs:"tls_server_name"`
+
+	ServerPublicKeyPath string `json:"server_public_key_path" mapstructure:"server_public_key_path" structs:"server_public_key_path"`
+
+	// ServerType is either mysql or mariadb, and is detected from the server's
+	// version if not set
+	ServerType string `json:"server_type" mapstructure:"server_type" structs:"server_type"`
+
+	// VerifyRevocation makes RevokeUser check that the user has been dropped
+	VerifyRevocation bool `json:"verify_revocation" mapstructure:"verify_revocation" structs:"verify_revocation"`
+
+	// PasswordPolicy is a password policy, in the same HCL format as Vault's
+	// password policies, that generated passwords adhere to
+	PasswordPolicy string `json:"password_policy" mapstructure:"password_policy" structs:"password_policy"`
+
+	// passwordGenerator is the parsed PasswordPolicy, or nil if none is set
+	passwordGenerator *random.StringGenerator
+
+	UsernameTemplate string `json:"username_template" mapstructure:"username_template" structs:"username_template"`
+
+	// usernameTemplate is the parsed UsernameTemplate, or nil if none is set
+	usernameTemplate *template.Template
+
+	// connectionURLTemplate is the connection URL before the credentials are
+	// substituted, so that it can be rendered again once they are rotated
+	connectionURLTemplate string
 
 	// tlsConfigName is a globally unique name that references the TLS config for this instance in the mysql driver
 	tlsConfigName string
 
+	// serverPubKeyName is a globally unique name that references the server's RSA public key for this instance in
+	// the mysql driver
+	serverPubKeyName string
+
 	RawConfig             map[string]interface{}
 	maxConnectionLifetime time.Duration
 	Initialized           bool
@@ -62,16 +97,18 @@ func (c *mySQLConnectionProducer) Init(ctx context.Context, conf map[string]inte
 		return nil, fmt.Errorf("connection_url cannot be empty")
 	}
 
-	// Don't escape special characters for MySQL password
-	password := c.Password
+	c.connectionURLTemplate = c.ConnectionURL
+	c.renderConnectionURL()
 
-	// QueryHelper doesn't do any SQL escaping, but if it starts to do so
-	// then maybe we won't be able to use it to do URL substitution any more.
-	c.ConnectionURL = dbutil.QueryHelper(c.ConnectionURL, map[string]string{
-		"username": url.PathEscape(c.Username),
-		"password": password,
-	})
+	switch c.ServerType {
+	case "", serverTypeMySQL, serverTypeMariaDB:
+	default:
+		return nil, fmt.Errorf("invalid server_type %q, must be %q or %q", c.ServerType, serverTypeMySQL, serverTypeMariaDB)
+	}
 
+	if c.MaxOpenConnections < 0 {
+		return nil, fmt.Errorf("max_open_connections cannot be negative")
+	}
 	if c.MaxOpenConnections == 0 {
 		c.MaxOpenConnections = 4
 	}
@@ -91,6 +128,22 @@ func (c *mySQLConnectionProducer) Init(ctx context.Context, conf map[string]inte
 		return nil, errwrap.Wrapf("invalid max_connection_lifetime: {{err}}", err)
 	}
 
+	c.usernameTemplate = nil
+	if c.UsernameTemplate != "" {
+		c.usernameTemplate, err = parseUsernameTemplate(c.UsernameTemplate)
+		if err != nil {
+			return nil, errwrap.Wrapf("invalid username_template: {{err}}", err)
+		}
+	}
+
+	c.passwordGenerator = nil
+	if c.PasswordPolicy != "" {
+		c.passwordGenerator, err = parsePasswordPolicy(c.PasswordPolicy)
+		if err != nil {
+			return nil, errwrap.Wrapf("invalid password_policy: {{err}}", err)
+		}
+	}
+
 	tlsConfig, err := c.getTLSAuth()
 	if err != nil {
 		return nil, err
@@ -104,7 +157,25 @@ func (c *mySQLConnectionProducer) Init(ctx context.Context, conf map[string]inte
 			}
 		}
 
-		mysql.RegisterTLSConfig(c.tlsConfigName, tlsConfig)
+		if err := mysql.RegisterTLSConfig(c.tlsConfigName, tlsConfig); err != nil {
+			return nil, errwrap.Wrapf("unable to register TLS configuration: {{err}}", err)
+		}
+	}
+
+	if c.ServerPublicKeyPath != "" {
+		pubKey, err := readServerPublicKey(c.ServerPublicKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.serverPubKeyName == "" {
+			c.serverPubKeyName, err = uuid.GenerateUUID()
+			if err != nil {
+				return nil, fmt.Errorf("unable to generate UUID for server public key: %w", err)
+			}
+		}
+
+		mysql.RegisterServerPubKey(c.serverPubKeyName, pubKey)
 	}
 
 	// Set initialized to true at this point since all fields are set,
@@ -124,6 +195,20 @@ func (c *mySQLConnectionProducer) Init(ctx context.Context, conf map[string]inte
 	return c.RawConfig, nil
 }
 
+// renderConnectionURL substitutes the configured credentials into the
+// connection URL template.
+func (c *mySQLConnectionProducer) renderConnectionURL() {
+	// Don't escape special characters for MySQL password
+	password := c.Password
+
+	// QueryHelper doesn't do any SQL escaping, but if it starts to do so
+	// then maybe we won't be able to use it to do URL substitution any more.
+	c.ConnectionURL = dbutil.QueryHelper(c.connectionURLTemplate, map[string]string{
+		"username": url.PathEscape(c.Username),
+		"password": password,
+	})
+}
+
 func (c *mySQLConnectionProducer) Connection(ctx context.Context) (interface{}, error) {
 	if !c.Initialized {
 		return nil, connutil.ErrNotInitialized
@@ -181,15 +266,19 @@ func (c *mySQLConnectionProducer) Close() error {
 
 func (c *mySQLConnectionProducer) getTLSAuth() (tlsConfig *tls.Config, err error) {
 	if len(c.TLSCAData) == 0 &&
-		len(c.TLSCertificateKeyData) == 0 {
+		len(c.TLSCertificateKeyData) == 0 &&
+		c.TLSServerName == "" {
 		return nil, nil
 	}
 
-	rootCertPool := x509.NewCertPool()
+	// Without a CA, the server certificate is verified against the system's
+	// root CAs
+	var rootCertPool *x509.CertPool
 	if len(c.TLSCAData) > 0 {
+		rootCertPool = x509.NewCertPool()
 		ok := rootCertPool.AppendCertsFromPEM(c.TLSCAData)
 		if !ok {
-			return nil, fmt.Errorf("failed to append CA to client options")
+			return nil, fmt.Errorf("failed to parse tls_ca: no PEM encoded certificates found")
 		}
 	}
 
@@ -207,6 +296,7 @@ func (c *mySQLConnectionProducer) getTLSAuth() (tlsConfig *tls.Config, err error
 	tlsConfig = &tls.Config{
 		RootCAs:      rootCertPool,
 		Certificates: clientCert,
+		ServerName:   c.TLSServerName,
 	}
 
 	return tlsConfig, nil
@@ -222,7 +312,50 @@ func (c *mySQLConnectionProducer) addTLStoDSN() (connURL string, err error) {
 		config.TLSConfig = c.tlsConfigName
 	}
 
+	if c.ServerPublicKeyPath != "" {
+		config.ServerPubKey = c.serverPubKeyName
+	}
+
 	connURL = config.FormatDSN()
 
 	return connURL, nil
 }
+
+// securesPasswordExchange returns true if the connection either uses TLS or
+// encrypts the password exchange with the server's RSA public key.
+func (c *mySQLConnectionProducer) securesPasswordExchange() bool {
+	if c.tlsConfigName != "" || c.ServerPublicKeyPath != "" {
+		return true
+	}
+
+	config, err := mysql.ParseDSN(c.ConnectionURL)
+	if err != nil {
+		return false
+	}
+	return config.TLSConfig != "" && config.TLSConfig != "false"
+}
+
+// readServerPublicKey reads the PEM encoded RSA public key of the server.
+func readServerPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to read server_public_key_path: {{err}}", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse server_public_key_path: no PEM encoded public key found in %q", path)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server_public_key_path: %w", err)
+	}
+
+	pubKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse server_public_key_path: %q is not an RSA public key", path)
+	}
+
+	return pubKey, nil
+}
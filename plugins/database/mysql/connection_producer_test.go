@@ -2,16 +2,22 @@ package mysql
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"database/sql"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"os"
 	paths "path"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/hashicorp/vault/helper/testhelpers/certhelpers"
 	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
 	"github.com/ory/dockertest"
@@ -70,6 +76,254 @@ func Test_addTLStoDSN(t *testing.T) {
 	}
 }
 
+func TestInit_ConnectionPool(t *testing.T) {
+	type testCase struct {
+		conf             map[string]interface{}
+		expectedOpen     int
+		expectedIdle     int
+		expectedLifetime time.Duration
+		expectErr        bool
+	}
+
+	tests := map[string]testCase{
+		"defaults": {
+			conf:         map[string]interface{}{},
+			expectedOpen: 4,
+			expectedIdle: 4,
+		},
+		"custom values": {
+			conf: map[string]interface{}{
+				"max_open_connections":    10,
+				"max_idle_connections":    "5",
+				"max_connection_lifetime": "30s",
+			},
+			expectedOpen:     10,
+			expectedIdle:     5,
+			expectedLifetime: 30 * time.Second,
+		},
+		"idle reduced to open": {
+			conf: map[string]interface{}{
+				"max_open_connections": 2,
+				"max_idle_connections": 8,
+			},
+			expectedOpen: 2,
+			expectedIdle: 2,
+		},
+		"negative open": {
+			conf: map[string]interface{}{
+				"max_open_connections": -1,
+			},
+			expectErr: true,
+		},
+		"invalid lifetime": {
+			conf: map[string]interface{}{
+				"max_connection_lifetime": "forever",
+			},
+			expectErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.conf["connection_url"] = "user:password@tcp(localhost:3306)/test"
+
+			db := new(MetadataLen, MetadataLen, UsernameLen)
+			_, err := db.Init(context.Background(), test.conf, false)
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			// Opening the pool doesn't connect to the server
+			conn, err := db.getConnection(context.Background())
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer db.Close()
+
+			if open := conn.Stats().MaxOpenConnections; open != test.expectedOpen {
+				t.Fatalf("expected %d max open connections, got %d", test.expectedOpen, open)
+			}
+			if db.MaxIdleConnections != test.expectedIdle {
+				t.Fatalf("expected %d max idle connections, got %d", test.expectedIdle, db.MaxIdleConnections)
+			}
+			if db.maxConnectionLifetime != test.expectedLifetime {
+				t.Fatalf("expected max connection lifetime %s, got %s", test.expectedLifetime, db.maxConnectionLifetime)
+			}
+		})
+	}
+}
+
+func TestInit_TLSConfig(t *testing.T) {
+	caCert := certhelpers.NewCert(t,
+		certhelpers.CommonName("test certificate authority"),
+		certhelpers.IsCA(true),
+		certhelpers.SelfSign(),
+	)
+	clientCert := certhelpers.NewCert(t,
+		certhelpers.CommonName("client"),
+		certhelpers.DNS("client"),
+		certhelpers.Parent(caCert),
+	)
+
+	type testCase struct {
+		conf        map[string]interface{}
+		expectTLS   bool
+		expectedErr string
+	}
+
+	tests := map[string]testCase{
+		"no tls": {
+			conf: map[string]interface{}{},
+		},
+		"ca, client certificate and server name": {
+			conf: map[string]interface{}{
+				"tls_ca":              caCert.Pem,
+				"tls_certificate_key": clientCert.CombinedPEM(),
+				"tls_server_name":     "mysql.example.com",
+			},
+			expectTLS: true,
+		},
+		"server name only": {
+			conf: map[string]interface{}{
+				"tls_server_name": "mysql.example.com",
+			},
+			expectTLS: true,
+		},
+		"invalid ca": {
+			conf: map[string]interface{}{
+				"tls_ca": "not a certificate",
+			},
+			expectedErr: "failed to parse tls_ca",
+		},
+		"invalid client certificate": {
+			conf: map[string]interface{}{
+				"tls_certificate_key": caCert.Pem,
+			},
+			expectedErr: "unable to load tls_certificate_key_data",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.conf["connection_url"] = "user:password@tcp(localhost:3306)/test"
+
+			// The connection isn't verified, so no server is needed
+			db := new(MetadataLen, MetadataLen, UsernameLen)
+			_, err := db.Init(context.Background(), test.conf, false)
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Fatalf("expected error containing %q, got: %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			if !test.expectTLS {
+				if db.tlsConfigName != "" {
+					t.Fatalf("expected no TLS config to be registered, got: %q", db.tlsConfigName)
+				}
+				return
+			}
+
+			// The TLS config is registered with the driver under a unique name,
+			// which the DSN refers to
+			if db.tlsConfigName == "" {
+				t.Fatal("expected a TLS config to be registered")
+			}
+			dsn, err := db.addTLStoDSN()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			config, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatalf("the DSN doesn't refer to a registered TLS config: %s", err)
+			}
+			if config.TLSConfig != db.tlsConfigName {
+				t.Fatalf("expected tls=%s in the DSN, got: %s", db.tlsConfigName, dsn)
+			}
+
+			tlsConfig, err := db.getTLSAuth()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if tlsConfig.ServerName != test.conf["tls_server_name"] {
+				t.Fatalf("expected server name %q, got: %q", test.conf["tls_server_name"], tlsConfig.ServerName)
+			}
+		})
+	}
+}
+
+func TestInit_ServerPublicKey(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyPath := filepath.Join(dir, "public_key.pem")
+	writeFile(t, pubKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes}), 0644)
+
+	invalidKeyPath := filepath.Join(dir, "invalid.pem")
+	writeFile(t, invalidKeyPath, []byte("not a key"), 0644)
+
+	t.Run("valid key", func(t *testing.T) {
+		db := new(MetadataLen, MetadataLen, UsernameLen)
+		_, err := db.Init(context.Background(), map[string]interface{}{
+			"connection_url":         "user:password@tcp(localhost:3306)/test",
+			"server_public_key_path": pubKeyPath,
+		}, false)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// The key is registered with the driver under a unique name, which
+		// the DSN refers to
+		dsn, err := db.addTLStoDSN()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		config, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if db.serverPubKeyName == "" || config.ServerPubKey != db.serverPubKeyName {
+			t.Fatalf("expected serverPubKey=%s in the DSN, got: %s", db.serverPubKeyName, dsn)
+		}
+		if !db.securesPasswordExchange() {
+			t.Fatal("expected the password exchange to be secured")
+		}
+	})
+
+	for name, path := range map[string]string{
+		"invalid key":  invalidKeyPath,
+		"missing file": filepath.Join(dir, "missing.pem"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := new(MetadataLen, MetadataLen, UsernameLen)
+			_, err := db.Init(context.Background(), map[string]interface{}{
+				"connection_url":         "user:password@tcp(localhost:3306)/test",
+				"server_public_key_path": path,
+			}, false)
+			if err == nil || !strings.Contains(err.Error(), "server_public_key_path") {
+				t.Fatalf("expected server_public_key_path error, got: %v", err)
+			}
+		})
+	}
+}
+
 func TestInit_clientTLS(t *testing.T) {
 	t.Skip("Skipping this test because CircleCI can't mount the files we need without further investigation: " +
 		"https://support.circleci.com/hc/en-us/articles/360007324514-How-can-I-mount-volumes-to-docker-containers-")
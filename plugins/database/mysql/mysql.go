@@ -4,14 +4,20 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	stdmysql "github.com/go-sql-driver/mysql"
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/random"
 	"github.com/hashicorp/vault/sdk/database/dbplugin"
 	"github.com/hashicorp/vault/sdk/database/helper/credsutil"
 	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
+	"github.com/hashicorp/vault/sdk/helper/base62"
 	"github.com/hashicorp/vault/sdk/helper/strutil"
 )
 
@@ -21,11 +27,22 @@ const (
 		DROP USER '{{name}}'@'%'
 	`
 
+	// defaultMariaDBRevocationStmts drops the user along with its privileges
+	// and role grants. IF EXISTS makes retrying a partially failed
+	// revocation succeed.
+	defaultMariaDBRevocationStmts = `
+		DROP USER IF EXISTS '{{name}}'@'%'
+	`
+
 	defaultMySQLRotateCredentialsSQL = `
 		ALTER USER '{{username}}'@'%' IDENTIFIED BY '{{password}}';
 	`
 
 	mySQLTypeName = "mysql"
+
+	// The values of the server_type option
+	serverTypeMySQL   = "mysql"
+	serverTypeMariaDB = "mariadb"
 )
 
 var (
@@ -37,9 +54,69 @@ var (
 
 var _ dbplugin.Database = (*MySQL)(nil)
 
+// usernameTemplateData is the data a username template is rendered with.
+type usernameTemplateData struct {
+	DisplayName string
+	RoleName    string
+}
+
+// usernameTemplateFuncs are the functions available to username templates, on
+// top of the text/template builtins.
+var usernameTemplateFuncs = template.FuncMap{
+	"random": func(length int) (string, error) {
+		return base62.Random(length)
+	},
+	"truncate": func(length int, s string) string {
+		if length >= 0 && len(s) > length {
+			return s[:length]
+		}
+		return s
+	},
+	"unix_time": func() string {
+		return strconv.FormatInt(time.Now().Unix(), 10)
+	},
+	"lowercase": strings.ToLower,
+	"uppercase": strings.ToUpper,
+}
+
+// parsePasswordPolicy parses a password policy. Since passwords are
+// substituted into the statements as quoted literals, the policy can't
+// generate quotes or backslashes.
+func parsePasswordPolicy(policy string) (*random.StringGenerator, error) {
+	gen, err := random.ParsePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range gen.Rules {
+		charsetRule, ok := rule.(interface{ Chars() []rune })
+		if !ok {
+			continue
+		}
+		for _, r := range charsetRule.Chars() {
+			switch r {
+			case '\'', '"', '\\':
+				return nil, fmt.Errorf("charset must not contain %q, which would break the quoting of the statements", r)
+			}
+		}
+	}
+
+	return &gen, nil
+}
+
+// parseUsernameTemplate parses a username template, such as
+// "v_{{.RoleName | truncate 8}}_{{random 8}}".
+func parseUsernameTemplate(tmpl string) (*template.Template, error) {
+	return template.New("username").Funcs(usernameTemplateFuncs).Parse(tmpl)
+}
+
 type MySQL struct {
 	*mySQLConnectionProducer
 	credsutil.CredentialsProducer
+
+	// usernameLen is the maximum length of the usernames supported by the
+	// server
+	usernameLen int
 }
 
 // New implements builtinplugins.BuiltinFactory
@@ -66,6 +143,7 @@ func new(displayNameLen, roleNameLen, usernameLen int) *MySQL {
 	return &MySQL{
 		mySQLConnectionProducer: connProducer,
 		CredentialsProducer:     credsProducer,
+		usernameLen:             usernameLen,
 	}
 }
 
@@ -116,7 +194,7 @@ func (m *MySQL) CreateUser(ctx context.Context, statements dbplugin.Statements,
 		return "", "", dbutil.ErrEmptyCreationStatement
 	}
 
-	username, err = m.GenerateUsername(usernameConfig)
+	username, err = m.generateUsername(usernameConfig)
 	if err != nil {
 		return "", "", err
 	}
@@ -139,11 +217,62 @@ func (m *MySQL) CreateUser(ctx context.Context, statements dbplugin.Statements,
 	}
 
 	if err := m.executePreparedStatmentsWithMap(ctx, statements.Creation, queryMap); err != nil {
-		return "", "", err
+		return "", "", wrapPasswordValidationError(err)
 	}
 	return username, password, nil
 }
 
+// GeneratePassword generates a password adhering to the configured password
+// policy, falling back to the default generator if none is set.
+func (m *MySQL) GeneratePassword() (string, error) {
+	if m.passwordGenerator == nil {
+		return m.CredentialsProducer.GeneratePassword()
+	}
+
+	return m.passwordGenerator.Generate(context.Background(), nil)
+}
+
+// GenerateCredentials generates a password for a static account, adhering to
+// the configured password policy.
+func (m *MySQL) GenerateCredentials(ctx context.Context) (string, error) {
+	if m.passwordGenerator == nil {
+		return m.CredentialsProducer.GenerateCredentials(ctx)
+	}
+
+	return m.passwordGenerator.Generate(ctx, nil)
+}
+
+// generateUsername renders the configured username template, falling back to
+// the default username scheme if none is set.
+func (m *MySQL) generateUsername(usernameConfig dbplugin.UsernameConfig) (string, error) {
+	m.Lock()
+	tmpl := m.usernameTemplate
+	m.Unlock()
+
+	if tmpl == nil {
+		return m.GenerateUsername(usernameConfig)
+	}
+
+	var b strings.Builder
+	err := tmpl.Execute(&b, usernameTemplateData{
+		DisplayName: usernameConfig.DisplayName,
+		RoleName:    usernameConfig.RoleName,
+	})
+	if err != nil {
+		return "", errwrap.Wrapf("unable to render username template: {{err}}", err)
+	}
+
+	username := b.String()
+	if username == "" {
+		return "", errors.New("username template rendered an empty username")
+	}
+	if m.usernameLen > 0 && len(username) > m.usernameLen {
+		return "", fmt.Errorf("username %q rendered from the username template is longer than the maximum of %d characters", username, m.usernameLen)
+	}
+
+	return username, nil
+}
+
 // NOOP
 func (m *MySQL) RenewUser(ctx context.Context, statements dbplugin.Statements, username string, expiration time.Time) error {
 	return nil
@@ -165,7 +294,15 @@ func (m *MySQL) RevokeUser(ctx context.Context, statements dbplugin.Statements,
 	revocationStmts := statements.Revocation
 	// Use a default SQL statement for revocation if one cannot be fetched from the role
 	if len(revocationStmts) == 0 {
+		serverType, err := m.serverType(ctx, db)
+		if err != nil {
+			return err
+		}
+
 		revocationStmts = []string{defaultMysqlRevocationStmts}
+		if serverType == serverTypeMariaDB {
+			revocationStmts = []string{defaultMariaDBRevocationStmts}
+		}
 	}
 
 	// Start a transaction
@@ -199,6 +336,27 @@ func (m *MySQL) RevokeUser(ctx context.Context, statements dbplugin.Statements,
 		return err
 	}
 
+	if m.VerifyRevocation {
+		if err := verifyUserRevoked(ctx, db, username); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyUserRevoked returns an error if the user still exists, which happens
+// when the revocation statements don't drop it. The user may then still be
+// able to authenticate, so the revocation must be retried.
+func verifyUserRevoked(ctx context.Context, db *sql.DB, username string) error {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM mysql.user WHERE user = ?", username).Scan(&count); err != nil {
+		return errwrap.Wrapf("unable to verify the revocation: {{err}}", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("user %q still exists after running the revocation statements; they must drop the user", username)
+	}
+
 	return nil
 }
 
@@ -248,7 +406,7 @@ func (m *MySQL) RotateRootCredentials(ctx context.Context, statements []string)
 			query = strings.Replace(query, "{{password}}", password, -1)
 
 			if _, err := tx.ExecContext(ctx, query); err != nil {
-				return nil, err
+				return nil, wrapPasswordValidationError(err)
 			}
 		}
 	}
@@ -257,11 +415,20 @@ func (m *MySQL) RotateRootCredentials(ctx context.Context, statements []string)
 		return nil, err
 	}
 
-	if err := db.Close(); err != nil {
-		return nil, err
+	// The password has been changed on the server at this point, so the new
+	// configuration is returned regardless of any further failure; otherwise
+	// the new password would be lost.
+	m.RawConfig["password"] = password
+
+	// Reconnect with the new password on next use, since the existing
+	// connections may be dropped by the server
+	m.Password = password
+	m.renderConnectionURL()
+	if m.db != nil {
+		m.db.Close()
+		m.db = nil
 	}
 
-	m.RawConfig["password"] = password
 	return m.RawConfig, nil
 }
 
@@ -289,7 +456,7 @@ func (m *MySQL) SetCredentials(ctx context.Context, statements dbplugin.Statemen
 	}
 
 	if err := m.executePreparedStatmentsWithMap(ctx, rotateStatements, queryMap); err != nil {
-		return "", "", err
+		return "", "", wrapPasswordValidationError(err)
 	}
 	return username, password, nil
 }
@@ -307,6 +474,11 @@ func (m *MySQL) executePreparedStatmentsWithMap(ctx context.Context, statements
 	if err != nil {
 		return err
 	}
+
+	if err := m.checkPasswordExchange(ctx, db, statements); err != nil {
+		return err
+	}
+
 	// Start a transaction
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
@@ -359,3 +531,86 @@ func (m *MySQL) executePreparedStatmentsWithMap(ctx context.Context, statements
 	}
 	return nil
 }
+
+// checkPasswordExchange returns an error if the statements set up a user with
+// the caching_sha2_password authentication plugin of MySQL 8, while the
+// connection neither uses TLS nor has the server's RSA public key to encrypt
+// the password exchange with.
+func (m *MySQL) checkPasswordExchange(ctx context.Context, db *sql.DB, statements []string) error {
+	var usesCachingSHA2 bool
+	for _, stmt := range statements {
+		if strings.Contains(strings.ToLower(stmt), "caching_sha2_password") {
+			usesCachingSHA2 = true
+			break
+		}
+	}
+	if !usesCachingSHA2 || m.securesPasswordExchange() {
+		return nil
+	}
+
+	version, err := serverVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if !isMySQL8(version) {
+		return nil
+	}
+
+	return errors.New("users authenticating with caching_sha2_password on MySQL 8 require the connection to use TLS or server_public_key_path to be set")
+}
+
+// serverType returns the configured server type, detecting it from the
+// server's version if it isn't set.
+func (m *MySQL) serverType(ctx context.Context, db *sql.DB) (string, error) {
+	if m.ServerType != "" {
+		return m.ServerType, nil
+	}
+
+	version, err := serverVersion(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	if isMariaDB(version) {
+		return serverTypeMariaDB, nil
+	}
+	return serverTypeMySQL, nil
+}
+
+// serverVersion returns the version reported by the server.
+func serverVersion(ctx context.Context, db *sql.DB) (string, error) {
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err != nil {
+		return "", errwrap.Wrapf("unable to determine the server version: {{err}}", err)
+	}
+	return version, nil
+}
+
+// isMariaDB returns true if the version reported by the server is a MariaDB
+// version, such as 10.5.9-MariaDB.
+func isMariaDB(version string) bool {
+	return strings.Contains(strings.ToLower(version), "mariadb")
+}
+
+// isMySQL8 returns true if the version reported by the server is MySQL 8 or
+// later. MariaDB versions, which start at 10, are not considered.
+func isMySQL8(version string) bool {
+	if isMariaDB(version) {
+		return false
+	}
+
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return false
+	}
+	return major >= 8
+}
+
+// wrapPasswordValidationError explains an error returned by the server when a
+// generated password doesn't satisfy its validate_password requirements.
+func wrapPasswordValidationError(err error) error {
+	// 1819: Your password does not satisfy the current policy requirements
+	if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1819 {
+		return fmt.Errorf("the generated password was rejected by the server's password validation, set password_policy to generate passwords that satisfy it: %w", err)
+	}
+	return err
+}
@@ -3,6 +3,8 @@ package mysql
 import (
 	"context"
 	"database/sql"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -183,6 +185,291 @@ func testCreateUser(t *testing.T, db *MySQL, connURL string) {
 	}
 }
 
+func TestMySQL_UsernameTemplate(t *testing.T) {
+	usernameConfig := dbplugin.UsernameConfig{
+		DisplayName: "token-display-name",
+		RoleName:    "readonly",
+	}
+
+	initDB := func(t *testing.T, usernameLen int, tmpl string) (*MySQL, error) {
+		t.Helper()
+
+		// The connection isn't verified, so no server is needed
+		db := new(MetadataLen, MetadataLen, usernameLen)
+		_, err := db.Init(context.Background(), map[string]interface{}{
+			"connection_url":    "root:secret@tcp(127.0.0.1:3306)/",
+			"username_template": tmpl,
+		}, false)
+		return db, err
+	}
+
+	t.Run("custom template", func(t *testing.T) {
+		db, err := initDB(t, UsernameLen, `v_{{.RoleName | truncate 4}}_{{.DisplayName | truncate 5 | uppercase}}_{{random 8}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		username, err := db.generateUsername(usernameConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(username, "v_read_TOKEN_") {
+			t.Fatalf("unexpected username: %q", username)
+		}
+		if len(username) != len("v_read_TOKEN_")+8 {
+			t.Fatalf("expected 8 random characters, got username: %q", username)
+		}
+	})
+
+	t.Run("default scheme", func(t *testing.T) {
+		db, err := initDB(t, UsernameLen, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		username, err := db.generateUsername(usernameConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(username, "v-token-disp-readonly-") {
+			t.Fatalf("unexpected username: %q", username)
+		}
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		db, err := initDB(t, LegacyUsernameLen, `{{.DisplayName}}-{{.RoleName}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.generateUsername(usernameConfig)
+		if err == nil {
+			t.Fatal("expected error for a username over the maximum length")
+		}
+		if !strings.Contains(err.Error(), "longer than the maximum of 16 characters") {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		if _, err := initDB(t, UsernameLen, `{{.RoleName`); err == nil {
+			t.Fatal("expected error for an invalid template")
+		}
+	})
+}
+
+func TestMySQL8_CreateUser_CachingSHA2(t *testing.T) {
+	cleanup, connURL := mysqlhelper.PrepareTestContainerWithImage(t, "mysql", "8.0", "secret")
+	defer cleanup()
+
+	// Give a timeout just in case the test decides to be problematic
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Fetch the server's public key, which is used to encrypt the password
+	// exchange without TLS
+	mClient := connect(t, connURL)
+	var statusName, pubKey string
+	err := mClient.QueryRowContext(ctx, "SHOW STATUS LIKE 'Caching_sha2_password_rsa_public_key'").Scan(&statusName, &pubKey)
+	mClient.Close()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	confDir := makeTempDir(t)
+	defer os.RemoveAll(confDir)
+	pubKeyPath := filepath.Join(confDir, "public_key.pem")
+	writeFile(t, pubKeyPath, []byte(pubKey), 0644)
+
+	statements := dbplugin.Statements{
+		Creation: []string{`
+			CREATE USER '{{name}}'@'%' IDENTIFIED WITH caching_sha2_password BY '{{password}}';
+			GRANT SELECT ON *.* TO '{{name}}'@'%';`,
+		},
+	}
+	usernameConfig := dbplugin.UsernameConfig{
+		DisplayName: "test",
+		RoleName:    "test",
+	}
+
+	// Without TLS or the server's public key, the user isn't created
+	db := new(MetadataLen, MetadataLen, UsernameLen)
+	_, err = db.Init(ctx, map[string]interface{}{
+		"connection_url": connURL,
+	}, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, _, err = db.CreateUser(ctx, statements, usernameConfig, time.Now().Add(time.Minute))
+	if err == nil || !strings.Contains(err.Error(), "caching_sha2_password") {
+		t.Fatalf("expected caching_sha2_password error, got: %v", err)
+	}
+	db.Close()
+
+	db = new(MetadataLen, MetadataLen, UsernameLen)
+	_, err = db.Init(ctx, map[string]interface{}{
+		"connection_url":         connURL,
+		"server_public_key_path": pubKeyPath,
+	}, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	username, password, err := db.CreateUser(ctx, statements, usernameConfig, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := mysqlhelper.TestCredsExist(t, connURL, username, password); err != nil {
+		t.Fatalf("Could not connect with new credentials: %s", err)
+	}
+}
+
+func TestIsMySQL8(t *testing.T) {
+	tests := map[string]bool{
+		"5.6.51":                    false,
+		"5.7.33-log":                false,
+		"8.0.23":                    true,
+		"8.0.23-0ubuntu0.20.04.1":   true,
+		"10.5.9-MariaDB":            false,
+		"10.5.9-MariaDB-1:10.5.9+m": false,
+		"":                          false,
+	}
+
+	for version, expected := range tests {
+		if actual := isMySQL8(version); actual != expected {
+			t.Fatalf("version %q: expected %t, got %t", version, expected, actual)
+		}
+	}
+}
+
+func TestIsMariaDB(t *testing.T) {
+	tests := map[string]bool{
+		"5.7.33-log":                false,
+		"8.0.23":                    false,
+		"10.5.9-MariaDB":            true,
+		"5.5.5-10.5.9-MariaDB-log":  true,
+		"10.5.9-MariaDB-1:10.5.9+m": true,
+	}
+
+	for version, expected := range tests {
+		if actual := isMariaDB(version); actual != expected {
+			t.Fatalf("version %q: expected %t, got %t", version, expected, actual)
+		}
+	}
+}
+
+func TestMySQL_ServerType(t *testing.T) {
+	for _, serverType := range []string{"", "mysql", "mariadb"} {
+		db := new(MetadataLen, MetadataLen, UsernameLen)
+		_, err := db.Init(context.Background(), map[string]interface{}{
+			"connection_url": "user:password@tcp(localhost:3306)/test",
+			"server_type":    serverType,
+		}, false)
+		if err != nil {
+			t.Fatalf("server type %q: %s", serverType, err)
+		}
+	}
+
+	db := new(MetadataLen, MetadataLen, UsernameLen)
+	_, err := db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "user:password@tcp(localhost:3306)/test",
+		"server_type":    "postgres",
+	}, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid server_type") {
+		t.Fatalf("expected invalid server_type error, got: %v", err)
+	}
+}
+
+func TestMySQL_PasswordPolicy(t *testing.T) {
+	policy := `
+length = 20
+rule "charset" {
+  charset = "abcdefghijklmnopqrstuvwxyz"
+}
+rule "charset" {
+  charset = "0123456789"
+  min-chars = 2
+}
+rule "charset" {
+  charset = "!#$%&*+-=?@^_"
+  min-chars = 3
+}`
+
+	db := new(MetadataLen, MetadataLen, UsernameLen)
+	_, err := db.Init(context.Background(), map[string]interface{}{
+		"connection_url":  "user:password@tcp(localhost:3306)/test",
+		"password_policy": policy,
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countIn := func(s, chars string) int {
+		count := 0
+		for _, r := range s {
+			if strings.ContainsRune(chars, r) {
+				count++
+			}
+		}
+		return count
+	}
+
+	generators := map[string]func() (string, error){
+		"GeneratePassword": db.GeneratePassword,
+		"GenerateCredentials": func() (string, error) {
+			return db.GenerateCredentials(context.Background())
+		},
+	}
+	for name, generate := range generators {
+		for i := 0; i < 100; i++ {
+			password, err := generate()
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if len(password) != 20 {
+				t.Fatalf("%s: expected a password of 20 characters, got %q", name, password)
+			}
+			if countIn(password, "0123456789") < 2 {
+				t.Fatalf("%s: expected at least 2 digits, got %q", name, password)
+			}
+			if countIn(password, "!#$%&*+-=?@^_") < 3 {
+				t.Fatalf("%s: expected at least 3 special characters, got %q", name, password)
+			}
+		}
+	}
+
+	// Policies that could generate characters breaking the quoting of the
+	// statements are rejected
+	db = new(MetadataLen, MetadataLen, UsernameLen)
+	_, err = db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "user:password@tcp(localhost:3306)/test",
+		"password_policy": `
+length = 20
+rule "charset" {
+  charset = "abc'"
+}`,
+	}, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid password_policy") {
+		t.Fatalf("expected invalid password_policy error, got: %v", err)
+	}
+}
+
+func TestWrapPasswordValidationError(t *testing.T) {
+	err := wrapPasswordValidationError(&stdmysql.MySQLError{
+		Number:  1819,
+		Message: "Your password does not satisfy the current policy requirements",
+	})
+	if !strings.Contains(err.Error(), "password_policy") {
+		t.Fatalf("expected the error to mention password_policy, got: %s", err)
+	}
+
+	other := &stdmysql.MySQLError{Number: 1045, Message: "Access denied"}
+	if err := wrapPasswordValidationError(other); err != other {
+		t.Fatalf("expected other errors to be returned unchanged, got: %s", err)
+	}
+}
+
 func TestMySQL_RotateRootCredentials(t *testing.T) {
 	type testCase struct {
 		statements []string
@@ -204,10 +491,10 @@ func TestMySQL_RotateRootCredentials(t *testing.T) {
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			cleanup, connURL := mysqlhelper.PrepareMySQLTestContainer(t, false, "secret")
+			cleanup, rootURL := mysqlhelper.PrepareMySQLTestContainer(t, false, "secret")
 			defer cleanup()
 
-			connURL = strings.Replace(connURL, "root:secret", `{{username}}:{{password}}`, -1)
+			connURL := strings.Replace(rootURL, "root:secret", `{{username}}:{{password}}`, -1)
 
 			connectionDetails := map[string]interface{}{
 				"connection_url": connURL,
@@ -236,6 +523,23 @@ func TestMySQL_RotateRootCredentials(t *testing.T) {
 			if newConf["password"] == "secret" {
 				t.Fatal("password was not updated")
 			}
+			newPassword := newConf["password"].(string)
+
+			if err := mysqlhelper.TestCredsExist(t, rootURL, "root", newPassword); err != nil {
+				t.Fatalf("Could not connect with new root credentials: %s", err)
+			}
+			if err := mysqlhelper.TestCredsExist(t, rootURL, "root", "secret"); err == nil {
+				t.Fatal("Should not be able to connect with the old root credentials")
+			}
+
+			// The plugin reconnects with the new root credentials
+			conn, err := db.getConnection(ctx)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := conn.PingContext(ctx); err != nil {
+				t.Fatalf("Could not reconnect with new root credentials: %s", err)
+			}
 
 			err = db.Close()
 			if err != nil {
@@ -323,6 +627,124 @@ func TestMySQL_RevokeUser(t *testing.T) {
 	}
 }
 
+func TestMySQL_RevokeUser_VerifyRevocation(t *testing.T) {
+	cleanup, connURL := mysqlhelper.PrepareMySQLTestContainer(t, false, "secret")
+	defer cleanup()
+
+	// Give a timeout just in case the test decides to be problematic
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := new(MetadataLen, MetadataLen, UsernameLen)
+	_, err := db.Init(ctx, map[string]interface{}{
+		"connection_url":    connURL,
+		"verify_revocation": true,
+	}, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	usernameConfig := dbplugin.UsernameConfig{
+		DisplayName: "test",
+		RoleName:    "test",
+	}
+	creation := []string{`
+		CREATE USER '{{name}}'@'%' IDENTIFIED BY '{{password}}';
+		GRANT SELECT ON *.* TO '{{name}}'@'%';`,
+	}
+
+	// Revoking the privileges without dropping the user leaves it able to
+	// authenticate, which the verification catches
+	partial := dbplugin.Statements{
+		Creation:   creation,
+		Revocation: []string{`REVOKE ALL PRIVILEGES, GRANT OPTION FROM '{{name}}'@'%'`},
+	}
+	username, password, err := db.CreateUser(ctx, partial, usernameConfig, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = db.RevokeUser(ctx, partial, username)
+	if err == nil || !strings.Contains(err.Error(), "still exists") {
+		t.Fatalf("expected error for the leftover user, got: %v", err)
+	}
+	if err := mysqlhelper.TestCredsExist(t, connURL, username, password); err != nil {
+		t.Fatalf("expected the leftover user to still authenticate: %s", err)
+	}
+
+	// The default revocation statements drop the user
+	full := dbplugin.Statements{
+		Creation: creation,
+	}
+	if err := db.RevokeUser(ctx, full, username); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := mysqlhelper.TestCredsExist(t, connURL, username, password); err == nil {
+		t.Fatal("Credentials were not revoked")
+	}
+}
+
+func TestMariaDB_RevokeUser(t *testing.T) {
+	cleanup, connURL := mysqlhelper.PrepareTestContainerWithImage(t, "mariadb", "10.5", "secret")
+	defer cleanup()
+
+	// Give a timeout just in case the test decides to be problematic
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The server type is detected from the server's version
+	db := new(MetadataLen, MetadataLen, UsernameLen)
+	_, err := db.Init(ctx, map[string]interface{}{
+		"connection_url": connURL,
+	}, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	statements := dbplugin.Statements{
+		Creation: []string{`
+			CREATE USER '{{name}}'@'%' IDENTIFIED BY '{{password}}';
+			GRANT SELECT ON *.* TO '{{name}}'@'%';`,
+		},
+	}
+	usernameConfig := dbplugin.UsernameConfig{
+		DisplayName: "test",
+		RoleName:    "test",
+	}
+
+	username, password, err := db.CreateUser(ctx, statements, usernameConfig, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := mysqlhelper.TestCredsExist(t, connURL, username, password); err != nil {
+		t.Fatalf("Could not connect with new credentials: %s", err)
+	}
+
+	if err := db.RevokeUser(ctx, statements, username); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The user is fully removed, rather than only losing its privileges
+	mClient := connect(t, connURL)
+	defer mClient.Close()
+	var count int
+	if err := mClient.QueryRowContext(ctx, "SELECT COUNT(*) FROM mysql.user WHERE user = ?", username).Scan(&count); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected user %q to be dropped", username)
+	}
+	if err := mysqlhelper.TestCredsExist(t, connURL, username, password); err == nil {
+		t.Fatal("Credentials were not revoked")
+	}
+
+	// Retrying the revocation succeeds
+	if err := db.RevokeUser(ctx, statements, username); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
 func TestMySQL_SetCredentials(t *testing.T) {
 	type testCase struct {
 		rotateStmts []string
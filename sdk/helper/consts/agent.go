@@ -3,3 +3,11 @@ package consts
 // AgentPathCacheClear is the path that the agent will use as its cache-clear
 // endpoint.
 const AgentPathCacheClear = "/agent/v1/cache-clear"
+
+// AgentPathMetrics is the path that the agent will use to expose its internal
+// metrics.
+const AgentPathMetrics = "/agent/v1/metrics"
+
+// AgentPathHealth is the path that the agent will use to report the status of
+// its auto-auth token and cache.
+const AgentPathHealth = "/agent/v1/health"
@@ -882,6 +882,10 @@ func NewCore(conf *CoreConfig) (*Core, error) {
 		c.ha = conf.HAPhysical
 	}
 
+	if raftBackend := c.getRaftBackend(); raftBackend != nil {
+		raftBackend.SetMetricSink(c.metricSink)
+	}
+
 	logicalBackends := make(map[string]logical.Factory)
 	for k, f := range conf.LogicalBackends {
 		logicalBackends[k] = f
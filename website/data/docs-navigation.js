@@ -199,7 +199,7 @@ export default [
           },
           {
             category: 'sinks',
-            content: ['file'],
+            content: ['fifo', 'file', 'kubernetes', 'websocket'],
           },
         ],
       },